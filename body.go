@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// sniffMimeType guesses the media type of a body from its content
+func sniffMimeType(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	return http.DetectContentType(body)
+}
+
+// isTextBody reports whether a body can be shown and sent as a plain string
+func isTextBody(body []byte) bool {
+	return utf8.Valid(body) && strings.HasPrefix(sniffMimeType(body), "text/")
+}
+
+// encodeBody returns a body as text when possible, otherwise as base64
+func encodeBody(body []byte) (string, string) {
+	if isTextBody(body) {
+		return string(body), "text"
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+// BodyPreview returns the body as text, or a short description if it's binary
+func (p CapturedPacket) BodyPreview() string {
+	if len(p.Body) == 0 || isTextBody(p.Body) {
+		return string(p.Body)
+	}
+	return fmt.Sprintf("(binary data, %d bytes, %s)", len(p.Body), p.MimeType)
+}
+
+// MarshalJSON sends text bodies as strings and binary bodies as base64
+func (p CapturedPacket) MarshalJSON() ([]byte, error) {
+	type packetJSON CapturedPacket
+	out := struct {
+		packetJSON
+		Body            string `json:"body"`
+		BodyEncoding    string `json:"bodyEncoding,omitempty"`
+		RawBody         string `json:"rawBody,omitempty"`
+		RawBodyEncoding string `json:"rawBodyEncoding,omitempty"`
+	}{packetJSON: packetJSON(p)}
+
+	if len(p.Body) > 0 {
+		out.Body, out.BodyEncoding = encodeBody(p.Body)
+	}
+	if len(p.RawBody) > 0 {
+		out.RawBody, out.RawBodyEncoding = encodeBody(p.RawBody)
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON reverses MarshalJSON
+func (p *CapturedPacket) UnmarshalJSON(data []byte) error {
+	type packetJSON CapturedPacket
+	var in struct {
+		packetJSON
+		Body            string `json:"body"`
+		BodyEncoding    string `json:"bodyEncoding"`
+		RawBody         string `json:"rawBody"`
+		RawBodyEncoding string `json:"rawBodyEncoding"`
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	*p = CapturedPacket(in.packetJSON)
+
+	var err error
+	if p.Body, err = decodeJSONBody(in.Body, in.BodyEncoding); err != nil {
+		return fmt.Errorf("body: %w", err)
+	}
+	if p.RawBody, err = decodeJSONBody(in.RawBody, in.RawBodyEncoding); err != nil {
+		return fmt.Errorf("rawBody: %w", err)
+	}
+	return nil
+}
+
+func decodeJSONBody(s, encoding string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return []byte(s), nil
+}
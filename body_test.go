@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestBodyJSON(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	tests := []struct {
+		name     string
+		body     []byte
+		text     string // the body as sent, base64 for binary
+		encoding string
+		mimeType string
+	}{
+		{"empty", nil, "", "", ""},
+		{"plain text", []byte("hello, world"), "hello, world", "text", "text/plain; charset=utf-8"},
+		{"json", []byte(`{"name":"widget"}`), `{"name":"widget"}`, "text", "text/plain; charset=utf-8"},
+		{"image", png, "iVBORw0KGgoAAAANSUhEUg==", "base64", "image/png"},
+		{"invalid UTF-8", []byte("caf\xe9"), "Y2Fm6Q==", "base64", "text/plain; charset=utf-8"},
+		{"control bytes", []byte{0x00, 0xff, 0x10, 0x80}, "AP8QgA==", "base64", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p CapturedPacket
+			p.setBody("", tt.body)
+			if p.MimeType != tt.mimeType {
+				t.Errorf("MimeType = %q, want %q", p.MimeType, tt.mimeType)
+			}
+
+			data, err := json.Marshal(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sent struct {
+				Body         string `json:"body"`
+				BodyEncoding string `json:"bodyEncoding"`
+			}
+			if err := json.Unmarshal(data, &sent); err != nil {
+				t.Fatal(err)
+			}
+			if sent.Body != tt.text || sent.BodyEncoding != tt.encoding {
+				t.Errorf("sent body %q as %q, want %q as %q", sent.Body, sent.BodyEncoding, tt.text, tt.encoding)
+			}
+
+			// Stored pairs are read back through the same encoding
+			var back CapturedPacket
+			if err := json.Unmarshal(data, &back); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(back.Body, tt.body) {
+				t.Errorf("body read back as %q, want %q", back.Body, tt.body)
+			}
+		})
+	}
+
+	// The wire form of a compressed body goes with it
+	var p CapturedPacket
+	p.setBody("gzip", compress(t, "gzip", []byte{0x00, 0x01}))
+	data, _ := json.Marshal(p)
+	var back CapturedPacket
+	if err := json.Unmarshal(data, &back); err != nil || !bytes.Equal(back.Body, p.Body) || !bytes.Equal(back.RawBody, p.RawBody) {
+		t.Errorf("read back body %x and raw body %x, %v; want %x and %x", back.Body, back.RawBody, err, p.Body, p.RawBody)
+	}
+}
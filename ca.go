@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	caCertFile   = "ca.pem"
+	caKeyFile    = "ca-key.pem"
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 30 * 24 * time.Hour
+	// maxLeaves caps how many leaf certificates are kept, dropping the least
+	// recently used
+	maxLeaves = 1000
+)
+
+// CertAuthority is the local CA used to intercept HTTPS. It mints a leaf
+// certificate for each host on first use and keeps the ones used most
+// recently in memory.
+type CertAuthority struct {
+	cert     *x509.Certificate
+	key      crypto.Signer
+	leafKey  crypto.Signer
+	certPath string
+
+	mu     sync.Mutex
+	leaves map[string]*cachedLeaf
+}
+
+// cachedLeaf is a minted leaf certificate with when it was last handed out
+type cachedLeaf struct {
+	cert *tls.Certificate
+	used time.Time
+}
+
+// fresh reports whether the leaf is valid for a while yet
+func (l *cachedLeaf) fresh(now time.Time) bool {
+	return now.Before(l.cert.Leaf.NotAfter.Add(-time.Hour))
+}
+
+// defaultCADir returns where the CA is kept unless -ca-dir says otherwise
+func defaultCADir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".local-http-inspector"
+	}
+	return filepath.Join(dir, "local-http-inspector")
+}
+
+// LoadOrCreateCA loads the CA from dir, generating and saving a new one the
+// first time
+func LoadOrCreateCA(dir string) (*CertAuthority, bool, error) {
+	certPath := filepath.Join(dir, caCertFile)
+	keyPath := filepath.Join(dir, caKeyFile)
+
+	created := false
+	certPEM, err := os.ReadFile(certPath)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := createCA(dir, certPath, keyPath); err != nil {
+			return nil, false, err
+		}
+		created = true
+		certPEM, err = os.ReadFile(certPath)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, false, err
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, false, fmt.Errorf("loading %s: %w", certPath, err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, false, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, false, fmt.Errorf("%s: unsupported key type", keyPath)
+	}
+
+	// One key for every leaf keeps minting fast
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &CertAuthority{
+		cert:     cert,
+		key:      key,
+		leafKey:  leafKey,
+		certPath: certPath,
+		leaves:   make(map[string]*cachedLeaf),
+	}, created, nil
+}
+
+func createCA(dir, certPath, keyPath string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "Local HTTP Inspector CA (" + hostname + ")", Organization: []string{"Local HTTP Inspector"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
+	}
+	return serial
+}
+
+// CertPath returns the file clients need to trust
+func (ca *CertAuthority) CertPath() string {
+	return ca.certPath
+}
+
+// leafFor returns a certificate for host, minting one if needed
+func (ca *CertAuthority) leafFor(host string) (*tls.Certificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	now := time.Now()
+	if leaf, ok := ca.leaves[host]; ok && leaf.fresh(now) {
+		leaf.used = now
+		return leaf.cert, nil
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, ca.leafKey.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  ca.leafKey,
+		Leaf:        leaf,
+	}
+	ca.leaves[host] = &cachedLeaf{cert: cert, used: now}
+	ca.trimLeaves(now)
+	return cert, nil
+}
+
+// trimLeaves drops the leaves that are no longer fresh and, past maxLeaves,
+// the least recently used. Must be called with ca.mu held.
+func (ca *CertAuthority) trimLeaves(now time.Time) {
+	for host, leaf := range ca.leaves {
+		if !leaf.fresh(now) {
+			delete(ca.leaves, host)
+		}
+	}
+	for len(ca.leaves) > maxLeaves {
+		oldest := ""
+		for host, leaf := range ca.leaves {
+			if oldest == "" || leaf.used.Before(ca.leaves[oldest].used) {
+				oldest = host
+			}
+		}
+		delete(ca.leaves, oldest)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLeafCacheBounded(t *testing.T) {
+	ca, _, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := ca.leafFor("first.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := ca.leafFor("first.test"); again != first {
+		t.Error("a host's leaf was minted again while still fresh")
+	}
+
+	// Fill the cache with stand-ins, each used before the next, and one that
+	// has expired
+	now := time.Now()
+	for i := range maxLeaves {
+		ca.leaves[fmt.Sprintf("host-%d.test", i)] = &cachedLeaf{cert: first, used: now.Add(time.Duration(i-maxLeaves) * time.Second)}
+	}
+	expired := &tls.Certificate{Leaf: &x509.Certificate{NotAfter: now.Add(-time.Minute)}}
+	ca.leaves["expired.test"] = &cachedLeaf{cert: expired, used: now}
+
+	if _, err := ca.leafFor("new.test"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ca.leaves) != maxLeaves {
+		t.Errorf("kept %d leaves, want %d", len(ca.leaves), maxLeaves)
+	}
+	for host, kept := range map[string]bool{"expired.test": false, "host-0.test": false, "host-1.test": false, "host-2.test": true, "first.test": true, "new.test": true} {
+		if _, ok := ca.leaves[host]; ok != kept {
+			t.Errorf("leaf for %s kept = %v, want %v", host, ok, kept)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// rawPacket is a captured frame kept so its connection can be exported later
+type rawPacket struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+// RawPacketStore keeps the raw packets of recent TCP connections in memory
+type RawPacketStore struct {
+	mu       sync.Mutex
+	linkType layers.LinkType
+	conns    map[string][]rawPacket
+	order    []string
+	size     int
+	maxBytes int
+}
+
+// Global raw packet store
+var RawPackets = NewRawPacketStore(64 << 20)
+
+// NewRawPacketStore creates a raw packet store holding at most maxBytes of packet data
+func NewRawPacketStore(maxBytes int) *RawPacketStore {
+	return &RawPacketStore{
+		linkType: layers.LinkTypeEthernet,
+		conns:    make(map[string][]rawPacket),
+		order:    make([]string, 0),
+		maxBytes: maxBytes,
+	}
+}
+
+// SetLinkType sets the link type used when exporting packets
+func (s *RawPacketStore) SetLinkType(linkType layers.LinkType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.linkType = linkType
+}
+
+// Add records a packet under the connection it belongs to
+func (s *RawPacketStore) Add(connKey string, ci gopacket.CaptureInfo, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.conns[connKey]; !exists {
+		s.order = append(s.order, connKey)
+	}
+	s.conns[connKey] = append(s.conns[connKey], rawPacket{ci: ci, data: data})
+	s.size += len(data)
+
+	// Drop whole connections, oldest first, until we're back under budget
+	for s.size > s.maxBytes && len(s.order) > 1 {
+		oldest := s.order[0]
+		for _, p := range s.conns[oldest] {
+			s.size -= len(p.data)
+		}
+		delete(s.conns, oldest)
+		s.order = s.order[1:]
+	}
+
+	// A connection that's over budget by itself loses its oldest packets,
+	// down to three quarters of the budget so this doesn't happen on every packet.
+	// The rest are copied so the dropped ones can be freed.
+	if s.size > s.maxBytes {
+		key := s.order[0]
+		packets := s.conns[key]
+		n := 0
+		for n < len(packets)-1 && s.size > s.maxBytes/4*3 {
+			s.size -= len(packets[n].data)
+			n++
+		}
+		s.conns[key] = slices.Clone(packets[n:])
+	}
+}
+
+// WritePcapng writes all packets of a connection to w in pcapng format
+func (s *RawPacketStore) WritePcapng(w io.Writer, connKey string) error {
+	s.mu.Lock()
+	packets := s.conns[connKey]
+	linkType := s.linkType
+	s.mu.Unlock()
+
+	if len(packets) == 0 {
+		return fmt.Errorf("no packets stored for connection %s", connKey)
+	}
+
+	ngw, err := pcapgo.NewNgWriter(w, linkType)
+	if err != nil {
+		return err
+	}
+	for _, p := range packets {
+		if err := ngw.WritePacket(p.ci, p.data); err != nil {
+			return err
+		}
+	}
+	return ngw.Flush()
+}
+
+// connectionKey identifies a TCP connection regardless of packet direction
+func connectionKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + "-" + b
+}
+
+// packetConnectionKey returns the connection key for a captured packet
+func packetConnectionKey(packet gopacket.Packet) (string, bool) {
+	netLayer := packet.NetworkLayer()
+	tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if netLayer == nil || !ok {
+		return "", false
+	}
+	netFlow := netLayer.NetworkFlow()
+	transport := tcp.TransportFlow()
+	return connectionKey(
+		fmt.Sprintf("%s:%s", netFlow.Src(), transport.Src()),
+		fmt.Sprintf("%s:%s", netFlow.Dst(), transport.Dst()),
+	), true
+}
+
+// pairConnectionKey converts a PairKey (client-server) into a connection key
+func pairConnectionKey(pairKey string) string {
+	pairKey, _, _ = strings.Cut(pairKey, "#") // HTTP/2 stream
+	client, server, _ := strings.Cut(pairKey, "-")
+	return connectionKey(client, server)
+}
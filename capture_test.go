@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+func TestRawPacketStoreBudget(t *testing.T) {
+	s := NewRawPacketStore(1000)
+	add := func(conn string, n int) {
+		for range n {
+			s.Add(conn, gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: 100, Length: 100}, make([]byte, 100))
+		}
+	}
+	count := func(conn string) int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.conns[conn])
+	}
+
+	add("a", 6)
+	add("b", 6)
+	// a is dropped as a whole to make room for b
+	if count("a") != 0 || count("b") != 6 || s.size != 600 {
+		t.Errorf("kept %d packets of a and %d of b, %d bytes", count("a"), count("b"), s.size)
+	}
+
+	// b alone outgrows the budget, so it loses its oldest packets
+	add("b", 5)
+	if count("b") != 7 || s.size != 700 {
+		t.Errorf("kept %d packets of b, %d bytes, want the latest 7", count("b"), s.size)
+	}
+
+	var buf bytes.Buffer
+	if err := s.WritePcapng(&buf, "b"); err != nil || buf.Len() == 0 {
+		t.Errorf("WritePcapng: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxDecodedBodySize caps how much of a body is kept, on the wire and once
+// decoded
+const maxDecodedBodySize = 32 << 20
+
+// decodeBody undoes a Content-Encoding header value. Encodings are listed in
+// the order they were applied, so they're removed in reverse. A body that
+// decodes to more than maxDecodedBodySize is cut there, reported with truncated.
+func decodeBody(contentEncoding string, body []byte) (decoded []byte, truncated bool, err error) {
+	encodings := strings.Split(contentEncoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		if encoding == "" || encoding == "identity" {
+			continue
+		}
+
+		// Once cut short, what's left of the next encoding out can only be
+		// decoded as far as it goes
+		var cut bool
+		body, cut, err = decodeOne(encoding, body, truncated)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %w", encoding, err)
+		}
+		truncated = truncated || cut
+	}
+	return body, truncated, nil
+}
+
+// decodeOne removes one encoding. A partial body is decoded as far as it goes.
+func decodeOne(encoding string, body []byte, partial bool) ([]byte, bool, error) {
+	var r io.Reader
+	switch encoding {
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, false, err
+		}
+		defer gr.Close()
+		r = gr
+	case "deflate":
+		// "deflate" is meant to be zlib-wrapped, but raw deflate is common too
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			fr := flate.NewReader(bytes.NewReader(body))
+			defer fr.Close()
+			r = fr
+		} else {
+			defer zr.Close()
+			r = zr
+		}
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, false, err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, false, fmt.Errorf("unsupported encoding")
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(r, maxDecodedBodySize+1))
+	if err != nil && !(partial && len(decoded) > 0) {
+		return nil, false, err
+	}
+	if len(decoded) > maxDecodedBodySize {
+		return decoded[:maxDecodedBodySize], true, nil
+	}
+	return decoded, false, nil
+}
+
+// setBody stores the wire body and, when it was compressed, its decoded form.
+// The body of a packet that's still streaming is left as it is on the wire.
+func (p *CapturedPacket) setBody(contentEncoding string, wire []byte) {
+	p.Encoding = contentEncoding
+	p.WireSize = len(wire)
+	p.Body = wire
+	p.BodySize = len(wire)
+	defer func() { p.MimeType = sniffMimeType(p.Body) }()
+
+	if contentEncoding == "" || len(wire) == 0 || p.Streaming {
+		return
+	}
+	decoded, truncated, err := decodeBody(contentEncoding, wire)
+	if err != nil {
+		p.DecodeError = err.Error()
+		return
+	}
+	p.Truncated = p.Truncated || truncated
+	if bytes.Equal(decoded, wire) {
+		return
+	}
+	p.RawBody = wire
+	p.Body = decoded
+	p.BodySize = len(decoded)
+}
+
+// bodySummary describes the body size for console output
+func (p *CapturedPacket) bodySummary() string {
+	switch {
+	case p.Streaming:
+		return fmt.Sprintf("%d bytes so far, streaming", p.BodySize)
+	case p.DecodeError != "":
+		return fmt.Sprintf("%d bytes (%s, could not decode: %s)", p.WireSize, p.Encoding, p.DecodeError)
+	case p.RawBody != nil:
+		return fmt.Sprintf("%d bytes (%d on the wire, %s)", p.BodySize, p.WireSize, p.Encoding)
+	default:
+		return fmt.Sprintf("%d bytes", p.BodySize)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compress encodes data with one Content-Encoding
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	case "flate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = zw
+	default:
+		t.Fatalf("no encoder for %q", encoding)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeBody(t *testing.T) {
+	text := []byte(strings.Repeat("hello, world\n", 100))
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     []byte
+		err      string
+	}{
+		{"gzip", "gzip", compress(t, "gzip", text), text, ""},
+		{"x-gzip", "x-gzip", compress(t, "gzip", text), text, ""},
+		{"deflate with zlib", "deflate", compress(t, "zlib", text), text, ""},
+		{"raw deflate", "deflate", compress(t, "flate", text), text, ""},
+		{"brotli", "br", compress(t, "br", text), text, ""},
+		{"zstd", "zstd", compress(t, "zstd", text), text, ""},
+		{"identity", "identity", text, text, ""},
+		// Encodings are removed in the reverse of the order they're listed
+		{"stacked", "gzip, br", compress(t, "br", compress(t, "gzip", text)), text, ""},
+		{"case and spaces", " GZIP ", compress(t, "gzip", text), text, ""},
+		{"unsupported", "compress", text, nil, "compress: unsupported encoding"},
+		{"corrupt", "gzip", text, nil, "gzip: gzip: invalid header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, truncated, err := decodeBody(tt.encoding, tt.body)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("decodeBody(%q) error %v, want %q", tt.encoding, err, tt.err)
+				}
+				return
+			}
+			if err != nil || truncated || !bytes.Equal(got, tt.want) {
+				t.Errorf("decodeBody(%q) = %d bytes, %v, %v; want %d bytes", tt.encoding, len(got), truncated, err, len(tt.want))
+			}
+		})
+	}
+
+	// The largest body allowed decodes in full, and a larger one is cut there
+	full := make([]byte, maxDecodedBodySize)
+	if got, truncated, err := decodeBody("gzip", compress(t, "gzip", full)); err != nil || truncated || len(got) != len(full) {
+		t.Errorf("decodeBody of %d bytes = %d bytes, %v, %v", len(full), len(got), truncated, err)
+	}
+	if got, truncated, err := decodeBody("gzip", compress(t, "gzip", make([]byte, maxDecodedBodySize+1))); err != nil || !truncated || len(got) != maxDecodedBodySize {
+		t.Errorf("decodeBody of %d bytes = %d bytes, %v, %v", maxDecodedBodySize+1, len(got), truncated, err)
+	}
+}
+
+func TestSetBodyDecodeError(t *testing.T) {
+	// A body that fails to decode is kept as it came, with the reason
+	var p CapturedPacket
+	p.setBody("gzip", []byte("not gzip"))
+	if p.DecodeError == "" || string(p.Body) != "not gzip" || len(p.RawBody) != 0 || p.BodySize != 8 || p.WireSize != 8 {
+		t.Errorf("packet = %+v", p)
+	}
+
+	p = CapturedPacket{}
+	p.setBody("gzip", compress(t, "gzip", []byte("hello")))
+	if p.DecodeError != "" || string(p.Body) != "hello" || len(p.RawBody) == 0 || p.BodySize != 5 || p.WireSize != len(p.RawBody) {
+		t.Errorf("packet = %+v", p)
+	}
+}
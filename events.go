@@ -0,0 +1,59 @@
+package main
+
+// Pair event types sent to subscribers
+const (
+	EventPair  = "pair"  // a pair was created or updated
+	EventEvict = "evict" // pairs were dropped to stay under the size limit
+	EventClear = "clear" // the store was cleared
+)
+
+// subscriberBuffer is how many events a slow subscriber may fall behind by
+// before it is disconnected
+const subscriberBuffer = 256
+
+// PairEvent describes a change to the stored pairs
+type PairEvent struct {
+	Type string
+	Pair PacketPair
+	IDs  []int
+}
+
+// Subscribe returns the current pairs (newest first) together with a channel
+// of every change made after them. The channel is closed if the subscriber
+// falls too far behind; call the returned function to unsubscribe.
+func (s *PacketStore) Subscribe() ([]PacketPair, <-chan PairEvent, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shared := s.snapshot()
+	snapshot := make([]PacketPair, len(shared))
+	for i, p := range shared {
+		snapshot[i] = *p
+	}
+
+	ch := make(chan PairEvent, subscriberBuffer)
+	s.subscribers[ch] = struct{}{}
+
+	unsubscribe := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.subscribers[ch]; ok {
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+	return snapshot, ch, unsubscribe
+}
+
+// publish sends an event to all subscribers. Must be called with s.mu held.
+func (s *PacketStore) publish(ev PairEvent) {
+	for ch := range s.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			// Too far behind; closing makes the client reconnect and resync
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+}
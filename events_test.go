@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	request := func(key string) CapturedPacket {
+		return CapturedPacket{Type: PacketRequest, Method: "GET", URL: "/" + key, PairKey: key}
+	}
+	response := func(key string) CapturedPacket {
+		return CapturedPacket{Type: PacketResponse, StatusCode: 200, PairKey: key}
+	}
+	tests := []struct {
+		name   string
+		before []CapturedPacket // stored before subscribing
+		change func(s *PacketStore)
+		events []string // type and pair ID or evicted IDs
+	}{
+		{
+			name:   "new pair",
+			change: func(s *PacketStore) { s.Add(request("a")) },
+			events: []string{"pair 1"},
+		},
+		{
+			name:   "answered",
+			before: []CapturedPacket{request("a")},
+			change: func(s *PacketStore) { s.Add(response("a")) },
+			events: []string{"pair 1"},
+		},
+		{
+			name:   "over the pair limit",
+			before: []CapturedPacket{request("a"), request("b")},
+			change: func(s *PacketStore) { s.Add(request("c")) },
+			events: []string{"pair 3", "evict [1]"},
+		},
+		{
+			name:   "cleared",
+			before: []CapturedPacket{request("a")},
+			change: func(s *PacketStore) { s.Clear() },
+			events: []string{"clear"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewPacketStore(2, 0)
+			for _, p := range tt.before {
+				s.Add(p)
+			}
+			snapshot, events, unsubscribe := s.Subscribe()
+			defer unsubscribe()
+			if len(snapshot) != len(tt.before) {
+				t.Errorf("snapshot has %d pairs, want %d", len(snapshot), len(tt.before))
+			}
+
+			tt.change(s)
+			var got []string
+			for len(events) > 0 {
+				ev := <-events
+				switch ev.Type {
+				case EventPair:
+					got = append(got, fmt.Sprintf("pair %d", ev.Pair.ID))
+				case EventEvict:
+					got = append(got, fmt.Sprintf("evict %v", ev.IDs))
+				default:
+					got = append(got, ev.Type)
+				}
+			}
+			if !slices.Equal(got, tt.events) {
+				t.Errorf("events %q, want %q", got, tt.events)
+			}
+		})
+	}
+}
+
+func TestSubscriberFallsBehind(t *testing.T) {
+	s := NewPacketStore(2*subscriberBuffer, 0)
+	_, slow, unsubscribeSlow := s.Subscribe()
+	_, events, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+
+	// A subscriber that stops reading is dropped rather than holding up the store
+	for i := range subscriberBuffer + 1 {
+		s.Add(CapturedPacket{Type: PacketRequest, URL: "/", PairKey: fmt.Sprint(i)})
+		<-events
+	}
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Errorf("slow subscriber got %d events before its channel closed, want %d", n, subscriberBuffer)
+	}
+	unsubscribeSlow() // already dropped, so this does nothing
+
+	// The others carry on
+	s.Add(CapturedPacket{Type: PacketRequest, URL: "/", PairKey: "last"})
+	if ev, ok := <-events; !ok || ev.Type != EventPair {
+		t.Errorf("got %v, %v after the slow subscriber was dropped", ev.Type, ok)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InterimResponse is a 1xx response sent ahead of the final one, such as
+// 100 Continue or 103 Early Hints
+type InterimResponse struct {
+	Timestamp  time.Time         `json:"timestamp"`
+	Status     string            `json:"status"`
+	StatusCode int               `json:"statusCode"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Protocol   string            `json:"protocol"`
+}
+
+// isInterim reports whether a status code is an interim response. 101 is
+// left out, since it ends the exchange when the protocol switches.
+func isInterim(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
+
+// requestQueue hands the requests read on one direction of a connection to
+// the other, which needs their methods to tell where each response ends
+type requestQueue struct {
+	refs int // streams using the queue, guarded by the factory
+
+	mu      sync.Mutex
+	pending []queuedRequest
+	clients int           // client directions still being read
+	reading time.Time     // capture time of the chunk the client is parsing, zero once it wants more
+	changed chan struct{} // closed when pending grows or the client direction moves on
+}
+
+// queuedRequest is a request still to be answered
+type queuedRequest struct {
+	method string
+	seen   time.Time
+}
+
+func newRequestQueue() *requestQueue {
+	return &requestQueue{changed: make(chan struct{})}
+}
+
+// notify wakes any response waiting for a request. Must be called with q.mu held.
+func (q *requestQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// open notes that the client direction is being read
+func (q *requestQueue) open() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.clients++
+}
+
+// close notes that the client direction has ended, so nothing more will be queued
+func (q *requestQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.clients--
+	q.notify()
+}
+
+// startChunk notes that the client direction was handed a chunk captured at
+// seen, and endChunk that it has parsed all of it and is waiting for more
+func (q *requestQueue) startChunk(seen time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reading = seen
+}
+
+func (q *requestQueue) endChunk() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reading = time.Time{}
+	q.notify()
+}
+
+// push queues a request seen at the given capture time
+func (q *requestQueue) push(method string, seen time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = append(q.pending, queuedRequest{method: method, seen: seen})
+	q.notify()
+}
+
+// next returns the request answered by a response seen at the given capture
+// time. While the client direction is still parsing data captured no later
+// than the response, the request may be in it, so next waits for that chunk
+// to be finished. It returns nil when the request wasn't captured, as when
+// the capture started mid-exchange.
+func (q *requestQueue) next(seen time.Time) *http.Request {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) == 0 && q.clients > 0 && !q.reading.IsZero() && !q.reading.After(seen) {
+		changed := q.changed
+		q.mu.Unlock()
+		<-changed
+		q.mu.Lock()
+	}
+
+	// A request sent after the response started isn't the one it answers
+	if len(q.pending) == 0 || q.pending[0].seen.After(seen) {
+		return nil
+	}
+	req := q.pending[0]
+	q.pending = q.pending[1:]
+	return &http.Request{Method: req.method}
+}
+
+// requestQueue returns the queue shared by both directions of a connection,
+// creating it for whichever direction comes first
+func (h *httpStreamFactory) requestQueue(key string) *requestQueue {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.queues == nil {
+		h.queues = make(map[string]*requestQueue)
+	}
+	queue, ok := h.queues[key]
+	if !ok {
+		queue = newRequestQueue()
+		h.queues[key] = queue
+	}
+	queue.refs++
+	return queue
+}
+
+// releaseRequestQueue forgets a connection's queue once both directions are done
+func (h *httpStreamFactory) releaseRequestQueue(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	queue, ok := h.queues[key]
+	if !ok {
+		return
+	}
+	queue.refs--
+	if queue.refs <= 0 {
+		delete(h.queues, key)
+	}
+}
+
+// logInterim stores and prints a 1xx response, adding it to the exchange it
+// belongs to rather than pairing it as the final response
+func (h *httpStream) logInterim(resp *http.Response, start time.Time, stream uint32) {
+	interim := InterimResponse{
+		Timestamp:  start,
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		Headers:    joinHeader(resp.Header),
+		Protocol:   resp.Proto,
+	}
+	pairKey := streamPairKey(fmt.Sprintf("%s:%s-%s:%s", h.net.Dst(), h.transport.Dst(), h.net.Src(), h.transport.Src()), stream)
+	Store.AddInterim(pairKey, interim)
+	printInterim(interim, fmt.Sprintf("%s ← %s", h.net.Dst(), h.net.Src()))
+}
+
+// printInterim logs an interim response to the console
+func printInterim(interim InterimResponse, connection string) {
+	timestamp := interim.Timestamp.Format("2006-01-02 15:04:05")
+
+	fmt.Printf("┌─ HTTP INTERIM RESPONSE [%s]\n", timestamp)
+	fmt.Printf("├─ Status: %s\n", interim.Status)
+	fmt.Printf("├─ Connection: %s\n", connection)
+	for key, value := range interim.Headers {
+		fmt.Printf("├─ %s: %s\n", key, value)
+	}
+	fmt.Printf("└─ Protocol: %s\n", interim.Protocol)
+	fmt.Println()
+}
+
+// statusLineCode returns the status code of an HTTP/1.x status line, or 0
+func statusLineCode(line string) int {
+	_, rest, _ := strings.Cut(line, " ")
+	code, err := strconv.Atoi(rest[:min(len(rest), 3)])
+	if err != nil {
+		return 0
+	}
+	return code
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// nextMethod returns the method of the request q hands a response seen at
+// the given time, or "" for none
+func nextMethod(q *requestQueue, seen time.Time) string {
+	if req := q.next(seen); req != nil {
+		return req.Method
+	}
+	return ""
+}
+
+func TestRequestQueueNext(t *testing.T) {
+	at := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		reading time.Time // chunk the client direction is parsing, if any
+		pending []queuedRequest
+		want    string
+	}{
+		{"queued", time.Time{}, []queuedRequest{{"HEAD", at.Add(-time.Second)}}, "HEAD"},
+		{"client idle", time.Time{}, nil, ""},
+		{"client reading later data", at.Add(time.Second), nil, ""},
+		{"request sent after response", time.Time{}, []queuedRequest{{"GET", at.Add(time.Second)}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newRequestQueue()
+			q.open()
+			q.pending = tt.pending
+			if !tt.reading.IsZero() {
+				q.startChunk(tt.reading)
+			}
+			if got := nextMethod(q, at); got != tt.want {
+				t.Errorf("next = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestQueueWaitsForClientChunk(t *testing.T) {
+	at := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		name   string
+		finish func(q *requestQueue)
+		want   string
+	}{
+		{"request parsed", func(q *requestQueue) { q.push("HEAD", at.Add(-time.Millisecond)) }, "HEAD"},
+		{"chunk had no request", func(q *requestQueue) { q.endChunk() }, ""},
+		{"client closed", func(q *requestQueue) { q.close() }, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newRequestQueue()
+			q.open()
+			// The client is still parsing a chunk captured before the response
+			q.startChunk(at.Add(-time.Millisecond))
+
+			got := make(chan string, 1)
+			go func() { got <- nextMethod(q, at) }()
+			tt.finish(q)
+			if method := <-got; method != tt.want {
+				t.Errorf("next = %q, want %q", method, tt.want)
+			}
+		})
+	}
+}
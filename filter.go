@@ -0,0 +1,643 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Filter is a compiled filter expression such as
+//
+//	method == "POST" && status >= 500 && header("Cf-Ipcountry") == "DE" && body ~ "timeout"
+//
+// Comparisons are ==, !=, <, <=, >, >= and ~ / !~ (regular expression match),
+// combined with &&, || and !. A bare string literal matches URLs containing it.
+// Double-quoted strings take Go escapes; single-quoted ones keep backslashes
+// as they are, for regular expressions, apart from \' for a quote.
+type Filter struct {
+	src  string
+	root filterNode
+}
+
+// filterFields lists the field names a filter may reference
+var filterFields = []string{
+	"id", "type", "method", "url", "path", "query", "host", "status", "protocol",
+	"content_type", "size", "body", "duration", "ttfb", "service", "port", "connection",
+	"sni", "alpn", "tls_version", "cipher", "ja3", "ja4",
+	"grpc_method", "grpc_status", "error",
+}
+
+// filterFuncs lists the functions a filter may call, all taking one string
+var filterFuncs = []string{"header", "req_header", "res_header"}
+
+// ParseFilter compiles a filter expression
+func ParseFilter(src string) (*Filter, error) {
+	tokens, err := lexFilter(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+	return &Filter{src: src, root: root}, nil
+}
+
+// String returns the source of the filter
+func (f *Filter) String() string {
+	return f.src
+}
+
+// MatchPair reports whether a pair satisfies the filter
+func (f *Filter) MatchPair(p PacketPair) bool {
+	return f.root.eval(pairTarget{p})
+}
+
+// MatchPacket reports whether a single packet satisfies the filter
+func (f *Filter) MatchPacket(p CapturedPacket) bool {
+	return f.root.eval(packetTarget{p})
+}
+
+// filterValue is a string that may also be a number
+type filterValue struct {
+	s     string
+	n     float64
+	isNum bool
+}
+
+func stringValue(s string) filterValue {
+	return filterValue{s: s}
+}
+
+func numberValue(n float64) filterValue {
+	return filterValue{s: strconv.FormatFloat(n, 'f', -1, 64), n: n, isNum: true}
+}
+
+// filterTarget resolves field and header values on whatever is being filtered.
+// Fields may have several values (e.g. a pair has two bodies); a comparison
+// holds if any of them matches.
+type filterTarget interface {
+	field(name string) []filterValue
+	header(scope, name string) []filterValue
+}
+
+// Expression tree
+
+type filterNode interface {
+	eval(t filterTarget) bool
+}
+
+type andNode struct{ left, right filterNode }
+
+func (n andNode) eval(t filterTarget) bool { return n.left.eval(t) && n.right.eval(t) }
+
+type orNode struct{ left, right filterNode }
+
+func (n orNode) eval(t filterTarget) bool { return n.left.eval(t) || n.right.eval(t) }
+
+type notNode struct{ inner filterNode }
+
+func (n notNode) eval(t filterTarget) bool { return !n.inner.eval(t) }
+
+// operand is a literal, a field or a header() call
+type operand struct {
+	literal *filterValue
+	field   string
+	fn      string
+	arg     string
+}
+
+func (o operand) values(t filterTarget) []filterValue {
+	switch {
+	case o.literal != nil:
+		return []filterValue{*o.literal}
+	case o.fn == "header":
+		return t.header("", o.arg)
+	case o.fn == "req_header":
+		return t.header("request", o.arg)
+	case o.fn == "res_header":
+		return t.header("response", o.arg)
+	default:
+		return t.field(o.field)
+	}
+}
+
+// truthNode is an operand used on its own: a string literal searches URLs,
+// anything else is true when it has a non-empty, non-zero value
+type truthNode struct{ operand operand }
+
+func (n truthNode) eval(t filterTarget) bool {
+	if n.operand.literal != nil {
+		needle := strings.ToLower(n.operand.literal.s)
+		for _, v := range t.field("url") {
+			if strings.Contains(strings.ToLower(v.s), needle) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, v := range n.operand.values(t) {
+		if v.s != "" && v.s != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+type compareNode struct {
+	left, right operand
+	op          string
+	re          *regexp.Regexp
+}
+
+func (n compareNode) eval(t filterTarget) bool {
+	switch n.op {
+	case "!=":
+		return !n.any(t, "==")
+	case "!~":
+		return !n.any(t, "~")
+	default:
+		return n.any(t, n.op)
+	}
+}
+
+func (n compareNode) any(t filterTarget, op string) bool {
+	rights := n.right.values(t)
+	for _, l := range n.left.values(t) {
+		if op == "~" {
+			if n.re.MatchString(l.s) {
+				return true
+			}
+			continue
+		}
+		for _, r := range rights {
+			if compareValues(l, r, op) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func compareValues(l, r filterValue, op string) bool {
+	cmp := 0
+	if l.isNum && r.isNum {
+		switch {
+		case l.n < r.n:
+			cmp = -1
+		case l.n > r.n:
+			cmp = 1
+		}
+	} else if op == "==" {
+		// Header names, methods etc. are easiest to match case-insensitively
+		return strings.EqualFold(l.s, r.s)
+	} else {
+		cmp = strings.Compare(l.s, r.s)
+	}
+
+	switch op {
+	case "==":
+		return cmp == 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// Lexer
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var filterOps = []string{"&&", "||", "==", "!=", ">=", "<=", "!~", ">", "<", "~", "!", "(", ")", ","}
+
+func lexFilter(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(src) && rune(src[end]) != c {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			text := src[i+1 : end]
+			if c == '"' {
+				unquoted, err := strconv.Unquote(src[i : end+1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid string at position %d: %v", i, err)
+				}
+				text = unquoted
+			} else {
+				text = strings.ReplaceAll(text, `\'`, "'")
+			}
+			tokens = append(tokens, token{kind: tokString, text: text, pos: i})
+			i = end + 1
+		case unicode.IsDigit(c):
+			end := i
+			for end < len(src) && (unicode.IsDigit(rune(src[end])) || src[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[i:end], pos: i})
+			i = end
+		case unicode.IsLetter(c) || c == '_':
+			end := i
+			for end < len(src) && (unicode.IsLetter(rune(src[end])) || unicode.IsDigit(rune(src[end])) || src[end] == '_') {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: src[i:end], pos: i})
+			i = end
+		default:
+			matched := false
+			for _, op := range filterOps {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, token{kind: tokOp, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+// Parser
+
+type filterParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *filterParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *filterParser) accept(op string) bool {
+	if tok := p.peek(); tok.kind == tokOp && tok.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) expect(op string) error {
+	if !p.accept(op) {
+		tok := p.peek()
+		return fmt.Errorf("expected %q at position %d", op, tok.pos)
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.accept("!") {
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{inner}, nil
+	}
+	if p.accept("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	tok := p.peek()
+	if tok.kind != tokOp {
+		return truthNode{left}, nil
+	}
+	switch tok.text {
+	case "==", "!=", "<", "<=", ">", ">=", "~", "!~":
+	default:
+		return truthNode{left}, nil
+	}
+	p.next()
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	node := compareNode{left: left, right: right, op: tok.text}
+	if tok.text == "~" || tok.text == "!~" {
+		if right.literal == nil {
+			return nil, fmt.Errorf("%s needs a string pattern at position %d", tok.text, tok.pos)
+		}
+		if node.re, err = regexp.Compile(right.literal.s); err != nil {
+			return nil, fmt.Errorf("invalid pattern at position %d: %v", tok.pos, err)
+		}
+	}
+	return node, nil
+}
+
+func (p *filterParser) parseOperand() (operand, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokString:
+		v := stringValue(tok.text)
+		return operand{literal: &v}, nil
+	case tokNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return operand{}, fmt.Errorf("invalid number %q at position %d", tok.text, tok.pos)
+		}
+		v := numberValue(n)
+		return operand{literal: &v}, nil
+	case tokIdent:
+		name := strings.ToLower(tok.text)
+		if p.accept("(") {
+			if !slices.Contains(filterFuncs, name) {
+				return operand{}, fmt.Errorf("unknown function %q at position %d", tok.text, tok.pos)
+			}
+			arg := p.next()
+			if arg.kind != tokString {
+				return operand{}, fmt.Errorf("%s() takes a string at position %d", name, arg.pos)
+			}
+			if err := p.expect(")"); err != nil {
+				return operand{}, err
+			}
+			return operand{fn: name, arg: arg.text}, nil
+		}
+		if !slices.Contains(filterFields, name) {
+			return operand{}, fmt.Errorf("unknown field %q at position %d (fields: %s)", tok.text, tok.pos, strings.Join(filterFields, ", "))
+		}
+		return operand{field: name}, nil
+	case tokEOF:
+		return operand{}, fmt.Errorf("unexpected end of filter")
+	default:
+		return operand{}, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+}
+
+// Targets
+
+// packetTarget filters individual packets
+type packetTarget struct{ p CapturedPacket }
+
+func (t packetTarget) field(name string) []filterValue {
+	return packetField(&t.p, name)
+}
+
+func (t packetTarget) header(scope, name string) []filterValue {
+	if scope != "" && scope != string(t.p.Type) {
+		return nil
+	}
+	return headerValues(&t.p, name)
+}
+
+// pairTarget filters pairs, drawing each field from the request or response
+type pairTarget struct{ p PacketPair }
+
+func (t pairTarget) field(name string) []filterValue {
+	if t.p.TLS != nil {
+		return tlsField(t.p, name)
+	}
+	if t.p.ParseError != nil {
+		return parseErrorField(t.p, name)
+	}
+	switch name {
+	case "id":
+		return []filterValue{numberValue(float64(t.p.ID))}
+	case "type":
+		return []filterValue{stringValue("pair")}
+	case "duration":
+		return []filterValue{numberValue(t.p.Timing.TotalMs)}
+	case "ttfb":
+		return []filterValue{numberValue(t.p.Timing.TTFBMs)}
+	case "method", "url", "path", "query", "host", "grpc_method":
+		return packetField(t.p.Request, name)
+	case "status", "size", "grpc_status":
+		return packetField(t.p.Response, name)
+	}
+
+	// Everything else can come from either side
+	values := packetField(t.p.Request, name)
+	return append(values, packetField(t.p.Response, name)...)
+}
+
+func (t pairTarget) header(scope, name string) []filterValue {
+	var values []filterValue
+	if scope != "response" {
+		values = append(values, headerValues(t.p.Request, name)...)
+	}
+	if scope != "request" {
+		values = append(values, headerValues(t.p.Response, name)...)
+	}
+	return values
+}
+
+// tlsField resolves fields on an encrypted connection, which has no
+// request or response to draw them from
+func tlsField(p PacketPair, name string) []filterValue {
+	c := p.TLS
+	switch name {
+	case "id":
+		return []filterValue{numberValue(float64(p.ID))}
+	case "type":
+		return []filterValue{stringValue("tls")}
+	case "duration":
+		return []filterValue{numberValue(c.DurationMs)}
+	case "host", "sni":
+		return []filterValue{stringValue(c.ServerName)}
+	case "protocol", "alpn":
+		values := []filterValue{stringValue(c.NegotiatedALPN)}
+		if name == "alpn" {
+			for _, protocol := range c.ALPN {
+				values = append(values, stringValue(protocol))
+			}
+		}
+		return values
+	case "size":
+		return []filterValue{numberValue(float64(c.ClientBytes + c.ServerBytes))}
+	case "tls_version":
+		return []filterValue{stringValue(c.Version)}
+	case "cipher":
+		return []filterValue{stringValue(c.CipherSuite)}
+	case "ja3":
+		return []filterValue{stringValue(c.JA3)}
+	case "ja4":
+		return []filterValue{stringValue(c.JA4)}
+	case "service":
+		return []filterValue{stringValue(c.Service)}
+	case "port":
+		return []filterValue{numberValue(float64(c.ServicePort))}
+	case "connection":
+		return []filterValue{stringValue(c.Connection)}
+	}
+	return nil
+}
+
+// parseErrorField resolves fields on bytes that couldn't be parsed
+func parseErrorField(p PacketPair, name string) []filterValue {
+	e := p.ParseError
+	switch name {
+	case "id":
+		return []filterValue{numberValue(float64(p.ID))}
+	case "type":
+		return []filterValue{stringValue("parse_error")}
+	case "error":
+		return []filterValue{stringValue(e.Error)}
+	case "size":
+		return []filterValue{numberValue(float64(e.Skipped))}
+	case "service":
+		return []filterValue{stringValue(e.Service)}
+	case "port":
+		return []filterValue{numberValue(float64(e.ServicePort))}
+	case "connection":
+		return []filterValue{stringValue(e.Connection)}
+	}
+	return nil
+}
+
+func packetField(p *CapturedPacket, name string) []filterValue {
+	if p == nil {
+		return nil
+	}
+	switch name {
+	case "id":
+		return []filterValue{numberValue(float64(p.ID))}
+	case "type":
+		return []filterValue{stringValue(string(p.Type))}
+	case "method":
+		return []filterValue{stringValue(p.Method)}
+	case "url":
+		return []filterValue{stringValue(p.URL)}
+	case "path", "query":
+		u, err := url.Parse(p.URL)
+		if err != nil {
+			return nil
+		}
+		if name == "path" {
+			return []filterValue{stringValue(u.Path)}
+		}
+		return []filterValue{stringValue(u.RawQuery)}
+	case "host":
+		return []filterValue{stringValue(p.Host)}
+	case "status":
+		return []filterValue{numberValue(float64(p.StatusCode))}
+	case "protocol":
+		return []filterValue{stringValue(p.Protocol)}
+	case "content_type":
+		return []filterValue{stringValue(p.ContentType)}
+	case "size":
+		return []filterValue{numberValue(float64(p.BodySize))}
+	case "body":
+		return []filterValue{stringValue(string(p.Body))}
+	case "duration":
+		return []filterValue{numberValue(durationMs(p.StartTime, p.EndTime))}
+	case "service":
+		return []filterValue{stringValue(p.Service)}
+	case "port":
+		return []filterValue{numberValue(float64(p.ServicePort))}
+	case "connection":
+		return []filterValue{stringValue(p.Connection)}
+	case "grpc_method":
+		if p.GRPC != nil {
+			return []filterValue{stringValue(p.GRPC.Method)}
+		}
+	case "grpc_status":
+		// Matches either the name or the number
+		if p.GRPC != nil && p.GRPC.Status != "" {
+			return []filterValue{stringValue(p.GRPC.Status), numberValue(float64(p.GRPC.StatusCode))}
+		}
+	}
+	return nil
+}
+
+func headerValues(p *CapturedPacket, name string) []filterValue {
+	if p == nil {
+		return nil
+	}
+	for key, value := range p.Headers {
+		if strings.EqualFold(key, name) {
+			return []filterValue{stringValue(value)}
+		}
+	}
+	return nil
+}
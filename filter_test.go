@@ -0,0 +1,115 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLexFilter(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []token
+	}{
+		{`status>=500`, []token{{tokIdent, "status", 0}, {tokOp, ">=", 6}, {tokNumber, "500", 8}}},
+		{`a&&!b||c`, []token{{tokIdent, "a", 0}, {tokOp, "&&", 1}, {tokOp, "!", 3}, {tokIdent, "b", 4}, {tokOp, "||", 5}, {tokIdent, "c", 7}}},
+		{`url !~ "a\"b"`, []token{{tokIdent, "url", 0}, {tokOp, "!~", 4}, {tokString, `a"b`, 7}}},
+		// Single quotes keep backslashes, which suits regular expressions
+		{`body ~ '\d+'`, []token{{tokIdent, "body", 0}, {tokOp, "~", 5}, {tokString, `\d+`, 7}}},
+		{`body ~ 'it\'s \.'`, []token{{tokIdent, "body", 0}, {tokOp, "~", 5}, {tokString, `it's \.`, 7}}},
+		{`header("X-Id") != 1.5`, []token{{tokIdent, "header", 0}, {tokOp, "(", 6}, {tokString, "X-Id", 7}, {tokOp, ")", 13}, {tokOp, "!=", 15}, {tokNumber, "1.5", 18}}},
+		{"  ", nil},
+	}
+	for _, tt := range tests {
+		got, err := lexFilter(tt.src)
+		if err != nil {
+			t.Errorf("lexFilter(%q): %v", tt.src, err)
+			continue
+		}
+		want := append(tt.want, token{kind: tokEOF, pos: len(tt.src)})
+		if !slices.Equal(got, want) {
+			t.Errorf("lexFilter(%q) = %v, want %v", tt.src, got, want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`method == "GET`, "unterminated string at position 10"},
+		{`method == "\q"`, "invalid string at position 10"},
+		{`status # 5`, `unexpected character '#' at position 7`},
+		{`nope == 1`, `unknown field "nope" at position 0`},
+		{`cookie("a")`, `unknown function "cookie" at position 0`},
+		{`header(a)`, "header() takes a string at position 7"},
+		{`header("a"`, `expected ")" at position 10`},
+		{`(status == 200`, `expected ")" at position 14`},
+		{`status ==`, "unexpected end of filter"},
+		{`status == 200 method`, `unexpected "method" at position 14`},
+		{`body ~ status`, "~ needs a string pattern at position 5"},
+		{`body ~ "("`, "invalid pattern at position 5"},
+		{`size > 1.2.3`, `invalid number "1.2.3" at position 7`},
+		{`&& status`, `unexpected "&&" at position 0`},
+	}
+	for _, tt := range tests {
+		_, err := ParseFilter(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ParseFilter(%q) = %v, want an error containing %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestFilterMatchPair(t *testing.T) {
+	pair := PacketPair{
+		ID: 42,
+		Request: &CapturedPacket{
+			Type: PacketRequest, Method: "POST", URL: "/api/orders?page=2", Host: "shop.example",
+			Headers: map[string]string{"Content-Type": "application/json", "X-Trace": "abc"},
+			Body:    []byte(`{"item":"widget"}`), BodySize: 17, Service: "shop", ServicePort: 8080,
+		},
+		Response: &CapturedPacket{
+			Type: PacketResponse, StatusCode: 503, Protocol: "HTTP/1.1",
+			Headers: map[string]string{"Retry-After": "30"},
+			Body:    []byte("upstream timeout"), BodySize: 16,
+		},
+	}
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{`method == "post"`, true},
+		{`method != "POST"`, false},
+		{`status >= 500 && status < 600`, true},
+		{`status == 200 || id == 42`, true},
+		{`!(status == 503)`, false},
+		{`path == "/api/orders" && query == "page=2"`, true},
+		{`host ~ '^shop\.'`, true},
+		{`body ~ "timeout"`, true},
+		{`body ~ "widget"`, true}, // either side's body
+		{`body !~ "widget"`, false},
+		{`size > 16`, false}, // the response's size
+		{`port == 8080 && service == "shop"`, true},
+		{`header("x-trace") == "abc"`, true},
+		{`req_header("Retry-After")`, false},
+		{`res_header("Retry-After") >= 30`, true},
+		{`"ORDERS"`, true},
+		{`"checkout"`, false},
+		{`grpc_method`, false},
+		{`type == "pair" && !error`, true},
+		// && binds tighter than ||
+		{`status == 200 && id == 1 || method == "POST"`, true},
+		{`status == 200 && (id == 1 || method == "POST")`, false},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.src)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", tt.src, err)
+			continue
+		}
+		if got := f.MatchPair(pair); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// isGREASE reports whether a value is one of the reserved GREASE values
+// (RFC 8701) that clients sprinkle in to keep servers tolerant
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// withoutGREASE returns the values that aren't GREASE
+func withoutGREASE(values []uint16) []uint16 {
+	return slices.DeleteFunc(slices.Clone(values), isGREASE)
+}
+
+// JA3 returns the JA3 fingerprint string of a ClientHello and its MD5 hash
+func (h *clientHello) JA3() (string, string) {
+	join := func(values []uint16) string {
+		parts := make([]string, len(values))
+		for i, v := range values {
+			parts[i] = strconv.Itoa(int(v))
+		}
+		return strings.Join(parts, "-")
+	}
+	formats := make([]uint16, len(h.pointFormats))
+	for i, f := range h.pointFormats {
+		formats[i] = uint16(f)
+	}
+
+	full := strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		join(withoutGREASE(h.cipherSuites)),
+		join(withoutGREASE(h.extensions)),
+		join(withoutGREASE(h.supportedGroups)),
+		join(formats),
+	}, ",")
+	sum := md5.Sum([]byte(full))
+	return full, hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint of a ClientHello seen over TCP
+func (h *clientHello) JA4() string {
+	version := h.version
+	if versions := withoutGREASE(h.supportedVersions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+	sni := "i"
+	if h.serverName != "" {
+		sni = "d"
+	}
+	ciphers := withoutGREASE(h.cipherSuites)
+	extensions := withoutGREASE(h.extensions)
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(version), sni, min(len(ciphers), 99), min(len(extensions), 99), ja4ALPN(h.alpn))
+
+	// The hashed parts are sorted, so extension order shuffling doesn't change them
+	b := ja4Hash(ja4Hex(slices.Sorted(slices.Values(ciphers))))
+	extensions = slices.DeleteFunc(extensions, func(v uint16) bool {
+		return v == extensionServerName || v == extensionALPN
+	})
+	c := ja4Hex(slices.Sorted(slices.Values(extensions)))
+	if len(h.signatureAlgorithms) > 0 {
+		c += "_" + ja4Hex(h.signatureAlgorithms)
+	}
+	if len(extensions) == 0 {
+		c = ""
+	}
+	return a + "_" + b + "_" + ja4Hash(c)
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	}
+	return "00"
+}
+
+// ja4ALPN is the first and last character of the first ALPN protocol
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	first, last := alpn[0][0], alpn[0][len(alpn[0])-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		h := hex.EncodeToString([]byte(alpn[0]))
+		return h[:1] + h[len(h)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// ja4Hex formats values as comma-separated four-digit hex
+func ja4Hex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ja4Hash is the truncated SHA-256 JA4 uses, or zeros for an empty list
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
@@ -0,0 +1,91 @@
+package main
+
+import "testing"
+
+func TestJA3(t *testing.T) {
+	// The example from the JA3 README
+	const want, wantHash = "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0", "ada70206e40642a3e4461f35503241d5"
+	ciphers := []uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4}
+	groups := tlsExtension{extensionSupportedGroups, vec(2, u16s(23, 24, 25))}
+	formats := tlsExtension{extensionECPointFormats, vec(1, []byte{0})}
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"plain", helloBody(true, 0x0301, make([]byte, 32), ciphers, sniExtension("example.com"), groups, formats)},
+		{
+			name: "GREASE ignored",
+			body: helloBody(true, 0x0301, make([]byte, 32), append([]uint16{0x0a0a}, ciphers...),
+				tlsExtension{0x1a1a, nil}, sniExtension("example.com"),
+				tlsExtension{extensionSupportedGroups, vec(2, u16s(0x2a2a, 23, 24, 25))}, formats),
+		},
+	}
+	for _, tt := range tests {
+		hello, err := parseClientHello(tt.body)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if full, hash := hello.JA3(); full != want || hash != wantHash {
+			t.Errorf("%s: JA3 = %q %s, want %q %s", tt.name, full, hash, want, wantHash)
+		}
+	}
+}
+
+func TestJA4(t *testing.T) {
+	sigalgs := tlsExtension{extensionSignatureAlgorithms, vec(2, u16s(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601))}
+	versions := tlsExtension{extensionSupportedVersions, vec(1, u16s(0x3a3a, 0x0304, 0x0303))}
+	// A browser hello: 15 ciphers and 16 extensions besides GREASE, with
+	// the extensions in shuffled order
+	browser := helloBody(true, 0x0303, make([]byte, 32),
+		[]uint16{0x4a4a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		tlsExtension{0x0a0a, nil}, tlsExtension{0x0023, nil}, alpnExtension("h2", "http/1.1"), tlsExtension{0x4469, nil},
+		tlsExtension{0x0005, nil}, sniExtension("example.com"), tlsExtension{0xff01, []byte{0}}, tlsExtension{0x0012, nil},
+		sigalgs, tlsExtension{0x0033, nil}, versions, tlsExtension{0x002d, nil}, tlsExtension{0x0017, nil},
+		tlsExtension{extensionECPointFormats, vec(1, []byte{0})}, tlsExtension{0x001b, nil},
+		tlsExtension{extensionSupportedGroups, vec(2, u16s(0x1d))}, tlsExtension{0x0015, nil}, tlsExtension{0x5a5a, nil},
+	)
+	tests := []struct {
+		name string
+		body []byte
+		want string
+	}{
+		{"browser", browser, "t13d1516h2_8daaf6152771_e5627efa2ab1"},
+		{
+			name: "TLS 1.2 without SNI",
+			body: helloBody(true, 0x0303, make([]byte, 32), []uint16{0xc02f, 0x002f},
+				tlsExtension{extensionSignatureAlgorithms, vec(2, u16s(0x0401, 0x0804))},
+				alpnExtension("http/1.1"), tlsExtension{extensionECPointFormats, vec(1, []byte{0})}),
+			want: "t12i0203h1_37f356531c84_943205e1906a",
+		},
+		{"no extensions", helloBody(true, 0x0303, make([]byte, 32), []uint16{0x002f}), "t12i010000_ba72b8082249_000000000000"},
+	}
+	for _, tt := range tests {
+		hello, err := parseClientHello(tt.body)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := hello.JA4(); got != tt.want {
+			t.Errorf("%s: JA4 = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestJA4ALPN(t *testing.T) {
+	tests := []struct {
+		alpn []string
+		want string
+	}{
+		{nil, "00"},
+		{[]string{""}, "00"},
+		{[]string{"h2", "http/1.1"}, "h2"},
+		{[]string{"http/1.1"}, "h1"},
+		{[]string{"h"}, "hh"},
+		// Not alphanumeric at either end, so the first and last hex digits
+		{[]string{"\xabh2"}, "a2"},
+	}
+	for _, tt := range tests {
+		if got := ja4ALPN(tt.alpn); got != tt.want {
+			t.Errorf("ja4ALPN(%q) = %s, want %s", tt.alpn, got, tt.want)
+		}
+	}
+}
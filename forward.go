@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// tlsHandshakeRecord is the first byte of a TLS ClientHello
+const tlsHandshakeRecord = 0x16
+
+// RunForwardProxy serves an explicit HTTP proxy on listen. Plain HTTP requests
+// are forwarded as they are; CONNECT tunnels are decrypted with certificates
+// from ca, so HTTPS exchanges are recorded too. Anyone who can reach the
+// proxy can make requests through it, so a listen address without a host
+// only listens on localhost.
+func RunForwardProxy(listen string, ca *CertAuthority) error {
+	if host, port, err := net.SplitHostPort(listen); err == nil && host == "" {
+		listen = net.JoinHostPort("127.0.0.1", port)
+	}
+
+	recorder := newRecordingProxy(func(r *http.Request) *url.URL {
+		return &url.URL{Scheme: r.URL.Scheme, Host: r.URL.Host}
+	}, false)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodConnect:
+			handleConnect(w, r, ca, recorder)
+		case r.URL.IsAbs():
+			recorder.ServeHTTP(w, r)
+		default:
+			http.Error(w, "this is a proxy; configure it with HTTP_PROXY / HTTPS_PROXY", http.StatusBadRequest)
+		}
+	})
+
+	fmt.Printf("Forward proxy listening on %s (CA certificate: %s)\n", listen, ca.CertPath())
+	return http.ListenAndServe(listen, handler)
+}
+
+// handleConnect takes over a CONNECT tunnel and serves the requests inside it
+// through the recorder, terminating TLS with a minted certificate
+func handleConnect(w http.ResponseWriter, r *http.Request, ca *CertAuthority, recorder http.Handler) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Error taking over CONNECT to %s: %v\n", r.Host, err)
+		return
+	}
+	if _, err := rw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n"); err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	connectHost := r.Host
+	hostname, port, err := net.SplitHostPort(connectHost)
+	if err != nil {
+		hostname = connectHost
+	}
+
+	// Tunnels don't have to carry TLS, so look before handshaking
+	tunnel := &bufferedConn{Conn: conn, r: rw.Reader}
+	scheme := "http"
+	var served net.Conn = tunnel
+	if first, err := tunnel.r.Peek(1); err == nil && first[0] == tlsHandshakeRecord {
+		scheme = "https"
+		served = tls.Server(tunnel, &tls.Config{
+			// Only offer HTTP/1.1 so every exchange goes through the recorder the same way
+			NextProtos: []string{"http/1.1"},
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				name := hello.ServerName
+				if name == "" {
+					name = hostname
+				}
+				return ca.leafFor(name)
+			},
+		})
+	}
+
+	// Leave default ports out of the recorded URLs
+	urlHost := connectHost
+	if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") {
+		urlHost = hostname
+	}
+	inner := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL.Scheme = scheme
+		req.URL.Host = urlHost
+		req.RemoteAddr = r.RemoteAddr
+		recorder.ServeHTTP(w, req)
+	})
+	// Handshake failures (usually a client that doesn't trust the CA) are logged by the server
+	server := &http.Server{Handler: inner}
+	server.Serve(newOneConnListener(served))
+}
+
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader that may
+// already hold data from the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// oneConnListener hands out a single connection, then blocks until it closes
+type oneConnListener struct {
+	conn      net.Conn
+	once      sync.Once
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newOneConnListener(conn net.Conn) *oneConnListener {
+	l := &oneConnListener{closed: make(chan struct{})}
+	l.conn = &notifyCloseConn{Conn: conn, onClose: func() { l.Close() }}
+	return l
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if conn := l.take(); conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *oneConnListener) take() net.Conn {
+	var conn net.Conn
+	l.once.Do(func() { conn = l.conn })
+	return conn
+}
+
+func (l *oneConnListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// notifyCloseConn calls onClose once the connection is closed
+type notifyCloseConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+}
+
+func (c *notifyCloseConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.onClose)
+	return err
+}
+
+// portOf returns the port of a listen address such as ":8081"
+func portOf(listen string) string {
+	if _, port, err := net.SplitHostPort(listen); err == nil {
+		return port
+	}
+	return listen
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/gopacket/tcpassembly"
+)
+
+const (
+	// gapTimeout is how long reassembly waits for a missing segment before
+	// giving up on it and carrying on after the gap
+	gapTimeout = 5 * time.Second
+	// maxLossEntries caps how many lossy streams the store keeps track of
+	maxLossEntries = 1000
+)
+
+// StreamLoss counts what reassembly couldn't deliver on one direction of a
+// connection
+type StreamLoss struct {
+	Connection      string    `json:"connection"`
+	PairKey         string    `json:"pairKey"`
+	Direction       string    `json:"direction"` // "request" or "response", the messages the stream carries
+	Gaps            int       `json:"gaps"`
+	MissingBytes    int64     `json:"missingBytes"`
+	Retransmissions int       `json:"retransmissions"` // segments whose data had already been delivered
+	MidStream       bool      `json:"midStream"`       // the capture joined after the stream started
+	ServicePort     int       `json:"servicePort"`
+	Service         string    `json:"service,omitempty"`
+	LastSeen        time.Time `json:"lastSeen"`
+}
+
+// LossStats totals the loss on every stream since the capture started
+type LossStats struct {
+	Streams         int   `json:"streams"` // streams that lost data
+	Gaps            int   `json:"gaps"`
+	MissingBytes    int64 `json:"missingBytes"`
+	Retransmissions int   `json:"retransmissions"`
+}
+
+// streamGap is a run of bytes the capture missed, at its stream offset
+type streamGap struct {
+	offset int64
+	size   int64
+}
+
+// trackLoss notes any gap or retransmission in a reassembled chunk before
+// it's handed to the reader
+func (h *httpStream) trackLoss(r tcpassembly.Reassembly) {
+	h.mu.Lock()
+	changed := true
+	switch {
+	case r.Skip > 0:
+		h.gaps = append(h.gaps, streamGap{offset: h.delivered, size: int64(r.Skip)})
+		h.loss.Gaps++
+		h.loss.MissingBytes += int64(r.Skip)
+	case r.Skip < 0:
+		h.loss.MidStream = true
+	case len(r.Bytes) == 0 && !r.Start && !r.End:
+		h.loss.Retransmissions++
+	default:
+		changed = false
+	}
+	h.delivered += int64(len(r.Bytes))
+	if !changed {
+		h.mu.Unlock()
+		return
+	}
+	h.loss.LastSeen = r.Seen
+	loss := h.loss
+	h.mu.Unlock()
+
+	Store.RecordLoss(loss)
+}
+
+// lostBetween returns how many bytes the capture missed inside the stream
+// range from-to, dropping gaps before from since messages are read in order
+func (h *httpStream) lostBetween(from, to int64) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var lost int64
+	kept := h.gaps[:0]
+	for _, gap := range h.gaps {
+		if gap.offset < from {
+			continue
+		}
+		kept = append(kept, gap)
+		if gap.offset > from && gap.offset < to {
+			lost += gap.size
+		}
+	}
+	h.gaps = kept
+	return lost
+}
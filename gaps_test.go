@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/tcpassembly"
+)
+
+func TestLostBetween(t *testing.T) {
+	// Each range is asked about in stream order, as messages are read
+	tests := []struct {
+		name     string
+		from, to int64
+		want     int64
+	}{
+		// Lost before the message's start line was found, so not from it
+		{"gap at the first byte", 0, 10, 0},
+		{"gap inside", 10, 30, 3},
+		{"gap at the end belongs to the next message", 30, 40, 0},
+		{"gap at the start of the next message", 40, 50, 0},
+		{"gaps before the last range are forgotten", 0, 100, 18},
+	}
+	h := testStream(t, false)
+	h.gaps = []streamGap{{offset: 0, size: 5}, {offset: 20, size: 3}, {offset: 40, size: 7}, {offset: 60, size: 11}}
+	for _, tt := range tests {
+		if got := h.lostBetween(tt.from, tt.to); got != tt.want {
+			t.Errorf("%s: lostBetween(%d, %d) = %d, want %d", tt.name, tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestTrackLossMarksIncompleteMessages(t *testing.T) {
+	h := testStream(t, false)
+	h.requests = newRequestQueue()
+
+	first := "POST /a HTTP/1.1\r\nContent-Length: 10\r\n\r\n01234"
+	second := "GET /b HTTP/1.1\r\n\r\n"
+	now := time.Now()
+	// Five bytes of the first body were lost, then a whole message the
+	// capture never saw before the second request
+	for _, r := range []tcpassembly.Reassembly{
+		{Bytes: []byte(first), Seen: now, Start: true},
+		{Bytes: []byte("56789"), Skip: 5, Seen: now},
+		{Bytes: []byte(second), Skip: 100, Seen: now},
+	} {
+		h.trackLoss(r)
+	}
+	if h.loss.Gaps != 2 || h.loss.MissingBytes != 105 {
+		t.Errorf("loss = %+v, want 2 gaps and 105 bytes", h.loss)
+	}
+
+	tr, buf := testReader([]byte(first+"56789"+second), now)
+	tr.lost = h.lostBetween
+	h.readHTTP(tr, buf)
+
+	missing := map[string]int64{}
+	for _, pair := range Store.GetPairs() {
+		if pair.Request != nil {
+			missing[pair.Request.URL] = pair.Request.Missing
+		}
+	}
+	if missing["/a"] != 5 || missing["/b"] != 0 {
+		t.Errorf("missing bytes by request = %v, want /a 5 and /b 0", missing)
+	}
+}
@@ -2,6 +2,15 @@ module github.com/magnushjensen/local-http-inspector
 
 go 1.25.4
 
-require github.com/google/gopacket v1.1.19
+require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/google/gopacket v1.1.19
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.44.0
+	golang.org/x/net v0.47.0
+)
 
-require golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
+require (
+	golang.org/x/sys v0.38.0 // indirect
+	golang.org/x/text v0.31.0 // indirect
+)
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// grpcStatusNames are the gRPC status codes
+var grpcStatusNames = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED",
+	"NOT_FOUND", "ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED",
+	"INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED",
+}
+
+// GRPCBody is a gRPC or gRPC-Web body split into its length-prefixed messages
+type GRPCBody struct {
+	Protocol      string        `json:"protocol"`              // grpc, grpc-web or grpc-web-text
+	Method        string        `json:"method,omitempty"`      // /package.Service/Method
+	MessageType   string        `json:"messageType,omitempty"` // set when -proto-descriptors knows the method
+	Messages      []GRPCMessage `json:"messages"`
+	Status        string        `json:"status,omitempty"` // the call's outcome, such as OK or NOT_FOUND
+	StatusCode    int           `json:"statusCode"`
+	StatusMessage string        `json:"statusMessage,omitempty"`
+	Error         string        `json:"error,omitempty"` // the body doesn't split into whole messages
+}
+
+// GRPCMessage is one message of a gRPC body. It's decoded by name when its
+// type is known, and otherwise as bare field numbers and wire types.
+type GRPCMessage struct {
+	Size       int            `json:"size"`
+	Compressed bool           `json:"compressed,omitempty"`
+	Decoded    map[string]any `json:"decoded,omitempty"`
+	Fields     []ProtoField   `json:"fields,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// grpcProtocol returns which gRPC protocol a content type belongs to, or ""
+func grpcProtocol(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	for _, protocol := range []string{"grpc-web-text", "grpc-web", "grpc"} {
+		if mediaType == "application/"+protocol || strings.HasPrefix(mediaType, "application/"+protocol+"+") {
+			return protocol
+		}
+	}
+	return ""
+}
+
+// setGRPC splits a gRPC body into messages. method is the call's path, which
+// a response only learns once it's paired with its request.
+func (p *CapturedPacket) setGRPC(method string) {
+	protocol := grpcProtocol(p.ContentType)
+	if protocol == "" {
+		return
+	}
+	g := &GRPCBody{Protocol: protocol, Method: method}
+	if ProtoTypes != nil && method != "" {
+		g.MessageType = ProtoTypes.MessageType(method, p.Type == PacketRequest)
+	}
+	// Messages sent with the JSON codec are left as they are
+	mediaType, _, _ := mime.ParseMediaType(p.ContentType)
+	jsonCodec := strings.HasSuffix(mediaType, "+json")
+
+	body := p.Body
+	if protocol == "grpc-web-text" {
+		var err error
+		if body, err = decodeGRPCWebText(body); err != nil {
+			g.Error = "decoding base64: " + err.Error()
+		}
+	}
+	trailer := g.split(body, p.Headers["Grpc-Encoding"], jsonCodec)
+
+	// The status comes in HTTP/2 trailers, in the headers of a response
+	// without messages, or for gRPC-Web in a trailer frame in the body
+	if p.Type == PacketResponse {
+		for _, fields := range []map[string]string{trailer, p.Trailers, p.Headers} {
+			if status, ok := fields["Grpc-Status"]; ok {
+				g.setStatus(status, fields["Grpc-Message"])
+				break
+			}
+		}
+	}
+	p.GRPC = g
+}
+
+// split reads the messages in body, returning the fields of a gRPC-Web trailer frame
+func (g *GRPCBody) split(body []byte, encoding string, jsonCodec bool) map[string]string {
+	var trailer map[string]string
+	for len(body) > 0 {
+		if len(body) < 5 {
+			g.Error = fmt.Sprintf("%d trailing bytes", len(body))
+			break
+		}
+		flags, length := body[0], binary.BigEndian.Uint32(body[1:5])
+		if uint64(length) > uint64(len(body)-5) {
+			g.Error = fmt.Sprintf("message of %d bytes cut off after %d", length, len(body)-5)
+			break
+		}
+		data := body[5 : 5+length]
+		body = body[5+length:]
+
+		if flags&0x80 != 0 {
+			trailer = parseGRPCWebTrailer(data)
+			continue
+		}
+		msg := GRPCMessage{Size: int(length), Compressed: flags&0x01 != 0}
+		if msg.Compressed {
+			var err error
+			if encoding == "" {
+				msg.Error = "compressed without a grpc-encoding"
+			} else if data, _, err = decodeBody(encoding, data); err != nil {
+				msg.Error = "decompressing: " + err.Error()
+			}
+		}
+		if msg.Error == "" && !jsonCodec {
+			g.decode(&msg, data)
+		}
+		g.Messages = append(g.Messages, msg)
+	}
+	return trailer
+}
+
+// decode decodes a message by its type if it's known, and without a schema otherwise
+func (g *GRPCBody) decode(msg *GRPCMessage, data []byte) {
+	if g.MessageType != "" {
+		decoded, err := ProtoTypes.Decode(g.MessageType, data)
+		if err == nil {
+			msg.Decoded = decoded
+			return
+		}
+		msg.Error = fmt.Sprintf("decoding as %s: %s", g.MessageType, err)
+	}
+	fields, err := decodeProtoFields(data, 0)
+	msg.Fields = fields
+	if err != nil && msg.Error == "" {
+		msg.Error = err.Error()
+	}
+}
+
+// setStatus records the grpc-status and grpc-message of a finished call
+func (g *GRPCBody) setStatus(status, message string) {
+	g.StatusCode, _ = strconv.Atoi(strings.TrimSpace(status))
+	g.Status = strconv.Itoa(g.StatusCode)
+	if g.StatusCode >= 0 && g.StatusCode < len(grpcStatusNames) {
+		g.Status = grpcStatusNames[g.StatusCode]
+	}
+	// grpc-message is percent-encoded
+	if unescaped, err := url.PathUnescape(message); err == nil {
+		message = unescaped
+	}
+	g.StatusMessage = message
+}
+
+// decodeGRPCWebText decodes a grpc-web-text body, which is base64 sent in
+// chunks that may each carry their own padding
+func decodeGRPCWebText(body []byte) ([]byte, error) {
+	text := strings.Join(strings.Fields(string(body)), "")
+	var out []byte
+	for text != "" {
+		end := len(text)
+		if i := strings.IndexByte(text, '='); i >= 0 {
+			for end = i; end < len(text) && text[end] == '='; end++ {
+			}
+		}
+		chunk, err := base64.StdEncoding.DecodeString(text[:end])
+		if err != nil {
+			return out, err
+		}
+		out = append(out, chunk...)
+		text = text[end:]
+	}
+	return out, nil
+}
+
+// parseGRPCWebTrailer parses the header lines of a gRPC-Web trailer frame
+func parseGRPCWebTrailer(data []byte) map[string]string {
+	trailer := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if ok {
+			trailer[http.CanonicalHeaderKey(strings.TrimSpace(name))] = strings.TrimSpace(value)
+		}
+	}
+	return trailer
+}
+
+// grpcMethod returns the gRPC method a request calls
+func grpcMethod(requestURL string) string {
+	u, err := url.Parse(requestURL)
+	if err != nil {
+		return requestURL
+	}
+	return u.Path
+}
+
+// linkGRPC gives a paired gRPC response the method of its request, so its
+// messages can be decoded with the method's response type
+func linkGRPC(pair *PacketPair) {
+	if pair.Request == nil || pair.Response == nil || pair.Request.GRPC == nil ||
+		pair.Response.GRPC == nil || pair.Response.GRPC.Method != "" {
+		return
+	}
+	response := *pair.Response
+	response.setGRPC(pair.Request.GRPC.Method)
+	pair.Response = &response
+}
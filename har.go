@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// HAR 1.2 types, see http://www.softwareishard.com/blog/har-12-spec/
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Connection      string      `json:"connection,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	HTTPOnly bool       `json:"httpOnly,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+}
+
+type harPostData struct {
+	MimeType  string `json:"mimeType"`
+	Text      string `json:"text"`
+	Encoding  string `json:"_encoding,omitempty"`  // not in the spec; set for binary bodies
+	Truncated bool   `json:"_truncated,omitempty"` // not in the spec; the text is only the start of the body
+}
+
+type harContent struct {
+	Size        int    `json:"size"`
+	Compression int    `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Truncated   bool   `json:"_truncated,omitempty"` // not in the spec; the text is only the start of the body
+}
+
+// harTimings uses -1 for phases a packet capture can't see
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// WriteHAR writes pairs as a HAR 1.2 log, oldest first. Pairs that never saw
+// a request are left out, since every HAR entry needs one.
+func WriteHAR(w io.Writer, pairs []PacketPair) error {
+	sorted := make([]PacketPair, 0, len(pairs))
+	for _, pair := range pairs {
+		if pair.Request != nil {
+			sorted = append(sorted, pair)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Timestamp.Before(sorted[j].Timestamp) })
+
+	har := harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "local-http-inspector", Version: version},
+		Entries: make([]harEntry, len(sorted)),
+	}}
+	for i, pair := range sorted {
+		har.Log.Entries[i] = harEntryFromPair(pair)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(har)
+}
+
+func harEntryFromPair(pair PacketPair) harEntry {
+	req := pair.Request
+	entry := harEntry{
+		StartedDateTime: req.StartTime,
+		Time:            pair.Timing.UploadMs,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         absoluteURL(req),
+			HTTPVersion: req.Protocol,
+			Cookies:     requestCookies(req.Headers["Cookie"]),
+			Headers:     harHeaders(req.Headers),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    req.WireSize,
+		},
+		Response: harResponse{
+			Cookies:     []harCookie{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings: harTimings{
+			Blocked: -1,
+			DNS:     -1,
+			Connect: -1,
+			SSL:     -1,
+			Send:    pair.Timing.UploadMs,
+		},
+		Connection: req.Connection,
+	}
+	if entry.StartedDateTime.IsZero() {
+		entry.StartedDateTime = req.Timestamp
+	}
+
+	if u, err := url.Parse(entry.Request.URL); err == nil {
+		for name, values := range u.Query() {
+			for _, value := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: name, Value: value})
+			}
+		}
+		sort.Slice(entry.Request.QueryString, func(i, j int) bool {
+			return entry.Request.QueryString[i].Name < entry.Request.QueryString[j].Name
+		})
+	}
+
+	if len(req.Body) > 0 {
+		text, encoding := encodeBody(req.Body)
+		entry.Request.PostData = &harPostData{MimeType: req.ContentType, Text: text, Truncated: req.Truncated}
+		if encoding == "base64" {
+			entry.Request.PostData.Encoding = encoding
+		}
+	}
+
+	if res := pair.Response; res != nil {
+		entry.Time = pair.Timing.TotalMs
+		entry.Timings.Wait = pair.Timing.TTFBMs
+		entry.Timings.Receive = pair.Timing.DownloadMs
+		entry.Response = harResponse{
+			Status:      res.StatusCode,
+			StatusText:  strings.TrimSpace(strings.TrimPrefix(res.Status, fmt.Sprint(res.StatusCode))),
+			HTTPVersion: res.Protocol,
+			Cookies:     responseCookies(res.Headers["Set-Cookie"]),
+			Headers:     harHeaders(res.Headers),
+			Content: harContent{
+				Size:      res.BodySize,
+				MimeType:  res.ContentType,
+				Truncated: res.Truncated,
+			},
+			RedirectURL: res.Headers["Location"],
+			HeadersSize: -1,
+			BodySize:    res.WireSize,
+		}
+		if res.RawBody != nil {
+			entry.Response.Content.Compression = res.BodySize - res.WireSize
+		}
+		if len(res.Body) > 0 {
+			text, encoding := encodeBody(res.Body)
+			entry.Response.Content.Text = text
+			if encoding == "base64" {
+				entry.Response.Content.Encoding = encoding
+			}
+		}
+	}
+	return entry
+}
+
+// absoluteURL rebuilds the full URL HAR expects from the request target and Host
+func absoluteURL(p *CapturedPacket) string {
+	if u, err := url.Parse(p.URL); err == nil && u.IsAbs() {
+		return p.URL
+	}
+	return "http://" + p.Host + p.URL
+}
+
+func harHeaders(headers map[string]string) []harNameValue {
+	out := make([]harNameValue, 0, len(headers))
+	for name, value := range headers {
+		out = append(out, harNameValue{Name: name, Value: value})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func requestCookies(header string) []harCookie {
+	out := []harCookie{}
+	if header == "" {
+		return out
+	}
+	cookies, err := http.ParseCookie(header)
+	if err != nil {
+		return out
+	}
+	for _, c := range cookies {
+		out = append(out, harCookie{Name: c.Name, Value: c.Value})
+	}
+	return out
+}
+
+// responseCookies parses Set-Cookie, which we store joined with ", ". Expires
+// dates ("Wed, 21 Oct 2015 ...") contain ", " too, so those are glued back.
+func responseCookies(header string) []harCookie {
+	out := []harCookie{}
+	if header == "" {
+		return out
+	}
+	var values []string
+	for _, piece := range strings.Split(header, ", ") {
+		if n := len(values); n > 0 && expiresDay.MatchString(values[n-1]) {
+			values[n-1] += ", " + piece
+			continue
+		}
+		values = append(values, piece)
+	}
+	for _, value := range values {
+		c, err := http.ParseSetCookie(value)
+		if err != nil {
+			continue
+		}
+		cookie := harCookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain, HTTPOnly: c.HttpOnly, Secure: c.Secure}
+		if !c.Expires.IsZero() {
+			cookie.Expires = &c.Expires
+		}
+		out = append(out, cookie)
+	}
+	return out
+}
+
+var expiresDay = regexp.MustCompile(`(?i)expires=[a-z]{3}$`)
+
+// harVersion matches the httpVersion values an entry may carry. Entries
+// without a response leave it empty.
+var harVersion = regexp.MustCompile(`^(?i:HTTP/\d\.\d|h2|h3)?$`)
+
+// harImports numbers imported entries so each gets its own pair key
+var harImports atomic.Int64
+
+// ImportHAR loads the entries of a HAR file into the store and returns how
+// many were added. Every entry is checked first, so a bad one adds nothing.
+func ImportHAR(store *PacketStore, r io.Reader) (int, error) {
+	var har harFile
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return 0, fmt.Errorf("invalid HAR: %w", err)
+	}
+
+	type harPackets struct{ req, res CapturedPacket }
+	packets := make([]harPackets, len(har.Log.Entries))
+	for i, entry := range har.Log.Entries {
+		req, res, err := packetsFromHAREntry(entry)
+		if err != nil {
+			return 0, fmt.Errorf("entry %d: %w", i, err)
+		}
+		packets[i] = harPackets{req, res}
+	}
+
+	for _, p := range packets {
+		store.Add(p.req)
+		if p.res.StatusCode != 0 {
+			store.Add(p.res)
+		}
+	}
+	return len(packets), nil
+}
+
+// ImportHARFile loads a HAR file from disk into the store
+func ImportHARFile(store *PacketStore, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return ImportHAR(store, f)
+}
+
+func packetsFromHAREntry(entry harEntry) (CapturedPacket, CapturedPacket, error) {
+	// These end up in the dashboard as they are, so hold them to what the
+	// wire allows. A method is a token, the same grammar as a header name.
+	if !httpguts.ValidHeaderFieldName(entry.Request.Method) {
+		return CapturedPacket{}, CapturedPacket{}, fmt.Errorf("invalid method %q", entry.Request.Method)
+	}
+	for _, version := range []string{entry.Request.HTTPVersion, entry.Response.HTTPVersion} {
+		if !harVersion.MatchString(version) {
+			return CapturedPacket{}, CapturedPacket{}, fmt.Errorf("invalid httpVersion %q", version)
+		}
+	}
+
+	u, err := url.Parse(entry.Request.URL)
+	if err != nil {
+		return CapturedPacket{}, CapturedPacket{}, err
+	}
+
+	// HAR timings are relative, so rebuild the capture timestamps from them
+	phase := func(ms float64) time.Duration {
+		if ms < 0 {
+			return 0
+		}
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+	requestStart := entry.StartedDateTime
+	requestEnd := requestStart.Add(phase(entry.Timings.Blocked) + phase(entry.Timings.DNS) + phase(entry.Timings.Connect) + phase(entry.Timings.Send))
+	responseStart := requestEnd.Add(phase(entry.Timings.Wait))
+	responseEnd := responseStart.Add(phase(entry.Timings.Receive))
+
+	connection := entry.Connection
+	if connection == "" {
+		connection = "HAR import"
+	}
+	pairKey := fmt.Sprintf("har-%d", harImports.Add(1))
+
+	req := CapturedPacket{
+		Type:        PacketRequest,
+		Timestamp:   requestStart,
+		StartTime:   requestStart,
+		EndTime:     requestEnd,
+		Method:      entry.Request.Method,
+		URL:         u.RequestURI(),
+		Host:        u.Host,
+		Headers:     harHeaderMap(entry.Request.Headers),
+		Protocol:    entry.Request.HTTPVersion,
+		Connection:  connection,
+		PairKey:     pairKey,
+		ServicePort: harPort(u),
+	}
+	req.ContentType = req.Headers["Content-Type"]
+	var body []byte
+	if entry.Request.PostData != nil {
+		if req.ContentType == "" {
+			req.ContentType = entry.Request.PostData.MimeType
+		}
+		body, err = harBody(entry.Request.PostData.Text, entry.Request.PostData.Encoding)
+		if err != nil {
+			return req, CapturedPacket{}, fmt.Errorf("request body: %w", err)
+		}
+	}
+	req.setBody("", body)
+	req.Truncated = entry.Request.PostData != nil && entry.Request.PostData.Truncated
+	req.setGRPC(grpcMethod(req.URL))
+
+	res := CapturedPacket{
+		Type:        PacketResponse,
+		Timestamp:   responseStart,
+		StartTime:   responseStart,
+		EndTime:     responseEnd,
+		Status:      strings.TrimSpace(fmt.Sprintf("%d %s", entry.Response.Status, entry.Response.StatusText)),
+		StatusCode:  entry.Response.Status,
+		ContentType: entry.Response.Content.MimeType,
+		Headers:     harHeaderMap(entry.Response.Headers),
+		Protocol:    entry.Response.HTTPVersion,
+		Connection:  connection,
+		PairKey:     pairKey,
+		ServicePort: req.ServicePort,
+	}
+	// HAR content is already decoded, so don't try to undo Content-Encoding again
+	body, err = harBody(entry.Response.Content.Text, entry.Response.Content.Encoding)
+	if err != nil {
+		return req, res, fmt.Errorf("response body: %w", err)
+	}
+	res.setBody("", body)
+	res.Truncated = entry.Response.Content.Truncated
+	res.setGRPC("")
+	return req, res, nil
+}
+
+func harHeaderMap(headers []harNameValue) map[string]string {
+	out := make(map[string]string)
+	for _, h := range headers {
+		name := http.CanonicalHeaderKey(h.Name)
+		if existing, ok := out[name]; ok {
+			out[name] = existing + ", " + h.Value
+		} else {
+			out[name] = h.Value
+		}
+	}
+	return out
+}
+
+func harBody(text, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return []byte(text), nil
+}
+
+func harPort(u *url.URL) int {
+	if port, err := strconv.Atoi(u.Port()); err == nil {
+		return port
+	}
+	if u.Scheme == "https" {
+		return 443
+	}
+	return 80
+}
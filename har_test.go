@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHARRoundTrip(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	src := NewPacketStore(10, 0)
+	req := CapturedPacket{
+		Type:       PacketRequest,
+		Timestamp:  start,
+		StartTime:  start,
+		EndTime:    start.Add(10 * time.Millisecond),
+		Method:     "POST",
+		URL:        "/api/items?b=2&a=1",
+		Host:       "example.com:8080",
+		Headers:    map[string]string{"Content-Type": "application/json", "Host": "example.com:8080"},
+		Protocol:   "HTTP/1.1",
+		Connection: "127.0.0.1:50000 → 127.0.0.1:8080",
+		PairKey:    "conn-1",
+	}
+	req.ContentType = "application/json"
+	req.setBody("", []byte(`{"name":"widget"}`))
+	res := CapturedPacket{
+		Type:       PacketResponse,
+		Timestamp:  start.Add(30 * time.Millisecond),
+		StartTime:  start.Add(30 * time.Millisecond),
+		EndTime:    start.Add(45 * time.Millisecond),
+		Status:     "201 Created",
+		StatusCode: 201,
+		Headers:    map[string]string{"Content-Type": "application/octet-stream"},
+		Protocol:   "HTTP/1.1",
+		Connection: req.Connection,
+		PairKey:    "conn-1",
+	}
+	res.ContentType = "application/octet-stream"
+	res.setBody("", []byte{0x00, 0xff, 0x10, 0x80})
+	res.Truncated = true
+	src.Add(req)
+	src.Add(res)
+
+	var har bytes.Buffer
+	if err := WriteHAR(&har, src.GetPairs()); err != nil {
+		t.Fatalf("WriteHAR: %v", err)
+	}
+
+	dst := NewPacketStore(10, 0)
+	n, err := ImportHAR(dst, &har)
+	if err != nil {
+		t.Fatalf("ImportHAR: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("imported %d entries, want 1", n)
+	}
+
+	pairs := dst.GetPairs()
+	if len(pairs) != 1 || pairs[0].Request == nil || pairs[0].Response == nil {
+		t.Fatalf("got %+v, want one complete pair", pairs)
+	}
+	gotReq, gotRes := pairs[0].Request, pairs[0].Response
+
+	if gotReq.Method != "POST" || gotReq.URL != req.URL || gotReq.Host != req.Host || gotReq.Protocol != "HTTP/1.1" {
+		t.Errorf("request line = %s %s %s (host %s)", gotReq.Method, gotReq.URL, gotReq.Protocol, gotReq.Host)
+	}
+	if string(gotReq.Body) != `{"name":"widget"}` {
+		t.Errorf("request body = %q", gotReq.Body)
+	}
+	if gotReq.Headers["Content-Type"] != "application/json" {
+		t.Errorf("request headers = %v", gotReq.Headers)
+	}
+	if gotRes.StatusCode != 201 || gotRes.Status != "201 Created" {
+		t.Errorf("response status = %d %q", gotRes.StatusCode, gotRes.Status)
+	}
+	if !bytes.Equal(gotRes.Body, res.Body) {
+		t.Errorf("response body = %x, want %x", gotRes.Body, res.Body)
+	}
+	if gotReq.Truncated || !gotRes.Truncated {
+		t.Errorf("truncated = %v, %v; want only the response", gotReq.Truncated, gotRes.Truncated)
+	}
+	if !gotReq.StartTime.Equal(req.StartTime) || !gotRes.StartTime.Equal(res.StartTime) || !gotRes.EndTime.Equal(res.EndTime) {
+		t.Errorf("timestamps = %v %v %v", gotReq.StartTime, gotRes.StartTime, gotRes.EndTime)
+	}
+}
+
+func TestImportHARRejectsInvalidEntries(t *testing.T) {
+	entry := func(method, version string) string {
+		return `{"startedDateTime":"2024-05-01T12:00:00Z","request":{"method":"` + method +
+			`","url":"http://example.com/","httpVersion":"` + version +
+			`","headers":[]},"response":{"status":200,"statusText":"OK","httpVersion":"HTTP/1.1","headers":[],"content":{"size":0,"mimeType":""}},"timings":{"send":0,"wait":0,"receive":0}}`
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		version string
+		ok      bool
+	}{
+		{"valid", "GET", "HTTP/1.1", true},
+		{"h2", "PROPFIND", "h2", true},
+		{"lowercase version", "GET", "http/2.0", true},
+		{"html method", "<img src=x onerror=alert(1)>", "HTTP/1.1", false},
+		{"quote in method", `GET\" onmouseover=\"x`, "HTTP/1.1", false},
+		{"empty method", "", "HTTP/1.1", false},
+		{"html version", "GET", "<script>", false},
+		{"unknown version", "GET", "SPDY/3", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The bad entry comes second, so nothing may be added at all
+			har := `{"log":{"version":"1.2","entries":[` + entry("GET", "HTTP/1.1") + `,` + entry(tt.method, tt.version) + `]}}`
+			store := NewPacketStore(10, 0)
+			n, err := ImportHAR(store, strings.NewReader(har))
+			if tt.ok {
+				if err != nil || n != 2 {
+					t.Fatalf("ImportHAR = %d, %v; want 2 entries", n, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("ImportHAR accepted method %q version %q", tt.method, tt.version)
+			}
+			if n != 0 || store.Count() != 0 {
+				t.Errorf("partial import: n=%d, store holds %d", n, store.Count())
+			}
+		})
+	}
+}
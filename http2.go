@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// http2TableSize is the HPACK dynamic table size we decode with. Peers may
+// agree on more than the default 4096 bytes, and a larger table is harmless
+// since an encoder never refers to entries it has evicted.
+const http2TableSize = 1 << 16
+
+// looksLikeHTTP2Settings reports whether the stream starts with the SETTINGS
+// frame a server opens an HTTP/2 connection with
+func looksLikeHTTP2Settings(buf *bufio.Reader) bool {
+	header, err := buf.Peek(9)
+	if err != nil {
+		return false
+	}
+	length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+	return header[3] == byte(http2.FrameSettings) && header[4] == 0 &&
+		binary.BigEndian.Uint32(header[5:])&0x7fffffff == 0 && length%6 == 0
+}
+
+// isHTTP2Preface reports whether the stream continues with the client preface
+func isHTTP2Preface(buf *bufio.Reader) bool {
+	data, err := buf.Peek(len(http2.ClientPreface))
+	return err == nil && string(data) == http2.ClientPreface
+}
+
+// http2Message is a request or response being read from one HTTP/2 stream
+type http2Message struct {
+	fields    []hpack.HeaderField
+	trailer   []hpack.HeaderField
+	body      []byte
+	truncated bool // more than maxDecodedBodySize arrived
+	start     time.Time
+	last      time.Time // capture time of the latest frame
+
+	streaming *streamingResponse // a response whose body is published as it arrives
+	pairID    int                // a message stored before its body arrived
+}
+
+// http2Reader reads one direction of an HTTP/2 connection, logging each
+// stream's request or response as it ends
+type http2Reader struct {
+	h        *httpStream
+	tr       *timedReader
+	buf      *bufio.Reader
+	framer   *http2.Framer
+	decoder  *hpack.Decoder
+	upgraded bool // stream 1 answers the HTTP/1.1 request that asked for h2c
+
+	streams map[uint32]*http2Message
+
+	// The header block being read, which CONTINUATION frames add to
+	fields      []hpack.HeaderField
+	blockStream uint32
+	blockEnds   bool // the block's HEADERS frame also ended the stream
+	blockPush   bool // the block is a PUSH_PROMISE
+	blockStart  time.Time
+	blockOffset int64  // of the frame that opened the block
+	blockRaw    []byte // the encoded block, up to maxSnippet bytes of it
+	blockSize   int64  // frame bytes the block took up
+}
+
+// readHTTP2 reads HTTP/2 frames until the stream ends
+func (h *httpStream) readHTTP2(tr *timedReader, buf *bufio.Reader, upgraded bool) {
+	if isHTTP2Preface(buf) {
+		buf.Discard(len(http2.ClientPreface))
+	}
+
+	r := &http2Reader{
+		h:        h,
+		tr:       tr,
+		buf:      buf,
+		framer:   http2.NewFramer(io.Discard, buf),
+		upgraded: upgraded,
+		streams:  make(map[uint32]*http2Message),
+	}
+	r.decoder = hpack.NewDecoder(http2TableSize, func(f hpack.HeaderField) {
+		r.fields = append(r.fields, f)
+	})
+	// We only watch, so take frames as the peers agreed on them and check
+	// the ordering of header blocks ourselves
+	r.framer.SetMaxReadFrameSize(1<<24 - 1)
+	r.framer.AllowIllegalReads = true
+
+	if err := r.run(); err != nil {
+		log.Println("Error reading HTTP/2", h.net, h.transport, ":", err)
+		io.Copy(io.Discard, buf)
+	}
+
+	// Log whatever was cut off, so requests without an answer still show up
+	for id, msg := range r.streams {
+		r.finish(id, msg, msg.last)
+	}
+}
+
+// run reads frames until the stream ends, or until an error that leaves the
+// rest of it unreadable
+func (r *http2Reader) run() error {
+	for {
+		start := r.tr.consumed(r.buf)
+		r.tr.forget(start)
+		frame, err := r.framer.ReadFrame()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			if _, ok := err.(http2.StreamError); ok {
+				continue
+			}
+			return err
+		}
+		seen := r.tr.timeAt(start)
+		end := r.tr.timeAt(r.tr.consumed(r.buf) - 1)
+		size := r.tr.consumed(r.buf) - start
+
+		if r.blockStream != 0 {
+			f, ok := frame.(*http2.ContinuationFrame)
+			if !ok || f.StreamID != r.blockStream {
+				return fmt.Errorf("expected CONTINUATION for stream %d, got %v", r.blockStream, frame.Header())
+			}
+			r.blockSize += size
+			if err := r.headerFragment(f.HeaderBlockFragment(), f.HeadersEnded(), end); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch f := frame.(type) {
+		case *http2.HeadersFrame:
+			r.fields, r.blockRaw = nil, nil
+			r.blockStream, r.blockEnds, r.blockPush, r.blockStart = f.StreamID, f.StreamEnded(), false, seen
+			r.blockOffset, r.blockSize = start, size
+			if err := r.headerFragment(f.HeaderBlockFragment(), f.HeadersEnded(), end); err != nil {
+				return err
+			}
+		case *http2.PushPromiseFrame:
+			// Promised requests aren't logged, but their headers still go
+			// through the decoder to keep its table in step with the sender's
+			r.fields, r.blockRaw = nil, nil
+			r.blockStream, r.blockEnds, r.blockPush, r.blockStart = f.StreamID, false, true, seen
+			r.blockOffset, r.blockSize = start, size
+			if err := r.headerFragment(f.HeaderBlockFragment(), f.HeadersEnded(), end); err != nil {
+				return err
+			}
+		case *http2.DataFrame:
+			if msg, ok := r.streams[f.StreamID]; ok {
+				// A response still open after a while is shown before it ends
+				if msg.streaming == nil && end.Sub(msg.start) > streamingAfter && pseudoHeader(msg.fields, ":status") != "" {
+					msg.streaming = r.h.startStreamingResponse(r.response(msg), msg.body, msg.truncated, msg.start, msg.last, r.pairStream(f.StreamID), msg.pairID)
+				}
+				if msg.streaming != nil {
+					msg.streaming.add(f.Data(), end)
+				} else {
+					data := f.Data()
+					room := maxDecodedBodySize - len(msg.body)
+					msg.body = append(msg.body, data[:min(len(data), max(room, 0))]...)
+					msg.truncated = msg.truncated || len(data) > room
+				}
+				msg.last = end
+				if f.StreamEnded() {
+					r.finish(f.StreamID, msg, end)
+				}
+			}
+		case *http2.RSTStreamFrame:
+			if msg, ok := r.streams[f.StreamID]; ok {
+				r.finish(f.StreamID, msg, end)
+			}
+		}
+	}
+}
+
+// headerFragment adds part of a header block, handling the block once it's complete
+func (r *http2Reader) headerFragment(fragment []byte, ended bool, end time.Time) error {
+	if room := maxSnippet - len(r.blockRaw); room > 0 {
+		r.blockRaw = append(r.blockRaw, fragment[:min(len(fragment), room)]...)
+	}
+	if _, err := r.decoder.Write(fragment); err != nil {
+		return fmt.Errorf("decoding headers: %w", err)
+	}
+	if !ended {
+		return nil
+	}
+	if err := r.decoder.Close(); err != nil {
+		return fmt.Errorf("decoding headers: %w", err)
+	}
+
+	id := r.blockStream
+	r.blockStream = 0
+	if r.blockPush {
+		return nil
+	}
+
+	msg, ok := r.streams[id]
+	if !ok {
+		if status := pseudoHeader(r.fields, ":status"); len(status) == 3 && status[0] == '1' {
+			// Interim response, the final one follows
+			r.h.logInterim(r.response(&http2Message{fields: r.fields}), r.blockStart, r.pairStream(id))
+			return nil
+		}
+		if pseudoHeader(r.fields, ":method") != "" {
+			// A stream with a bad request is dropped, so its DATA frames
+			// are skipped along with it
+			if err := checkRequestFields(r.fields); err != nil {
+				resync := streamResync{h: r.h}
+				resync.fail(r.blockOffset, r.blockStart, fmt.Errorf("stream %d: %w", id, err), r.blockRaw)
+				resync.skip(int(r.blockSize))
+				resync.done()
+				return nil
+			}
+		}
+		msg = &http2Message{fields: r.fields, start: r.blockStart, last: end}
+		r.streams[id] = msg
+		if !r.blockEnds {
+			if pseudoHeader(msg.fields, ":method") != "" {
+				msg.pairID = r.h.startRequest(r.request(msg), msg.start, end, r.pairStream(id))
+			} else if resp := r.response(msg); isStreamingResponse(resp) {
+				msg.streaming = r.h.startStreamingResponse(resp, nil, false, msg.start, end, r.pairStream(id), 0)
+			} else {
+				msg.pairID = r.h.startResponse(resp, msg.start, end, r.pairStream(id))
+			}
+		}
+	} else {
+		msg.trailer, msg.last = r.fields, end
+	}
+	if r.blockEnds {
+		r.finish(id, msg, end)
+	}
+	return nil
+}
+
+// finish logs a stream's request or response
+func (r *http2Reader) finish(id uint32, msg *http2Message, end time.Time) {
+	delete(r.streams, id)
+	stream := r.pairStream(id)
+	trailer := fieldsHeader(msg.trailer)
+	if msg.streaming != nil {
+		msg.streaming.finish(end, trailer)
+		return
+	}
+
+	if pseudoHeader(msg.fields, ":method") != "" {
+		req := r.request(msg)
+		req.Trailer = trailer
+		if msg.pairID != 0 {
+			r.h.finishRequest(msg.pairID, req, msg.body, msg.truncated, msg.start, end, stream, 0)
+		} else {
+			r.h.logRequest(req, msg.body, msg.truncated, msg.start, end, stream, 0)
+		}
+		return
+	}
+
+	resp := r.response(msg)
+	resp.Trailer = trailer
+	if msg.pairID != 0 {
+		r.h.finishResponse(msg.pairID, resp, msg.body, msg.truncated, msg.start, end, stream, 0)
+	} else {
+		r.h.logResponse(resp, msg.body, msg.truncated, msg.start, end, stream, 0)
+	}
+}
+
+// pairStream returns the stream number a stream's exchange is paired by
+func (r *http2Reader) pairStream(id uint32) uint32 {
+	if r.upgraded && id == 1 {
+		return 0 // pairs with the request sent over HTTP/1.1
+	}
+	return id
+}
+
+// request builds a request from a stream's headers
+func (r *http2Reader) request(msg *http2Message) *http.Request {
+	path := pseudoHeader(msg.fields, ":path")
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		u = &url.URL{Path: path}
+	}
+	header := fieldsHeader(msg.fields)
+	host := pseudoHeader(msg.fields, ":authority")
+	if host == "" {
+		host = header.Get("Host")
+	}
+	return &http.Request{
+		Method:     pseudoHeader(msg.fields, ":method"),
+		URL:        u,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     header,
+		Host:       host,
+	}
+}
+
+// checkRequestFields makes sure a request's pseudo-headers hold what HTTP
+// allows before they're shown anywhere, as http.ReadRequest does for HTTP/1.x
+func checkRequestFields(fields []hpack.HeaderField) error {
+	method := pseudoHeader(fields, ":method")
+	if !httpguts.ValidHeaderFieldName(method) {
+		return fmt.Errorf("invalid :method %q", method)
+	}
+	if authority := pseudoHeader(fields, ":authority"); !httpguts.ValidHostHeader(authority) {
+		return fmt.Errorf("invalid :authority %q", authority)
+	}
+	path := pseudoHeader(fields, ":path")
+	if path == "" && method == http.MethodConnect {
+		return nil
+	}
+	if !strings.HasPrefix(path, "/") && path != "*" {
+		return fmt.Errorf("invalid :path %q", path)
+	}
+	for i := 0; i < len(path); i++ {
+		if path[i] <= ' ' || path[i] >= 0x7f {
+			return fmt.Errorf("invalid :path %q", path)
+		}
+	}
+	return nil
+}
+
+// response builds a response from a stream's headers
+func (r *http2Reader) response(msg *http2Message) *http.Response {
+	code, _ := strconv.Atoi(pseudoHeader(msg.fields, ":status"))
+	header := fieldsHeader(msg.fields)
+	length := int64(-1)
+	if n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		length = n
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        header,
+		ContentLength: length,
+	}
+}
+
+// fieldsHeader collects the regular fields of a header block
+func fieldsHeader(fields []hpack.HeaderField) http.Header {
+	header := http.Header{}
+	for _, f := range fields {
+		if !strings.HasPrefix(f.Name, ":") {
+			header.Add(f.Name, f.Value)
+		}
+	}
+	return header
+}
+
+// pseudoHeader returns the value of a pseudo-header field such as :method
+func pseudoHeader(fields []hpack.HeaderField, name string) string {
+	for _, f := range fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// encodeFields HPACK-encodes header fields with enc
+func encodeFields(enc *hpack.Encoder, buf *bytes.Buffer, fields ...string) []byte {
+	buf.Reset()
+	for i := 0; i < len(fields); i += 2 {
+		enc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return bytes.Clone(buf.Bytes())
+}
+
+func TestHTTP2Continuation(t *testing.T) {
+	h := testStream(t, false)
+
+	var frames, block bytes.Buffer
+	framer := http2.NewFramer(&frames, nil)
+	enc := hpack.NewEncoder(&block)
+	frames.WriteString(http2.ClientPreface)
+
+	// A header block split over HEADERS and two CONTINUATION frames
+	first := encodeFields(enc, &block,
+		":method", "POST", ":scheme", "http", ":authority", "example.com", ":path", "/upload",
+		"content-type", "text/plain", "x-long", strings.Repeat("a", 300))
+	framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: first[:10]})
+	framer.WriteContinuation(1, false, first[10:20])
+	framer.WriteContinuation(1, true, first[20:])
+	framer.WriteData(1, true, []byte("hello"))
+
+	// The second request refers back to the dynamic table the first filled
+	second := encodeFields(enc, &block,
+		":method", "GET", ":scheme", "http", ":authority", "example.com", ":path", "/next",
+		"x-long", strings.Repeat("a", 300))
+	framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, BlockFragment: second, EndHeaders: true, EndStream: true})
+
+	tr, buf := testReader(frames.Bytes(), time.Now())
+	h.readHTTP2(tr, buf, false)
+
+	pairs := Store.GetPairs()
+	if len(pairs) != 2 {
+		t.Fatalf("got %d pairs, want 2", len(pairs))
+	}
+	byURL := map[string]*CapturedPacket{}
+	for _, pair := range pairs {
+		byURL[pair.Request.URL] = pair.Request
+	}
+	upload, next := byURL["/upload"], byURL["/next"]
+	if upload == nil || next == nil {
+		t.Fatalf("got requests %v, want /upload and /next", byURL)
+	}
+	if upload.Method != "POST" || upload.Host != "example.com" || string(upload.Body) != "hello" {
+		t.Errorf("upload = %s %s host %q body %q", upload.Method, upload.URL, upload.Host, upload.Body)
+	}
+	if upload.Headers["X-Long"] != strings.Repeat("a", 300) || upload.Headers["Content-Type"] != "text/plain" {
+		t.Errorf("upload headers = %v", upload.Headers)
+	}
+	if next.Method != "GET" || next.Headers["X-Long"] != strings.Repeat("a", 300) {
+		t.Errorf("next = %s, headers %v", next.Method, next.Headers)
+	}
+	if !strings.HasSuffix(upload.PairKey, "#1") || !strings.HasSuffix(next.PairKey, "#3") {
+		t.Errorf("pair keys = %q, %q", upload.PairKey, next.PairKey)
+	}
+}
+
+func TestHTTP2TruncatesLongBodies(t *testing.T) {
+	h := testStream(t, false)
+
+	var frames, block bytes.Buffer
+	framer := http2.NewFramer(&frames, nil)
+	enc := hpack.NewEncoder(&block)
+	frames.WriteString(http2.ClientPreface)
+	fields := encodeFields(enc, &block, ":method", "POST", ":scheme", "http", ":authority", "example.com", ":path", "/upload")
+	framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: fields, EndHeaders: true})
+	chunk := bytes.Repeat([]byte("a"), 16<<10)
+	for range maxDecodedBodySize / len(chunk) {
+		framer.WriteData(1, false, chunk)
+	}
+	framer.WriteData(1, true, chunk)
+
+	tr, buf := testReader(frames.Bytes(), time.Now())
+	h.readHTTP2(tr, buf, false)
+
+	pairs := Store.GetPairs()
+	if len(pairs) != 1 || pairs[0].Request == nil {
+		t.Fatalf("got %d pairs, want 1 request", len(pairs))
+	}
+	if req := pairs[0].Request; !req.Truncated || len(req.Body) != maxDecodedBodySize {
+		t.Errorf("kept %d bytes, truncated %v; want the first %d, truncated", len(req.Body), req.Truncated, maxDecodedBodySize)
+	}
+}
+
+func TestHTTP2InterleavedContinuation(t *testing.T) {
+	h := testStream(t, false)
+
+	var frames, block bytes.Buffer
+	framer := http2.NewFramer(&frames, nil)
+	enc := hpack.NewEncoder(&block)
+	fields := encodeFields(enc, &block, ":method", "GET", ":scheme", "http", ":authority", "example.com", ":path", "/")
+	framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: fields[:4]})
+	// Only CONTINUATION may follow a block that hasn't ended
+	framer.WriteData(1, true, []byte("x"))
+	framer.WriteContinuation(1, true, fields[4:])
+
+	tr, buf := testReader(frames.Bytes(), time.Now())
+	h.readHTTP2(tr, buf, false)
+
+	if n := Store.Count(); n != 0 {
+		t.Errorf("got %d pairs from a broken header block, want 0", n)
+	}
+}
+
+func TestHTTP2InvalidRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []string
+	}{
+		{"html method", []string{":method", "<img src=x onerror=alert(1)>", ":path", "/"}},
+		{"empty path", []string{":method", "GET", ":path", ""}},
+		{"relative path", []string{":method", "GET", ":path", "index.html"}},
+		{"space in path", []string{":method", "GET", ":path", "/a b"}},
+		{"control in path", []string{":method", "GET", ":path", "/a\x00"}},
+		{"bad authority", []string{":method", "GET", ":path", "/", ":authority", "exa mple.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := testStream(t, false)
+
+			var frames, block bytes.Buffer
+			framer := http2.NewFramer(&frames, nil)
+			enc := hpack.NewEncoder(&block)
+			bad := encodeFields(enc, &block, tt.fields...)
+			framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: bad, EndHeaders: true})
+			framer.WriteData(1, true, []byte("ignored"))
+			good := encodeFields(enc, &block, ":method", "GET", ":scheme", "http", ":path", "/ok")
+			framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, BlockFragment: good, EndHeaders: true, EndStream: true})
+
+			tr, buf := testReader(frames.Bytes(), time.Now())
+			h.readHTTP2(tr, buf, false)
+
+			var parseErrors, requests int
+			for _, pair := range Store.GetPairs() {
+				switch {
+				case pair.ParseError != nil:
+					parseErrors++
+					if !strings.Contains(pair.ParseError.Error, "stream 1") || pair.ParseError.Offset != 0 {
+						t.Errorf("parse error = %+v", pair.ParseError)
+					}
+				case pair.Request != nil:
+					requests++
+					if pair.Request.URL != "/ok" {
+						t.Errorf("logged request %s %s", pair.Request.Method, pair.Request.URL)
+					}
+				}
+			}
+			if parseErrors != 1 || requests != 1 {
+				t.Errorf("got %d parse errors and %d requests, want 1 of each", parseErrors, requests)
+			}
+		})
+	}
+}
+
+func TestCheckRequestFields(t *testing.T) {
+	tests := []struct {
+		fields []string
+		ok     bool
+	}{
+		{[]string{":method", "GET", ":path", "/"}, true},
+		{[]string{":method", "OPTIONS", ":path", "*"}, true},
+		{[]string{":method", "CONNECT", ":authority", "example.com:443"}, true},
+		{[]string{":method", "GET", ":path", "/search?q=%3Cb%3E", ":authority", "[::1]:8080"}, true},
+		{[]string{":method", "GET"}, false},
+		{[]string{":method", "GE T", ":path", "/"}, false},
+		{[]string{":method", "GET\"", ":path", "/"}, false},
+		{[]string{":method", "GET", ":path", "/é"}, false},
+		{[]string{":method", "GET", ":path", "/", ":authority", "a<b"}, false},
+	}
+	for _, tt := range tests {
+		var fields []hpack.HeaderField
+		for i := 0; i < len(tt.fields); i += 2 {
+			fields = append(fields, hpack.HeaderField{Name: tt.fields[i], Value: tt.fields[i+1]})
+		}
+		if err := checkRequestFields(fields); (err == nil) != tt.ok {
+			t.Errorf("checkRequestFields(%q) = %v, want ok %v", tt.fields, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key log labels, as written by tls.Config.KeyLogWriter and SSLKEYLOGFILE
+const (
+	keyLogMasterSecret          = "CLIENT_RANDOM"
+	keyLogClientHandshakeSecret = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogServerHandshakeSecret = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogClientTrafficSecret   = "CLIENT_TRAFFIC_SECRET_0"
+	keyLogServerTrafficSecret   = "SERVER_TRAFFIC_SECRET_0"
+)
+
+// KeyLog holds the secrets from an NSS key log file. The file is reread as it
+// grows, so it can be shared with a running process.
+type KeyLog struct {
+	path string
+
+	mu      sync.Mutex
+	offset  int64
+	modTime time.Time // of the file when it was last read
+	partial string
+	secrets map[string][]byte // label + " " + hex client random → secret
+}
+
+// OpenKeyLog reads the key log at path
+func OpenKeyLog(path string) (*KeyLog, error) {
+	k := &KeyLog{path: path, secrets: make(map[string][]byte)}
+	if err := k.refresh(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Secret returns the secret logged under label for a client random, first
+// rereading the file if it has changed. It never waits for the secret: the
+// process being watched may log it a little after we see the handshake, so
+// callers look again later.
+func (k *KeyLog) Secret(label string, clientRandom []byte) ([]byte, bool) {
+	key := label + " " + hex.EncodeToString(clientRandom)
+	k.mu.Lock()
+	secret, ok := k.secrets[key]
+	k.mu.Unlock()
+	if ok {
+		return secret, true
+	}
+
+	if err := k.refresh(); err != nil {
+		return nil, false
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	secret, ok = k.secrets[key]
+	return secret, ok
+}
+
+// refresh reads whatever has been appended to the file since the last read
+func (k *KeyLog) refresh() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// Most lookups are for connections that were never logged, so only
+	// reopen the file when it has changed
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == k.offset && info.ModTime().Equal(k.modTime) {
+		return nil
+	}
+	k.modTime = info.ModTime()
+
+	f, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if info.Size() < k.offset {
+		// Truncated or replaced; start over
+		k.offset = 0
+		k.partial = ""
+	}
+	if _, err := f.Seek(k.offset, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	k.offset += int64(len(data))
+
+	// Keep an unfinished last line for the next read
+	text := k.partial + string(data)
+	end := strings.LastIndexByte(text, '\n') + 1
+	k.partial = text[end:]
+
+	scanner := bufio.NewScanner(strings.NewReader(text[:end]))
+	for scanner.Scan() {
+		k.parseLine(scanner.Text())
+	}
+	return nil
+}
+
+// parseLine adds one "<label> <client random> <secret>" line, ignoring
+// comments and anything malformed
+func (k *KeyLog) parseLine(line string) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+		return
+	}
+	clientRandom, err := hex.DecodeString(fields[1])
+	if err != nil || len(clientRandom) != 32 {
+		return
+	}
+	secret, err := hex.DecodeString(fields[2])
+	if err != nil {
+		return
+	}
+	k.secrets[fields[0]+" "+hex.EncodeToString(clientRandom)] = secret
+}
+
+// String describes the key log for startup messages
+func (k *KeyLog) String() string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return fmt.Sprintf("%s (%d secrets)", k.path, len(k.secrets))
+}
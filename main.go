@@ -4,13 +4,12 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
-
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
-	"github.com/google/gopacket/tcpassembly"
+	"sync"
+	"syscall"
 )
 
 var (
@@ -20,8 +19,25 @@ var (
 )
 
 func main() {
-	port := flag.Int("port", 8080, "Cloudflare tunnel port to monitor")
+	portList := flag.String("port", "8080", "Ports to monitor, e.g. 8080,9000-9010 or api=8080,auth=9000")
+	mode := flag.String("mode", "sniff", "Capture mode: \"sniff\" captures packets, \"proxy\" runs a reverse proxy, \"forward\" runs an HTTP(S) forward proxy")
+	listen := flag.String("listen", ":8081", "Address the proxy listens on (proxy and forward modes)")
+	upstream := flag.String("upstream", "localhost:8080", "Where the proxy forwards requests, as host:port or a URL (proxy mode)")
+	caDir := flag.String("ca-dir", defaultCADir(), "Where the forward proxy keeps its CA certificate and key")
 	dashboardPort := flag.Int("dashboard", 4040, "Web dashboard port")
+	dashboardHost := flag.String("dashboard-host", "127.0.0.1", "Address the dashboard listens on (\"\" for every interface)")
+	readFile := flag.String("read", "", "Read packets from a .pcap/.pcapng file instead of capturing live")
+	writeFile := flag.String("write", "", "Also write captured packets to a .pcapng file")
+	ifaceName := flag.String("iface", defaultInterface(), "Network interface to capture on (\"any\" for all interfaces on Linux)")
+	bpfExpr := flag.String("bpf", "", "Custom BPF filter expression (overrides the filter built from -port)")
+	keyLogFile := flag.String("keylog", "", "Decrypt TLS on the monitored ports with secrets from this SSLKEYLOGFILE")
+	protoDescriptors := flag.String("proto-descriptors", "", "Decode gRPC messages with the types in this FileDescriptorSet (protoc --descriptor_set_out)")
+	importHAR := flag.String("import-har", "", "Load the entries of a HAR file into the dashboard on startup")
+	maxPairs := flag.Int("max-pairs", 500, "Maximum number of pairs kept in memory")
+	maxMemory := flag.String("max-memory", "256MB", "Approximate memory budget for captured data, e.g. 256MB or 1GB (0 for no limit)")
+	dataDir := flag.String("data-dir", "", "Directory to keep captured pairs in across restarts")
+	retain := flag.String("retain", "", "How much of -data-dir to keep, e.g. 24h, 100000 (pairs), 2GB or a combination like 24h,2GB")
+	listIfaces := flag.Bool("list-ifaces", false, "List available capture interfaces and exit")
 	showVersion := flag.Bool("version", false, "Show version information")
 	flag.Parse()
 
@@ -32,57 +48,192 @@ func main() {
 		return
 	}
 
-	// Start web dashboard in background
-	go func() {
-		if err := StartDashboardServer(*dashboardPort, *port); err != nil {
-			log.Printf("Dashboard server error: %v\n", err)
+	if *listIfaces {
+		if err := printInterfaces(os.Stdout); err != nil {
+			log.Printf("Could not list interfaces: %v\n", err)
+			os.Exit(1)
 		}
-	}()
-
-	// Determine the loopback interface name based on OS
-	iface := "lo0"
-	if runtime.GOOS == "linux" {
-		iface = "lo"
+		return
 	}
 
-	fmt.Printf("Starting HTTP monitor on port %d (interface: %s)\n", *port, iface)
-
-	handle, err := pcap.OpenLive(iface, 65536, true, pcap.BlockForever)
+	ports, err := ParsePorts(*portList)
 	if err != nil {
-		log.Printf("Error opening interface %s: %v\n", iface, err)
-		log.Println("Available interfaces:")
-		devices, listErr := pcap.FindAllDevs()
-		if listErr != nil {
-			log.Printf("  Could not list interfaces: %v\n", listErr)
-		} else {
-			for _, dev := range devices {
-				log.Printf("  - %s: %s\n", dev.Name, dev.Description)
-			}
+		log.Printf("Invalid -port value %q: %v\n", *portList, err)
+		os.Exit(1)
+	}
+
+	var target *url.URL
+	var ca *CertAuthority
+	switch *mode {
+	case "sniff":
+	case "forward":
+		var created bool
+		if ca, created, err = LoadOrCreateCA(*caDir); err != nil {
+			log.Printf("Error loading CA from %s: %v\n", *caDir, err)
+			os.Exit(1)
+		}
+		if created {
+			fmt.Printf("Created a new CA in %s\n", *caDir)
+		}
+		fmt.Printf("Clients must trust %s to have HTTPS intercepted, e.g. SSL_CERT_FILE=%s or curl --cacert %s\n", ca.CertPath(), ca.CertPath(), ca.CertPath())
+		listenPort, err := ParsePorts(portOf(*listen))
+		if err != nil {
+			log.Printf("Invalid -listen value %q: %v\n", *listen, err)
+			os.Exit(1)
+		}
+		ports = listenPort
+	case "proxy":
+		if target, err = ParseUpstream(*upstream); err != nil {
+			log.Printf("Invalid -upstream value %q: %v\n", *upstream, err)
+			os.Exit(1)
 		}
+		// The dashboard shows the upstream as the monitored port
+		ports = PortSet{{First: upstreamPort(target), Last: upstreamPort(target)}}
+	default:
+		log.Printf("Invalid -mode value %q: must be sniff, proxy or forward\n", *mode)
 		os.Exit(1)
 	}
-	defer handle.Close()
 
-	filter := fmt.Sprintf("tcp port %d", *port)
-	if err := handle.SetBPFFilter(filter); err != nil {
-		log.Printf("Error setting BPF filter '%s': %v\n", filter, err)
+	if *maxPairs < 1 {
+		log.Printf("Invalid -max-pairs value %d: must be at least 1\n", *maxPairs)
 		os.Exit(1)
 	}
+	memoryLimit, err := parseByteSize(*maxMemory)
+	if err != nil {
+		log.Printf("Invalid -max-memory value %q: %v\n", *maxMemory, err)
+		os.Exit(1)
+	}
+
+	if *protoDescriptors != "" {
+		if ProtoTypes, err = LoadProtoDescriptors(*protoDescriptors); err != nil {
+			log.Printf("Error reading proto descriptors %s: %v\n", *protoDescriptors, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Decoding gRPC messages with %s from %s\n", ProtoTypes, *protoDescriptors)
+	}
 
-	streamFactory := &httpStreamFactory{}
-	pool := tcpassembly.NewStreamPool(streamFactory)
-	assembler := tcpassembly.NewAssembler(pool)
+	Store = NewPacketStore(*maxPairs, memoryLimit)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		shutdownMu.Lock()
+		for _, f := range shutdownHooks {
+			f()
+		}
+		fmt.Println("Bye bye!")
+		os.Exit(0)
+	}()
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	for packet := range packetSource.Packets() {
-		if tcp := packet.Layer(layers.LayerTypeTCP); tcp != nil {
-			assembler.AssembleWithTimestamp(
-				packet.NetworkLayer().NetworkFlow(),
-				tcp.(*layers.TCP),
-				packet.Metadata().Timestamp,
-			)
+	if *dataDir != "" {
+		retention, err := ParseRetention(*retain)
+		if err != nil {
+			log.Printf("Invalid -retain value %q: %v\n", *retain, err)
+			os.Exit(1)
+		}
+		backend, err := OpenSegmentStore(*dataDir, retention)
+		if err != nil {
+			log.Printf("Error opening data directory %s: %v\n", *dataDir, err)
+			os.Exit(1)
+		}
+		if err := Store.SetBackend(backend); err != nil {
+			log.Printf("Error loading stored pairs from %s: %v\n", *dataDir, err)
+			os.Exit(1)
 		}
+		fmt.Printf("Storing captured pairs in %s\n", *dataDir)
+		if *retain == "" {
+			log.Printf("No -retain limit given, so %s will grow until it's cleared; try -retain 24h,2GB\n", *dataDir)
+		}
+
+		// Pairs still waiting for a response are only written out on shutdown
+		atShutdown(func() {
+			if err := Store.Close(); err != nil {
+				log.Printf("Error closing storage: %v\n", err)
+			}
+		})
+	} else if *retain != "" {
+		log.Println("-retain has no effect without -data-dir")
 	}
 
+	if *importHAR != "" {
+		n, err := ImportHARFile(Store, *importHAR)
+		if err != nil {
+			log.Printf("Error importing %s: %v\n", *importHAR, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Imported %d entries from %s\n", n, *importHAR)
+	}
+
+	// Start web dashboard in background
+	go func() {
+		if err := StartDashboardServer(*dashboardHost, *dashboardPort, ports); err != nil {
+			log.Printf("Dashboard server error: %v\n", err)
+		}
+	}()
+
+	if ca != nil {
+		if err := RunForwardProxy(*listen, ca); err != nil {
+			log.Printf("Proxy error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if target != nil {
+		if err := RunReverseProxy(*listen, target); err != nil {
+			log.Printf("Proxy error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var keyLog *KeyLog
+	if *keyLogFile != "" {
+		if keyLog, err = OpenKeyLog(*keyLogFile); err != nil {
+			log.Printf("Error reading key log %s: %v\n", *keyLogFile, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Decrypting TLS with secrets from %s\n", keyLog)
+	}
+
+	runSniffer(sniffOptions{
+		ports:     ports,
+		readFile:  *readFile,
+		writeFile: *writeFile,
+		iface:     *ifaceName,
+		bpf:       *bpfExpr,
+		keyLog:    keyLog,
+	})
+
+	if *readFile != "" {
+		// Keep the dashboard up so the capture can be inspected
+		fmt.Printf("Finished reading %s, dashboard still running (Ctrl+C to exit)\n", *readFile)
+		select {}
+	}
+
+	if err := Store.Close(); err != nil {
+		log.Printf("Error closing storage: %v\n", err)
+	}
 	fmt.Println("Bye bye!")
 }
+
+// shutdownHooks are run when the process is interrupted, before it exits
+var (
+	shutdownMu    sync.Mutex
+	shutdownHooks []func()
+)
+
+// atShutdown registers f to run when the process is interrupted
+func atShutdown(f func()) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownHooks = append(shutdownHooks, f)
+}
+
+// defaultInterface returns the loopback interface name for this OS
+func defaultInterface() string {
+	if runtime.GOOS == "linux" {
+		return "lo"
+	}
+	return "lo0"
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortRange is a monitored port (or range of ports) with an optional label
+type PortRange struct {
+	Label string
+	First int
+	Last  int
+}
+
+// PortSet is the list of ports being monitored
+type PortSet []PortRange
+
+// ParsePorts parses a port list such as "8080,8443,9000-9010" or "api=8080,auth=9000"
+func ParsePorts(s string) (PortSet, error) {
+	var ports PortSet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var pr PortRange
+		if label, rest, ok := strings.Cut(part, "="); ok {
+			if strings.TrimSpace(label) == "" {
+				return nil, fmt.Errorf("empty label in %q", part)
+			}
+			pr.Label = strings.TrimSpace(label)
+			part = strings.TrimSpace(rest)
+		}
+
+		first, last, isRange := strings.Cut(part, "-")
+		var err error
+		if pr.First, err = parsePort(first); err != nil {
+			return nil, err
+		}
+		pr.Last = pr.First
+		if isRange {
+			if pr.Last, err = parsePort(last); err != nil {
+				return nil, err
+			}
+			if pr.Last < pr.First {
+				return nil, fmt.Errorf("invalid port range %q", part)
+			}
+		}
+		ports = append(ports, pr)
+	}
+
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no ports given")
+	}
+	return ports, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// Contains reports whether port falls inside the range
+func (pr PortRange) Contains(port int) bool {
+	return port >= pr.First && port <= pr.Last
+}
+
+// String formats the range the same way it is parsed
+func (pr PortRange) String() string {
+	s := strconv.Itoa(pr.First)
+	if pr.Last != pr.First {
+		s += "-" + strconv.Itoa(pr.Last)
+	}
+	if pr.Label != "" {
+		s = pr.Label + "=" + s
+	}
+	return s
+}
+
+// Match returns the range a port belongs to
+func (ps PortSet) Match(port int) (PortRange, bool) {
+	for _, pr := range ps {
+		if pr.Contains(port) {
+			return pr, true
+		}
+	}
+	return PortRange{}, false
+}
+
+// Lookup resolves a port filter, which is either a label or a port list
+func (ps PortSet) Lookup(filter string) (PortSet, error) {
+	for _, pr := range ps {
+		if pr.Label != "" && pr.Label == filter {
+			return PortSet{pr}, nil
+		}
+	}
+	return ParsePorts(filter)
+}
+
+// BPFFilter builds a BPF expression matching every port in the set
+func (ps PortSet) BPFFilter() string {
+	terms := make([]string, len(ps))
+	for i, pr := range ps {
+		if pr.First == pr.Last {
+			terms[i] = fmt.Sprintf("port %d", pr.First)
+		} else {
+			terms[i] = fmt.Sprintf("portrange %d-%d", pr.First, pr.Last)
+		}
+	}
+	if len(terms) == 1 {
+		return "tcp " + terms[0]
+	}
+	return "tcp and (" + strings.Join(terms, " or ") + ")"
+}
+
+// String formats the set the same way it is parsed
+func (ps PortSet) String() string {
+	parts := make([]string, len(ps))
+	for i, pr := range ps {
+		parts[i] = pr.String()
+	}
+	return strings.Join(parts, ",")
+}
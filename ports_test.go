@@ -0,0 +1,87 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		in   string
+		want PortSet
+		bpf  string
+		err  string
+	}{
+		{in: "8080", want: PortSet{{First: 8080, Last: 8080}}, bpf: "tcp port 8080"},
+		{in: "9000-9010", want: PortSet{{First: 9000, Last: 9010}}, bpf: "tcp portrange 9000-9010"},
+		{in: "1-65535", want: PortSet{{First: 1, Last: 65535}}, bpf: "tcp portrange 1-65535"},
+		{in: "5000-5000", want: PortSet{{First: 5000, Last: 5000}}, bpf: "tcp port 5000"},
+		{
+			in:   "api=8080, auth = 9000-9001,8443,",
+			want: PortSet{{Label: "api", First: 8080, Last: 8080}, {Label: "auth", First: 9000, Last: 9001}, {First: 8443, Last: 8443}},
+			bpf:  "tcp and (port 8080 or portrange 9000-9001 or port 8443)",
+		},
+		{in: "9010-9000", err: `invalid port range "9010-9000"`},
+		{in: "0", err: `invalid port "0"`},
+		{in: "65536", err: `invalid port "65536"`},
+		{in: "8080-70000", err: `invalid port "70000"`},
+		{in: "http", err: `invalid port "http"`},
+		{in: "=8080", err: `empty label in "=8080"`},
+		{in: " , ", err: "no ports given"},
+	}
+	for _, tt := range tests {
+		got, err := ParsePorts(tt.in)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("ParsePorts(%q) error %v, want %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("ParsePorts(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+			continue
+		}
+		if bpf := got.BPFFilter(); bpf != tt.bpf {
+			t.Errorf("BPFFilter(%q) = %q, want %q", tt.in, bpf, tt.bpf)
+		}
+		// Sets print the way they're parsed
+		if again, err := ParsePorts(got.String()); err != nil || !slices.Equal(again, got) {
+			t.Errorf("ParsePorts(%q) = %v, %v; want %v", got.String(), again, err, got)
+		}
+	}
+}
+
+func TestPortSetLookup(t *testing.T) {
+	ports, err := ParsePorts("api=8080,auth=9000-9010,8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		filter string
+		want   PortSet
+		err    bool
+	}{
+		{filter: "auth", want: PortSet{{Label: "auth", First: 9000, Last: 9010}}},
+		{filter: "8443", want: PortSet{{First: 8443, Last: 8443}}},
+		// Ports don't have to be monitored to be looked up
+		{filter: "3000-3001", want: PortSet{{First: 3000, Last: 3001}}},
+		{filter: "unknown", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ports.Lookup(tt.filter)
+		if (err != nil) != tt.err || !slices.Equal(got, tt.want) {
+			t.Errorf("Lookup(%q) = %v, %v", tt.filter, got, err)
+		}
+	}
+
+	for port, label := range map[int]string{8080: "api", 9005: "auth", 8443: "", 7000: "none"} {
+		pr, ok := ports.Match(port)
+		if label == "none" {
+			if ok {
+				t.Errorf("Match(%d) = %v, want no match", port, pr)
+			}
+		} else if !ok || pr.Label != label {
+			t.Errorf("Match(%d) = %v, %v; want label %q", port, pr, ok, label)
+		}
+	}
+}
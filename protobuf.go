@@ -0,0 +1,557 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Protobuf wire types
+const (
+	wireVarint = 0
+	wireI64    = 1
+	wireLen    = 2
+	wireI32    = 5
+)
+
+var wireTypeNames = map[int]string{
+	wireVarint: "varint",
+	wireI64:    "i64",
+	wireLen:    "len",
+	wireI32:    "i32",
+}
+
+// maxProtoDepth bounds how deeply nested messages are decoded
+const maxProtoDepth = 32
+
+var errBadProto = errors.New("not a valid protobuf message")
+
+// forEachProtoField walks the fields of an encoded message. value holds
+// varint and fixed-size values; data holds length-delimited ones.
+func forEachProtoField(msg []byte, fn func(number, wireType int, value uint64, data []byte) error) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errBadProto
+		}
+		msg = msg[n:]
+		number, wireType := int(tag>>3), int(tag&7)
+		if number <= 0 || number > 1<<29-1 {
+			return errBadProto
+		}
+
+		var value uint64
+		var data []byte
+		switch wireType {
+		case wireVarint:
+			if value, n = binary.Uvarint(msg); n <= 0 {
+				return errBadProto
+			}
+			msg = msg[n:]
+		case wireI64:
+			if len(msg) < 8 {
+				return errBadProto
+			}
+			value, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+		case wireI32:
+			if len(msg) < 4 {
+				return errBadProto
+			}
+			value, msg = uint64(binary.LittleEndian.Uint32(msg)), msg[4:]
+		case wireLen:
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || length > uint64(len(msg)-n) {
+				return errBadProto
+			}
+			data, msg = msg[n:n+int(length)], msg[n+int(length):]
+		default:
+			// Groups are long deprecated and rare enough not to bother with
+			return errBadProto
+		}
+		if err := fn(number, wireType, value, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProtoField is a field decoded without a schema. Length-delimited fields are
+// shown as text, a nested message or bytes, whichever looks most likely.
+type ProtoField struct {
+	Number   int          `json:"number"`
+	WireType string       `json:"wireType"`
+	Value    any          `json:"value,omitempty"`
+	Message  []ProtoField `json:"message,omitempty"`
+	Bytes    []byte       `json:"bytes,omitempty"`
+}
+
+// decodeProtoFields decodes a message without knowing its schema
+func decodeProtoFields(msg []byte, depth int) ([]ProtoField, error) {
+	fields := []ProtoField{}
+	err := forEachProtoField(msg, func(number, wireType int, value uint64, data []byte) error {
+		field := ProtoField{Number: number, WireType: wireTypeNames[wireType]}
+		switch wireType {
+		case wireVarint, wireI64, wireI32:
+			field.Value = value
+		case wireLen:
+			if isPrintable(data) {
+				field.Value = string(data)
+				break
+			}
+			field.Bytes = data
+			if depth < maxProtoDepth {
+				if nested, err := decodeProtoFields(data, depth+1); err == nil {
+					field.Message, field.Bytes = nested, nil
+				}
+			}
+		}
+		fields = append(fields, field)
+		return nil
+	})
+	return fields, err
+}
+
+// isPrintable reports whether data reads as text, which a nested message
+// almost never does since its tags are control characters
+func isPrintable(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if !unicode.IsPrint(r) && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// Field types from descriptor.proto
+const (
+	protoDouble   = 1
+	protoFloat    = 2
+	protoInt64    = 3
+	protoUint64   = 4
+	protoInt32    = 5
+	protoFixed64  = 6
+	protoFixed32  = 7
+	protoBool     = 8
+	protoString   = 9
+	protoMessage  = 11
+	protoBytes    = 12
+	protoUint32   = 13
+	protoEnum     = 14
+	protoSfixed32 = 15
+	protoSfixed64 = 16
+	protoSint32   = 17
+	protoSint64   = 18
+
+	protoLabelRepeated = 3
+)
+
+// ProtoRegistry holds the message types and gRPC methods from a
+// FileDescriptorSet, as written by protoc --descriptor_set_out
+type ProtoRegistry struct {
+	messages map[string]*protoMessageType // by full name
+	enums    map[string]map[int32]string  // full name → number → value name
+	methods  map[string]protoMethod       // by gRPC path, /package.Service/Method
+}
+
+type protoMessageType struct {
+	fields   map[int]*protoFieldType
+	mapEntry bool
+}
+
+type protoFieldType struct {
+	name     string
+	typ      int
+	typeName string // message or enum types
+	repeated bool
+}
+
+type protoMethod struct {
+	input, output string
+}
+
+// ProtoTypes decodes gRPC messages when -proto-descriptors is given
+var ProtoTypes *ProtoRegistry
+
+// LoadProtoDescriptors reads a FileDescriptorSet
+func LoadProtoDescriptors(path string) (*ProtoRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &ProtoRegistry{
+		messages: make(map[string]*protoMessageType),
+		enums:    make(map[string]map[int32]string),
+		methods:  make(map[string]protoMethod),
+	}
+	err = forEachProtoField(data, func(number, wireType int, _ uint64, file []byte) error {
+		if number == 1 && wireType == wireLen {
+			return r.addFile(file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading descriptor set: %w", err)
+	}
+	if len(r.messages) == 0 {
+		return nil, errors.New("no message types in descriptor set")
+	}
+	return r, nil
+}
+
+// String describes the registry for startup messages
+func (r *ProtoRegistry) String() string {
+	return fmt.Sprintf("%d message types and %d methods", len(r.messages), len(r.methods))
+}
+
+// addFile adds the types in a FileDescriptorProto
+func (r *ProtoRegistry) addFile(file []byte) error {
+	var pkg string
+	var messages, enums, services [][]byte
+	err := forEachProtoField(file, func(number, wireType int, _ uint64, data []byte) error {
+		switch number {
+		case 2:
+			pkg = string(data)
+		case 4:
+			messages = append(messages, data)
+		case 5:
+			enums = append(enums, data)
+		case 6:
+			services = append(services, data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, m := range messages {
+		if err := r.addMessage(pkg, m); err != nil {
+			return err
+		}
+	}
+	for _, e := range enums {
+		if err := r.addEnum(pkg, e); err != nil {
+			return err
+		}
+	}
+	for _, s := range services {
+		if err := r.addService(pkg, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addMessage adds a DescriptorProto and the types nested in it
+func (r *ProtoRegistry) addMessage(scope string, msg []byte) error {
+	var name string
+	var fields, nested, enums [][]byte
+	t := &protoMessageType{fields: make(map[int]*protoFieldType)}
+	err := forEachProtoField(msg, func(number, wireType int, _ uint64, data []byte) error {
+		switch number {
+		case 1:
+			name = string(data)
+		case 2:
+			fields = append(fields, data)
+		case 3:
+			nested = append(nested, data)
+		case 4:
+			enums = append(enums, data)
+		case 7: // MessageOptions
+			return forEachProtoField(data, func(number, _ int, value uint64, _ []byte) error {
+				if number == 7 {
+					t.mapEntry = value != 0
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fullName := qualify(scope, name)
+	r.messages[fullName] = t
+
+	for _, f := range fields {
+		field := &protoFieldType{}
+		var number int
+		err := forEachProtoField(f, func(n, _ int, value uint64, data []byte) error {
+			switch n {
+			case 1:
+				field.name = string(data)
+			case 3:
+				number = int(value)
+			case 4:
+				field.repeated = value == protoLabelRepeated
+			case 5:
+				field.typ = int(value)
+			case 6:
+				field.typeName = strings.TrimPrefix(string(data), ".")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		t.fields[number] = field
+	}
+	for _, m := range nested {
+		if err := r.addMessage(fullName, m); err != nil {
+			return err
+		}
+	}
+	for _, e := range enums {
+		if err := r.addEnum(fullName, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addEnum adds an EnumDescriptorProto
+func (r *ProtoRegistry) addEnum(scope string, enum []byte) error {
+	var name string
+	values := make(map[int32]string)
+	err := forEachProtoField(enum, func(number, _ int, _ uint64, data []byte) error {
+		switch number {
+		case 1:
+			name = string(data)
+		case 2:
+			var valueName string
+			var valueNumber int32
+			err := forEachProtoField(data, func(n, _ int, value uint64, data []byte) error {
+				switch n {
+				case 1:
+					valueName = string(data)
+				case 2:
+					valueNumber = int32(value)
+				}
+				return nil
+			})
+			values[valueNumber] = valueName
+			return err
+		}
+		return nil
+	})
+	r.enums[qualify(scope, name)] = values
+	return err
+}
+
+// addService adds the methods of a ServiceDescriptorProto
+func (r *ProtoRegistry) addService(pkg string, service []byte) error {
+	var name string
+	var methods [][]byte
+	err := forEachProtoField(service, func(number, _ int, _ uint64, data []byte) error {
+		switch number {
+		case 1:
+			name = string(data)
+		case 2:
+			methods = append(methods, data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, m := range methods {
+		var methodName string
+		var method protoMethod
+		err := forEachProtoField(m, func(number, _ int, _ uint64, data []byte) error {
+			switch number {
+			case 1:
+				methodName = string(data)
+			case 2:
+				method.input = strings.TrimPrefix(string(data), ".")
+			case 3:
+				method.output = strings.TrimPrefix(string(data), ".")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		r.methods["/"+qualify(pkg, name)+"/"+methodName] = method
+	}
+	return nil
+}
+
+func qualify(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+// MessageType returns the request or response type of a gRPC method
+func (r *ProtoRegistry) MessageType(path string, request bool) string {
+	method, ok := r.methods[path]
+	if !ok {
+		return ""
+	}
+	if request {
+		return method.input
+	}
+	return method.output
+}
+
+// Decode decodes a message of a known type into field names and values,
+// in the style of the protobuf JSON mapping. Fields missing from the schema
+// are kept under their numbers.
+func (r *ProtoRegistry) Decode(typeName string, msg []byte) (map[string]any, error) {
+	return r.decode(typeName, msg, 0)
+}
+
+func (r *ProtoRegistry) decode(typeName string, msg []byte, depth int) (map[string]any, error) {
+	t, ok := r.messages[typeName]
+	if !ok {
+		return nil, fmt.Errorf("unknown message type %s", typeName)
+	}
+	if depth > maxProtoDepth {
+		return nil, errors.New("message nested too deeply")
+	}
+
+	out := make(map[string]any)
+	err := forEachProtoField(msg, func(number, wireType int, value uint64, data []byte) error {
+		field, ok := t.fields[number]
+		if !ok {
+			unknown := ProtoField{Number: number, WireType: wireTypeNames[wireType], Value: value}
+			if wireType == wireLen {
+				unknown.Value, unknown.Bytes = nil, data
+			}
+			out[strconv.Itoa(number)] = unknown
+			return nil
+		}
+
+		// Packed repeated scalars come as one length-delimited run
+		var values []any
+		if wireType == wireLen && field.repeated && isPackable(field.typ) {
+			for len(data) > 0 {
+				v, n, err := r.packedValue(field, data)
+				if err != nil {
+					return err
+				}
+				values, data = append(values, v), data[n:]
+			}
+		} else {
+			v, err := r.value(field, value, data, depth)
+			if err != nil {
+				return err
+			}
+			values = []any{v}
+		}
+
+		switch {
+		case field.repeated && r.isMapEntry(field):
+			m, _ := out[field.name].(map[string]any)
+			if m == nil {
+				m = make(map[string]any)
+			}
+			for _, v := range values {
+				entry := v.(map[string]any)
+				m[fmt.Sprint(entry["key"])] = entry["value"]
+			}
+			out[field.name] = m
+		case field.repeated:
+			list, _ := out[field.name].([]any)
+			out[field.name] = append(list, values...)
+		default:
+			out[field.name] = values[len(values)-1]
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (r *ProtoRegistry) isMapEntry(field *protoFieldType) bool {
+	t, ok := r.messages[field.typeName]
+	return field.typ == protoMessage && ok && t.mapEntry
+}
+
+func isPackable(typ int) bool {
+	return typ != protoString && typ != protoBytes && typ != protoMessage
+}
+
+// packedValue reads one value from a packed run, returning its size
+func (r *ProtoRegistry) packedValue(field *protoFieldType, data []byte) (any, int, error) {
+	var value uint64
+	var n int
+	switch field.typ {
+	case protoDouble, protoFixed64, protoSfixed64:
+		if len(data) < 8 {
+			return nil, 0, errBadProto
+		}
+		value, n = binary.LittleEndian.Uint64(data), 8
+	case protoFloat, protoFixed32, protoSfixed32:
+		if len(data) < 4 {
+			return nil, 0, errBadProto
+		}
+		value, n = uint64(binary.LittleEndian.Uint32(data)), 4
+	default:
+		if value, n = binary.Uvarint(data); n <= 0 {
+			return nil, 0, errBadProto
+		}
+	}
+	v, err := r.value(field, value, nil, 0)
+	return v, n, err
+}
+
+// value converts one field value to its JSON form. 64-bit integers become
+// strings, as in the protobuf JSON mapping, so JavaScript doesn't round them.
+func (r *ProtoRegistry) value(field *protoFieldType, value uint64, data []byte, depth int) (any, error) {
+	switch field.typ {
+	case protoDouble:
+		return jsonFloat(math.Float64frombits(value)), nil
+	case protoFloat:
+		return jsonFloat(float64(math.Float32frombits(uint32(value)))), nil
+	case protoInt64, protoSfixed64:
+		return strconv.FormatInt(int64(value), 10), nil
+	case protoUint64, protoFixed64:
+		return strconv.FormatUint(value, 10), nil
+	case protoSint64:
+		return strconv.FormatInt(int64(value>>1)^-int64(value&1), 10), nil
+	case protoInt32, protoSfixed32:
+		return int32(value), nil
+	case protoUint32, protoFixed32:
+		return uint32(value), nil
+	case protoSint32:
+		return int32(uint32(value)>>1) ^ -int32(value&1), nil
+	case protoBool:
+		return value != 0, nil
+	case protoEnum:
+		if name, ok := r.enums[field.typeName][int32(value)]; ok {
+			return name, nil
+		}
+		return int32(value), nil
+	case protoString:
+		return string(data), nil
+	case protoBytes:
+		return base64.StdEncoding.EncodeToString(data), nil
+	case protoMessage:
+		return r.decode(field.typeName, data, depth+1)
+	}
+	return nil, fmt.Errorf("field %s has unsupported type %d", field.name, field.typ)
+}
+
+// jsonFloat keeps values JSON can't hold as strings, as the JSON mapping does
+func jsonFloat(f float64) any {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return f
+}
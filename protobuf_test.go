@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// pbVarint, pbLen, pbI64 and pbI32 encode one field of a protobuf message
+func pbVarint(number int, value uint64) []byte {
+	b := binary.AppendUvarint(nil, uint64(number)<<3|wireVarint)
+	return binary.AppendUvarint(b, value)
+}
+
+func pbLen(number int, parts ...[]byte) []byte {
+	data := slices.Concat(parts...)
+	b := binary.AppendUvarint(nil, uint64(number)<<3|wireLen)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func pbI64(number int, value uint64) []byte {
+	b := binary.AppendUvarint(nil, uint64(number)<<3|wireI64)
+	return binary.LittleEndian.AppendUint64(b, value)
+}
+
+func pbI32(number int, value uint32) []byte {
+	b := binary.AppendUvarint(nil, uint64(number)<<3|wireI32)
+	return binary.LittleEndian.AppendUint32(b, value)
+}
+
+func TestForEachProtoField(t *testing.T) {
+	type field struct {
+		number, wireType int
+		value            uint64
+		data             string
+	}
+	tests := []struct {
+		name string
+		msg  []byte
+		want []field
+		ok   bool
+	}{
+		{"empty", nil, nil, true},
+		{
+			name: "every wire type",
+			msg:  slices.Concat(pbVarint(1, 300), pbI64(2, 1<<40), pbLen(3, []byte("hi")), pbI32(4, 7)),
+			want: []field{{1, wireVarint, 300, ""}, {2, wireI64, 1 << 40, ""}, {3, wireLen, 0, "hi"}, {4, wireI32, 7, ""}},
+			ok:   true,
+		},
+		{"largest field number", pbVarint(1<<29-1, 1), []field{{1<<29 - 1, wireVarint, 1, ""}}, true},
+		{"field number 0", pbVarint(0, 1), nil, false},
+		{"truncated tag", []byte{0x80}, nil, false},
+		{"truncated varint", []byte{0x08, 0xff}, nil, false},
+		{"truncated i64", pbI64(1, 1)[:5], nil, false},
+		{"truncated i32", pbI32(1, 1)[:3], nil, false},
+		{"length past the end", pbLen(1, []byte("hello"))[:4], nil, false},
+		{"group", []byte{0x0b, 0x0c}, nil, false},
+		{"error after a good field", append(pbVarint(1, 1), 0xff), []field{{1, wireVarint, 1, ""}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []field
+			err := forEachProtoField(tt.msg, func(number, wireType int, value uint64, data []byte) error {
+				got = append(got, field{number, wireType, value, string(data)})
+				return nil
+			})
+			if (err == nil) != tt.ok {
+				t.Errorf("err = %v, want ok %v", err, tt.ok)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("fields = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeProtoFields(t *testing.T) {
+	msg := slices.Concat(
+		pbLen(1, []byte("widget")),
+		pbLen(2, pbVarint(1, 5), pbLen(2, []byte("nested"))),
+		pbLen(3, []byte{0xff, 0x00}),
+		pbVarint(4, 1),
+	)
+	fields, err := decodeProtoFields(msg, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ProtoField{
+		{Number: 1, WireType: "len", Value: "widget"},
+		{Number: 2, WireType: "len", Message: []ProtoField{
+			{Number: 1, WireType: "varint", Value: uint64(5)},
+			{Number: 2, WireType: "len", Value: "nested"},
+		}},
+		{Number: 3, WireType: "len", Bytes: []byte{0xff, 0x00}},
+		{Number: 4, WireType: "varint", Value: uint64(1)},
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("decodeProtoFields = %+v\nwant %+v", fields, want)
+	}
+
+	if _, err := decodeProtoFields([]byte{0x08}, 0); err == nil {
+		t.Error("decodeProtoFields accepted a truncated message")
+	}
+}
+
+func TestDecodeProtoFieldsDepth(t *testing.T) {
+	msg := pbVarint(1, 1)
+	for range maxProtoDepth + 2 {
+		msg = pbLen(1, msg)
+	}
+	fields, err := decodeProtoFields(msg, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nesting stops at maxProtoDepth, leaving the rest as bytes
+	depth := 0
+	for fields[0].Message != nil {
+		fields = fields[0].Message
+		depth++
+	}
+	if depth != maxProtoDepth || fields[0].Bytes == nil {
+		t.Errorf("decoded %d levels deep, then bytes %x, want %d levels", depth, fields[0].Bytes, maxProtoDepth)
+	}
+}
+
+// fieldDescriptor encodes a FieldDescriptorProto
+func fieldDescriptor(name string, number, typ int, repeated bool, typeName string) []byte {
+	label := uint64(1)
+	if repeated {
+		label = protoLabelRepeated
+	}
+	return pbLen(2, pbLen(1, []byte(name)), pbVarint(3, uint64(number)), pbVarint(4, label),
+		pbVarint(5, uint64(typ)), pbLen(6, []byte(typeName)))
+}
+
+// testRegistry loads a descriptor set for a shop.Item message and a
+// shop.Shop service
+func testRegistry(t *testing.T) *ProtoRegistry {
+	t.Helper()
+	attrsEntry := pbLen(3,
+		pbLen(1, []byte("AttrsEntry")),
+		fieldDescriptor("key", 1, protoString, false, ""),
+		fieldDescriptor("value", 2, protoString, false, ""),
+		pbLen(7, pbVarint(7, 1)),
+	)
+	kind := pbLen(4,
+		pbLen(1, []byte("Kind")),
+		pbLen(2, pbLen(1, []byte("UNKNOWN")), pbVarint(2, 0)),
+		pbLen(2, pbLen(1, []byte("BOOK")), pbVarint(2, 1)),
+	)
+	item := pbLen(4,
+		pbLen(1, []byte("Item")),
+		fieldDescriptor("name", 1, protoString, false, ""),
+		fieldDescriptor("count", 2, protoInt64, false, ""),
+		fieldDescriptor("tags", 3, protoString, true, ""),
+		fieldDescriptor("ids", 4, protoInt32, true, ""),
+		fieldDescriptor("kind", 5, protoEnum, false, ".shop.Item.Kind"),
+		fieldDescriptor("child", 6, protoMessage, false, ".shop.Item"),
+		fieldDescriptor("attrs", 7, protoMessage, true, ".shop.Item.AttrsEntry"),
+		fieldDescriptor("delta", 8, protoSint32, false, ""),
+		fieldDescriptor("ratio", 9, protoDouble, false, ""),
+		fieldDescriptor("data", 10, protoBytes, false, ""),
+		attrsEntry, kind,
+	)
+	service := pbLen(6,
+		pbLen(1, []byte("Shop")),
+		pbLen(2, pbLen(1, []byte("GetItem")), pbLen(2, []byte(".shop.Item")), pbLen(3, []byte(".shop.Item"))),
+	)
+	set := pbLen(1, pbLen(1, []byte("shop.proto")), pbLen(2, []byte("shop")), item, service)
+
+	path := filepath.Join(t.TempDir(), "shop.pb")
+	if err := os.WriteFile(path, set, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadProtoDescriptors(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestProtoRegistryDecode(t *testing.T) {
+	r := testRegistry(t)
+	if got := r.MessageType("/shop.Shop/GetItem", true); got != "shop.Item" {
+		t.Errorf("MessageType = %q, want shop.Item", got)
+	}
+
+	packed := slices.Concat(binary.AppendUvarint(nil, 1), binary.AppendUvarint(nil, 2))
+	tests := []struct {
+		name string
+		msg  []byte
+		want string // JSON
+		ok   bool
+	}{
+		{"scalars", slices.Concat(pbLen(1, []byte("widget")), pbVarint(2, 1<<53+1), pbVarint(8, 3), pbI64(9, math.Float64bits(0.5))),
+			`{"count":"9007199254740993","delta":-2,"name":"widget","ratio":0.5}`, true},
+		{"repeated and packed", slices.Concat(pbLen(3, []byte("a")), pbLen(3, []byte("b")), pbLen(4, packed), pbVarint(4, 3)),
+			`{"ids":[1,2,3],"tags":["a","b"]}`, true},
+		{"enum", pbVarint(5, 1), `{"kind":"BOOK"}`, true},
+		{"unknown enum value", pbVarint(5, 9), `{"kind":9}`, true},
+		{"nested message", pbLen(6, pbLen(1, []byte("inner"))), `{"child":{"name":"inner"}}`, true},
+		{"map", slices.Concat(pbLen(7, pbLen(1, []byte("color")), pbLen(2, []byte("red"))), pbLen(7, pbLen(1, []byte("size")), pbLen(2, []byte("L")))),
+			`{"attrs":{"color":"red","size":"L"}}`, true},
+		{"bytes", pbLen(10, []byte{0xff, 0x00}), `{"data":"/wA="}`, true},
+		{"unknown field", pbVarint(99, 7), `{"99":{"number":99,"wireType":"varint","value":7}}`, true},
+		{"last value wins", slices.Concat(pbLen(1, []byte("old")), pbLen(1, []byte("new"))), `{"name":"new"}`, true},
+		{"broken packed run", pbLen(4, []byte{0x80}), "", false},
+		{"broken nested message", pbLen(6, []byte{0x0a, 0x05}), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := r.Decode("shop.Item", tt.msg)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Decode: %v, want ok %v", err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+			got, err := json.Marshal(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Decode = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := r.Decode("shop.Missing", nil); err == nil {
+		t.Error("Decode accepted an unknown type")
+	}
+}
+
+func TestProtoRegistryDecodeDepth(t *testing.T) {
+	r := testRegistry(t)
+	msg := pbLen(1, []byte("leaf"))
+	for range maxProtoDepth + 2 {
+		msg = pbLen(6, msg)
+	}
+	if _, err := r.Decode("shop.Item", msg); err == nil {
+		t.Error("Decode accepted a message nested too deeply")
+	}
+}
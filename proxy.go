@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// proxyExchanges numbers proxied exchanges so each gets its own pair key
+var proxyExchanges atomic.Int64
+
+// proxyExchange carries what's known about one proxied exchange from the
+// handler to the transport
+type proxyExchange struct {
+	target      *url.URL
+	pairKey     string
+	connection  string
+	servicePort int
+}
+
+type exchangeKey struct{}
+
+// ParseUpstream accepts host:port or a URL and returns the upstream base URL
+func ParseUpstream(upstream string) (*url.URL, error) {
+	if !strings.Contains(upstream, "://") {
+		upstream = "http://" + upstream
+	}
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if target.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	return target, nil
+}
+
+// upstreamPort returns the port requests are forwarded to
+func upstreamPort(target *url.URL) int {
+	if port, err := strconv.Atoi(target.Port()); err == nil {
+		return port
+	}
+	if target.Scheme == "https" {
+		return 443
+	}
+	return 80
+}
+
+// RunReverseProxy serves on listen, forwarding every request to target and
+// recording each exchange in the store. No packet capture is involved, so it
+// needs no special privileges.
+func RunReverseProxy(listen string, target *url.URL) error {
+	handler := newRecordingProxy(func(*http.Request) *url.URL { return target }, true)
+
+	fmt.Printf("Proxying %s to %s\n", listen, target)
+	return http.ListenAndServe(listen, handler)
+}
+
+// recordingProxy forwards each request to the upstream picked by route and
+// records the exchange in the store
+type recordingProxy struct {
+	route func(*http.Request) *url.URL
+	proxy *httputil.ReverseProxy
+}
+
+// newRecordingProxy creates a recordingProxy. With forwarded set, the usual
+// X-Forwarded-* headers are added, as a reverse proxy would.
+func newRecordingProxy(route func(*http.Request) *url.URL, forwarded bool) *recordingProxy {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Pass Content-Encoding through untouched, as the client would see it
+	transport.DisableCompression = true
+	// HTTP(S)_PROXY usually points at this proxy, so following it would loop
+	transport.Proxy = nil
+
+	p := &recordingProxy{route: route}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			exchange := r.In.Context().Value(exchangeKey{}).(*proxyExchange)
+			r.SetURL(exchange.target)
+			if forwarded {
+				r.SetXForwarded()
+			}
+			// Keep the Host the client asked for, as a tunnel's ingress would
+			r.Out.Host = r.In.Host
+		},
+		Transport: &recordingTransport{base: transport},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Proxy error for %s %s: %v\n", r.Method, r.URL, err)
+			if exchange, ok := r.Context().Value(exchangeKey{}).(*proxyExchange); ok {
+				now := time.Now()
+				resp := &http.Response{
+					Status:     "502 Bad Gateway",
+					StatusCode: http.StatusBadGateway,
+					Proto:      "HTTP/1.1",
+					ProtoMajor: 1,
+					ProtoMinor: 1,
+					Header:     http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+				}
+				exchange.recordResponse(resp, []byte(err.Error()), now, now)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	return p
+}
+
+// ServeHTTP implements http.Handler
+func (p *recordingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	target := p.route(r)
+	exchange := &proxyExchange{
+		target:      target,
+		pairKey:     fmt.Sprintf("proxy-%d", proxyExchanges.Add(1)),
+		connection:  fmt.Sprintf("%s → %s", r.RemoteAddr, target.Host),
+		servicePort: upstreamPort(target),
+	}
+
+	// A body is forwarded as it arrives, so the request shows up from its
+	// headers on and is recorded in full once it has all been sent
+	if r.ContentLength == 0 {
+		exchange.recordRequest(0, r, nil, false, start, start)
+	} else {
+		pairID := exchange.startRequest(r, start)
+		r.Body = newRecordingBody(r.Body, func(body []byte, truncated bool) {
+			exchange.recordRequest(pairID, r, body, truncated, start, time.Now())
+		})
+	}
+
+	p.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), exchangeKey{}, exchange)))
+}
+
+// fill sets where a packet was seen
+func (e *proxyExchange) fill(packet *CapturedPacket) {
+	packet.Connection = e.connection
+	packet.PairKey = e.pairKey
+	packet.ServicePort = e.servicePort
+}
+
+// startRequest stores a request whose body is still to come and returns its
+// pair's ID
+func (e *proxyExchange) startRequest(r *http.Request, start time.Time) int {
+	packet := newRequestPacket(r, nil, start, start)
+	packet.Streaming = true
+	e.fill(&packet)
+	return Store.Add(packet).ID
+}
+
+// recordRequest stores and prints a request. pairID is the request's pair if
+// startRequest stored it, otherwise 0.
+func (e *proxyExchange) recordRequest(pairID int, r *http.Request, body []byte, truncated bool, start, end time.Time) {
+	packet := newRequestPacket(r, body, start, end)
+	packet.Truncated = packet.Truncated || truncated
+	e.fill(&packet)
+	if pairID != 0 {
+		Store.UpdatePacket(pairID, packet)
+	} else {
+		Store.Add(packet)
+	}
+	printRequest(r, packet, e.connection)
+}
+
+// responsePacket builds the stored form of a response, without its body
+func (e *proxyExchange) responsePacket(resp *http.Response, start, end time.Time, _ int64) CapturedPacket {
+	packet := newResponsePacket(resp, nil, start, end)
+	e.fill(&packet)
+	return packet
+}
+
+// recordResponse stores and prints a response
+func (e *proxyExchange) recordResponse(resp *http.Response, body []byte, start, end time.Time) {
+	packet := newResponsePacket(resp, body, start, end)
+	e.fill(&packet)
+	pair := Store.Add(packet)
+	e.printResponse(resp, packet, pair.Timing)
+}
+
+func (e *proxyExchange) printResponse(resp *http.Response, packet CapturedPacket, timing PairTiming) {
+	printResponse(resp, packet, timing, strings.Replace(e.connection, "→", "←", 1))
+}
+
+// recordingTransport records responses as the proxy streams them to the client
+type recordingTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+
+	exchange, ok := req.Context().Value(exchangeKey{}).(*proxyExchange)
+	if !ok {
+		return resp, nil
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols || resp.Body == http.NoBody {
+		// There's no body to wait for. After an upgrade the body is the
+		// connection, which never ends like a body.
+		exchange.recordResponse(resp, nil, start, start)
+		return resp, nil
+	}
+
+	// The response shows up from its headers on and fills in as its body is
+	// streamed to the client, as a captured streaming response does
+	response, _ := newStreamingResponse(resp, nil, false, start, start, 0, exchange.responsePacket)
+	resp.Body = &streamingBody{
+		ReadCloser: resp.Body,
+		response:   response,
+		done: func(pair PacketPair) {
+			if pair.Response != nil {
+				exchange.printResponse(resp, *pair.Response, pair.Timing)
+			}
+		},
+	}
+	return resp, nil
+}
+
+// recordingBody passes a request body through while keeping a copy of its
+// first maxDecodedBodySize bytes, and reports the copy once, when the body
+// is exhausted or closed
+type recordingBody struct {
+	io.Reader // the body, teed into kept
+	body      io.Closer
+	kept      cappedBuffer
+	once      sync.Once
+	done      func(body []byte, truncated bool)
+}
+
+func newRecordingBody(body io.ReadCloser, done func(body []byte, truncated bool)) *recordingBody {
+	b := &recordingBody{body: body, kept: cappedBuffer{max: maxDecodedBodySize}, done: done}
+	b.Reader = io.TeeReader(body, &b.kept)
+	return b
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	b.finish()
+	return b.body.Close()
+}
+
+func (b *recordingBody) finish() {
+	b.once.Do(func() { b.done(b.kept.bytes()) })
+}
+
+// cappedBuffer keeps the first max bytes written to it and notes whether
+// there were more. Writes never fail, so a TeeReader into it reads the whole
+// body. The proxy may close a body while the transport is still reading it,
+// so it's safe for concurrent use.
+type cappedBuffer struct {
+	mu        sync.Mutex
+	buf       []byte
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	room := b.max - len(b.buf)
+	b.buf = append(b.buf, p[:min(len(p), room)]...)
+	b.truncated = b.truncated || len(p) > room
+	return len(p), nil
+}
+
+// bytes returns a copy of what was kept and whether anything was left out
+func (b *cappedBuffer) bytes() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf), b.truncated
+}
+
+// streamingBody passes a response body through to the client, adding each
+// part read to the recorded response and finishing it once, when the body is
+// exhausted or closed
+type streamingBody struct {
+	io.ReadCloser
+	response *streamingResponse
+	once     sync.Once
+	done     func(PacketPair)
+}
+
+func (b *streamingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.response.add(p[:n], time.Now())
+	}
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *streamingBody) Close() error {
+	b.finish()
+	return b.ReadCloser.Close()
+}
+
+func (b *streamingBody) finish() {
+	b.once.Do(func() {
+		b.done(b.response.finish(time.Now(), b.response.resp.Trailer))
+	})
+}
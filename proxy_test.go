@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyRecordsFromHeaders(t *testing.T) {
+	saved := Store
+	Store = NewPacketStore(100, 0)
+	t.Cleanup(func() { Store = saved })
+
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("first,"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second"))
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+	proxy := httptest.NewServer(newRecordingProxy(func(*http.Request) *url.URL { return target }, true))
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/upload", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The response is stored once its headers are through, before its body ends
+	pairs := Store.GetPairs()
+	if len(pairs) != 1 || pairs[0].Response == nil || !pairs[0].Response.Streaming {
+		t.Fatalf("got %d pairs before the body ended, want a streaming response", len(pairs))
+	}
+
+	close(release)
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "first,second" {
+		t.Errorf("client got %q", body)
+	}
+
+	// The proxy finishes recording just after the client has it all
+	var pair PacketPair
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		pair = Store.GetPairs()[0]
+		if !pair.Request.Streaming && !pair.Response.Streaming {
+			break
+		}
+	}
+	req, res := pair.Request, pair.Response
+	if req.Streaming || string(req.Body) != "hello" || req.Truncated {
+		t.Errorf("request: streaming %v, body %q, truncated %v", req.Streaming, req.Body, req.Truncated)
+	}
+	if res.Streaming || string(res.Body) != "first,second" || res.Truncated {
+		t.Errorf("response: streaming %v, body %q, truncated %v", res.Streaming, res.Body, res.Truncated)
+	}
+}
+
+func TestCappedBuffer(t *testing.T) {
+	b := &cappedBuffer{max: 8}
+	r := io.TeeReader(strings.NewReader("0123456789abcdef"), b)
+	read, err := io.ReadAll(r)
+	if err != nil || len(read) != 16 {
+		t.Fatalf("read %d bytes through the tee, err %v", len(read), err)
+	}
+	kept, truncated := b.bytes()
+	if !bytes.Equal(kept, []byte("01234567")) || !truncated {
+		t.Errorf("kept %q, truncated %v", kept, truncated)
+	}
+
+	b = &cappedBuffer{max: 8}
+	b.Write([]byte("0123"))
+	b.Write([]byte("4567"))
+	if kept, truncated := b.bytes(); string(kept) != "01234567" || truncated {
+		t.Errorf("kept %q, truncated %v, want all of it", kept, truncated)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Query selects pairs or packets for the API. It is built from the request's
+// query string:
+//
+//	q         filter expression (see Filter)
+//	port      port label or number (see PortSet.Lookup)
+//	from, to  time range, as RFC 3339 timestamps or durations ago ("15m")
+//	since_id  only entries with a larger ID, returned oldest first
+//	before_id only entries with a smaller ID
+//	limit     maximum number of entries
+type Query struct {
+	Filter   *Filter
+	Ports    PortSet
+	From     time.Time
+	To       time.Time
+	SinceID  int
+	BeforeID int
+	Limit    int
+}
+
+// parseQuery reads a Query from the request, using ports to resolve ?port=
+func parseQuery(r *http.Request, ports PortSet) (Query, error) {
+	var q Query
+	values := r.URL.Query()
+
+	if expr := values.Get("q"); expr != "" {
+		filter, err := ParseFilter(expr)
+		if err != nil {
+			return q, fmt.Errorf("invalid q: %w", err)
+		}
+		q.Filter = filter
+	}
+	if filter := values.Get("port"); filter != "" {
+		wanted, err := ports.Lookup(filter)
+		if err != nil {
+			return q, err
+		}
+		q.Ports = wanted
+	}
+
+	var err error
+	now := time.Now()
+	if q.From, err = parseQueryTime(values.Get("from"), now); err != nil {
+		return q, fmt.Errorf("invalid from: %w", err)
+	}
+	if q.To, err = parseQueryTime(values.Get("to"), now); err != nil {
+		return q, fmt.Errorf("invalid to: %w", err)
+	}
+	for name, dst := range map[string]*int{"since_id": &q.SinceID, "before_id": &q.BeforeID, "limit": &q.Limit} {
+		s := values.Get(name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("invalid %s %q", name, s)
+		}
+		*dst = n
+	}
+	return q, nil
+}
+
+// parseQueryTime accepts an RFC 3339 timestamp or a duration before now
+func parseQueryTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// MatchPair reports whether a pair passes the filter, port and time range
+func (q Query) MatchPair(p PacketPair) bool {
+	if q.Ports != nil {
+		if _, ok := q.Ports.Match(p.ServicePort()); !ok {
+			return false
+		}
+	}
+	return q.inRange(p.Timestamp) && (q.Filter == nil || q.Filter.MatchPair(p))
+}
+
+// MatchPacket reports whether a packet passes the filter, port and time range
+func (q Query) MatchPacket(p CapturedPacket) bool {
+	if q.Ports != nil {
+		if _, ok := q.Ports.Match(p.ServicePort); !ok {
+			return false
+		}
+	}
+	return q.inRange(p.Timestamp) && (q.Filter == nil || q.Filter.MatchPacket(p))
+}
+
+func (q Query) inRange(t time.Time) bool {
+	if !q.From.IsZero() && t.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && t.After(q.To) {
+		return false
+	}
+	return true
+}
+
+// Pairs applies the query to pairs listed newest first
+func (q Query) Pairs(pairs []PacketPair) []PacketPair {
+	return applyQuery(q, pairs, q.MatchPair, func(p PacketPair) int { return p.ID })
+}
+
+// Packets applies the query to packets listed newest first
+func (q Query) Packets(packets []CapturedPacket) []CapturedPacket {
+	return applyQuery(q, packets, q.MatchPacket, func(p CapturedPacket) int { return p.ID })
+}
+
+// applyQuery filters items (newest first) and pages through them. With
+// since_id the oldest matches come first, so a client can keep polling with
+// the last ID it saw without missing entries.
+func applyQuery[T any](q Query, items []T, match func(T) bool, id func(T) int) []T {
+	items = slices.DeleteFunc(items, func(item T) bool {
+		if q.SinceID > 0 && id(item) <= q.SinceID {
+			return true
+		}
+		if q.BeforeID > 0 && id(item) >= q.BeforeID {
+			return true
+		}
+		return !match(item)
+	})
+	if q.SinceID > 0 {
+		slices.Reverse(items)
+	}
+	if q.Limit > 0 && len(items) > q.Limit {
+		items = items[:q.Limit]
+	}
+	return items
+}
+
+// hint lets a storage backend skip data the query can't match
+func (q Query) hint() ScanHint {
+	return ScanHint{From: q.From, To: q.To, SinceID: q.SinceID, BeforeID: q.BeforeID}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// maxSnippet is how many of the offending bytes a parse error keeps
+const maxSnippet = 64
+
+// ParseError records bytes on a connection that couldn't be parsed as HTTP,
+// and how many were skipped to find the next message
+type ParseError struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Direction   string    `json:"direction"` // "request" or "response", the messages the stream carries
+	Offset      int64     `json:"offset"`    // of the first bad byte in this direction of the stream
+	Skipped     int64     `json:"skipped"`   // bytes skipped before the stream lined up again
+	Error       string    `json:"error"`
+	Snippet     string    `json:"snippet"` // hex of the first bad bytes
+	Connection  string    `json:"connection"`
+	PairKey     string    `json:"pairKey"`
+	ServicePort int       `json:"servicePort"`
+	Service     string    `json:"service,omitempty"`
+}
+
+var (
+	// startLinePattern matches a complete HTTP/1.x request or status line
+	startLinePattern = regexp.MustCompile(`^(?:(?:GET|POST|PUT|DELETE|PATCH|HEAD|OPTIONS|TRACE|CONNECT) [^\s]+ HTTP/\d\.\d|HTTP/\d\.\d \d{3}(?: [^\r\n]*)?)\r?\n$`)
+	// startLineCandidate finds where a start line might begin inside other data
+	startLineCandidate = regexp.MustCompile(`(?:GET|POST|PUT|DELETE|PATCH|HEAD|OPTIONS|TRACE|CONNECT) |HTTP/`)
+)
+
+// isStartLine reports whether line, including its newline, starts an HTTP/1.x message
+func isStartLine(line []byte) bool {
+	return startLinePattern.Match(line)
+}
+
+// nextStartLine returns the offset of the first start line in data, or -1
+// if there is none. A candidate cut off by the end of data counts, since the
+// rest of it may still be coming.
+func nextStartLine(data []byte) int {
+	for from := 0; from < len(data); {
+		loc := startLineCandidate.FindIndex(data[from:])
+		if loc == nil {
+			return -1
+		}
+		at := from + loc[0]
+		end := bytes.IndexByte(data[at:], '\n')
+		if end < 0 || isStartLine(data[at:at+end+1]) {
+			return at
+		}
+		from = at + 1
+	}
+	return -1
+}
+
+// headStartLine returns the offset of a start line that begins one of the
+// header lines of head after from, or -1. Headers interrupted like this
+// belong to a message that was cut short.
+func headStartLine(head []byte, from int) int {
+	for i := from; i < len(head); {
+		end := i + bytes.IndexByte(head[i:], '\n') + 1
+		if end <= i {
+			break
+		}
+		if isStartLine(head[i:end]) {
+			return i
+		}
+		i = end
+	}
+	return -1
+}
+
+// streamResync collects a run of unparseable bytes on one direction of a
+// stream, recording it as a single parse error once the stream lines up
+// with a message again
+type streamResync struct {
+	h       *httpStream
+	pending *ParseError
+}
+
+// fail starts a run of bad bytes at offset, unless one is already going
+func (r *streamResync) fail(offset int64, seen time.Time, err error, data []byte) {
+	if r.pending != nil {
+		return
+	}
+	h := r.h
+	e := &ParseError{
+		Timestamp:   seen,
+		Offset:      offset,
+		Error:       err.Error(),
+		Snippet:     hex.EncodeToString(data[:min(len(data), maxSnippet)]),
+		ServicePort: h.servicePort,
+		Service:     h.serviceLabel,
+	}
+	e.Connection, e.PairKey, e.Direction = h.endpoints()
+	r.pending = e
+}
+
+// skip counts n bytes as skipped by the current run
+func (r *streamResync) skip(n int) {
+	if r.pending != nil {
+		r.pending.Skipped += int64(n)
+	}
+}
+
+// done records the current run, if any, now that it's over
+func (r *streamResync) done() {
+	if r.pending == nil {
+		return
+	}
+	// The snippet was taken before it was known how much would be skipped
+	if skipped := int(min(r.pending.Skipped, maxSnippet)); skipped > 0 && 2*skipped < len(r.pending.Snippet) {
+		r.pending.Snippet = r.pending.Snippet[:2*skipped]
+	}
+	Store.RecordParseError(*r.pending)
+	printParseError(*r.pending)
+	r.pending = nil
+}
+
+// printParseError logs a parse error to the console
+func printParseError(e ParseError) {
+	timestamp := e.Timestamp.Format("2006-01-02 15:04:05")
+
+	fmt.Printf("┌─ PARSE ERROR [%s]\n", timestamp)
+	fmt.Printf("├─ Error: %s\n", e.Error)
+	fmt.Printf("├─ Direction: %s\n", e.Direction)
+	fmt.Printf("├─ Offset: %d\n", e.Offset)
+	fmt.Printf("├─ Skipped: %d bytes\n", e.Skipped)
+	fmt.Printf("├─ Bytes: %s\n", e.Snippet)
+	fmt.Printf("└─ Connection: %s\n", e.Connection)
+	fmt.Println()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestIsStartLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"GET / HTTP/1.1\r\n", true},
+		{"OPTIONS * HTTP/1.0\n", true},
+		{"HTTP/1.1 200 OK\r\n", true},
+		{"HTTP/1.1 204\r\n", true},
+		{"GET / HTTP/1.1", false}, // no newline yet
+		{"GET  / HTTP/1.1\r\n", false},
+		{"get / HTTP/1.1\r\n", false},
+		{"BREW /pot HTTP/1.1\r\n", false},
+		{"HTTP/1.1 20 OK\r\n", false},
+		{"HTTP/2 200\r\n", false},
+		{"Host: example.com\r\n", false},
+	}
+	for _, tt := range tests {
+		if got := isStartLine([]byte(tt.line)); got != tt.want {
+			t.Errorf("isStartLine(%q) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestNextStartLine(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want int
+	}{
+		{"none", "\x00\x01garbage\r\n", -1},
+		{"empty", "", -1},
+		{"at the start", "GET / HTTP/1.1\r\n", 0},
+		{"after garbage", "xx\r\nHTTP/1.1 200 OK\r\n", 4},
+		{"inside a line", "abcGET /a HTTP/1.1\r\n", 3},
+		{"false candidate first", "GET nothing\nPOST /b HTTP/1.1\n", 12},
+		{"candidates overlapping", "HTTP/HTTP/1.1 404 Not Found\r\n", 5},
+		// The rest of the line may still be coming
+		{"cut off", "junk\nHTTP/1.", 5},
+		{"only false candidates", "GET x\nHTTP/oops\n", -1},
+	}
+	for _, tt := range tests {
+		if got := nextStartLine([]byte(tt.data)); got != tt.want {
+			t.Errorf("%s: nextStartLine(%q) = %d, want %d", tt.name, tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestHeadStartLine(t *testing.T) {
+	head := "GET / HTTP/1.1\r\nHost: a\r\nHTTP/1.1 200 OK\r\n\r\n"
+	if got := headStartLine([]byte(head), len("GET / HTTP/1.1\r\n")); got != 25 {
+		t.Errorf("headStartLine = %d, want 25", got)
+	}
+	clean := "GET / HTTP/1.1\r\nHost: a\r\nX-Note: GET / HTTP/1.1\r\n\r\n"
+	if got := headStartLine([]byte(clean), len("GET / HTTP/1.1\r\n")); got != -1 {
+		t.Errorf("headStartLine found a start line in a header value at %d", got)
+	}
+}
+
+func TestReadHTTPResyncs(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		skipped []int64 // bytes skipped by each parse error
+		urls    []string
+	}{
+		{
+			name:    "garbage before a request",
+			data:    "\x16\x03junk\r\nmore junk\r\nGET /a HTTP/1.1\r\nHost: x\r\n\r\n",
+			skipped: []int64{19},
+			urls:    []string{"/a"},
+		},
+		{
+			name:    "garbage between requests",
+			data:    "GET /a HTTP/1.1\r\nHost: x\r\n\r\nnot http\r\nGET /b HTTP/1.1\r\nHost: x\r\n\r\n",
+			skipped: []int64{10},
+			urls:    []string{"/a", "/b"},
+		},
+		{
+			name:    "headers cut short by the next request",
+			data:    "GET /a HTTP/1.1\r\nHost: x\r\nGET /b HTTP/1.1\r\nHost: x\r\n\r\n",
+			skipped: []int64{26},
+			urls:    []string{"/b"},
+		},
+		{
+			name:    "stream ends inside a line",
+			data:    "GET /a HTTP/1.1\r\nHost: x\r\n\r\nGET /b",
+			skipped: []int64{6},
+			urls:    []string{"/a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := testStream(t, false)
+			h.requests = newRequestQueue()
+			tr, buf := testReader([]byte(tt.data), time.Now())
+			h.readHTTP(tr, buf)
+
+			var skipped []int64
+			var urls []string
+			pairs := Store.GetPairs()
+			for i := len(pairs) - 1; i >= 0; i-- {
+				if e := pairs[i].ParseError; e != nil {
+					skipped = append(skipped, e.Skipped)
+				} else if pairs[i].Request != nil {
+					urls = append(urls, pairs[i].Request.URL)
+				}
+			}
+			if !slices.Equal(skipped, tt.skipped) || !slices.Equal(urls, tt.urls) {
+				t.Errorf("skipped %v and logged %v, want %v and %v", skipped, urls, tt.skipped, tt.urls)
+			}
+		})
+	}
+}
@@ -4,7 +4,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"time"
 )
 
 const dashboardHTML = `<!DOCTYPE html>
@@ -44,12 +52,13 @@ const dashboardHTML = `<!DOCTYPE html>
             gap: 12px;
             align-items: center;
         }
-        .controls a {
+        .controls a, .controls .import {
             color: #888;
             text-decoration: none;
             font-size: 11px;
+            cursor: pointer;
         }
-        .controls a:hover { color: #ccc; }
+        .controls a:hover, .controls .import:hover { color: #ccc; }
         #search {
             background: #1a1a1a;
             border: 1px solid #444;
@@ -59,7 +68,17 @@ const dashboardHTML = `<!DOCTYPE html>
             font-size: 12px;
             width: 180px;
         }
-        #search:focus { outline: none; border-color: #666; }
+        #search:focus, #port-filter:focus { outline: none; border-color: #666; }
+        #search.invalid { border-color: #f87171; }
+        #search-error { color: #f87171; font-size: 11px; max-width: 320px; }
+        #port-filter {
+            background: #1a1a1a;
+            border: 1px solid #444;
+            padding: 5px 6px;
+            color: #ccc;
+            font-family: inherit;
+            font-size: 12px;
+        }
         #search::placeholder { color: #666; }
         .badge {
             background: #333;
@@ -96,6 +115,8 @@ const dashboardHTML = `<!DOCTYPE html>
         .method.PUT { color: #fa7; }
         .method.DELETE { color: #f77; }
         .method.PATCH { color: #c9f; }
+        .method.TLS { color: #5cc; }
+        .method.ERROR { color: #f77; }
         .status {
             font-size: 11px;
         }
@@ -110,11 +131,72 @@ const dashboardHTML = `<!DOCTYPE html>
             text-overflow: ellipsis;
             white-space: nowrap;
         }
+        .service {
+            font-size: 11px;
+            color: #888;
+            white-space: nowrap;
+        }
+        .duration {
+            font-size: 11px;
+            color: #888;
+            min-width: 60px;
+            text-align: right;
+            white-space: nowrap;
+        }
+        .inflight {
+            background: #202020;
+            border-bottom: 1px solid #333;
+            padding: 6px 16px;
+        }
+        .inflight-title { font-size: 11px; color: #fa7; padding-bottom: 4px; }
+        .inflight-row {
+            display: flex;
+            gap: 12px;
+            align-items: center;
+            padding: 2px 0;
+            cursor: pointer;
+        }
+        .inflight-row:hover { background: #2a2a2a; }
+        .inflight-row .url { flex: 1; }
+        .elapsed { font-size: 11px; color: #fa7; min-width: 60px; text-align: right; }
+
+        .streaming {
+            font-size: 11px;
+            color: #7af;
+            white-space: nowrap;
+        }
+        .incomplete {
+            font-size: 11px;
+            color: #fa7;
+            white-space: nowrap;
+        }
+
         .timestamp {
             font-size: 11px;
             color: #666;
+            min-width: 60px;
+            text-align: right;
             white-space: nowrap;
         }
+        .list-header {
+            display: flex;
+            justify-content: flex-end;
+            gap: 10px;
+            padding: 0 12px 6px;
+            font-size: 10px;
+            text-transform: uppercase;
+            letter-spacing: 0.5px;
+            color: #666;
+        }
+        .list-header .sort { min-width: 60px; text-align: right; cursor: pointer; }
+        .list-header .sort:hover, .list-header .sort.active { color: #ccc; }
+        .body-toggle { text-transform: none; letter-spacing: 0; font-weight: normal; margin-left: 6px; }
+        .body-toggle a { color: #666; cursor: pointer; }
+        .body-toggle a:hover, .body-toggle a.active { color: #ccc; }
+        .body-image { max-width: 100%; max-height: 400px; background: repeating-conic-gradient(#2a2a2a 0% 25%, #222 0% 50%) 50% / 16px 16px; }
+        .timing-row { display: flex; padding: 3px 0; }
+        .timing-name { color: #999; min-width: 160px; }
+        .timing-value { color: #ccc; }
         .packet-details {
             display: none;
             border-top: 1px solid #333;
@@ -176,25 +258,47 @@ const dashboardHTML = `<!DOCTYPE html>
         .tab-content { display: none; }
         .tab-content.active { display: block; }
         .pending { color: #666; font-style: italic; padding: 10px; }
+        .truncated { color: #fa7; }
+        .ws-message { border-bottom: 1px solid #2a2a2a; padding: 4px 0; }
+        .ws-meta { display: flex; gap: 12px; font-size: 11px; color: #999; padding-bottom: 2px; }
+        .ws-dir.client { color: #7af; }
+        .ws-dir.server { color: #7c7; }
+        .ws-error { color: #f77; }
+        .grpc-message { border-bottom: 1px solid #2a2a2a; padding: 4px 0; }
+        .grpc-meta { display: flex; gap: 12px; font-size: 11px; color: #999; padding-bottom: 2px; }
+        .grpc-error { color: #f77; }
+        .tabs .actions { margin-left: auto; padding: 6px 0; }
+        .tabs .actions a { color: #666; font-size: 11px; text-decoration: none; }
+        .tabs .actions a:hover { color: #ccc; }
     </style>
 </head>
 <body>
     <div class="header">
         <div>
             <h1>Local HTTP Inspector</h1>
-            <div class="info">Monitoring port {{.Port}} | Auto-refresh: 3s</div>
+            <div class="info">Monitoring port{{if gt (len .Ports) 1}}s{{end}} {{.Ports}} | <span id="live-status">Connecting...</span></div>
         </div>
         <div class="controls">
-            <input type="text" id="search" placeholder="Filter by URL path..." autocomplete="off">
+            {{if gt (len .Ports) 1}}
+            <select id="port-filter">
+                <option value="">All ports</option>
+                {{range .Ports}}<option value="{{if .Label}}{{.Label}}{{else}}{{.}}{{end}}">{{.}}</option>{{end}}
+            </select>
+            {{end}}
+            <input type="text" id="search" placeholder='Filter: /path or status >= 500 && method == "POST"' title="Plain text matches URLs; expressions use method, status, url, host, body, duration, header(&quot;Name&quot;), ==, !=, &lt;, &gt;, ~ (regex), &amp;&amp;, ||, !" autocomplete="off">
+            <span id="search-error"></span>
             <span class="badge">{{.Count}} requests</span>
-            <a href="/clear" onclick="return confirm('Clear all packets?')">Clear</a>
+            <a href="/api/export.har" onclick="return exportHAR(this)">Export HAR</a>
+            <label class="import">Import HAR<input type="file" id="har-import" accept=".har,application/json" hidden></label>
+            <a href="#" onclick="clearPackets(); return false">Clear</a>
         </div>
     </div>
+    <div id="inflight" class="inflight" hidden></div>
     <div class="container">
         {{if eq .Count 0}}
         <div class="empty">
             <h2>No packets captured yet</h2>
-            <p>Waiting for HTTP traffic on port {{.Port}}...</p>
+            <p>Waiting for HTTP traffic on port{{if gt (len .Ports) 1}}s{{end}} {{.Ports}}...</p>
         </div>
         {{else}}
         <div class="packet-list">
@@ -241,7 +345,7 @@ Connection: {{.Connection}}</div>
                     {{if .Body}}
                     <div class="detail-section">
                         <div class="detail-title">Body</div>
-                        <div class="detail-content">{{.Body}}</div>
+                        <div class="detail-content">{{.BodyPreview}}</div>
                     </div>
                     {{end}}
                 </div>
@@ -253,22 +357,163 @@ Connection: {{.Connection}}</div>
     <script>
         const expandedPairs = new Set();
         const activeTab = {};
-        let allPairs = [];
+        const bodyView = {};
+        const pairsById = new Map();
+        const pendingUpdates = new Set();
+        let updateScheduled = false;
+        let events = null;
+        let sortKey = 'time';
+        let sortDesc = true;
         const searchInput = document.getElementById('search');
+        const portFilter = document.getElementById('port-filter');
+        const multiPort = {{if gt (len .Ports) 1}}true{{else}}false{{end}};
 
-        searchInput.addEventListener('input', () => render(allPairs));
+        let searchTimer = null;
+        let activeFilter = '';
 
-        async function refresh() {
-            try {
-                const resp = await fetch('/api/pairs');
-                allPairs = await resp.json();
-                document.querySelector('.badge').textContent = allPairs.length + ' requests';
-                render(allPairs);
-            } catch (e) {
-                console.error('Refresh failed:', e);
+        searchInput.addEventListener('input', () => {
+            clearTimeout(searchTimer);
+            searchTimer = setTimeout(applySearch, 300);
+        });
+        if (portFilter) portFilter.addEventListener('change', connect);
+        document.getElementById('har-import').addEventListener('change', importHAR);
+
+        // Plain text searches URLs; anything that looks like an expression goes to the server as-is
+        function searchFilter() {
+            const text = searchInput.value.trim();
+            if (!text || /[=<>~!&|()"']/.test(text)) return text;
+            return '"' + text.replace(/["\\]/g, '\\$&') + '"';
+        }
+
+        // applySearch checks the filter with the server before reconnecting with it
+        async function applySearch() {
+            const filter = searchFilter();
+            const errorEl = document.getElementById('search-error');
+            if (filter) {
+                const res = await fetch('/api/pairs?limit=1&q=' + encodeURIComponent(filter));
+                if (!res.ok) {
+                    errorEl.textContent = (await res.text()).trim();
+                    searchInput.classList.add('invalid');
+                    return;
+                }
+            }
+            errorEl.textContent = '';
+            searchInput.classList.remove('invalid');
+            if (filter !== activeFilter) {
+                activeFilter = filter;
+                connect();
+            }
+        }
+
+        // exportHAR downloads what's currently listed, using the same filters
+        function exportHAR(link) {
+            const params = new URLSearchParams();
+            if (portFilter && portFilter.value) params.set('port', portFilter.value);
+            if (activeFilter) params.set('q', activeFilter);
+            link.href = '/api/export.har' + (params.toString() ? '?' + params : '');
+            return true;
+        }
+
+        // Imported entries arrive through the event stream like captured ones
+        async function importHAR(e) {
+            const file = e.target.files[0];
+            if (!file) return;
+            const res = await fetch('/api/import.har', {method: 'POST', headers: {'Content-Type': 'application/json'}, body: file});
+            if (!res.ok) alert('Import failed: ' + (await res.text()).trim());
+            e.target.value = '';
+        }
+
+        // Open dashboards empty themselves on the clear event that follows
+        async function clearPackets() {
+            if (!confirm('Clear all packets?')) return;
+            const res = await fetch('/clear', {method: 'POST'});
+            if (!res.ok) alert('Clear failed: ' + (await res.text()).trim());
+        }
+
+        // The server sends a snapshot on every (re)connect, then each change as it happens
+        function connect() {
+            if (events) events.close();
+            const params = new URLSearchParams();
+            if (portFilter && portFilter.value) params.set('port', portFilter.value);
+            if (activeFilter) params.set('q', activeFilter);
+            events = new EventSource('/api/events' + (params.toString() ? '?' + params : ''));
+            events.onopen = () => setLiveStatus('Live');
+            events.onerror = () => setLiveStatus('Reconnecting...');
+            events.addEventListener('snapshot', e => {
+                pairsById.clear();
+                JSON.parse(e.data).forEach(pair => pairsById.set(pair.id, pair));
+                renderAll();
+            });
+            events.addEventListener('pair', e => {
+                const pair = JSON.parse(e.data);
+                pairsById.set(pair.id, pair);
+                scheduleUpdate(pair.id);
+            });
+            events.addEventListener('evict', e => {
+                JSON.parse(e.data).forEach(id => {
+                    pairsById.delete(id);
+                    scheduleUpdate(id);
+                });
+            });
+            events.addEventListener('clear', () => {
+                pairsById.clear();
+                renderAll();
+            });
+        }
+
+        function setLiveStatus(text) {
+            document.getElementById('live-status').textContent = text;
+        }
+
+        function updateBadge() {
+            document.querySelector('.badge').textContent = pairsById.size + ' requests';
+        }
+
+        function scheduleUpdate(id) {
+            pendingUpdates.add(id);
+            if (!updateScheduled) {
+                updateScheduled = true;
+                requestAnimationFrame(flushUpdates);
             }
         }
 
+        // flushUpdates patches only the changed rows instead of re-rendering the list
+        function flushUpdates() {
+            updateScheduled = false;
+            const ids = Array.from(pendingUpdates);
+            pendingUpdates.clear();
+
+            const list = document.querySelector('.packet-list');
+            if (!list || sortKey !== 'time' || !sortDesc) {
+                renderAll();
+                return;
+            }
+
+            ids.forEach(id => {
+                const existing = list.querySelector('.packet[data-id="' + id + '"]');
+                const pair = pairsById.get(id);
+                if (!pair) {
+                    if (existing) existing.remove();
+                    return;
+                }
+                const tmp = document.createElement('div');
+                tmp.innerHTML = renderPair(pair);
+                const el = tmp.firstElementChild;
+                if (existing) {
+                    existing.replaceWith(el);
+                    return;
+                }
+                const next = Array.from(list.children).find(c => Number(c.dataset.id) < id);
+                list.insertBefore(el, next || null);
+            });
+
+            if (list.children.length === 0) {
+                renderAll();
+                return;
+            }
+            updateBadge();
+        }
+
         function togglePair(el, event) {
             if (event.target.closest('.packet-details') || event.target.closest('.tab')) return;
             const id = el.dataset.id;
@@ -283,7 +528,38 @@ Connection: {{.Connection}}</div>
         function switchTab(pairId, tab, event) {
             event.stopPropagation();
             activeTab[pairId] = tab;
-            render(allPairs);
+            scheduleUpdate(Number(pairId));
+        }
+
+        function setSort(key) {
+            if (sortKey === key) {
+                sortDesc = !sortDesc;
+            } else {
+                sortKey = key;
+                sortDesc = true;
+            }
+            renderAll();
+        }
+
+        function formatMs(ms) {
+            if (!ms) return '-';
+            if (ms >= 1000) return (ms / 1000).toFixed(2) + 's';
+            if (ms >= 10) return Math.round(ms) + 'ms';
+            return ms.toFixed(1) + 'ms';
+        }
+
+        function renderTiming(t) {
+            if (!t || !t.requestStart) return '<div class="pending">Waiting for request...</div>';
+            const rows = [
+                ['Request sent', formatMs(t.uploadMs)],
+                ['Waiting (TTFB)', t.responseStart ? formatMs(t.ttfbMs) : 'pending'],
+                ['Content download', t.responseStart ? formatMs(t.downloadMs) : 'pending'],
+                ['Total', t.responseEnd ? formatMs(t.totalMs) : 'pending'],
+                ['Started at', new Date(t.requestStart).toISOString()],
+            ];
+            return '<div class="detail-section"><div class="detail-title">Timing</div><div class="headers-list">' +
+                rows.map(([k, v]) => '<div class="timing-row"><span class="timing-name">' + k + '</span><span class="timing-value">' + escapeHtml(v) + '</span></div>').join('') +
+                '</div></div>';
         }
 
         function escapeHtml(str) {
@@ -297,29 +573,148 @@ Connection: {{.Connection}}</div>
             ).join('');
         }
 
-        function renderPacketContent(p, type) {
+        function switchBodyView(key, field, value, event) {
+            event.stopPropagation();
+            bodyView[key] = Object.assign({}, bodyView[key], {[field]: value});
+            scheduleUpdate(Number(key.split('-')[0]));
+        }
+
+        function bodyBytes(data, encoding) {
+            if (encoding !== 'base64') return new TextEncoder().encode(data || '');
+            const bin = atob(data);
+            const out = new Uint8Array(bin.length);
+            for (let i = 0; i < bin.length; i++) out[i] = bin.charCodeAt(i);
+            return out;
+        }
+
+        function hexDump(bytes) {
+            const limit = Math.min(bytes.length, 65536);
+            const lines = [];
+            for (let off = 0; off < limit; off += 16) {
+                const chunk = bytes.subarray(off, Math.min(off + 16, limit));
+                let hex = '', ascii = '';
+                for (let i = 0; i < 16; i++) {
+                    if (i < chunk.length) {
+                        hex += chunk[i].toString(16).padStart(2, '0') + ' ';
+                        ascii += chunk[i] >= 32 && chunk[i] < 127 ? String.fromCharCode(chunk[i]) : '.';
+                    } else {
+                        hex += '   ';
+                    }
+                    if (i === 7) hex += ' ';
+                }
+                lines.push(off.toString(16).padStart(8, '0') + '  ' + hex + ' ' + ascii);
+            }
+            if (bytes.length > limit) lines.push('... ' + (bytes.length - limit) + ' more bytes');
+            return lines.join('\n');
+        }
+
+        function viewLink(key, field, value, label, current) {
+            return '<a class="' + (current === value ? 'active' : '') + '" onclick="switchBodyView(\'' + key + '\', \'' + field + '\', \'' + value + '\', event)">' + label + '</a>';
+        }
+
+        function renderBody(p, key) {
+            if (!p.body && !p.rawBody) return '';
+            const state = bodyView[key] || {};
+            const source = p.rawBody ? (state.source || 'decoded') : 'decoded';
+            const data = source === 'raw' ? p.rawBody : p.body;
+            const encoding = source === 'raw' ? p.rawBodyEncoding : p.bodyEncoding;
+            const isText = encoding === 'text';
+            const isImage = source === 'decoded' && (p.mimeType || '').startsWith('image/');
+            const formats = [];
+            if (isText) formats.push('text');
+            formats.push('hex');
+            if (isImage) formats.push('image');
+            const format = formats.includes(state.format) ? state.format : formats[0] === 'text' ? 'text' : isImage ? 'image' : 'hex';
+
+            let title = 'Body (' + p.bodySize + ' bytes';
+            if (p.mimeType) title += ', ' + escapeHtml(p.mimeType);
+            if (p.rawBody) title += ', ' + p.wireSize + ' on the wire, ' + escapeHtml(p.contentEncoding);
+            title += ')';
+
+            let toggle = ' <span class="body-toggle">';
+            if (p.rawBody) {
+                toggle += viewLink(key, 'source', 'decoded', 'decoded', source) + ' | ' + viewLink(key, 'source', 'raw', 'raw', source) + ' &middot; ';
+            }
+            toggle += formats.map(f => viewLink(key, 'format', f, f, format)).join(' | ');
+            toggle += ' &middot; <a href="/api/packets/' + p.id + '/body' + (source === 'raw' ? '?raw=1' : '') + '" target="_blank">open</a></span>';
+
+            let content;
+            if (format === 'image') {
+                content = '<div class="detail-content"><img class="body-image" src="/api/packets/' + p.id + '/body"></div>';
+            } else if (format === 'hex') {
+                content = '<div class="detail-content">' + escapeHtml(hexDump(bodyBytes(data, encoding))) + '</div>';
+            } else {
+                content = '<div class="detail-content">' + escapeHtml(data) + '</div>';
+            }
+
+            const note = p.decodeError ? '<div class="detail-content">Could not decode ' + escapeHtml(p.contentEncoding) + ' body: ' + escapeHtml(p.decodeError) + '</div>' : '';
+            return '<div class="detail-section"><div class="detail-title">' + title + toggle + '</div>' + note + content + '</div>';
+        }
+
+        function renderProtoFields(fields, indent) {
+            return fields.map(f => {
+                let line = indent + f.number + ' (' + f.wireType + ')';
+                if (f.message) return line + ' {\n' + renderProtoFields(f.message, indent + '  ') + indent + '}\n';
+                if (f.bytes) return line + ': ' + Array.from(bodyBytes(f.bytes, 'base64'), b => b.toString(16).padStart(2, '0')).join(' ') + '\n';
+                return line + ': ' + JSON.stringify(f.value === undefined ? '' : f.value) + '\n';
+            }).join('');
+        }
+
+        function renderGRPC(g) {
+            let title = 'gRPC Messages (' + g.messages.length + ')';
+            if (g.messageType) title += ' · ' + escapeHtml(g.messageType);
+            let html = '<div class="detail-section"><div class="detail-title">' + title + '</div>';
+            if (g.error) html += '<div class="detail-content">' + escapeHtml(g.error) + '</div>';
+            html += g.messages.map((m, i) => {
+                let content = '';
+                if (m.decoded) content = JSON.stringify(m.decoded, null, 2);
+                else if (m.fields) content = renderProtoFields(m.fields, '');
+                return '<div class="grpc-message"><div class="grpc-meta"><span>#' + (i + 1) + '</span><span>' + m.size + 'B' + (m.compressed ? ', compressed' : '') + '</span>' +
+                    (m.error ? '<span class="grpc-error">' + escapeHtml(m.error) + '</span>' : '') + '</div>' +
+                    (content ? '<div class="detail-content">' + escapeHtml(content) + '</div>' : '') + '</div>';
+            }).join('');
+            return html + '</div>';
+        }
+
+        function renderPacketContent(p, type, id) {
             if (!p) return '<div class="pending">Waiting for ' + type + '...</div>';
 
             const headersHtml = renderHeaders(p.headers);
+            const incompleteHtml = p.incomplete ? '<div class="detail-section"><div class="detail-content incomplete">⚠ Incomplete: the capture missed ' + p.missingBytes + ' bytes of this ' + type + ', so its body isn\'t what was sent</div></div>' : '';
+            const truncatedHtml = p.truncated ? '<div class="detail-section"><div class="detail-content truncated">⚠ Truncated: only the first ' + p.bodySize + ' bytes of this ' + type + '\'s body were kept</div></div>' : '';
+            const grpcHtml = p.grpc ? renderGRPC(p.grpc) : '';
+            const trailersHtml = p.trailers ? '<div class="detail-section"><div class="detail-title">Trailers</div><div class="headers-list">' + renderHeaders(p.trailers) + '</div></div>' : '';
             if (type === 'request') {
-                return '<div class="detail-section"><div class="detail-title">Request Info</div>' +
-                    '<div class="detail-content">' + p.method + ' ' + escapeHtml(p.url) + ' ' + p.protocol + '\nHost: ' + escapeHtml(p.host) + '\nConnection: ' + escapeHtml(p.connection) + '</div></div>' +
+                return incompleteHtml + truncatedHtml + '<div class="detail-section"><div class="detail-title">Request Info</div>' +
+                    '<div class="detail-content">' + escapeHtml(p.method) + ' ' + escapeHtml(p.url) + ' ' + escapeHtml(p.protocol) + '\nHost: ' + escapeHtml(p.host) + '\nConnection: ' + escapeHtml(p.connection) + '</div></div>' +
                     '<div class="detail-section"><div class="detail-title">Headers</div><div class="headers-list">' + headersHtml + '</div></div>' +
-                    (p.body ? '<div class="detail-section"><div class="detail-title">Body (' + p.bodySize + ' bytes)</div><div class="detail-content">' + escapeHtml(p.body) + '</div></div>' : '');
+                    renderBody(p, id + '-request') + grpcHtml + trailersHtml;
             } else {
-                return '<div class="detail-section"><div class="detail-title">Response Info</div>' +
-                    '<div class="detail-content">' + p.protocol + ' ' + escapeHtml(p.status) + '\nConnection: ' + escapeHtml(p.connection) + '</div></div>' +
+                return incompleteHtml + truncatedHtml + '<div class="detail-section"><div class="detail-title">Response Info</div>' +
+                    '<div class="detail-content">' + escapeHtml(p.protocol) + ' ' + escapeHtml(p.status) +
+                    (p.grpc && p.grpc.status ? '\ngRPC Status: ' + escapeHtml(p.grpc.status + ' ' + (p.grpc.statusMessage || '')) : '') +
+                    '\nConnection: ' + escapeHtml(p.connection) + '</div></div>' +
                     '<div class="detail-section"><div class="detail-title">Headers</div><div class="headers-list">' + headersHtml + '</div></div>' +
-                    (p.body ? '<div class="detail-section"><div class="detail-title">Body (' + p.bodySize + ' bytes)</div><div class="detail-content">' + escapeHtml(p.body) + '</div></div>' : '');
+                    renderBody(p, id + '-response') + grpcHtml + trailersHtml;
             }
         }
 
-        function render(pairs) {
-            const query = searchInput.value.toLowerCase().trim();
-            const filtered = pairs.filter(pair => {
-                if (!query) return true;
-                return pair.request && pair.request.url && pair.request.url.toLowerCase().includes(query);
-            });
+        function renderInterim(interim) {
+            if (interim.length === 0) return '';
+            return '<div class="detail-section"><div class="detail-title">Interim Responses</div>' +
+                interim.map(r => {
+                    const time = new Date(r.timestamp);
+                    const stamp = time.toLocaleTimeString('en-GB', {hour12: false}) + '.' + String(time.getMilliseconds()).padStart(3, '0');
+                    return '<div class="detail-content">' + escapeHtml(r.protocol + ' ' + r.status) + ' at ' + stamp + '</div>' +
+                        (r.headers ? '<div class="headers-list">' + renderHeaders(r.headers) + '</div>' : '');
+                }).join('') +
+                '</div>';
+        }
+
+        function renderAll() {
+            updateBadge();
+            const query = activeFilter;
+            const filtered = Array.from(pairsById.values());
 
             const container = document.querySelector('.container');
             if (filtered.length === 0) {
@@ -327,41 +722,256 @@ Connection: {{.Connection}}</div>
                 return;
             }
 
-            const html = '<div class="packet-list">' + filtered.map(pair => {
-                const id = String(pair.id);
-                const isExpanded = expandedPairs.has(id);
-                const currentTab = activeTab[id] || 'request';
-                const req = pair.request;
-                const res = pair.response;
-                const time = new Date(pair.timestamp).toLocaleTimeString('en-GB', {hour12: false});
-
-                const method = req ? req.method : '???';
-                const url = req ? req.url : '(pending)';
-                const statusCode = res ? res.statusCode : 0;
-                const statusClass = statusCode >= 500 ? 's5xx' : statusCode >= 400 ? 's4xx' : statusCode >= 300 ? 's3xx' : statusCode >= 200 ? 's2xx' : '';
-                const statusText = res ? res.status : 'pending';
-
-                return '<div class="packet' + (isExpanded ? ' expanded' : '') + '" data-id="' + id + '" onclick="togglePair(this, event)">' +
-                    '<div class="packet-header">' +
-                    '<span class="method ' + method + '">' + method + '</span>' +
-                    '<span class="url">' + escapeHtml(url) + '</span>' +
-                    (res ? '<span class="status ' + statusClass + '">' + escapeHtml(statusText) + '</span>' : '<span class="status" style="color:#64748b">pending</span>') +
-                    '<span class="timestamp">' + time + '</span>' +
-                    '</div>' +
-                    '<div class="packet-details">' +
-                    '<div class="tabs">' +
-                    '<div class="tab' + (currentTab === 'request' ? ' active' : '') + (req ? '' : ' disabled') + '" onclick="switchTab(\'' + id + '\', \'request\', event)">Request' + (req ? ' (' + req.bodySize + 'B)' : '') + '</div>' +
-                    '<div class="tab' + (currentTab === 'response' ? ' active' : '') + (res ? '' : ' disabled') + '" onclick="switchTab(\'' + id + '\', \'response\', event)">Response' + (res ? ' (' + res.bodySize + 'B)' : '') + '</div>' +
-                    '</div>' +
-                    '<div class="tab-content' + (currentTab === 'request' ? ' active' : '') + '">' + renderPacketContent(req, 'request') + '</div>' +
-                    '<div class="tab-content' + (currentTab === 'response' ? ' active' : '') + '">' + renderPacketContent(res, 'response') + '</div>' +
-                    '</div></div>';
-            }).join('') + '</div>';
+            const sorted = filtered.slice().sort((a, b) => {
+                const diff = sortKey === 'duration' ? (a.timing.totalMs || 0) - (b.timing.totalMs || 0) : a.id - b.id;
+                return sortDesc ? -diff : diff;
+            });
+            const arrow = sortDesc ? ' ▾' : ' ▴';
+
+            const html = '<div class="list-header">' +
+                '<span class="sort' + (sortKey === 'duration' ? ' active' : '') + '" onclick="setSort(\'duration\')">Duration' + (sortKey === 'duration' ? arrow : '') + '</span>' +
+                '<span class="sort' + (sortKey === 'time' ? ' active' : '') + '" onclick="setSort(\'time\')">Time' + (sortKey === 'time' ? arrow : '') + '</span>' +
+                '</div>' +
+                '<div class="packet-list">' + sorted.map(renderPair).join('') + '</div>';
 
             container.innerHTML = html;
         }
 
-        setInterval(refresh, 3000);
+        function renderMessages(ws) {
+            if (!ws || ws.messages.length === 0) return '<div class="pending">No messages yet...</div>';
+            let html = '<div class="detail-section"><div class="detail-title">Messages (' + ws.messages.length +
+                (ws.dropped ? ', ' + ws.dropped + ' older dropped' : '') + (ws.closed ? ', closed' : '') + ')</div>';
+            // Each direction is decoded separately, so put them back in capture order
+            const messages = ws.messages.slice().sort((a, b) => new Date(a.timestamp) - new Date(b.timestamp));
+            html += messages.map(m => {
+                const time = new Date(m.timestamp);
+                const stamp = time.toLocaleTimeString('en-GB', {hour12: false}) + '.' + String(time.getMilliseconds()).padStart(3, '0');
+                let details = m.size + 'B';
+                if (m.compressed) details += ', compressed';
+                if (m.truncated) details += ', truncated';
+                if (m.closeCode) details += ', code ' + m.closeCode;
+                let content = '';
+                if (m.data) {
+                    content = '<div class="detail-content">' + escapeHtml(m.dataEncoding === 'text' ? m.data : hexDump(bodyBytes(m.data, m.dataEncoding))) + '</div>';
+                }
+                return '<div class="ws-message"><div class="ws-meta">' +
+                    '<span class="ws-dir ' + (m.fromClient ? 'client">↑ client' : 'server">↓ server') + '</span>' +
+                    '<span>' + escapeHtml(m.type) + '</span><span>' + details + '</span><span>' + stamp + '</span>' +
+                    (m.error ? '<span class="ws-error">' + escapeHtml(m.error) + '</span>' : '') +
+                    '</div>' + content + '</div>';
+            }).join('');
+            return html + '</div>';
+        }
+
+        function renderEvents(res) {
+            const log = res.events;
+            if (!log || log.events.length === 0) return '<div class="pending">' + (res.streaming ? 'No events yet...' : 'No events') + '</div>';
+            let html = '<div class="detail-section"><div class="detail-title">Events (' + log.events.length +
+                (log.dropped ? ', ' + log.dropped + ' older dropped' : '') + (res.streaming ? ', streaming' : '') + ')</div>';
+            html += log.events.map(e => {
+                const time = new Date(e.timestamp);
+                const stamp = time.toLocaleTimeString('en-GB', {hour12: false}) + '.' + String(time.getMilliseconds()).padStart(3, '0');
+                let details = escapeHtml(e.event || 'message');
+                if (e.id) details += ' · id ' + escapeHtml(e.id);
+                if (e.retry) details += ' · retry ' + e.retry + 'ms';
+                if (e.truncated) details += ' · truncated';
+                return '<div class="ws-message"><div class="ws-meta"><span>' + details + '</span><span>' + stamp + '</span></div>' +
+                    '<div class="detail-content">' + escapeHtml(e.data) + '</div></div>';
+            }).join('');
+            return html + '</div>';
+        }
+
+        function formatBytes(n) {
+            if (n >= 1048576) return (n / 1048576).toFixed(1) + ' MB';
+            if (n >= 1024) return (n / 1024).toFixed(1) + ' KB';
+            return n + ' B';
+        }
+
+        function renderTLSPair(pair) {
+            const id = String(pair.id);
+            const isExpanded = expandedPairs.has(id);
+            const tls = pair.tls;
+            const time = new Date(pair.timestamp).toLocaleTimeString('en-GB', {hour12: false});
+            const service = tls.service || tls.servicePort;
+            const status = tls.alert || tls.version || 'handshake';
+            const alpn = (tls.alpn || []).join(', ') + (tls.negotiatedAlpn ? ' (negotiated ' + tls.negotiatedAlpn + ')' : '');
+
+            const rows = [
+                ['Server name', tls.serverName || '-'],
+                ['Version', tls.version || '-'],
+                ['Cipher suite', tls.cipherSuite || '-'],
+                ['ALPN', alpn || '-'],
+                ['JA3', tls.ja3 || '-'],
+                ['JA4', tls.ja4 || '-'],
+                ['Alert', tls.alert || '-'],
+                ['Client bytes', formatBytes(tls.clientBytes)],
+                ['Server bytes', formatBytes(tls.serverBytes)],
+                ['Duration', tls.closed ? formatMs(tls.durationMs) : formatMs(tls.durationMs) + ' (open)'],
+                ['Decrypted', tls.decrypted ? 'yes' : 'no'],
+                ['Connection', tls.connection],
+                ['Started at', new Date(tls.startTime).toISOString()],
+            ];
+
+            return '<div class="packet' + (isExpanded ? ' expanded' : '') + '" data-id="' + id + '" onclick="togglePair(this, event)">' +
+                '<div class="packet-header">' +
+                '<span class="method TLS">TLS</span>' +
+                '<span class="url">' + escapeHtml(tls.serverName || tls.connection) + '</span>' +
+                '<span class="status ' + (tls.alert ? 's5xx' : 's2xx') + '">' + escapeHtml(status) + '</span>' +
+                (multiPort && service ? '<span class="service">' + escapeHtml(service) + '</span>' : '') +
+                '<span class="duration">' + formatMs(tls.durationMs) + '</span>' +
+                '<span class="timestamp">' + time + '</span>' +
+                '</div>' +
+                '<div class="packet-details">' +
+                '<div class="tabs">' +
+                '<div class="tab active">Connection</div>' +
+                '<div class="actions"><a href="/api/pairs/' + id + '/pcap">Download pcap</a></div>' +
+                '</div>' +
+                '<div class="tab-content active"><div class="detail-section"><div class="detail-title">TLS Connection</div><div class="headers-list">' +
+                rows.map(([k, v]) => '<div class="timing-row"><span class="timing-name">' + k + '</span><span class="timing-value">' + escapeHtml(v) + '</span></div>').join('') +
+                '</div></div></div>' +
+                '</div></div>';
+        }
+
+        function renderParseErrorPair(pair) {
+            const id = String(pair.id);
+            const isExpanded = expandedPairs.has(id);
+            const e = pair.parseError;
+            const time = new Date(pair.timestamp).toLocaleTimeString('en-GB', {hour12: false});
+            const service = e.service || e.servicePort;
+            const snippet = new Uint8Array((e.snippet.match(/../g) || []).map(b => parseInt(b, 16)));
+
+            const rows = [
+                ['Error', e.error],
+                ['Direction', e.direction],
+                ['Offset', String(e.offset)],
+                ['Skipped', formatBytes(e.skipped)],
+                ['Connection', e.connection],
+                ['Seen at', new Date(e.timestamp).toISOString()],
+            ];
+
+            return '<div class="packet' + (isExpanded ? ' expanded' : '') + '" data-id="' + id + '" onclick="togglePair(this, event)">' +
+                '<div class="packet-header">' +
+                '<span class="method ERROR">ERROR</span>' +
+                '<span class="url">' + escapeHtml(e.error) + '</span>' +
+                '<span class="status s5xx">skipped ' + formatBytes(e.skipped) + '</span>' +
+                (multiPort && service ? '<span class="service">' + escapeHtml(service) + '</span>' : '') +
+                '<span class="timestamp">' + time + '</span>' +
+                '</div>' +
+                '<div class="packet-details">' +
+                '<div class="tabs">' +
+                '<div class="tab active">Parse Error</div>' +
+                '<div class="actions"><a href="/api/pairs/' + id + '/pcap">Download pcap</a></div>' +
+                '</div>' +
+                '<div class="tab-content active"><div class="detail-section"><div class="detail-title">Unparseable ' + escapeHtml(e.direction) + ' bytes</div><div class="headers-list">' +
+                rows.map(([k, v]) => '<div class="timing-row"><span class="timing-name">' + k + '</span><span class="timing-value">' + escapeHtml(v) + '</span></div>').join('') +
+                '</div></div>' +
+                '<div class="detail-section"><div class="detail-title">First bytes</div><div class="detail-content">' + escapeHtml(hexDump(snippet)) + '</div></div></div>' +
+                '</div></div>';
+        }
+
+        function renderPair(pair) {
+            if (pair.tls) return renderTLSPair(pair);
+            if (pair.parseError) return renderParseErrorPair(pair);
+            const id = String(pair.id);
+            const isExpanded = expandedPairs.has(id);
+            const currentTab = activeTab[id] || 'request';
+            const req = pair.request;
+            const res = pair.response;
+            const ws = pair.websocket;
+            const sse = res && (res.events || /^text\/event-stream/i.test(res.contentType || ''));
+            const time = new Date(pair.timestamp).toLocaleTimeString('en-GB', {hour12: false});
+
+            const method = req ? req.method : '???';
+            const url = req ? req.url : '(pending)';
+            const statusCode = res ? res.statusCode : 0;
+            let statusClass = statusCode >= 500 ? 's5xx' : statusCode >= 400 ? 's4xx' : statusCode >= 300 ? 's3xx' : statusCode >= 200 ? 's2xx' : '';
+            let statusText = res ? res.status : 'pending';
+            // A gRPC call's outcome is in its trailers, not the HTTP status
+            if (res && res.grpc && res.grpc.status) {
+                statusText = 'gRPC ' + res.grpc.status;
+                statusClass = res.grpc.status === 'OK' ? 's2xx' : 's5xx';
+            }
+            const pkt = req || res;
+            const service = pkt ? (pkt.service || pkt.servicePort) : '';
+            const missing = (req && req.missingBytes || 0) + (res && res.missingBytes || 0);
+            const interim = pair.interim || [];
+
+            return '<div class="packet' + (isExpanded ? ' expanded' : '') + '" data-id="' + id + '" onclick="togglePair(this, event)">' +
+                '<div class="packet-header">' +
+                '<span class="method ' + escapeHtml(method) + '">' + escapeHtml(method) + '</span>' +
+                '<span class="url">' + escapeHtml(url) + '</span>' +
+                (res ? '<span class="status ' + statusClass + '">' + escapeHtml(statusText) + '</span>' : '<span class="status" style="color:#64748b">' + (interim.length ? escapeHtml(interim[interim.length - 1].status) : 'pending') + '</span>') +
+                (multiPort && service ? '<span class="service">' + escapeHtml(service) + '</span>' : '') +
+                (res && res.streaming ? '<span class="streaming">● streaming</span>' : '') +
+                (missing ? '<span class="incomplete" title="The capture missed ' + missing + ' bytes of this exchange">⚠ ' + formatBytes(missing) + ' missing</span>' : '') +
+                '<span class="duration">' + (req && res ? formatMs(pair.timing.totalMs) : '-') + '</span>' +
+                '<span class="timestamp">' + time + '</span>' +
+                '</div>' +
+                '<div class="packet-details">' +
+                '<div class="tabs">' +
+                '<div class="tab' + (currentTab === 'request' ? ' active' : '') + (req ? '' : ' disabled') + '" onclick="switchTab(\'' + id + '\', \'request\', event)">Request' + (req ? ' (' + req.bodySize + 'B)' : '') + '</div>' +
+                '<div class="tab' + (currentTab === 'response' ? ' active' : '') + (res || interim.length ? '' : ' disabled') + '" onclick="switchTab(\'' + id + '\', \'response\', event)">Response' + (res ? ' (' + res.bodySize + 'B)' : '') + '</div>' +
+                '<div class="tab' + (currentTab === 'timing' ? ' active' : '') + '" onclick="switchTab(\'' + id + '\', \'timing\', event)">Timing</div>' +
+                (ws ? '<div class="tab' + (currentTab === 'messages' ? ' active' : '') + '" onclick="switchTab(\'' + id + '\', \'messages\', event)">Messages (' + ws.messages.length + ')</div>' : '') +
+                (sse ? '<div class="tab' + (currentTab === 'events' ? ' active' : '') + '" onclick="switchTab(\'' + id + '\', \'events\', event)">Events (' + (res.events ? res.events.events.length : 0) + ')</div>' : '') +
+                '<div class="actions"><a href="/api/pairs/' + id + '/pcap">Download pcap</a></div>' +
+                '</div>' +
+                '<div class="tab-content' + (currentTab === 'request' ? ' active' : '') + '">' + renderPacketContent(req, 'request', id) + '</div>' +
+                '<div class="tab-content' + (currentTab === 'response' ? ' active' : '') + '">' + renderInterim(interim) + renderPacketContent(res, 'response', id) + '</div>' +
+                '<div class="tab-content' + (currentTab === 'timing' ? ' active' : '') + '">' + renderTiming(pair.timing) + '</div>' +
+                (ws ? '<div class="tab-content' + (currentTab === 'messages' ? ' active' : '') + '">' + renderMessages(ws) + '</div>' : '') +
+                (sse ? '<div class="tab-content' + (currentTab === 'events' ? ' active' : '') + '">' + renderEvents(res) + '</div>' : '') +
+                '</div></div>';
+        }
+
+        // Requests still waiting on the backend, polled and timed locally in between
+        let inflight = [];
+        let inflightFetched = 0;
+
+        async function pollInflight() {
+            try {
+                const resp = await fetch('/api/inflight');
+                inflight = await resp.json();
+                inflightFetched = Date.now();
+            } catch (e) {
+                inflight = [];
+            }
+            renderInflight();
+        }
+
+        function formatElapsed(ms) {
+            const s = Math.floor(ms / 1000);
+            if (s < 60) return (ms / 1000).toFixed(1) + 's';
+            if (s < 3600) return Math.floor(s / 60) + 'm' + String(s % 60).padStart(2, '0') + 's';
+            return Math.floor(s / 3600) + 'h' + String(Math.floor(s / 60) % 60).padStart(2, '0') + 'm';
+        }
+
+        function renderInflight() {
+            const panel = document.getElementById('inflight');
+            panel.hidden = inflight.length === 0;
+            if (panel.hidden) return;
+            const since = Date.now() - inflightFetched;
+            panel.innerHTML = '<div class="inflight-title">In flight (' + inflight.length + ')</div>' + inflight.map(r =>
+                '<div class="inflight-row" onclick="showPair(' + r.pairId + ')">' +
+                '<span class="method ' + escapeHtml(r.method) + '">' + escapeHtml(r.method) + '</span>' +
+                '<span class="url">' + escapeHtml(r.url) + '</span>' +
+                (multiPort ? '<span class="service">' + escapeHtml(r.service || String(r.servicePort)) + '</span>' : '') +
+                (r.uploading ? '<span class="streaming">uploading</span>' : '') +
+                '<span class="elapsed">' + formatElapsed(r.elapsedMs + since) + '</span>' +
+                '</div>').join('');
+        }
+
+        function showPair(id) {
+            expandedPairs.add(String(id));
+            renderAll();
+            const el = document.querySelector('.packet[data-id="' + id + '"]');
+            if (el) el.scrollIntoView({block: 'center'});
+        }
+
+        connect();
+        pollInflight();
+        setInterval(pollInflight, 2000);
+        setInterval(renderInflight, 1000);
     </script>
 </body>
 </html>`
@@ -375,16 +985,28 @@ type PacketView struct {
 
 // DashboardData holds data for the dashboard template
 type DashboardData struct {
-	Port    int
+	Ports   PortSet
 	Count   int
 	Packets []PacketView
 }
 
-// StartDashboardServer starts the web dashboard on the given port
-func StartDashboardServer(dashboardPort int, capturePort int) error {
+// StartDashboardServer starts the web dashboard on the given host and port
+func StartDashboardServer(dashboardHost string, dashboardPort int, ports PortSet) error {
+	addr := net.JoinHostPort(dashboardHost, strconv.Itoa(dashboardPort))
+	if dashboardHost == "" {
+		fmt.Printf("Dashboard available at http://localhost:%d on every interface\n", dashboardPort)
+	} else {
+		fmt.Printf("Dashboard available at http://%s\n", addr)
+	}
+	return http.ListenAndServe(addr, dashboardHandler(ports))
+}
+
+// dashboardHandler serves the dashboard page and its API
+func dashboardHandler(ports PortSet) http.Handler {
+	mux := http.NewServeMux()
 	tmpl := template.Must(template.New("dashboard").Parse(dashboardHTML))
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
 			http.NotFound(w, r)
 			return
@@ -412,7 +1034,7 @@ func StartDashboardServer(dashboardPort int, capturePort int) error {
 		}
 
 		data := DashboardData{
-			Port:    capturePort,
+			Ports:   ports,
 			Count:   len(Store.GetPairs()),
 			Packets: views,
 		}
@@ -421,21 +1043,257 @@ func StartDashboardServer(dashboardPort int, capturePort int) error {
 		tmpl.Execute(w, data)
 	})
 
-	http.HandleFunc("/api/packets", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/packets", func(w http.ResponseWriter, r *http.Request) {
+		query, err := parseQuery(r, ports)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		packets, err := Store.QueryPackets(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(packets)
+	})
+
+	mux.HandleFunc("/api/pairs", func(w http.ResponseWriter, r *http.Request) {
+		query, err := parseQuery(r, ports)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		pairs, err := Store.QueryPairs(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pairs)
+	})
+
+	mux.HandleFunc("GET /api/inflight", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Store.InFlight(time.Now()))
+	})
+
+	mux.HandleFunc("GET /api/loss", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Store.Loss())
+	})
+
+	mux.HandleFunc("GET /api/stats", func(w http.ResponseWriter, r *http.Request) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+
+		stats := struct {
+			StoreStats
+			HeapAllocBytes uint64 `json:"heapAllocBytes"`
+			SysBytes       uint64 `json:"sysBytes"`
+		}{Store.Stats(), mem.HeapAlloc, mem.Sys}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+
+	mux.HandleFunc("GET /api/export.har", func(w http.ResponseWriter, r *http.Request) {
+		query, err := parseQuery(r, ports)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		pairs, err := Store.QueryPairs(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(Store.GetAll())
+		w.Header().Set("Content-Disposition", "attachment; filename=\"capture.har\"")
+		if err := WriteHAR(w, pairs); err != nil {
+			log.Printf("Error writing HAR export: %v\n", err)
+		}
 	})
 
-	http.HandleFunc("/api/pairs", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("POST /api/import.har", func(w http.ResponseWriter, r *http.Request) {
+		// Only the dashboard itself may import, not any page the browser has open
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin import refused", http.StatusForbidden)
+			return
+		}
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			http.Error(w, "HAR must be sent as application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		n, err := ImportHAR(Store, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(Store.GetPairs())
+		json.NewEncoder(w).Encode(map[string]int{"imported": n})
 	})
 
-	http.HandleFunc("/clear", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("GET /api/pairs/{id}/pcap", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid pair id", http.StatusBadRequest)
+			return
+		}
+		pair, ok := Store.GetPair(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		pairKey := ""
+		if pair.Request != nil {
+			pairKey = pair.Request.PairKey
+		} else if pair.Response != nil {
+			pairKey = pair.Response.PairKey
+		} else if pair.TLS != nil {
+			pairKey = pair.TLS.PairKey
+		} else if pair.ParseError != nil {
+			pairKey = pair.ParseError.PairKey
+		}
+
+		w.Header().Set("Content-Type", "application/x-pcapng")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"pair-%d.pcapng\"", id))
+		if err := RawPackets.WritePcapng(w, pairConnectionKey(pairKey)); err != nil {
+			w.Header().Del("Content-Disposition")
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+	})
+
+	mux.HandleFunc("GET /api/packets/{id}/body", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid packet id", http.StatusBadRequest)
+			return
+		}
+		packet, ok := Store.GetPacket(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		// ?raw=1 returns the body as it was on the wire, before Content-Encoding decoding
+		body := packet.Body
+		contentType := packet.ContentType
+		if contentType == "" {
+			contentType = packet.MimeType
+		}
+		if r.URL.Query().Get("raw") != "" && packet.RawBody != nil {
+			body = packet.RawBody
+			contentType = ""
+		}
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		// Captured content must never run with the dashboard's origin
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Write(body)
+	})
+
+	mux.HandleFunc("/api/events", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		query, err := parseQuery(r, ports)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		snapshot, events, unsubscribe := Store.Subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		writeEvent(w, "snapshot", query.Pairs(snapshot))
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(15 * time.Second)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+			case ev, ok := <-events:
+				if !ok {
+					// We fell behind; the browser reconnects and gets a fresh snapshot
+					return
+				}
+				switch ev.Type {
+				case EventPair:
+					if !query.MatchPair(ev.Pair) {
+						// The pair may have matched before this update; drop it if so
+						writeEvent(w, EventEvict, []int{ev.Pair.ID})
+						break
+					}
+					writeEvent(w, ev.Type, ev.Pair)
+				case EventEvict:
+					writeEvent(w, ev.Type, ev.IDs)
+				default:
+					writeEvent(w, ev.Type, nil)
+				}
+			}
+			flusher.Flush()
+		}
+	})
+
+	mux.HandleFunc("POST /clear", func(w http.ResponseWriter, r *http.Request) {
+		// Clearing deletes stored segments too, so no other page may trigger it
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin clear refused", http.StatusForbidden)
+			return
+		}
 		Store.Clear()
-		http.Redirect(w, r, "/", http.StatusFound)
+		w.WriteHeader(http.StatusNoContent)
 	})
 
-	fmt.Printf("Dashboard available at http://localhost:%d\n", dashboardPort)
-	return http.ListenAndServe(fmt.Sprintf(":%d", dashboardPort), nil)
+	return mux
+}
+
+// sameOrigin reports whether a request came from the dashboard's own pages.
+// Requests without browser origin headers, such as from curl, are let through.
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// writeEvent writes a single Server-Sent Event with a JSON payload
+func writeEvent(w io.Writer, event string, data any) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Error encoding %s event: %v\n", event, err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testDashboard serves the dashboard over a fresh Store
+func testDashboard(t *testing.T) *httptest.Server {
+	t.Helper()
+	saved := Store
+	Store = NewPacketStore(100, 0)
+	t.Cleanup(func() { Store = saved })
+
+	ports, _ := ParsePorts("8080")
+	srv := httptest.NewServer(dashboardHandler(ports))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPacketBodyEndpoint(t *testing.T) {
+	srv := testDashboard(t)
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	image := CapturedPacket{Type: PacketResponse, PairKey: "conn-1"}
+	image.setBody("", png)
+	labelled := CapturedPacket{Type: PacketResponse, PairKey: "conn-2", ContentType: "application/json"}
+	labelled.setBody("gzip", compress(t, "gzip", []byte(`{"ok":true}`)))
+	Store.Add(image)
+	Store.Add(labelled)
+	imageID, labelledID := Store.GetPairs()[1].Response.ID, Store.GetPairs()[0].Response.ID
+
+	tests := []struct {
+		name        string
+		path        string
+		status      int
+		contentType string
+		body        []byte
+	}{
+		{"sniffed type", "/api/packets/" + strconv.Itoa(imageID) + "/body", http.StatusOK, "image/png", png},
+		{"declared type", "/api/packets/" + strconv.Itoa(labelledID) + "/body", http.StatusOK, "application/json", []byte(`{"ok":true}`)},
+		{"as on the wire", "/api/packets/" + strconv.Itoa(labelledID) + "/body?raw=1", http.StatusOK, "application/octet-stream", labelled.RawBody},
+		{"no wire form", "/api/packets/" + strconv.Itoa(imageID) + "/body?raw=1", http.StatusOK, "image/png", png},
+		{"unknown packet", "/api/packets/999/body", http.StatusNotFound, "", nil},
+		{"bad id", "/api/packets/x/body", http.StatusBadRequest, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(srv.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if got := resp.Header.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type %q, want %q", got, tt.contentType)
+			}
+			if !bytes.Equal(body, tt.body) {
+				t.Errorf("body %q, want %q", body, tt.body)
+			}
+			// Captured content must not run as the dashboard
+			if resp.Header.Get("Content-Security-Policy") != "sandbox" || resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+				t.Errorf("headers %v", resp.Header)
+			}
+		})
+	}
+}
+
+func TestEventsEndpoint(t *testing.T) {
+	srv := testDashboard(t)
+	Store.Add(CapturedPacket{Type: PacketRequest, Method: "GET", URL: "/old", PairKey: "conn-1"})
+
+	resp, err := http.Get(srv.URL + "/api/events?q=" + url.QueryEscape("status == 500"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	events := bufio.NewReader(resp.Body)
+	next := func() (string, string) {
+		t.Helper()
+		var event, data string
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading events: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			case line == "" && event != "":
+				return event, data
+			}
+		}
+	}
+
+	// The snapshot only has what the filter matches
+	if event, data := next(); event != "snapshot" || strings.Contains(data, "/old") {
+		t.Errorf("first event %s %s, want an empty snapshot", event, data)
+	}
+
+	// A pair that doesn't match is reported as gone, in case it matched before
+	pair := Store.Add(CapturedPacket{Type: PacketRequest, Method: "GET", URL: "/new", PairKey: "conn-2"})
+	if event, data := next(); event != EventEvict || data != "["+strconv.Itoa(pair.ID)+"]" {
+		t.Errorf("got %s %s, want %s of pair %d", event, data, EventEvict, pair.ID)
+	}
+
+	// and sent in full once it does
+	Store.Add(CapturedPacket{Type: PacketResponse, StatusCode: 500, Status: "500 Internal Server Error", PairKey: "conn-2"})
+	event, data := next()
+	var got PacketPair
+	if err := json.Unmarshal([]byte(data), &got); event != EventPair || err != nil || got.ID != pair.ID || got.Response == nil || got.Response.StatusCode != 500 {
+		t.Errorf("got %s %s, want the answered pair %d", event, data, pair.ID)
+	}
+
+	Store.Clear()
+	if event, _ := next(); event != EventClear {
+		t.Errorf("got %s, want %s", event, EventClear)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket"
+)
+
+// linkTypeLinuxSLL2 is DLT_LINUX_SLL2, used by the Linux "any" device and by
+// recent tcpdump versions. layers.LinkType is only 8 bits wide in gopacket
+// v1.1.19, so pcap reports it truncated to its low byte.
+const linkTypeLinuxSLL2 = 276
+
+const (
+	sllHeaderLen  = 16
+	sll2HeaderLen = 20
+)
+
+// sll2Source rewrites Linux SLL2 frames into SLL frames, which gopacket can decode
+type sll2Source struct {
+	src gopacket.PacketDataSource
+}
+
+// ReadPacketData implements gopacket.PacketDataSource
+func (s sll2Source) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.src.ReadPacketData()
+	if err != nil || len(data) < sll2HeaderLen {
+		return data, ci, err
+	}
+
+	// SLL2: protocol(2) reserved(2) ifindex(4) hatype(2) pkttype(1) halen(1) addr(8)
+	// SLL:  pkttype(2) hatype(2) halen(2) addr(8) protocol(2)
+	out := make([]byte, sllHeaderLen+len(data)-sll2HeaderLen)
+	binary.BigEndian.PutUint16(out[0:2], uint16(data[10]))
+	copy(out[2:4], data[8:10])
+	binary.BigEndian.PutUint16(out[4:6], uint16(data[11]))
+	copy(out[6:14], data[12:20])
+	copy(out[14:16], data[0:2])
+	copy(out[sllHeaderLen:], data[sll2HeaderLen:])
+
+	ci.CaptureLength = len(out)
+	ci.Length -= sll2HeaderLen - sllHeaderLen
+	return out, ci, nil
+}
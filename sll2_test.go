@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// frameSource hands out one frame
+type frameSource struct {
+	data []byte
+	err  error
+}
+
+func (s frameSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return s.data, gopacket.CaptureInfo{CaptureLength: len(s.data), Length: len(s.data) + 10}, s.err
+}
+
+// sll2Frame builds a Linux SLL2 header in front of payload
+func sll2Frame(protocol uint16, ifindex uint32, pktType byte, addr []byte, payload []byte) []byte {
+	header := []byte{
+		byte(protocol >> 8), byte(protocol), 0, 0, // protocol, reserved
+		byte(ifindex >> 24), byte(ifindex >> 16), byte(ifindex >> 8), byte(ifindex), // interface index
+		0, 1, pktType, byte(len(addr)), // ARPHRD_ETHER, packet type, address length
+	}
+	header = append(header, make([]byte, 8)...)
+	copy(header[12:], addr)
+	return append(header, payload...)
+}
+
+func TestSLL2Source(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02}
+	ip := []byte{0x45, 0, 0, 20, 0, 0, 0x40, 0, 64, 6, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}
+	tests := []struct {
+		name     string
+		frame    []byte
+		pktType  layers.LinuxSLLPacketType
+		ethType  layers.EthernetType
+		wantSame bool // passed through untouched
+	}{
+		{name: "outgoing IPv4", frame: sll2Frame(0x0800, 3, 4, mac, ip), pktType: layers.LinuxSLLPacketTypeOutgoing, ethType: layers.EthernetTypeIPv4},
+		{name: "incoming IPv6", frame: sll2Frame(0x86dd, 1, 0, mac, []byte{0x60, 0, 0, 0}), pktType: layers.LinuxSLLPacketTypeHost, ethType: layers.EthernetTypeIPv6},
+		{name: "no payload", frame: sll2Frame(0x0800, 1, 0, mac, nil), pktType: layers.LinuxSLLPacketTypeHost, ethType: layers.EthernetTypeIPv4},
+		{name: "shorter than a header", frame: sll2Frame(0x0800, 1, 0, mac, nil)[:sll2HeaderLen-1], wantSame: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, ci, err := sll2Source{src: frameSource{data: tt.frame}}.ReadPacketData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantSame {
+				if !bytes.Equal(out, tt.frame) {
+					t.Errorf("frame = %x, want it unchanged", out)
+				}
+				return
+			}
+
+			if len(out) != len(tt.frame)-(sll2HeaderLen-sllHeaderLen) || ci.CaptureLength != len(out) || ci.Length != len(out)+10 {
+				t.Errorf("got %d bytes, capture length %d, length %d from a %d byte frame", len(out), ci.CaptureLength, ci.Length, len(tt.frame))
+			}
+			packet := gopacket.NewPacket(out, layers.LinkTypeLinuxSLL, gopacket.Default)
+			sll, ok := packet.LinkLayer().(*layers.LinuxSLL)
+			if !ok {
+				t.Fatalf("no SLL layer in %x", out)
+			}
+			if sll.PacketType != tt.pktType || sll.AddrType != 1 || sll.AddrLen != 6 || !bytes.Equal(sll.Addr, mac) || sll.EthernetType != tt.ethType {
+				t.Errorf("SLL header = %+v", sll)
+			}
+			if !bytes.Equal(sll.LayerPayload(), tt.frame[sll2HeaderLen:]) {
+				t.Errorf("payload = %x, want %x", sll.LayerPayload(), tt.frame[sll2HeaderLen:])
+			}
+		})
+	}
+
+	// Read errors come through as they are
+	fail := errors.New("read failed")
+	if _, _, err := (sll2Source{src: frameSource{err: fail}}).ReadPacketData(); err != fail {
+		t.Errorf("error = %v, want %v", err, fail)
+	}
+}
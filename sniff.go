@@ -0,0 +1,198 @@
+//go:build !nopcap
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// sniffOptions configures packet capture
+type sniffOptions struct {
+	ports     PortSet
+	readFile  string
+	writeFile string
+	iface     string
+	bpf       string
+	keyLog    *KeyLog
+}
+
+// runSniffer captures packets live or from a file and feeds them to the HTTP
+// parser. It returns once a capture file has been read or the live capture ends.
+func runSniffer(opts sniffOptions) {
+	var err error
+	var handle *pcap.Handle
+	if opts.readFile != "" {
+		fmt.Printf("Reading HTTP traffic on ports %s from %s\n", opts.ports, opts.readFile)
+
+		handle, err = pcap.OpenOffline(opts.readFile)
+		if err != nil {
+			log.Printf("Error opening capture file %s: %v\n", opts.readFile, err)
+			os.Exit(1)
+		}
+	} else {
+		iface := opts.iface
+		fmt.Printf("Starting HTTP monitor on ports %s (interface: %s)\n", opts.ports, iface)
+
+		handle, err = pcap.OpenLive(iface, 65536, true, pcap.BlockForever)
+		if err != nil {
+			log.Printf("Error opening interface %s: %v\n", iface, err)
+			log.Println("Available interfaces:")
+			if listErr := printInterfaces(os.Stderr); listErr != nil {
+				log.Printf("  Could not list interfaces: %v\n", listErr)
+			}
+			os.Exit(1)
+		}
+
+		// Prefer the original cooked header on the Linux "any" device, which
+		// gopacket decodes natively; SLL2 is converted below if that fails.
+		if isLinuxSLL2(handle) {
+			handle.SetLinkType(layers.LinkTypeLinuxSLL)
+		}
+	}
+	defer handle.Close()
+
+	filter := opts.ports.BPFFilter()
+	if opts.bpf != "" {
+		filter = opts.bpf
+	}
+	if err := handle.SetBPFFilter(filter); err != nil {
+		log.Printf("Error setting BPF filter '%s': %v\n", filter, err)
+		os.Exit(1)
+	}
+
+	var source gopacket.PacketDataSource = handle
+	linkType := handle.LinkType()
+	if isLinuxSLL2(handle) {
+		source = sll2Source{src: handle}
+		linkType = layers.LinkTypeLinuxSLL
+	}
+
+	var writer *captureFile
+	if opts.writeFile != "" {
+		out, err := os.Create(opts.writeFile)
+		if err != nil {
+			log.Printf("Error creating output file %s: %v\n", opts.writeFile, err)
+			os.Exit(1)
+		}
+		defer out.Close()
+
+		w, err := pcapgo.NewNgWriter(out, linkType)
+		if err != nil {
+			log.Printf("Error writing pcapng header to %s: %v\n", opts.writeFile, err)
+			os.Exit(1)
+		}
+		writer = &captureFile{name: opts.writeFile, w: w}
+		defer writer.flush()
+		atShutdown(writer.flush)
+		fmt.Printf("Writing captured packets to %s\n", opts.writeFile)
+	}
+
+	RawPackets.SetLinkType(linkType)
+	readPackets(source, linkType, opts, writer)
+}
+
+// readPackets feeds the packets from source to the HTTP parser until it runs
+// out, copying each one to writer if it's set
+func readPackets(source gopacket.PacketDataSource, linkType layers.LinkType, opts sniffOptions, writer *captureFile) {
+	streamFactory := &httpStreamFactory{ports: opts.ports, keyLog: opts.keyLog}
+	pool := tcpassembly.NewStreamPool(streamFactory)
+	assembler := tcpassembly.NewAssembler(pool)
+
+	// Without this a lost segment would hold back the rest of its stream
+	// until the connection closed. Packet times are used so files replay the same.
+	var lastFlush time.Time
+	packetSource := gopacket.NewPacketSource(source, linkType)
+	for packet := range packetSource.Packets() {
+		if writer != nil {
+			writer.write(packet.Metadata().CaptureInfo, packet.Data())
+		}
+
+		if connKey, ok := packetConnectionKey(packet); ok {
+			RawPackets.Add(connKey, packet.Metadata().CaptureInfo, packet.Data())
+		}
+
+		if tcp := packet.Layer(layers.LayerTypeTCP); tcp != nil {
+			assembler.AssembleWithTimestamp(
+				packet.NetworkLayer().NetworkFlow(),
+				tcp.(*layers.TCP),
+				packet.Metadata().Timestamp,
+			)
+		}
+
+		if seen := packet.Metadata().Timestamp; seen.Sub(lastFlush) >= time.Second {
+			assembler.FlushWithOptions(tcpassembly.FlushOptions{T: seen.Add(-gapTimeout)})
+			if writer != nil {
+				writer.flush()
+			}
+			lastFlush = seen
+		}
+	}
+
+	if opts.readFile != "" {
+		// Flush any connections that never saw a FIN so their data is parsed,
+		// and have it all in the store before saying the file is done
+		assembler.FlushAll()
+		streamFactory.parsing.Wait()
+	}
+}
+
+// captureFile is the -write output. Packets are buffered and flushed once a
+// second and on shutdown, rather than after each one.
+type captureFile struct {
+	name string
+	mu   sync.Mutex
+	w    *pcapgo.NgWriter
+}
+
+func (f *captureFile) write(ci gopacket.CaptureInfo, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.w.WritePacket(ci, data); err != nil {
+		log.Printf("Error writing packet to %s: %v\n", f.name, err)
+	}
+}
+
+func (f *captureFile) flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.w.Flush(); err != nil {
+		log.Printf("Error flushing %s: %v\n", f.name, err)
+	}
+}
+
+// isLinuxSLL2 reports whether the handle delivers Linux SLL2 frames
+func isLinuxSLL2(handle *pcap.Handle) bool {
+	return handle.LinkType() == layers.LinkType(linkTypeLinuxSLL2&0xff)
+}
+
+// printInterfaces writes the capture interfaces reported by libpcap to w
+func printInterfaces(w io.Writer) error {
+	devices, err := pcap.FindAllDevs()
+	if err != nil {
+		return err
+	}
+	for _, dev := range devices {
+		addrs := make([]string, len(dev.Addresses))
+		for i, addr := range dev.Addresses {
+			addrs[i] = addr.IP.String()
+		}
+		fmt.Fprintf(w, "  - %s: %s", dev.Name, dev.Description)
+		if len(addrs) > 0 {
+			fmt.Fprintf(w, " [%s]", strings.Join(addrs, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
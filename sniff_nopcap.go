@@ -0,0 +1,34 @@
+//go:build nopcap
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+)
+
+// errNoPcap is returned by capture functions in builds without libpcap
+var errNoPcap = errors.New("built without packet capture support (nopcap); use -mode proxy")
+
+// sniffOptions configures packet capture
+type sniffOptions struct {
+	ports     PortSet
+	readFile  string
+	writeFile string
+	iface     string
+	bpf       string
+	keyLog    *KeyLog
+}
+
+// runSniffer is unavailable without libpcap
+func runSniffer(opts sniffOptions) {
+	log.Println(errNoPcap)
+	os.Exit(1)
+}
+
+// printInterfaces is unavailable without libpcap
+func printInterfaces(w io.Writer) error {
+	return errNoPcap
+}
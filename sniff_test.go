@@ -0,0 +1,164 @@
+//go:build !nopcap
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// tcpSegment is one packet of a test connection between 10.0.0.1:40000 and
+// a service on 10.0.0.2:8080. Sequence numbers follow the order segments are
+// listed in, not the order they're written.
+type tcpSegment struct {
+	fromServer bool
+	syn, fin   bool
+	payload    string
+	late       bool // written after the segment that follows it
+}
+
+// writePcap writes a connection's segments to a pcap file and returns its path
+func writePcap(t *testing.T, segments []tcpSegment) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4()
+	seq := map[bool]uint32{false: 1000, true: 5000}
+	seen := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var packets [][]byte
+	for _, s := range segments {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: client, DstIP: server}
+		tcp := &layers.TCP{SrcPort: 40000, DstPort: 8080, Seq: seq[s.fromServer], Ack: seq[!s.fromServer], SYN: s.syn, FIN: s.fin, ACK: !s.syn || s.fromServer, PSH: s.payload != "", Window: 65535}
+		if s.fromServer {
+			ip.SrcIP, ip.DstIP = server, client
+			tcp.SrcPort, tcp.DstPort = 8080, 40000
+		}
+		tcp.SetNetworkLayerForChecksum(ip)
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4}
+
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(s.payload)); err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, buf.Bytes())
+
+		seq[s.fromServer] += uint32(len(s.payload))
+		if s.syn || s.fin {
+			seq[s.fromServer]++
+		}
+	}
+	for i := 0; i < len(packets)-1; i++ {
+		if segments[i].late {
+			packets[i], packets[i+1] = packets[i+1], packets[i]
+			i++
+		}
+	}
+	for _, data := range packets {
+		seen = seen.Add(time.Millisecond)
+		if err := w.WritePacket(gopacket.CaptureInfo{Timestamp: seen, CaptureLength: len(data), Length: len(data)}, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestReadPacketsFromFile(t *testing.T) {
+	handshake := []tcpSegment{{syn: true}, {fromServer: true, syn: true}, {}}
+	tests := []struct {
+		name     string
+		segments []tcpSegment
+		want     []string
+	}{
+		{
+			name: "one exchange",
+			segments: append(slices.Clone(handshake),
+				tcpSegment{payload: "GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+				tcpSegment{fromServer: true, payload: "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"},
+				tcpSegment{fin: true},
+				tcpSegment{fromServer: true, fin: true},
+			),
+			want: []string{"GET /a 200"},
+		},
+		{
+			name: "keep-alive",
+			segments: append(slices.Clone(handshake),
+				tcpSegment{payload: "GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+				tcpSegment{fromServer: true, payload: "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"},
+				tcpSegment{payload: "POST /b HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello"},
+				tcpSegment{fromServer: true, payload: "HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n"},
+				tcpSegment{fin: true},
+				tcpSegment{fromServer: true, fin: true},
+			),
+			want: []string{"GET /a 200", "POST /b 201"},
+		},
+		{
+			name: "segments out of order",
+			segments: append(slices.Clone(handshake),
+				tcpSegment{payload: "GET /a HTTP/1.1\r\n", late: true},
+				tcpSegment{payload: "Host: example.com\r\n\r\n"},
+				tcpSegment{fromServer: true, payload: "HTTP/1.1 204 No Content\r\n\r\n"},
+				tcpSegment{fin: true},
+				tcpSegment{fromServer: true, fin: true},
+			),
+			want: []string{"GET /a 204"},
+		},
+		{
+			// The end of the file stands in for the connection closing
+			name: "no FIN",
+			segments: append(slices.Clone(handshake),
+				tcpSegment{payload: "GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+				tcpSegment{fromServer: true, payload: "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"},
+			),
+			want: []string{"GET /a 200"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := Store
+			Store = NewPacketStore(100, 0)
+			t.Cleanup(func() { Store = saved })
+
+			path := writePcap(t, tt.segments)
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			r, err := pcapgo.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ports, _ := ParsePorts("8080")
+			readPackets(r, r.LinkType(), sniffOptions{ports: ports, readFile: path}, nil)
+
+			var got []string
+			pairs := Store.GetPairs()
+			for i := len(pairs) - 1; i >= 0; i-- {
+				if req, res := pairs[i].Request, pairs[i].Response; req != nil && res != nil {
+					got = append(got, req.Method+" "+req.URL+" "+res.Status[:3])
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,918 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StorageBackend keeps pairs beyond what PacketStore holds in memory. The
+// store appends each pair once it's settled (answered, evicted or still
+// pending at shutdown) and scans the backend for anything older than memory.
+type StorageBackend interface {
+	Append(pair PacketPair) error
+	// Scan calls fn for stored pairs, oldest first, until fn returns false.
+	// Backends may use hint to skip pairs that can't match.
+	Scan(hint ScanHint, fn func(PacketPair) bool) error
+	// ScanNewest is like Scan but goes newest (highest ID) first, so a
+	// caller wanting the latest few pairs can stop early
+	ScanNewest(hint ScanHint, fn func(PacketPair) bool) error
+	// Flush makes the pairs appended so far visible to scans. Appends may
+	// be buffered until then.
+	Flush() error
+	// Expire drops what has gone past the backend's retention limits. It's
+	// called now and then, so age limits hold while nothing is appended.
+	Expire() error
+	Clear() error
+	Close() error
+}
+
+// ScanHint narrows a scan; zero fields don't restrict anything
+type ScanHint struct {
+	From, To time.Time
+	SinceID  int // pair IDs greater than this
+	BeforeID int // pair IDs less than this
+	PacketID int // pairs containing this packet
+}
+
+// Retention limits how much a backend keeps. Limits are applied a whole
+// segment at a time, so slightly more than the limit may be kept.
+type Retention struct {
+	MaxAge   time.Duration
+	MaxCount int
+	MaxBytes int64
+}
+
+// ParseRetention parses a comma-separated list of limits: durations ("24h")
+// limit age, sizes ("2GB") limit bytes and plain numbers limit pair count.
+func ParseRetention(s string) (Retention, error) {
+	var r Retention
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(part); err == nil && n > 0 {
+			r.MaxCount = n
+		} else if d, err := time.ParseDuration(part); err == nil && d > 0 {
+			r.MaxAge = d
+		} else if b, err := parseByteSize(part); err == nil && b > 0 {
+			r.MaxBytes = b
+		} else {
+			return r, fmt.Errorf("%q is not a duration, size or count", part)
+		}
+	}
+	return r, nil
+}
+
+// parseByteSize parses sizes such as 512KB, 256MB or 2GB (powers of 1024)
+func parseByteSize(s string) (int64, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"TB", 1 << 40}, {"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper = strings.TrimSuffix(upper, unit.suffix)
+			multiplier = unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(upper), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+const (
+	segmentMaxBytes = 32 << 20
+	segmentMaxAge   = time.Hour
+	segmentIndex    = "index.json"
+)
+
+// segmentInfo is the index entry for one segment file
+type segmentInfo struct {
+	Name        string    `json:"name"`
+	Count       int       `json:"count"`
+	Bytes       int64     `json:"bytes"`
+	FirstPair   int       `json:"firstPair"`
+	LastPair    int       `json:"lastPair"`
+	FirstPacket int       `json:"firstPacket"`
+	LastPacket  int       `json:"lastPacket"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Created     time.Time `json:"created"`
+}
+
+// add widens the entry to cover a pair written to the segment
+func (s *segmentInfo) add(pair PacketPair, size int64) {
+	if s.Count == 0 || pair.ID < s.FirstPair {
+		s.FirstPair = pair.ID
+	}
+	if pair.ID > s.LastPair {
+		s.LastPair = pair.ID
+	}
+	for _, p := range []*CapturedPacket{pair.Request, pair.Response} {
+		if p == nil {
+			continue
+		}
+		if s.FirstPacket == 0 || p.ID < s.FirstPacket {
+			s.FirstPacket = p.ID
+		}
+		if p.ID > s.LastPacket {
+			s.LastPacket = p.ID
+		}
+	}
+	if s.Start.IsZero() || pair.Timestamp.Before(s.Start) {
+		s.Start = pair.Timestamp
+	}
+	if pair.Timestamp.After(s.End) {
+		s.End = pair.Timestamp
+	}
+	s.Count++
+	s.Bytes += size
+}
+
+// mayContain reports whether the segment could hold pairs matching hint
+func (s *segmentInfo) mayContain(hint ScanHint) bool {
+	switch {
+	case s.Count == 0:
+		return false
+	case !hint.From.IsZero() && s.End.Before(hint.From):
+		return false
+	case !hint.To.IsZero() && s.Start.After(hint.To):
+		return false
+	case hint.SinceID > 0 && s.LastPair <= hint.SinceID:
+		return false
+	case hint.BeforeID > 0 && s.FirstPair >= hint.BeforeID:
+		return false
+	case hint.PacketID > 0 && (hint.PacketID < s.FirstPacket || hint.PacketID > s.LastPacket):
+		return false
+	}
+	return true
+}
+
+// SegmentStore is a StorageBackend writing pairs as JSON lines to rotating
+// segment files, with a small index of what each segment covers.
+type SegmentStore struct {
+	mu       sync.Mutex
+	dir      string
+	retain   Retention
+	segments []segmentInfo
+	file     *os.File
+	w        *bufio.Writer
+}
+
+// OpenSegmentStore opens (or creates) a segment store in dir. Segments hold
+// every captured header and body, so only the user may read them.
+func OpenSegmentStore(dir string, retain Retention) (*SegmentStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &SegmentStore{dir: dir, retain: retain}
+	if err := s.loadIndex(); err != nil {
+		return nil, err
+	}
+	s.applyRetention()
+	if err := s.writeIndex(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadIndex reads the index, rebuilding entries for segments it doesn't
+// describe accurately (for example after a crash)
+func (s *SegmentStore) loadIndex() error {
+	indexed := make(map[string]segmentInfo)
+	if data, err := os.ReadFile(filepath.Join(s.dir, segmentIndex)); err == nil {
+		var entries []segmentInfo
+		if err := json.Unmarshal(data, &entries); err != nil {
+			log.Printf("Ignoring unreadable index in %s: %v\n", s.dir, err)
+		}
+		for _, e := range entries {
+			indexed[e.Name] = e
+		}
+	}
+
+	names, err := filepath.Glob(filepath.Join(s.dir, "segment-*.jsonl"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, path := range names {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(path)
+		if e, ok := indexed[name]; ok && e.Bytes == info.Size() {
+			s.segments = append(s.segments, e)
+			continue
+		}
+
+		e := segmentInfo{Name: name, Created: info.ModTime()}
+		err = scanSegment(path, func(pair PacketPair, size int64) bool {
+			e.add(pair, size)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		e.Bytes = info.Size()
+		s.segments = append(s.segments, e)
+	}
+	return nil
+}
+
+func (s *SegmentStore) writeIndex() error {
+	data, err := json.MarshalIndent(s.segments, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, segmentIndex+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, segmentIndex))
+}
+
+// scanSegment reads the pairs in a segment file with the size of each line
+func scanSegment(path string, fn func(PacketPair, int64) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var pair PacketPair
+			if jsonErr := json.Unmarshal(line, &pair); jsonErr != nil {
+				log.Printf("Skipping unreadable record in %s: %v\n", path, jsonErr)
+			} else if !fn(pair, int64(len(line))) {
+				return nil
+			}
+		}
+		// A line without a newline was cut short by a crash and is ignored
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// Append writes a pair to the current segment, starting a new one if
+// needed. Writes are buffered until Flush.
+func (s *SegmentStore) Append(pair PacketPair) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	line, err := json.Marshal(pair)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if err := s.rotateIfNeeded(); err != nil {
+		return err
+	}
+	if _, err := s.w.Write(line); err != nil {
+		return err
+	}
+	s.segments[len(s.segments)-1].add(pair, int64(len(line)))
+	return nil
+}
+
+// rotateIfNeeded opens a fresh segment when there's none open or the
+// current one is full or old. Must be called with s.mu held.
+func (s *SegmentStore) rotateIfNeeded() error {
+	if s.file != nil {
+		current := s.segments[len(s.segments)-1]
+		if current.Bytes < segmentMaxBytes && time.Since(current.Created) < segmentMaxAge {
+			return nil
+		}
+		if err := s.closeSegment(); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("segment-%s.jsonl", now.UTC().Format("20060102T150405.000000000"))
+	f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.w = bufio.NewWriter(f)
+	s.segments = append(s.segments, segmentInfo{Name: name, Created: now})
+
+	s.applyRetention()
+	return s.writeIndex()
+}
+
+func (s *SegmentStore) closeSegment() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file, s.w = nil, nil
+	return err
+}
+
+// applyRetention deletes the oldest closed segments that are over the
+// limits. Must be called with s.mu held (or before the store is shared).
+func (s *SegmentStore) applyRetention() {
+	var totalCount int
+	var totalBytes int64
+	for _, seg := range s.segments {
+		totalCount += seg.Count
+		totalBytes += seg.Bytes
+	}
+
+	closed := len(s.segments)
+	if s.file != nil {
+		closed--
+	}
+	drop := 0
+	for drop < closed {
+		oldest := s.segments[drop]
+		expired := s.retain.MaxAge > 0 && oldest.Count > 0 && time.Since(oldest.End) > s.retain.MaxAge
+		tooMany := s.retain.MaxCount > 0 && totalCount-oldest.Count >= s.retain.MaxCount
+		tooBig := s.retain.MaxBytes > 0 && totalBytes > s.retain.MaxBytes
+		if !expired && !tooMany && !tooBig && oldest.Count > 0 {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.dir, oldest.Name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing segment %s: %v\n", oldest.Name, err)
+			break
+		}
+		totalCount -= oldest.Count
+		totalBytes -= oldest.Bytes
+		drop++
+	}
+	s.segments = s.segments[drop:]
+}
+
+// Expire deletes segments that have gone past the retention limits, closing
+// the current one first once it's old enough to rotate so it can expire too
+func (s *SegmentStore) Expire() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil && time.Since(s.segments[len(s.segments)-1].Created) >= segmentMaxAge {
+		if err := s.closeSegment(); err != nil {
+			return err
+		}
+	}
+	kept := len(s.segments)
+	s.applyRetention()
+	if len(s.segments) == kept {
+		return nil
+	}
+	return s.writeIndex()
+}
+
+// Flush writes the buffered appends to the current segment
+func (s *SegmentStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
+		return nil
+	}
+	return s.w.Flush()
+}
+
+// Scan reads pairs from every segment that may match hint, oldest first
+func (s *SegmentStore) Scan(hint ScanHint, fn func(PacketPair) bool) error {
+	s.mu.Lock()
+	segments := slices.Clone(s.segments)
+	s.mu.Unlock()
+
+	for _, seg := range segments {
+		if !seg.mayContain(hint) {
+			continue
+		}
+		stopped := false
+		err := scanSegment(filepath.Join(s.dir, seg.Name), func(pair PacketPair, _ int64) bool {
+			stopped = !fn(pair)
+			return !stopped
+		})
+		// Retention may have removed the segment since we looked
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// ScanNewest reads pairs from the segments that may match hint, newest
+// first. Segments are read newest first too, and a pair is only handed on
+// once no older segment can hold a newer one.
+func (s *SegmentStore) ScanNewest(hint ScanHint, fn func(PacketPair) bool) error {
+	s.mu.Lock()
+	segments := slices.Clone(s.segments)
+	s.mu.Unlock()
+
+	segments = slices.DeleteFunc(segments, func(seg segmentInfo) bool { return !seg.mayContain(hint) })
+	// newestBefore[i] is the highest pair ID in the segments before i
+	newestBefore := make([]int, len(segments)+1)
+	for i, seg := range segments {
+		newestBefore[i+1] = max(newestBefore[i], seg.LastPair)
+	}
+
+	var pending []PacketPair // read but not handed on yet, newest first
+	for i := len(segments) - 1; i >= 0; i-- {
+		err := scanSegment(filepath.Join(s.dir, segments[i].Name), func(pair PacketPair, _ int64) bool {
+			pending = append(pending, pair)
+			return true
+		})
+		// Retention may have removed the segment since we looked
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		slices.SortFunc(pending, func(a, b PacketPair) int { return b.ID - a.ID })
+
+		for len(pending) > 0 && pending[0].ID > newestBefore[i] {
+			if !fn(pending[0]) {
+				return nil
+			}
+			pending = pending[1:]
+		}
+	}
+	return nil
+}
+
+// Clear deletes every segment
+func (s *SegmentStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.closeSegment(); err != nil {
+		return err
+	}
+	for _, seg := range s.segments {
+		if err := os.Remove(filepath.Join(s.dir, seg.Name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	s.segments = nil
+	return s.writeIndex()
+}
+
+// Close flushes the current segment and saves the index
+func (s *SegmentStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.closeSegment()
+	if indexErr := s.writeIndex(); err == nil {
+		err = indexErr
+	}
+	return err
+}
+
+const (
+	// storageWriterQueue is how many pairs can wait to be written before the
+	// store has to wait for the disk
+	storageWriterQueue = 4096
+	// storageFlushBatch is how many appended pairs are flushed together
+	storageFlushBatch = 256
+	// storageFlushInterval is how long a smaller batch waits to be flushed
+	storageFlushInterval = time.Second
+	// storageExpireInterval is how often the backend drops what's past its
+	// retention limits
+	storageExpireInterval = time.Minute
+)
+
+// storageWriter appends pairs to a backend on its own goroutine, so adding
+// a pair to the store never waits on the disk. Appends are flushed in
+// batches rather than one at a time.
+type storageWriter struct {
+	backend StorageBackend
+	queue   chan PacketPair
+	done    chan struct{}
+
+	appendMu  sync.Mutex // held while a pair is being appended or flushed
+	unflushed []int      // IDs of the pairs appended since the last flush
+
+	mu       sync.Mutex
+	pending  map[int]PacketPair // queued but not flushed to disk yet, by pair ID
+	overflow []PacketPair       // added while the queue was full, oldest first
+}
+
+func newStorageWriter(backend StorageBackend) *storageWriter {
+	w := &storageWriter{
+		backend: backend,
+		queue:   make(chan PacketPair, storageWriterQueue),
+		done:    make(chan struct{}),
+		pending: make(map[int]PacketPair),
+	}
+	go w.run()
+	return w
+}
+
+func (w *storageWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(storageFlushInterval)
+	defer ticker.Stop()
+	expire := time.NewTicker(storageExpireInterval)
+	defer expire.Stop()
+	for {
+		select {
+		case pair, ok := <-w.queue:
+			if !ok {
+				w.appendOverflow()
+				w.flush()
+				return
+			}
+			w.append(pair)
+			// Whatever overflowed came after everything in the queue
+			if len(w.queue) == 0 {
+				w.appendOverflow()
+			}
+		case <-ticker.C:
+			w.flush()
+		case <-expire.C:
+			w.expire()
+		}
+	}
+}
+
+// appendOverflow writes the pairs added while the queue was full
+func (w *storageWriter) appendOverflow() {
+	w.mu.Lock()
+	overflow := w.overflow
+	w.overflow = nil
+	w.mu.Unlock()
+	for _, pair := range overflow {
+		w.append(pair)
+	}
+}
+
+// expire has the backend drop what's past its retention limits
+func (w *storageWriter) expire() {
+	w.appendMu.Lock()
+	defer w.appendMu.Unlock()
+	if err := w.backend.Expire(); err != nil {
+		log.Printf("Error applying retention: %v\n", err)
+	}
+}
+
+// append writes a pair to the backend, flushing once a batch is full
+func (w *storageWriter) append(pair PacketPair) {
+	w.appendMu.Lock()
+	defer w.appendMu.Unlock()
+	w.mu.Lock()
+	_, queued := w.pending[pair.ID]
+	w.mu.Unlock()
+
+	// Pairs dropped by clear aren't written
+	if !queued {
+		return
+	}
+	if err := w.backend.Append(pair); err != nil {
+		log.Printf("Error storing pair %d: %v\n", pair.ID, err)
+	}
+	w.unflushed = append(w.unflushed, pair.ID)
+	if len(w.unflushed) >= storageFlushBatch {
+		w.flushLocked()
+	}
+}
+
+// flush makes the appended pairs visible to scans
+func (w *storageWriter) flush() {
+	w.appendMu.Lock()
+	defer w.appendMu.Unlock()
+	w.flushLocked()
+}
+
+// flushLocked is flush with appendMu held. Pairs stay pending until they're
+// flushed, so queries find them in the meantime.
+func (w *storageWriter) flushLocked() {
+	if len(w.unflushed) == 0 {
+		return
+	}
+	if err := w.backend.Flush(); err != nil {
+		log.Printf("Error flushing storage: %v\n", err)
+	}
+	w.mu.Lock()
+	for _, id := range w.unflushed {
+		delete(w.pending, id)
+	}
+	w.mu.Unlock()
+	w.unflushed = w.unflushed[:0]
+}
+
+// add queues a pair to be written without waiting on the writer, so it can
+// be called with the store locked. While the queue is full pairs are held in
+// overflow until the writer catches up.
+func (w *storageWriter) add(pair PacketPair) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending[pair.ID] = pair
+	if len(w.overflow) == 0 {
+		select {
+		case w.queue <- pair:
+			return
+		default:
+		}
+	}
+	w.overflow = append(w.overflow, pair)
+}
+
+// unwritten returns the queued pairs that aren't flushed to disk yet
+func (w *storageWriter) unwritten() []PacketPair {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	pairs := make([]PacketPair, 0, len(w.pending))
+	for _, pair := range w.pending {
+		pairs = append(pairs, pair)
+	}
+	return pairs
+}
+
+// clear drops the queued pairs and clears the backend
+func (w *storageWriter) clear() error {
+	w.appendMu.Lock()
+	defer w.appendMu.Unlock()
+	w.mu.Lock()
+	clear(w.pending)
+	w.overflow = nil
+	w.mu.Unlock()
+	w.unflushed = w.unflushed[:0]
+	return w.backend.Clear()
+}
+
+// close writes out the queued pairs and stops the writer
+func (w *storageWriter) close() {
+	close(w.queue)
+	<-w.done
+}
+
+// SetBackend attaches a storage backend and loads the newest stored pairs
+// back into memory. Call it before capturing starts.
+func (s *PacketStore) SetBackend(backend StorageBackend) error {
+	// IDs have to carry on from the stored ones
+	var loaded []PacketPair
+	maxPair, maxPacket := 0, 0
+	err := backend.Scan(ScanHint{}, func(pair PacketPair) bool {
+		maxPair = max(maxPair, pair.ID)
+		for _, p := range []*CapturedPacket{pair.Request, pair.Response} {
+			if p != nil {
+				maxPacket = max(maxPacket, p.ID)
+			}
+		}
+		loaded = append(loaded, pair)
+		if len(loaded) > 2*len(s.ring) {
+			loaded = newestPairs(loaded, len(s.ring))
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.backend = backend
+	s.writer = newStorageWriter(backend)
+	s.nextPair = max(s.nextPair, maxPair+1)
+	s.nextID = max(s.nextID, maxPacket+1)
+	for _, pair := range newestPairs(loaded, len(s.ring)) {
+		pair.persisted = true
+		for _, p := range []*CapturedPacket{pair.Request, pair.Response} {
+			if p != nil {
+				s.packets[p.ID] = pair.ID
+			}
+		}
+		s.put(&pair)
+	}
+	s.trim()
+	return nil
+}
+
+// newestPairs returns the n pairs with the highest IDs, in ID order
+func newestPairs(pairs []PacketPair, n int) []PacketPair {
+	slices.SortFunc(pairs, func(a, b PacketPair) int { return a.ID - b.ID })
+	if len(pairs) > n {
+		pairs = pairs[len(pairs)-n:]
+	}
+	return pairs
+}
+
+// persist queues a pair for the backend. Must be called with s.mu held.
+func (s *PacketStore) persist(pair PacketPair) {
+	if s.writer == nil {
+		return
+	}
+	s.writer.add(pair)
+}
+
+// Close stores the pairs that are still waiting for an answer and closes the backend
+func (s *PacketStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.backend == nil {
+		return nil
+	}
+	for _, pair := range s.snapshot() {
+		if !pair.persisted {
+			s.persist(*pair)
+		}
+	}
+	s.writer.close()
+	backend := s.backend
+	s.backend, s.writer = nil, nil
+	return backend.Close()
+}
+
+// QueryPairs runs a query over the pairs in memory and, with a backend, the
+// older ones that were only kept on disk
+func (s *PacketStore) QueryPairs(q Query) ([]PacketPair, error) {
+	s.mu.RLock()
+	shared := s.snapshot()
+	backend, writer := s.backend, s.writer
+	oldest := s.nextPair
+	s.mu.RUnlock()
+
+	pairs := make([]PacketPair, len(shared))
+	for i, p := range shared {
+		pairs[i] = *p
+	}
+	if backend == nil {
+		return q.Pairs(pairs), nil
+	}
+
+	// Everything in memory is newer than what's only on disk
+	if len(pairs) > 0 {
+		oldest = pairs[len(pairs)-1].ID
+	}
+	hint := q.hint()
+	if hint.BeforeID == 0 || hint.BeforeID > oldest {
+		hint.BeforeID = oldest
+	}
+
+	// A page is the newest matches, so only read back as far as it needs.
+	// newest holds the IDs of the newest wanted matches found, lowest first.
+	paged := q.Limit > 0 && q.SinceID == 0
+	wanted := 0
+	if paged {
+		wanted = q.Limit - len(q.Pairs(slices.Clone(pairs)))
+	}
+	newest := &pairIDHeap{}
+
+	// Pairs evicted from memory may still be on their way to disk
+	seen := make(map[int]bool)
+	var stored []PacketPair
+	collect := func(pair PacketPair) {
+		if pair.ID < hint.BeforeID && !seen[pair.ID] && q.MatchPair(pair) {
+			seen[pair.ID] = true
+			stored = append(stored, pair)
+			if wanted > 0 {
+				heap.Push(newest, pair.ID)
+				if newest.Len() > wanted {
+					heap.Pop(newest)
+				}
+			}
+		}
+	}
+	for _, pair := range writer.unwritten() {
+		collect(pair)
+	}
+
+	var err error
+	if paged {
+		if wanted > 0 {
+			err = backend.ScanNewest(hint, func(pair PacketPair) bool {
+				collect(pair)
+				return newest.Len() < wanted || pair.ID > (*newest)[0]
+			})
+		}
+	} else {
+		err = backend.Scan(hint, func(pair PacketPair) bool {
+			collect(pair)
+			return true
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(stored, func(a, b PacketPair) int { return b.ID - a.ID })
+	pairs = append(pairs, stored...)
+	return q.Pairs(pairs), nil
+}
+
+// QueryPackets runs a query over the packets in memory and, with a backend,
+// those of the older pairs only kept on disk. Packet IDs don't follow the
+// order pairs are stored in, so every stored pair that may match is read.
+func (s *PacketStore) QueryPackets(q Query) ([]CapturedPacket, error) {
+	s.mu.RLock()
+	shared := s.snapshot()
+	backend, writer := s.backend, s.writer
+	oldest := s.nextPair
+	s.mu.RUnlock()
+
+	packets := []CapturedPacket{}
+	add := func(pair PacketPair) {
+		for _, p := range []*CapturedPacket{pair.Request, pair.Response} {
+			if p != nil && q.MatchPacket(*p) {
+				packets = append(packets, *p)
+			}
+		}
+	}
+	for _, pair := range shared {
+		add(*pair)
+	}
+
+	if backend != nil {
+		// Everything in memory is newer than what's only on disk. A response
+		// can come well after its pair started, so only the end of the time
+		// range narrows the scan.
+		if len(shared) > 0 {
+			oldest = shared[len(shared)-1].ID
+		}
+		hint := ScanHint{To: q.To, BeforeID: oldest}
+
+		// Pairs evicted from memory may still be on their way to disk
+		seen := make(map[int]bool)
+		collect := func(pair PacketPair) bool {
+			if pair.ID < oldest && !seen[pair.ID] {
+				seen[pair.ID] = true
+				add(pair)
+			}
+			return true
+		}
+		for _, pair := range writer.unwritten() {
+			collect(pair)
+		}
+		if err := backend.Scan(hint, collect); err != nil {
+			return nil, err
+		}
+	}
+
+	slices.SortFunc(packets, func(a, b CapturedPacket) int { return b.ID - a.ID })
+	return q.Packets(packets), nil
+}
+
+// pairIDHeap is a container/heap of pair IDs with the lowest on top
+type pairIDHeap []int
+
+func (h pairIDHeap) Len() int           { return len(h) }
+func (h pairIDHeap) Less(i, j int) bool { return h[i] < h[j] }
+func (h pairIDHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *pairIDHeap) Push(x any)        { *h = append(*h, x.(int)) }
+func (h *pairIDHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// findStored looks for a pair on disk, or on its way there
+func (s *PacketStore) findStored(hint ScanHint, match func(PacketPair) bool) (PacketPair, bool) {
+	s.mu.RLock()
+	backend, writer := s.backend, s.writer
+	s.mu.RUnlock()
+	if backend == nil {
+		return PacketPair{}, false
+	}
+
+	for _, pair := range writer.unwritten() {
+		if match(pair) {
+			return pair, true
+		}
+	}
+
+	var found PacketPair
+	ok := false
+	err := backend.Scan(hint, func(pair PacketPair) bool {
+		if match(pair) {
+			found, ok = pair, true
+		}
+		return !ok
+	})
+	if err != nil {
+		log.Printf("Error reading storage: %v\n", err)
+	}
+	return found, ok
+}
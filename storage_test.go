@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// appendPairs writes pairs with the given IDs to a new segment of s
+func appendPairs(t *testing.T, s *SegmentStore, ids ...int) {
+	t.Helper()
+	// Age the open segment so the next append starts another
+	if len(s.segments) > 0 {
+		s.segments[len(s.segments)-1].Created = time.Now().Add(-2 * segmentMaxAge)
+	}
+	for _, id := range ids {
+		pair := PacketPair{ID: id, Timestamp: time.Now(), Request: &CapturedPacket{ID: 2 * id, Type: PacketRequest}}
+		if err := s.Append(pair); err != nil {
+			t.Fatalf("Append(%d): %v", id, err)
+		}
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSegmentStoreScanNewest(t *testing.T) {
+	s, err := OpenSegmentStore(t.TempDir(), Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// A pair is written once it's settled, so a long-pending one can land
+	// in a later segment than newer pairs
+	appendPairs(t, s, 1, 2, 4)
+	appendPairs(t, s, 5, 3, 7)
+	appendPairs(t, s, 8, 6, 9)
+	if len(s.segments) != 3 {
+		t.Fatalf("got %d segments, want 3", len(s.segments))
+	}
+
+	var ids []int
+	if err := s.ScanNewest(ScanHint{}, func(pair PacketPair) bool {
+		ids = append(ids, pair.ID)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{9, 8, 7, 6, 5, 4, 3, 2, 1}; !slices.Equal(ids, want) {
+		t.Errorf("ScanNewest = %v, want %v", ids, want)
+	}
+
+	// Stopping early still hands on the newest first
+	ids = nil
+	s.ScanNewest(ScanHint{}, func(pair PacketPair) bool {
+		ids = append(ids, pair.ID)
+		return len(ids) < 2
+	})
+	if want := []int{9, 8}; !slices.Equal(ids, want) {
+		t.Errorf("ScanNewest stopped after 2 = %v, want %v", ids, want)
+	}
+}
+
+func TestQueryPairsLimitReadsNewestFromDisk(t *testing.T) {
+	backend, err := OpenSegmentStore(t.TempDir(), Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewPacketStore(3, 0)
+	if err := store.SetBackend(backend); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for i := range 10 {
+		at := start.Add(time.Duration(i) * time.Millisecond)
+		key := fmt.Sprintf("conn-%d", i)
+		store.Add(CapturedPacket{Type: PacketRequest, Timestamp: at, Method: "GET", URL: "/", PairKey: key})
+		store.Add(CapturedPacket{Type: PacketResponse, Timestamp: at, StatusCode: 200, PairKey: key})
+	}
+
+	// Pairs 1-7 were evicted; some may still be queued for the disk
+	pairs, err := store.QueryPairs(Query{Limit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for _, pair := range pairs {
+		ids = append(ids, pair.ID)
+	}
+	if want := []int{10, 9, 8, 7, 6}; !slices.Equal(ids, want) {
+		t.Errorf("QueryPairs(limit 5) = %v, want %v", ids, want)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var stored []int
+	backend, err = OpenSegmentStore(backend.dir, Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	backend.Scan(ScanHint{}, func(pair PacketPair) bool {
+		stored = append(stored, pair.ID)
+		return true
+	})
+	slices.Sort(stored)
+	if want := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}; !slices.Equal(stored, want) {
+		t.Errorf("stored after Close = %v, want %v", stored, want)
+	}
+}
+
+func TestSegmentStorePermissions(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	s, err := OpenSegmentStore(dir, Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendPairs(t, s, 1)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]os.FileMode{dir: 0o700, filepath.Join(dir, segmentIndex): 0o600}
+	for _, seg := range s.segments {
+		want[filepath.Join(dir, seg.Name)] = 0o600
+	}
+	for path, mode := range want {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("%s has mode %v, want %v", filepath.Base(path), info.Mode().Perm(), mode)
+		}
+	}
+}
+
+func TestSegmentStoreExpire(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSegmentStore(dir, Retention{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendPairs(t, s, 1)
+	if err := s.Expire(); err != nil || len(s.segments) != 1 {
+		t.Fatalf("Expire kept %d segments, %v; want the fresh one", len(s.segments), err)
+	}
+
+	// Nothing more is appended, but the segment still ages out
+	name := s.segments[0].Name
+	s.segments[0].Created = time.Now().Add(-2 * segmentMaxAge)
+	s.segments[0].End = time.Now().Add(-2 * time.Hour)
+	if err := s.Expire(); err != nil || len(s.segments) != 0 {
+		t.Fatalf("Expire kept %d segments, %v; want none", len(s.segments), err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+		t.Errorf("expired segment still on disk: %v", err)
+	}
+
+	// The next append starts a new segment
+	appendPairs(t, s, 2)
+	if len(s.segments) != 1 || s.segments[0].FirstPair != 2 {
+		t.Errorf("segments after expiring = %+v", s.segments)
+	}
+}
+
+func TestQueryPacketsReadsDisk(t *testing.T) {
+	backend, err := OpenSegmentStore(t.TempDir(), Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewPacketStore(2, 0)
+	if err := store.SetBackend(backend); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// Both requests go out before either response, so packet IDs interleave pairs
+	start := time.Now()
+	for i := range 3 {
+		at := start.Add(time.Duration(i) * time.Millisecond)
+		a, b := fmt.Sprintf("a-%d", i), fmt.Sprintf("b-%d", i)
+		store.Add(CapturedPacket{Type: PacketRequest, Timestamp: at, Method: "GET", URL: "/a", PairKey: a})
+		store.Add(CapturedPacket{Type: PacketRequest, Timestamp: at, Method: "POST", URL: "/b", PairKey: b})
+		store.Add(CapturedPacket{Type: PacketResponse, Timestamp: at, StatusCode: 200, PairKey: a})
+		store.Add(CapturedPacket{Type: PacketResponse, Timestamp: at, StatusCode: 500, PairKey: b})
+	}
+
+	ids := func(q Query) []int {
+		t.Helper()
+		packets, err := store.QueryPackets(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int
+		for _, p := range packets {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+	// Only the last two pairs are in memory
+	if got, want := ids(Query{}), []int{12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1}; !slices.Equal(got, want) {
+		t.Errorf("all packets = %v, want %v", got, want)
+	}
+	filter, _ := ParseFilter(`method == "POST" || status >= 500`)
+	if got, want := ids(Query{Filter: filter, Limit: 4}), []int{12, 10, 8, 6}; !slices.Equal(got, want) {
+		t.Errorf("POST or 5xx packets, limit 4 = %v, want %v", got, want)
+	}
+}
+
+// countingBackend is a StorageBackend that only counts what it's asked to do
+type countingBackend struct {
+	hold chan struct{} // if set, appends wait for it to close
+
+	mu       sync.Mutex
+	appended int
+	ids      []int
+	flushes  int
+}
+
+func (b *countingBackend) Append(pair PacketPair) error {
+	if b.hold != nil {
+		<-b.hold
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.appended++
+	b.ids = append(b.ids, pair.ID)
+	return nil
+}
+
+func (b *countingBackend) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushes++
+	return nil
+}
+
+func (b *countingBackend) Scan(ScanHint, func(PacketPair) bool) error       { return nil }
+func (b *countingBackend) ScanNewest(ScanHint, func(PacketPair) bool) error { return nil }
+func (b *countingBackend) Expire() error                                    { return nil }
+func (b *countingBackend) Clear() error                                     { return nil }
+func (b *countingBackend) Close() error                                     { return nil }
+
+func TestStorageWriterFlushesInBatches(t *testing.T) {
+	backend := &countingBackend{}
+	w := newStorageWriter(backend)
+	for id := 1; id <= 2*storageFlushBatch; id++ {
+		w.add(PacketPair{ID: id})
+	}
+	w.close()
+
+	// Two full batches, and maybe a timed flush if the writer was slow
+	if backend.appended != 2*storageFlushBatch || backend.flushes < 2 || backend.flushes > 3 {
+		t.Errorf("appended %d pairs with %d flushes", backend.appended, backend.flushes)
+	}
+	if n := len(w.unwritten()); n != 0 {
+		t.Errorf("%d pairs still unwritten after close", n)
+	}
+}
+
+func TestStorageWriterAddDoesNotBlock(t *testing.T) {
+	backend := &countingBackend{hold: make(chan struct{})}
+	w := newStorageWriter(backend)
+
+	// The store adds pairs with its lock held, so a stuck disk mustn't stop it
+	added := make(chan struct{})
+	n := storageWriterQueue + 100
+	go func() {
+		for id := 1; id <= n; id++ {
+			w.add(PacketPair{ID: id})
+		}
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("add blocked while the backend was stuck")
+	}
+	if got := len(w.unwritten()); got != n {
+		t.Errorf("%d pairs waiting, want %d", got, n)
+	}
+
+	// Once the backend catches up everything is written, in order
+	close(backend.hold)
+	w.close()
+	want := make([]int, n)
+	for i := range want {
+		want[i] = i + 1
+	}
+	if !slices.Equal(backend.ids, want) {
+		t.Errorf("appended %d pairs, not 1 to %d in order", len(backend.ids), n)
+	}
+}
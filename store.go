@@ -1,6 +1,10 @@
 package main
 
 import (
+	"log"
+	"net/http"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,6 +22,8 @@ type CapturedPacket struct {
 	ID          int               `json:"id"`
 	Type        PacketType        `json:"type"`
 	Timestamp   time.Time         `json:"timestamp"`
+	StartTime   time.Time         `json:"startTime"`
+	EndTime     time.Time         `json:"endTime"`
 	Method      string            `json:"method,omitempty"`
 	URL         string            `json:"url,omitempty"`
 	Host        string            `json:"host,omitempty"`
@@ -25,132 +31,798 @@ type CapturedPacket struct {
 	StatusCode  int               `json:"statusCode,omitempty"`
 	ContentType string            `json:"contentType"`
 	BodySize    int               `json:"bodySize"`
-	Body        string            `json:"body"`
+	Body        []byte            `json:"-"`
+	MimeType    string            `json:"mimeType,omitempty"`
+	WireSize    int               `json:"wireSize"`
+	RawBody     []byte            `json:"-"`
+	Encoding    string            `json:"contentEncoding,omitempty"`
+	DecodeError string            `json:"decodeError,omitempty"`
 	Headers     map[string]string `json:"headers"`
+	Trailers    map[string]string `json:"trailers,omitempty"`
+	GRPC        *GRPCBody         `json:"grpc,omitempty"`
+	Streaming   bool              `json:"streaming,omitempty"` // the body is still arriving
+	Events      *EventLog         `json:"events,omitempty"`    // for a text/event-stream response
+	Incomplete  bool              `json:"incomplete,omitempty"`
+	Missing     int64             `json:"missingBytes,omitempty"`
+	Truncated   bool              `json:"truncated,omitempty"` // only the first maxDecodedBodySize bytes of the body were kept
 	Protocol    string            `json:"protocol"`
 	Connection  string            `json:"connection"`
 	PairKey     string            `json:"pairKey"`
+	ServicePort int               `json:"servicePort"`
+	Service     string            `json:"service,omitempty"`
 }
 
 // PacketPair represents a correlated request/response pair
 type PacketPair struct {
-	ID        int             `json:"id"`
-	Timestamp time.Time       `json:"timestamp"`
-	Request   *CapturedPacket `json:"request,omitempty"`
-	Response  *CapturedPacket `json:"response,omitempty"`
+	ID         int               `json:"id"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Request    *CapturedPacket   `json:"request,omitempty"`
+	Response   *CapturedPacket   `json:"response,omitempty"`
+	Interim    []InterimResponse `json:"interim,omitempty"` // 1xx responses sent before the final one
+	Timing     PairTiming        `json:"timing"`
+	TLS        *TLSConnection    `json:"tls,omitempty"`        // set for an encrypted connection instead of an exchange
+	ParseError *ParseError       `json:"parseError,omitempty"` // set for bytes that couldn't be parsed instead of an exchange
+	WebSocket  *WebSocketLog     `json:"websocket,omitempty"`
+
+	persisted bool // already handed to the storage backend
+}
+
+// PairTiming breaks an exchange down using packet capture timestamps
+type PairTiming struct {
+	RequestStart  time.Time `json:"requestStart,omitzero"`
+	RequestEnd    time.Time `json:"requestEnd,omitzero"`
+	ResponseStart time.Time `json:"responseStart,omitzero"`
+	ResponseEnd   time.Time `json:"responseEnd,omitzero"`
+
+	UploadMs   float64 `json:"uploadMs"`   // first to last request byte
+	TTFBMs     float64 `json:"ttfbMs"`     // last request byte to first response byte
+	DownloadMs float64 `json:"downloadMs"` // first to last response byte
+	TotalMs    float64 `json:"totalMs"`    // first request byte to last response byte
+}
+
+// update recomputes the timing from the pair's request and response
+func (t *PairTiming) update(pair *PacketPair) {
+	if pair.Request != nil {
+		t.RequestStart = pair.Request.StartTime
+		t.RequestEnd = pair.Request.EndTime
+	}
+	if pair.Response != nil {
+		t.ResponseStart = pair.Response.StartTime
+		t.ResponseEnd = pair.Response.EndTime
+	}
+	t.UploadMs = durationMs(t.RequestStart, t.RequestEnd)
+	t.TTFBMs = durationMs(t.RequestEnd, t.ResponseStart)
+	t.DownloadMs = durationMs(t.ResponseStart, t.ResponseEnd)
+	t.TotalMs = durationMs(t.RequestStart, t.ResponseEnd)
+}
+
+// String formats the known durations for console output
+func (t PairTiming) String() string {
+	var parts []string
+	if !t.RequestStart.IsZero() {
+		parts = append(parts, "upload "+formatMs(t.UploadMs))
+	}
+	if !t.RequestEnd.IsZero() && !t.ResponseStart.IsZero() {
+		parts = append(parts, "TTFB "+formatMs(t.TTFBMs))
+	}
+	if !t.ResponseStart.IsZero() {
+		parts = append(parts, "download "+formatMs(t.DownloadMs))
+	}
+	if !t.RequestStart.IsZero() && !t.ResponseEnd.IsZero() {
+		parts = append(parts, "total "+formatMs(t.TotalMs))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// durationMs returns the milliseconds between two times, or 0 if either is unknown
+func durationMs(from, to time.Time) float64 {
+	if from.IsZero() || to.IsZero() {
+		return 0
+	}
+	return float64(to.Sub(from)) / float64(time.Millisecond)
+}
+
+func formatMs(ms float64) string {
+	return time.Duration(ms * float64(time.Millisecond)).Round(time.Microsecond).String()
+}
+
+// ServicePort returns the monitored port the pair was captured on
+func (p PacketPair) ServicePort() int {
+	if p.Request != nil {
+		return p.Request.ServicePort
+	}
+	if p.Response != nil {
+		return p.Response.ServicePort
+	}
+	if p.TLS != nil {
+		return p.TLS.ServicePort
+	}
+	if p.ParseError != nil {
+		return p.ParseError.ServicePort
+	}
+	return 0
+}
+
+// pairQueue tracks the unmatched exchanges of one connection in FIFO order.
+// Each direction of a connection is parsed by its own goroutine, so a response
+// can reach the store before the request it answers.
+type pairQueue struct {
+	awaitingResponse []int
+	awaitingRequest  []int
+	interim          []InterimResponse // seen while no request was waiting for a response
 }
 
-// PacketStore holds captured packets in memory
+// pairOverhead approximates the memory a pair uses besides its variable-size fields
+const pairOverhead = 1024
+
+// PacketStore holds captured pairs in memory, in a ring buffer limited by both
+// pair count and bytes. Stored pairs are never modified: an update replaces
+// the pair with a new copy, so readers can take a snapshot of the pointers and
+// read the pairs after letting go of the lock.
 type PacketStore struct {
 	mu       sync.RWMutex
-	packets  []CapturedPacket
-	pairs    map[string]*PacketPair
-	pairList []*PacketPair
-	maxSize  int
+	ring     []*PacketPair // oldest at head
+	head     int
+	count    int
+	index    map[int]int // pair ID -> ring position
+	packets  map[int]int // packet ID -> pair ID
+	pairs    map[string]*pairQueue
+	maxBytes int64
+	bytes    int64
+	evicted  int
 	nextID   int
 	nextPair int
+	loss     map[string]StreamLoss // streams that lost data, by connection
+	lossAll  LossStats
+
+	subscribers      map[chan PairEvent]struct{}
+	pendingEvictions []int
+	wsPublished      map[int]time.Time   // when each WebSocket pair's messages were last published
+	wsPending        map[int]*time.Timer // catch-up publishes of WebSocket pairs held back since
+	backend          StorageBackend
+	writer           *storageWriter // appends to backend
 }
 
 // Global packet store
-var Store = NewPacketStore(500)
+var Store = NewPacketStore(500, 256<<20)
 
-// NewPacketStore creates a new packet store with a maximum size
-func NewPacketStore(maxSize int) *PacketStore {
+// NewPacketStore creates a new packet store holding at most maxPairs pairs
+// and, approximately, maxBytes of captured data (0 for no byte limit)
+func NewPacketStore(maxPairs int, maxBytes int64) *PacketStore {
 	return &PacketStore{
-		packets:  make([]CapturedPacket, 0),
-		pairs:    make(map[string]*PacketPair),
-		pairList: make([]*PacketPair, 0),
-		maxSize:  maxSize,
+		ring:     make([]*PacketPair, max(maxPairs, 1)),
+		index:    make(map[int]int),
+		packets:  make(map[int]int),
+		pairs:    make(map[string]*pairQueue),
+		loss:     make(map[string]StreamLoss),
+		maxBytes: maxBytes,
 		nextID:   1,
 		nextPair: 1,
+
+		subscribers: make(map[chan PairEvent]struct{}),
+		wsPublished: make(map[int]time.Time),
+		wsPending:   make(map[int]*time.Timer),
 	}
 }
 
-// Add adds a new packet to the store
-func (s *PacketStore) Add(p CapturedPacket) {
+// Add adds a new packet to the store and returns the pair it was matched into
+func (s *PacketStore) Add(p CapturedPacket) PacketPair {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	p.ID = s.nextID
 	s.nextID++
 
-	s.packets = append(s.packets, p)
+	// Track request/response pairs. Exchanges on a connection are answered
+	// in order, so the Nth request pairs with the Nth response.
+	var pair *PacketPair
+	queue, exists := s.pairs[p.PairKey]
+	if !exists {
+		queue = &pairQueue{}
+	}
 
-	// Track request/response pairs
-	if p.PairKey != "" {
-		if pair, exists := s.pairs[p.PairKey]; exists {
-			if p.Type == PacketRequest {
-				pair.Request = &p
-			} else {
-				pair.Response = &p
+	if p.Type == PacketRequest {
+		if id, ok := s.dequeue(&queue.awaitingRequest); ok {
+			pair = s.copyPair(id)
+			pair.Request = &p
+			pair.Timestamp = p.Timestamp
+		} else {
+			pair = s.newPair(p.Timestamp)
+			pair.Request = &p
+			// Held 1xx responses came before the next final response, which
+			// answers this request if it's the first one waiting. A request
+			// matched to a response that's already stored was answered before them.
+			if len(queue.awaitingResponse) == 0 {
+				pair.Interim, queue.interim = queue.interim, nil
 			}
+			queue.awaitingResponse = append(queue.awaitingResponse, pair.ID)
+		}
+	} else {
+		if id, ok := s.dequeue(&queue.awaitingResponse); ok {
+			pair = s.copyPair(id)
+			pair.Response = &p
 		} else {
-			pair := &PacketPair{
-				ID:        s.nextPair,
-				Timestamp: p.Timestamp,
+			pair = s.newPair(p.Timestamp)
+			pair.Response = &p
+			// Held 1xx responses came right before this one
+			pair.Interim, queue.interim = queue.interim, nil
+			queue.awaitingRequest = append(queue.awaitingRequest, pair.ID)
+		}
+	}
+	pair.Timing.update(pair)
+	linkGRPC(pair)
+
+	// Packets without a connection can't be matched, so don't wait on them
+	if p.PairKey == "" || (len(queue.awaitingResponse) == 0 && len(queue.awaitingRequest) == 0 && len(queue.interim) == 0) {
+		delete(s.pairs, p.PairKey)
+	} else {
+		s.pairs[p.PairKey] = queue
+	}
+
+	if !pair.persisted && pair.complete() {
+		pair.persisted = true
+		s.persist(*pair)
+	}
+	s.packets[p.ID] = pair.ID
+	s.put(pair)
+	s.publish(PairEvent{Type: EventPair, Pair: *pair})
+
+	s.trim()
+	return *pair
+}
+
+// UpdatePacket replaces the request or response of a pair that was stored
+// before its body had been read, persisting the pair once it's complete
+func (s *PacketStore) UpdatePacket(pairID int, p CapturedPacket) PacketPair {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.index[pairID]; !ok {
+		return PacketPair{ID: pairID} // already evicted
+	}
+	pair := s.copyPair(pairID)
+	old := &pair.Response
+	if p.Type == PacketRequest {
+		old = &pair.Request
+	}
+	if *old != nil {
+		p.ID = (*old).ID
+	} else {
+		p.ID = s.nextID
+		s.nextID++
+		s.packets[p.ID] = pair.ID
+	}
+	*old = &p
+	pair.Timing.update(pair)
+	linkGRPC(pair)
+
+	if !pair.persisted && pair.complete() {
+		pair.persisted = true
+		s.persist(*pair)
+	}
+	s.put(pair)
+	s.publish(PairEvent{Type: EventPair, Pair: *pair})
+	s.trim()
+	return *pair
+}
+
+// complete reports whether a pair has both sides and nothing more to come,
+// so it can be persisted
+func (p *PacketPair) complete() bool {
+	if p.Request == nil || p.Response == nil || p.Request.Streaming || p.Response.Streaming {
+		return false
+	}
+	// An upgraded connection's pair is persisted once its messages are in
+	return p.Response.StatusCode != http.StatusSwitchingProtocols
+}
+
+// InFlightRequest is a request still waiting for its response
+type InFlightRequest struct {
+	PairID      int       `json:"pairId"`
+	Method      string    `json:"method"`
+	URL         string    `json:"url"`
+	Host        string    `json:"host"`
+	Connection  string    `json:"connection"`
+	ServicePort int       `json:"servicePort"`
+	Service     string    `json:"service,omitempty"`
+	StartTime   time.Time `json:"startTime"`
+	ElapsedMs   float64   `json:"elapsedMs"`
+	Uploading   bool      `json:"uploading,omitempty"` // the request body is still arriving
+}
+
+// InFlight returns the requests still waiting for a response on open
+// connections, oldest first, timed up to now
+func (s *PacketStore) InFlight(now time.Time) []InFlightRequest {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []InFlightRequest{}
+	for _, queue := range s.pairs {
+		for _, id := range queue.awaitingResponse {
+			pos, ok := s.index[id]
+			if !ok || s.ring[pos].Request == nil {
+				continue
 			}
-			s.nextPair++
-			if p.Type == PacketRequest {
-				pair.Request = &p
-			} else {
-				pair.Response = &p
+			req := s.ring[pos].Request
+			result = append(result, InFlightRequest{
+				PairID:      id,
+				Method:      req.Method,
+				URL:         req.URL,
+				Host:        req.Host,
+				Connection:  req.Connection,
+				ServicePort: req.ServicePort,
+				Service:     req.Service,
+				StartTime:   req.StartTime,
+				ElapsedMs:   durationMs(req.StartTime, now),
+				Uploading:   req.Streaming,
+			})
+		}
+	}
+	slices.SortFunc(result, func(a, b InFlightRequest) int { return a.PairID - b.PairID })
+	return result
+}
+
+// EndConnection stops waiting for responses on a connection that has closed,
+// including on each of its HTTP/2 streams
+func (s *PacketStore) EndConnection(pairKey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, queue := range s.pairs {
+		if key != pairKey && !strings.HasPrefix(key, pairKey+"#") {
+			continue
+		}
+		queue.awaitingResponse = nil
+		if len(queue.awaitingRequest) == 0 {
+			delete(s.pairs, key)
+		}
+	}
+}
+
+// AddInterim adds a 1xx response to the exchange waiting for its final
+// response on a connection. With none waiting it's held for the exchange
+// whose final response comes next. Without a connection there's nothing to
+// attach it to, so it's dropped.
+func (s *PacketStore) AddInterim(pairKey string, interim InterimResponse) {
+	if pairKey == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue, exists := s.pairs[pairKey]
+	if !exists || len(queue.awaitingResponse) == 0 {
+		if !exists {
+			queue = &pairQueue{}
+			s.pairs[pairKey] = queue
+		}
+		queue.interim = append(queue.interim, interim)
+		return
+	}
+
+	pair := s.copyPair(queue.awaitingResponse[0])
+	pair.Interim = append(slices.Clip(pair.Interim), interim)
+	s.put(pair)
+	s.publish(PairEvent{Type: EventPair, Pair: *pair})
+
+	s.trim()
+}
+
+// RecordLoss updates what reassembly couldn't deliver on a stream, keeping
+// the maxLossEntries streams seen most recently
+func (s *PacketStore) RecordLoss(loss StreamLoss) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.loss[loss.Connection]
+	if !ok {
+		s.lossAll.Streams++
+	}
+	s.lossAll.Gaps += loss.Gaps - old.Gaps
+	s.lossAll.MissingBytes += loss.MissingBytes - old.MissingBytes
+	s.lossAll.Retransmissions += loss.Retransmissions - old.Retransmissions
+	s.loss[loss.Connection] = loss
+
+	if len(s.loss) > maxLossEntries {
+		oldest := ""
+		for key, l := range s.loss {
+			if oldest == "" || l.LastSeen.Before(s.loss[oldest].LastSeen) {
+				oldest = key
 			}
-			s.pairs[p.PairKey] = pair
-			s.pairList = append(s.pairList, pair)
 		}
+		delete(s.loss, oldest)
+	}
+}
+
+// Loss returns the streams that lost data, most recently affected first
+func (s *PacketStore) Loss() []StreamLoss {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]StreamLoss, 0, len(s.loss))
+	for _, loss := range s.loss {
+		result = append(result, loss)
 	}
+	slices.SortFunc(result, func(a, b StreamLoss) int { return b.LastSeen.Compare(a.LastSeen) })
+	return result
+}
 
-	// Trim old packets if we exceed maxSize
-	if len(s.packets) > s.maxSize {
-		s.packets = s.packets[len(s.packets)-s.maxSize:]
+// RecordTLS stores an encrypted connection as a pair of its own, creating it
+// when id is 0 and otherwise replacing it, and returns the pair's ID. done
+// marks the connection as closed, which persists it.
+func (s *PacketStore) RecordTLS(id int, conn TLSConnection, done bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pair *PacketPair
+	if id == 0 {
+		pair = s.newPair(conn.StartTime)
+	} else if _, ok := s.index[id]; ok {
+		pair = s.copyPair(id)
+	} else {
+		return id // already evicted
+	}
+	pair.TLS = &conn
+	pair.Timing = PairTiming{TotalMs: conn.DurationMs}
+
+	if done && !pair.persisted {
+		pair.persisted = true
+		s.persist(*pair)
 	}
+	s.put(pair)
+	s.publish(PairEvent{Type: EventPair, Pair: *pair})
 
-	// Trim old pairs
-	if len(s.pairList) > s.maxSize {
-		// Remove old pairs from map
-		for _, oldPair := range s.pairList[:len(s.pairList)-s.maxSize] {
-			if oldPair.Request != nil {
-				delete(s.pairs, oldPair.Request.PairKey)
-			} else if oldPair.Response != nil {
-				delete(s.pairs, oldPair.Response.PairKey)
+	s.trim()
+	return pair.ID
+}
+
+// RecordParseError stores bytes that couldn't be parsed as a pair of its own
+func (s *PacketStore) RecordParseError(e ParseError) PacketPair {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pair := s.newPair(e.Timestamp)
+	pair.ParseError = &e
+	pair.persisted = true
+	s.persist(*pair)
+	s.put(pair)
+	s.publish(PairEvent{Type: EventPair, Pair: *pair})
+
+	s.trim()
+	return *pair
+}
+
+// AddWebSocketMessage adds a message to the pair whose exchange upgraded the
+// connection, dropping the pair's oldest message when it has too many
+func (s *PacketStore) AddWebSocketMessage(pairID int, msg WebSocketMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.index[pairID]; !ok {
+		return
+	}
+	pair := s.copyPair(pairID)
+	var ws WebSocketLog
+	if pair.WebSocket != nil {
+		ws = *pair.WebSocket
+	}
+	if len(ws.Messages) >= maxWebSocketMessages {
+		ws.Messages = ws.Messages[1:]
+		ws.Dropped++
+	}
+	ws.Messages = append(ws.Messages, msg)
+	pair.WebSocket = &ws
+
+	s.put(pair)
+	s.publishWebSocket(pairID)
+	s.trim()
+}
+
+// publishWebSocket tells subscribers about a WebSocket pair's new messages.
+// Messages often come in bursts, so it publishes at most every
+// streamSyncInterval and catches up on the rest once the burst is over.
+// Must be called with s.mu held.
+func (s *PacketStore) publishWebSocket(pairID int) {
+	if _, ok := s.wsPending[pairID]; ok {
+		return
+	}
+	if wait := streamSyncInterval - time.Since(s.wsPublished[pairID]); wait > 0 {
+		s.wsPending[pairID] = time.AfterFunc(wait, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.wsPending, pairID)
+			if pos, ok := s.index[pairID]; ok {
+				s.wsPublished[pairID] = time.Now()
+				s.publish(PairEvent{Type: EventPair, Pair: *s.ring[pos]})
 			}
+		})
+		return
+	}
+	s.wsPublished[pairID] = time.Now()
+	s.publish(PairEvent{Type: EventPair, Pair: *s.ring[s.index[pairID]]})
+}
+
+// forgetWebSocket stops holding back updates of a WebSocket pair
+func (s *PacketStore) forgetWebSocket(pairID int) {
+	if timer, ok := s.wsPending[pairID]; ok {
+		timer.Stop()
+		delete(s.wsPending, pairID)
+	}
+	delete(s.wsPublished, pairID)
+}
+
+// CloseWebSocket marks an upgraded connection as ended and persists its pair
+func (s *PacketStore) CloseWebSocket(pairID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.index[pairID]; !ok {
+		return
+	}
+	pair := s.copyPair(pairID)
+	ws := WebSocketLog{}
+	if pair.WebSocket != nil {
+		ws = *pair.WebSocket
+	}
+	ws.Closed = true
+	pair.WebSocket = &ws
+	s.forgetWebSocket(pairID)
+	if !pair.persisted {
+		pair.persisted = true
+		s.persist(*pair)
+	}
+	s.put(pair)
+	s.publish(PairEvent{Type: EventPair, Pair: *pair})
+}
+
+// dequeue pops the oldest pair ID from a queue that's still in memory
+func (s *PacketStore) dequeue(queue *[]int) (int, bool) {
+	for len(*queue) > 0 {
+		id := (*queue)[0]
+		*queue = (*queue)[1:]
+		if _, ok := s.index[id]; ok {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// copyPair returns a copy of a stored pair that can be modified and put back
+func (s *PacketStore) copyPair(id int) *PacketPair {
+	pair := *s.ring[s.index[id]]
+	return &pair
+}
+
+// newPair returns a new, empty pair with the next ID
+func (s *PacketStore) newPair(timestamp time.Time) *PacketPair {
+	pair := &PacketPair{
+		ID:        s.nextPair,
+		Timestamp: timestamp,
+	}
+	s.nextPair++
+	return pair
+}
+
+// put stores a pair, replacing the previous version if there is one
+func (s *PacketStore) put(pair *PacketPair) {
+	if pos, ok := s.index[pair.ID]; ok {
+		s.bytes += pairSize(pair) - pairSize(s.ring[pos])
+		s.ring[pos] = pair
+		return
+	}
+
+	if s.count == len(s.ring) {
+		s.evictOldest()
+	}
+	pos := (s.head + s.count) % len(s.ring)
+	s.ring[pos] = pair
+	s.index[pair.ID] = pos
+	s.count++
+	s.bytes += pairSize(pair)
+}
+
+// trim evicts the oldest pairs until the store is under its byte limit and
+// tells subscribers about everything evicted since the last trim. The newest
+// pair is always kept, which is never more than its two bodies of at most
+// maxDecodedBodySize each.
+func (s *PacketStore) trim() {
+	for s.maxBytes > 0 && s.bytes > s.maxBytes && s.count > 1 {
+		s.evictOldest()
+	}
+	if len(s.pendingEvictions) > 0 {
+		s.publish(PairEvent{Type: EventEvict, IDs: s.pendingEvictions})
+		s.pendingEvictions = nil
+	}
+}
+
+// evictOldest drops the pair at the head of the ring, stopping anything from
+// waiting on it and letting its bodies be garbage collected
+func (s *PacketStore) evictOldest() {
+	pair := s.ring[s.head]
+	s.ring[s.head] = nil
+	s.head = (s.head + 1) % len(s.ring)
+	s.count--
+	s.bytes -= pairSize(pair)
+	s.evicted++
+
+	delete(s.index, pair.ID)
+	for _, p := range []*CapturedPacket{pair.Request, pair.Response} {
+		if p != nil {
+			delete(s.packets, p.ID)
 		}
-		s.pairList = s.pairList[len(s.pairList)-s.maxSize:]
 	}
+	s.forgetPair(pair)
+	s.forgetWebSocket(pair.ID)
+	if !pair.persisted {
+		s.persist(*pair)
+	}
+	s.pendingEvictions = append(s.pendingEvictions, pair.ID)
+}
+
+// forgetPair removes a pair from its connection's queue
+func (s *PacketStore) forgetPair(pair *PacketPair) {
+	var pairKey string
+	if pair.Request != nil {
+		pairKey = pair.Request.PairKey
+	} else if pair.Response != nil {
+		pairKey = pair.Response.PairKey
+	}
+
+	queue, exists := s.pairs[pairKey]
+	if !exists {
+		return
+	}
+	queue.awaitingResponse = slices.DeleteFunc(queue.awaitingResponse, func(id int) bool { return id == pair.ID })
+	queue.awaitingRequest = slices.DeleteFunc(queue.awaitingRequest, func(id int) bool { return id == pair.ID })
+	// 1xx responses held on a connection this old won't find their exchange
+	queue.interim = nil
+	if len(queue.awaitingResponse) == 0 && len(queue.awaitingRequest) == 0 {
+		delete(s.pairs, pairKey)
+	}
+}
+
+// pairSize approximates the memory held by a pair
+func pairSize(pair *PacketPair) int64 {
+	size := int64(pairOverhead)
+	for _, p := range []*CapturedPacket{pair.Request, pair.Response} {
+		if p == nil {
+			continue
+		}
+		size += int64(len(p.Body) + len(p.RawBody) + len(p.URL) + len(p.Status) + len(p.Connection) + len(p.PairKey))
+		for key, value := range p.Headers {
+			size += int64(len(key) + len(value))
+		}
+		for key, value := range p.Trailers {
+			size += int64(len(key) + len(value))
+		}
+		if p.Events != nil {
+			for _, event := range p.Events.Events {
+				size += int64(len(event.Data) + len(event.ID) + len(event.Event) + 64)
+			}
+		}
+	}
+	for _, interim := range pair.Interim {
+		size += 64
+		for key, value := range interim.Headers {
+			size += int64(len(key) + len(value))
+		}
+	}
+	if pair.WebSocket != nil {
+		for _, msg := range pair.WebSocket.Messages {
+			size += int64(len(msg.Data) + len(msg.Error) + 64)
+		}
+	}
+	if pair.TLS != nil {
+		size += int64(len(pair.TLS.Connection) + len(pair.TLS.PairKey) + len(pair.TLS.JA3String))
+	}
+	if pair.ParseError != nil {
+		size += int64(len(pair.ParseError.Connection) + len(pair.ParseError.PairKey) + len(pair.ParseError.Error) + len(pair.ParseError.Snippet))
+	}
+	return size
+}
+
+// snapshot returns the stored pairs, newest first. The pairs themselves are
+// shared and must not be modified. Must be called with s.mu held.
+func (s *PacketStore) snapshot() []*PacketPair {
+	result := make([]*PacketPair, s.count)
+	for i := 0; i < s.count; i++ {
+		result[s.count-1-i] = s.ring[(s.head+i)%len(s.ring)]
+	}
+	return result
 }
 
 // GetAll returns all captured packets (newest first)
 func (s *PacketStore) GetAll() []CapturedPacket {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	pairs := s.snapshot()
+	s.mu.RUnlock()
 
-	// Return a copy in reverse order (newest first)
-	result := make([]CapturedPacket, len(s.packets))
-	for i, p := range s.packets {
-		result[len(s.packets)-1-i] = p
+	result := make([]CapturedPacket, 0, 2*len(pairs))
+	for _, pair := range pairs {
+		for _, p := range []*CapturedPacket{pair.Request, pair.Response} {
+			if p != nil {
+				result = append(result, *p)
+			}
+		}
 	}
+	slices.SortFunc(result, func(a, b CapturedPacket) int { return b.ID - a.ID })
 	return result
 }
 
 // GetPairs returns all packet pairs (newest first)
 func (s *PacketStore) GetPairs() []PacketPair {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	pairs := s.snapshot()
+	s.mu.RUnlock()
 
-	result := make([]PacketPair, len(s.pairList))
-	for i, p := range s.pairList {
-		result[len(s.pairList)-1-i] = *p
+	result := make([]PacketPair, len(pairs))
+	for i, p := range pairs {
+		result[i] = *p
 	}
 	return result
 }
 
-// Clear removes all packets from the store
+// GetPair returns the pair with the given ID
+func (s *PacketStore) GetPair(id int) (PacketPair, bool) {
+	s.mu.RLock()
+	if pos, ok := s.index[id]; ok {
+		pair := s.ring[pos]
+		s.mu.RUnlock()
+		return *pair, true
+	}
+	s.mu.RUnlock()
+
+	return s.findStored(ScanHint{SinceID: id - 1, BeforeID: id + 1}, func(p PacketPair) bool { return p.ID == id })
+}
+
+// GetPacket returns the packet with the given ID
+func (s *PacketStore) GetPacket(id int) (CapturedPacket, bool) {
+	s.mu.RLock()
+	var pair *PacketPair
+	if pairID, ok := s.packets[id]; ok {
+		pair = s.ring[s.index[pairID]]
+	}
+	s.mu.RUnlock()
+
+	if pair == nil {
+		stored, ok := s.findStored(ScanHint{PacketID: id}, func(p PacketPair) bool {
+			return (p.Request != nil && p.Request.ID == id) || (p.Response != nil && p.Response.ID == id)
+		})
+		if !ok {
+			return CapturedPacket{}, false
+		}
+		pair = &stored
+	}
+	if pair.Request != nil && pair.Request.ID == id {
+		return *pair.Request, true
+	}
+	return *pair.Response, true
+}
+
+// Clear removes all packets from the store, along with the counters and
+// bookkeeping that describe them
 func (s *PacketStore) Clear() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.packets = make([]CapturedPacket, 0)
-	s.pairs = make(map[string]*PacketPair)
-	s.pairList = make([]*PacketPair, 0)
+	clear(s.ring)
+	s.head, s.count, s.bytes, s.evicted = 0, 0, 0, 0
+	s.index = make(map[int]int)
+	s.packets = make(map[int]int)
+	s.pairs = make(map[string]*pairQueue)
+	s.loss = make(map[string]StreamLoss)
+	s.lossAll = LossStats{}
+	s.pendingEvictions = nil
+	for _, timer := range s.wsPending {
+		timer.Stop()
+	}
+	s.wsPublished = make(map[int]time.Time)
+	s.wsPending = make(map[int]*time.Timer)
+	if s.writer != nil {
+		if err := s.writer.clear(); err != nil {
+			log.Printf("Error clearing storage: %v\n", err)
+		}
+	}
+	s.publish(PairEvent{Type: EventClear})
 }
 
 // Count returns the number of stored packets
@@ -159,3 +831,38 @@ func (s *PacketStore) Count() int {
 	defer s.mu.RUnlock()
 	return len(s.packets)
 }
+
+// StoreStats describes how much the store is holding
+type StoreStats struct {
+	Pairs        int   `json:"pairs"`
+	Packets      int   `json:"packets"`
+	MaxPairs     int   `json:"maxPairs"`
+	MemoryBytes  int64 `json:"memoryBytes"`
+	MaxMemory    int64 `json:"maxMemoryBytes"`
+	EvictedPairs int   `json:"evictedPairs"`
+	OldestPairID int   `json:"oldestPairId,omitempty"`
+	NewestPairID int   `json:"newestPairId,omitempty"`
+
+	Loss LossStats `json:"loss"`
+}
+
+// Stats returns the store's current size and limits
+func (s *PacketStore) Stats() StoreStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := StoreStats{
+		Pairs:        s.count,
+		Packets:      len(s.packets),
+		MaxPairs:     len(s.ring),
+		MemoryBytes:  s.bytes,
+		MaxMemory:    s.maxBytes,
+		EvictedPairs: s.evicted,
+		Loss:         s.lossAll,
+	}
+	if s.count > 0 {
+		stats.OldestPairID = s.ring[s.head].ID
+		stats.NewestPairID = s.ring[(s.head+s.count-1)%len(s.ring)].ID
+	}
+	return stats
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storedIDs returns the IDs of the stored pairs, oldest first
+func storedIDs(s *PacketStore) []int {
+	var ids []int
+	for _, pair := range s.GetPairs() {
+		ids = append([]int{pair.ID}, ids...)
+	}
+	return ids
+}
+
+func TestPacketStorePairLimit(t *testing.T) {
+	s := NewPacketStore(3, 0)
+	for i := range 5 {
+		s.Add(CapturedPacket{Type: PacketRequest, Method: "GET", URL: fmt.Sprintf("/%d", i)})
+	}
+	if ids := storedIDs(s); !slices.Equal(ids, []int{3, 4, 5}) {
+		t.Errorf("stored pairs %v, want the newest three", ids)
+	}
+	stats := s.Stats()
+	if stats.Pairs != 3 || stats.Packets != 3 || stats.EvictedPairs != 2 || stats.OldestPairID != 3 || stats.NewestPairID != 5 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if _, ok := s.GetPacket(1); ok {
+		t.Error("the evicted pair's packet is still found")
+	}
+}
+
+func TestPacketStoreByteLimit(t *testing.T) {
+	body := []byte(strings.Repeat("x", 1000))
+	s := NewPacketStore(100, 5*pairOverhead)
+	for range 4 {
+		s.Add(CapturedPacket{Type: PacketRequest, Method: "POST", URL: "/", Body: body})
+	}
+	// Each pair takes a little over 2KB, so only two fit
+	if ids := storedIDs(s); !slices.Equal(ids, []int{3, 4}) {
+		t.Errorf("stored pairs %v, want the newest two", ids)
+	}
+	if stats := s.Stats(); stats.MemoryBytes > stats.MaxMemory || stats.EvictedPairs != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// The newest pair is kept however large it is
+	s.Add(CapturedPacket{Type: PacketRequest, Method: "POST", URL: "/", Body: []byte(strings.Repeat("x", 10*pairOverhead))})
+	if ids := storedIDs(s); !slices.Equal(ids, []int{5}) {
+		t.Errorf("stored pairs %v, want only the large one", ids)
+	}
+}
+
+func TestPacketStoreInFlight(t *testing.T) {
+	s := NewPacketStore(10, 0)
+	start := time.Now()
+	request := func(url string) CapturedPacket {
+		return CapturedPacket{Type: PacketRequest, Method: "GET", URL: url, PairKey: "conn", StartTime: start, Timestamp: start}
+	}
+	s.Add(request("/slow"))
+	s.Add(request("/next"))
+
+	inflight := s.InFlight(start.Add(1500 * time.Millisecond))
+	if len(inflight) != 2 || inflight[0].URL != "/slow" || inflight[1].URL != "/next" || inflight[0].ElapsedMs != 1500 {
+		t.Fatalf("in flight = %+v, want /slow then /next, 1500ms in", inflight)
+	}
+
+	// Responses come back in order, so the first one answers /slow
+	s.Add(CapturedPacket{Type: PacketResponse, StatusCode: 200, PairKey: "conn", Timestamp: start.Add(time.Second)})
+	if inflight := s.InFlight(time.Now()); len(inflight) != 1 || inflight[0].URL != "/next" {
+		t.Errorf("in flight after the first response = %+v, want only /next", inflight)
+	}
+	s.Add(CapturedPacket{Type: PacketResponse, StatusCode: 200, PairKey: "conn", Timestamp: start.Add(time.Second)})
+	if inflight := s.InFlight(time.Now()); len(inflight) != 0 {
+		t.Errorf("in flight after both responses = %+v", inflight)
+	}
+}
+
+func TestWebSocketUpdatesThrottled(t *testing.T) {
+	s := NewPacketStore(10, 0)
+	pair := s.Add(CapturedPacket{Type: PacketRequest, Method: "GET", URL: "/ws", PairKey: "conn"})
+	_, events, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+
+	// A burst of messages is published once straight away, then once more
+	// with the rest of the burst
+	for i := range 10 {
+		s.AddWebSocketMessage(pair.ID, WebSocketMessage{Type: "text", Data: fmt.Append(nil, i)})
+	}
+	var counts []int
+	for len(counts) < 2 {
+		select {
+		case ev := <-events:
+			counts = append(counts, len(ev.Pair.WebSocket.Messages))
+		case <-time.After(time.Second):
+			t.Fatalf("published message counts %v, want a catch-up after the first", counts)
+		}
+	}
+	if !slices.Equal(counts, []int{1, 10}) {
+		t.Errorf("published message counts %v, want [1 10]", counts)
+	}
+
+	// Closing is published at once, and nothing held back follows it
+	s.AddWebSocketMessage(pair.ID, WebSocketMessage{Type: "close"})
+	s.CloseWebSocket(pair.ID)
+	if ev := <-events; !ev.Pair.WebSocket.Closed || len(ev.Pair.WebSocket.Messages) != 11 {
+		t.Errorf("close published %d messages, closed %v", len(ev.Pair.WebSocket.Messages), ev.Pair.WebSocket.Closed)
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected %s event after the close", ev.Type)
+	case <-time.After(2 * streamSyncInterval):
+	}
+}
+
+func TestPacketStoreClear(t *testing.T) {
+	s := NewPacketStore(2, 0)
+	for i := range 3 {
+		s.Add(CapturedPacket{Type: PacketRequest, Method: "GET", URL: fmt.Sprintf("/%d", i), PairKey: "conn"})
+	}
+	s.RecordLoss(StreamLoss{Connection: "a → b", Gaps: 2, MissingBytes: 100, LastSeen: time.Now()})
+	if len(s.InFlight(time.Now())) == 0 || s.Stats().EvictedPairs == 0 || len(s.Loss()) == 0 {
+		t.Fatal("nothing to clear")
+	}
+
+	s.Clear()
+	if stats := s.Stats(); stats != (StoreStats{MaxPairs: 2}) {
+		t.Errorf("stats after clearing = %+v", stats)
+	}
+	if loss := s.Loss(); len(loss) != 0 {
+		t.Errorf("loss after clearing = %+v", loss)
+	}
+	if inflight := s.InFlight(time.Now()); len(inflight) != 0 {
+		t.Errorf("in flight after clearing = %+v", inflight)
+	}
+
+	// A response to a request from before the clear isn't paired with it
+	pair := s.Add(CapturedPacket{Type: PacketResponse, StatusCode: 200, PairKey: "conn"})
+	if pair.Request != nil {
+		t.Errorf("response paired with %s from before the clear", pair.Request.URL)
+	}
+}
+
+// replay stores the messages of one connection in the order given: "> /path"
+// for a request, "< 200" for a response and "< 1xx" for an interim response
+func replay(t *testing.T, s *PacketStore, messages ...string) {
+	t.Helper()
+	for _, msg := range messages {
+		dir, arg, _ := strings.Cut(msg, " ")
+		switch dir {
+		case ">":
+			s.Add(CapturedPacket{Type: PacketRequest, Method: "GET", URL: arg, PairKey: "conn"})
+		case "<":
+			code, err := strconv.Atoi(arg)
+			if err != nil {
+				t.Fatalf("bad status in %q", msg)
+			}
+			if isInterim(code) {
+				s.AddInterim("conn", InterimResponse{StatusCode: code})
+			} else {
+				s.Add(CapturedPacket{Type: PacketResponse, StatusCode: code, PairKey: "conn"})
+			}
+		default:
+			t.Fatalf("bad message %q", msg)
+		}
+	}
+}
+
+// exchanges describes each stored pair as "/path 200", oldest first, with any
+// interim responses after the final one, like "/path 200 103"
+func exchanges(s *PacketStore) []string {
+	var got []string
+	for _, pair := range slices.Backward(s.GetPairs()) {
+		desc := "-"
+		if pair.Request != nil {
+			desc = pair.Request.URL
+		}
+		if pair.Response != nil {
+			desc += " " + strconv.Itoa(pair.Response.StatusCode)
+		}
+		for _, interim := range pair.Interim {
+			desc += " " + strconv.Itoa(interim.StatusCode)
+		}
+		got = append(got, desc)
+	}
+	return got
+}
+
+func TestPacketStoreInterim(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		want     []string
+	}{
+		{
+			name:     "waiting request",
+			messages: []string{"> /a", "< 100", "< 200"},
+			want:     []string{"/a 200 100"},
+		},
+		{
+			name:     "before pipelined requests",
+			messages: []string{"< 103", "> /a", "> /b", "< 200", "< 204"},
+			want:     []string{"/a 200 103", "/b 204"},
+		},
+		{
+			// The first response reaches the store before either request, so
+			// the 1xx is held for the second request, not the first
+			name:     "after a response stored before its request",
+			messages: []string{"< 200", "< 100", "> /a", "> /b", "< 201"},
+			want:     []string{"/a 200", "/b 201 100"},
+		},
+		{
+			name:     "with its final response before the request",
+			messages: []string{"< 100", "< 200", "> /a", "> /b", "< 204"},
+			want:     []string{"/a 200 100", "/b 204"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewPacketStore(10, 0)
+			replay(t, s, tt.messages...)
+			if got := exchanges(s); !slices.Equal(got, tt.want) {
+				t.Errorf("pairs %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Nothing is held for packets without a connection, or once the
+	// connection's waiting exchanges have been evicted
+	s := NewPacketStore(1, 0)
+	s.AddInterim("", InterimResponse{StatusCode: 100})
+	replay(t, s, "< 200", "< 103")
+	s.Add(CapturedPacket{Type: PacketRequest, Method: "GET", URL: "/b", PairKey: "other"})
+	if _, held := s.pairs["conn"]; held || len(s.pairs) != 1 {
+		t.Errorf("kept %d connection queues, want only the one still waiting", len(s.pairs))
+	}
+}
+
+func TestPacketStorePairing(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		want     []string
+		waiting  bool // whether the connection still has unmatched exchanges
+	}{
+		{
+			name:     "keep-alive",
+			messages: []string{"> /a", "< 200", "> /b", "< 404", "> /c", "< 500"},
+			want:     []string{"/a 200", "/b 404", "/c 500"},
+		},
+		{
+			name:     "pipelined",
+			messages: []string{"> /a", "> /b", "> /c", "< 200", "< 404", "< 500"},
+			want:     []string{"/a 200", "/b 404", "/c 500"},
+		},
+		{
+			name:     "response before its request",
+			messages: []string{"< 200", "> /a"},
+			want:     []string{"/a 200"},
+		},
+		{
+			name:     "responses ahead of pipelined requests",
+			messages: []string{"> /a", "< 200", "< 404", "< 500", "> /b", "> /c"},
+			want:     []string{"/a 200", "/b 404", "/c 500"},
+		},
+		{
+			name:     "request still waiting",
+			messages: []string{"> /a", "> /b", "< 200"},
+			want:     []string{"/a 200", "/b"},
+			waiting:  true,
+		},
+		{
+			name:     "response still waiting",
+			messages: []string{"< 200", "< 204", "> /a"},
+			want:     []string{"/a 200", "- 204"},
+			waiting:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewPacketStore(10, 0)
+			replay(t, s, tt.messages...)
+			if got := exchanges(s); !slices.Equal(got, tt.want) {
+				t.Errorf("pairs %q, want %q", got, tt.want)
+			}
+			// A connection's queue is dropped once everything on it is matched
+			if _, waiting := s.pairs["conn"]; waiting != tt.waiting {
+				t.Errorf("connection queue kept = %v, want %v", waiting, tt.waiting)
+			}
+		})
+	}
+
+	// Packets without a connection are never matched or queued
+	s := NewPacketStore(10, 0)
+	s.Add(CapturedPacket{Type: PacketRequest, Method: "GET", URL: "/a"})
+	s.Add(CapturedPacket{Type: PacketResponse, StatusCode: 200})
+	if got := exchanges(s); !slices.Equal(got, []string{"/a", "- 200"}) || len(s.pairs) != 0 {
+		t.Errorf("pairs %q with %d queues, want two unmatched and none", got, len(s.pairs))
+	}
+}
+
+func TestPairTiming(t *testing.T) {
+	at := func(ms int) time.Time {
+		return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).Add(time.Duration(ms) * time.Millisecond)
+	}
+	packet := func(start, end int) *CapturedPacket {
+		return &CapturedPacket{StartTime: at(start), EndTime: at(end)}
+	}
+	tests := []struct {
+		name                          string
+		pair                          PacketPair
+		upload, ttfb, download, total float64
+		text                          string
+	}{
+		{
+			name:   "complete",
+			pair:   PacketPair{Request: packet(0, 10), Response: packet(40, 55)},
+			upload: 10, ttfb: 30, download: 15, total: 55,
+			text: "upload 10ms, TTFB 30ms, download 15ms, total 55ms",
+		},
+		{
+			name:   "waiting for a response",
+			pair:   PacketPair{Request: packet(0, 2)},
+			upload: 2,
+			text:   "upload 2ms",
+		},
+		{
+			name:     "response without a request",
+			pair:     PacketPair{Response: packet(40, 41)},
+			download: 1,
+			text:     "download 1ms",
+		},
+		{
+			name: "response still arriving",
+			pair: PacketPair{Request: packet(0, 0), Response: &CapturedPacket{StartTime: at(5)}},
+			ttfb: 5,
+			text: "upload 0s, TTFB 5ms, download 0s",
+		},
+		{
+			name: "sub-millisecond",
+			pair: PacketPair{Request: packet(0, 0), Response: &CapturedPacket{StartTime: at(0).Add(1500 * time.Microsecond), EndTime: at(2)}},
+			ttfb: 1.5, download: 0.5, total: 2,
+			text: "upload 0s, TTFB 1.5ms, download 500µs, total 2ms",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var timing PairTiming
+			timing.update(&tt.pair)
+			if timing.UploadMs != tt.upload || timing.TTFBMs != tt.ttfb || timing.DownloadMs != tt.download || timing.TotalMs != tt.total {
+				t.Errorf("timing = upload %v, TTFB %v, download %v, total %v; want %v, %v, %v, %v",
+					timing.UploadMs, timing.TTFBMs, timing.DownloadMs, timing.TotalMs, tt.upload, tt.ttfb, tt.download, tt.total)
+			}
+			if got := timing.String(); got != tt.text {
+				t.Errorf("String() = %q, want %q", got, tt.text)
+			}
+		})
+	}
+
+	// The response arriving later fills in the rest
+	pair := PacketPair{Request: packet(0, 10)}
+	var timing PairTiming
+	timing.update(&pair)
+	pair.Response = packet(40, 55)
+	timing.update(&pair)
+	if timing.RequestStart != at(0) || timing.ResponseEnd != at(55) || timing.TotalMs != 55 {
+		t.Errorf("timing after the response = %+v", timing)
+	}
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/gopacket"
@@ -15,13 +20,36 @@ import (
 	"github.com/google/gopacket/tcpassembly/tcpreader"
 )
 
+// maxHeaderSize is the largest header block parsed, and so how much of a
+// stream is buffered to find where one ends
+const maxHeaderSize = 64 << 10
+
 // httpStreamFactory implements tcpassembly.StreamFactory
-type httpStreamFactory struct{}
+type httpStreamFactory struct {
+	ports   PortSet
+	keyLog  *KeyLog        // decrypts TLS streams when set
+	parsing sync.WaitGroup // streams still being read
+
+	mu       sync.Mutex
+	sessions map[string]*tlsSession   // by connection key
+	queues   map[string]*requestQueue // by connection key
+}
 
 // httpStream will handle the actual decoding of http requests.
 type httpStream struct {
 	net, transport gopacket.Flow
 	r              tcpreader.ReaderStream
+	servicePort    int
+	serviceLabel   string
+	factory        *httpStreamFactory
+	session        *tlsSession // shared with the other direction, used if the stream is TLS
+	requests       *requestQueue
+
+	mu        sync.Mutex
+	seen      time.Time // capture time of the data currently being read
+	delivered int64     // bytes handed to the reader so far
+	gaps      []streamGap
+	loss      StreamLoss
 }
 
 func (h *httpStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
@@ -29,73 +57,520 @@ func (h *httpStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream
 		net:       net,
 		transport: transport,
 		r:         tcpreader.NewReaderStream(),
+		factory:   h,
+	}
+
+	// The service side is whichever end is a monitored port, preferring the destination
+	for _, endpoint := range []gopacket.Endpoint{transport.Dst(), transport.Src()} {
+		port := int(binary.BigEndian.Uint16(endpoint.Raw()))
+		if pr, ok := h.ports.Match(port); ok {
+			hstream.servicePort = port
+			hstream.serviceLabel = pr.Label
+			break
+		}
+	}
+	hstream.loss.Connection, hstream.loss.PairKey, hstream.loss.Direction = hstream.endpoints()
+	hstream.loss.ServicePort, hstream.loss.Service = hstream.servicePort, hstream.serviceLabel
+
+	// Taken now rather than once the stream turns out to be TLS, so a
+	// direction that ends quickly can't finish the connection on its own
+	hstream.session = h.tlsSession(net, transport)
+	hstream.requests = h.requestQueue(flowConnectionKey(net, transport))
+	if !hstream.fromServer() {
+		hstream.requests.open()
 	}
+	h.parsing.Add(1)
 	go hstream.run() // Important... we must guarantee that data from the reader stream is read.
 
-	// ReaderStream implements tcpassembly.Stream, so we can return a pointer to it.
-	return &hstream.r
+	// httpStream wraps the ReaderStream so it can track packet timestamps.
+	return hstream
+}
+
+// Reassembled implements tcpassembly.Stream. Chunks are handed to the reader
+// one at a time so that seen always matches the data being parsed.
+func (h *httpStream) Reassembled(reassembly []tcpassembly.Reassembly) {
+	for _, r := range reassembly {
+		h.mu.Lock()
+		h.seen = r.Seen
+		h.mu.Unlock()
+		h.trackLoss(r)
+		// The reader takes the next chunk only once it has parsed this one,
+		// which tells a waiting response whether its request can still come
+		if !h.fromServer() {
+			h.requests.startChunk(r.Seen)
+		}
+		h.r.Reassembled([]tcpassembly.Reassembly{r})
+		if !h.fromServer() {
+			h.requests.endChunk()
+		}
+	}
+}
+
+// ReassemblyComplete implements tcpassembly.Stream.
+func (h *httpStream) ReassemblyComplete() {
+	h.r.ReassemblyComplete()
+}
+
+// tlsSession returns the handshake state shared by both directions of a
+// connection, creating it for whichever direction comes first
+func (h *httpStreamFactory) tlsSession(net, transport gopacket.Flow) *tlsSession {
+	key := flowConnectionKey(net, transport)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessions == nil {
+		h.sessions = make(map[string]*tlsSession)
+	}
+	session, ok := h.sessions[key]
+	if !ok {
+		session = newTLSSession()
+		h.sessions[key] = session
+	}
+	session.refs++
+	return session
+}
+
+// releaseTLSSession forgets a connection's session once both directions are done
+func (h *httpStreamFactory) releaseTLSSession(net, transport gopacket.Flow) {
+	key := flowConnectionKey(net, transport)
+	h.mu.Lock()
+	session, ok := h.sessions[key]
+	if !ok {
+		h.mu.Unlock()
+		return
+	}
+	session.refs--
+	done := session.refs <= 0
+	if done {
+		delete(h.sessions, key)
+	}
+	h.mu.Unlock()
+
+	if done {
+		session.finish()
+	}
+}
+
+// flowConnectionKey returns the connection key for one direction of a stream
+func flowConnectionKey(net, transport gopacket.Flow) string {
+	return connectionKey(
+		fmt.Sprintf("%s:%s", net.Src(), transport.Src()),
+		fmt.Sprintf("%s:%s", net.Dst(), transport.Dst()),
+	)
+}
+
+// fromServer reports whether this direction of the connection is the one
+// the service sends its responses on
+func (h *httpStream) fromServer() bool {
+	return int(binary.BigEndian.Uint16(h.transport.Src().Raw())) == h.servicePort
+}
+
+// endpoints describes this direction of the connection the way its packets do
+func (h *httpStream) endpoints() (connection, pairKey, direction string) {
+	if h.fromServer() {
+		return fmt.Sprintf("%s:%s ← %s:%s", h.net.Dst(), h.transport.Dst(), h.net.Src(), h.transport.Src()),
+			fmt.Sprintf("%s:%s-%s:%s", h.net.Dst(), h.transport.Dst(), h.net.Src(), h.transport.Src()),
+			"response"
+	}
+	return fmt.Sprintf("%s:%s → %s:%s", h.net.Src(), h.transport.Src(), h.net.Dst(), h.transport.Dst()),
+		fmt.Sprintf("%s:%s-%s:%s", h.net.Src(), h.transport.Src(), h.net.Dst(), h.transport.Dst()),
+		"request"
+}
+
+// endConnection stops waiting for responses once the server's side of the
+// connection has closed
+func (h *httpStream) endConnection() {
+	if !h.fromServer() {
+		return
+	}
+	Store.EndConnection(fmt.Sprintf("%s:%s-%s:%s", h.net.Dst(), h.transport.Dst(), h.net.Src(), h.transport.Src()))
+}
+
+// lastSeen returns the capture time of the most recently reassembled data.
+func (h *httpStream) lastSeen() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.seen
 }
 
 func (h *httpStream) run() {
-	buf := bufio.NewReader(&h.r)
+	defer h.factory.parsing.Done()
+	defer h.factory.releaseTLSSession(h.net, h.transport)
+	defer h.factory.releaseRequestQueue(flowConnectionKey(h.net, h.transport))
+	defer h.endConnection()
+	if !h.fromServer() {
+		defer h.requests.close()
+	}
+
+	tr := &timedReader{src: &h.r, seen: h.lastSeen, lost: h.lostBetween}
+	buf := bufio.NewReaderSize(tr, maxHeaderSize)
+
+	if looksLikeTLS(buf) {
+		ep := tlsEndpoints{
+			src:         fmt.Sprintf("%s:%s", h.net.Src(), h.transport.Src()),
+			dst:         fmt.Sprintf("%s:%s", h.net.Dst(), h.transport.Dst()),
+			servicePort: h.servicePort,
+			service:     h.serviceLabel,
+		}
+		plain := newTLSReader(tr, buf, h.session, h.factory.keyLog, ep)
+		tr = &timedReader{src: plain, seen: plain.lastSeen}
+		buf = bufio.NewReaderSize(tr, maxHeaderSize)
+	}
+	h.readHTTP(tr, buf)
+}
+
+// readHTTP parses requests and responses from the stream until it ends
+func (h *httpStream) readHTTP(tr *timedReader, buf *bufio.Reader) {
+	// A server speaking HTTP/2 with prior knowledge starts with SETTINGS
+	if looksLikeHTTP2Settings(buf) {
+		h.readHTTP2(tr, buf, false)
+		return
+	}
+
+	resync := &streamResync{h: h}
+	defer resync.done()
+
 	for {
 		// Peek at the first line to determine if it's a request or response
-		line, _, err := buf.ReadLine()
-		if err == io.EOF {
+		line, err := peekLine(buf)
+		start := tr.consumed(buf)
+		if err != nil && err != bufio.ErrBufferFull {
+			// Whatever is left can't be a complete message
+			if len(line) > 0 {
+				resync.fail(start, tr.timeAt(start), errors.New("stream ended inside a line"), line)
+				resync.skip(len(line))
+			}
+			return
+		}
+		tr.forget(start)
+		lineStr := strings.TrimRight(string(line), "\r\n")
+
+		// Stray blank lines between messages are allowed
+		if lineStr == "" && resync.pending == nil {
+			buf.Discard(len(line))
+			continue
+		}
+
+		if lineStr == "PRI * HTTP/2.0" && isHTTP2Preface(buf) {
+			resync.done()
+			h.readHTTP2(tr, buf, false)
 			return
-		} else if err != nil {
-			log.Println("Error reading stream", h.net, h.transport, ":", err)
+		}
+
+		// Anything else that isn't a start line is skipped up to the next one
+		if err != nil || !isStartLine(line) {
+			resync.fail(start, tr.timeAt(start), errors.New("expected an HTTP start line"), line)
+			n := nextStartLine(line[1:]) + 1
+			if n <= 0 {
+				n = len(line)
+			}
+			buf.Discard(n)
+			resync.skip(n)
 			continue
 		}
+		resync.done()
 
-		lineStr := string(line)
+		head, ok := h.peekHead(tr, buf, resync, line, start)
+		if !ok {
+			continue
+		}
 
 		// Check if it's an HTTP request (starts with method)
 		if h.isHTTPRequest(lineStr) {
-			// Put the line back and read as request
-			fullLine := lineStr + "\r\n"
-			reader := io.MultiReader(strings.NewReader(fullLine), buf)
-			req, err := http.ReadRequest(bufio.NewReader(reader))
+			req, err := http.ReadRequest(buf)
 			if err != nil {
-				log.Println("Error reading request", h.net, h.transport, ":", err)
+				h.skipHead(tr, buf, resync, head, start, err)
 				continue
 			}
 
-			// Read the actual body content
-			bodyBytes, err := io.ReadAll(req.Body)
+			// A request with a body is in flight from its headers on, and may
+			// be answered with 100 Continue before the body is sent
+			pairID := 0
+			if req.ContentLength != 0 {
+				pairID = h.startRequest(req, tr.timeAt(start), tr.timeAt(tr.consumed(buf)-1), 0)
+				h.requests.push(req.Method, tr.timeAt(start))
+			}
+
+			// Read the actual body content, keeping as much of it as the proxy would
+			kept := cappedBuffer{max: maxDecodedBodySize}
+			_, err = io.Copy(&kept, req.Body)
+			bodyBytes, truncated := kept.bytes()
 			if err != nil {
-				log.Println("Error reading request body", h.net, h.transport, ":", err)
+				h.bodyError(tr, buf, resync, err)
 				bodyBytes = []byte{}
 			}
 			req.Body.Close()
 
-			h.logRequest(req, bodyBytes)
+			end := tr.consumed(buf)
+			var pair PacketPair
+			if pairID != 0 {
+				pair = h.finishRequest(pairID, req, bodyBytes, truncated, tr.timeAt(start), tr.timeAt(end-1), 0, tr.missing(start, end))
+			} else {
+				pair = h.logRequest(req, bodyBytes, truncated, tr.timeAt(start), tr.timeAt(end-1), 0, tr.missing(start, end))
+				h.requests.push(req.Method, tr.timeAt(start))
+			}
+
+			// Frames follow an upgrade request unless the server refused it
+			// and the client carried on with HTTP
+			if isWebSocketUpgrade(req.Header) {
+				if next, err := buf.Peek(1); err == nil && (next[0] < 'A' || next[0] > 'Z') {
+					h.readWebSocket(tr, buf, pair.ID, true)
+					return
+				}
+			}
 		} else if h.isHTTPResponse(lineStr) {
-			// Put the line back and read as response
-			fullLine := lineStr + "\r\n"
-			reader := io.MultiReader(strings.NewReader(fullLine), buf)
-			resp, err := http.ReadResponse(bufio.NewReader(reader), nil)
+			// Interim responses have no body and belong to the exchange still
+			// waiting for its final response
+			if isInterim(statusLineCode(lineStr)) {
+				resp, err := http.ReadResponse(buf, nil)
+				if err != nil {
+					h.skipHead(tr, buf, resync, head, start, err)
+					continue
+				}
+				h.logInterim(resp, tr.timeAt(start), 0)
+				continue
+			}
+
+			// Whether there's a body depends on the request, as with HEAD
+			resp, err := http.ReadResponse(buf, h.requests.next(tr.timeAt(start)))
 			if err != nil {
-				log.Println("Error reading response", h.net, h.transport, ":", err)
+				h.skipHead(tr, buf, resync, head, start, err)
 				continue
 			}
 
+			// Event streams and long-lived responses show up before they end
+			if isStreamingResponse(resp) {
+				h.readStreamingBody(tr, buf, resp, nil, false, start, 0)
+				continue
+			}
+
+			// A response with a body shows up from its headers on, so one that
+			// waits before sending it, like a long poll, isn't invisible
+			pairID := 0
+			if resp.Body != http.NoBody {
+				pairID = h.startResponse(resp, tr.timeAt(start), tr.timeAt(tr.consumed(buf)-1), 0)
+			}
+
 			// Read the actual body content
-			bodyBytes, err := io.ReadAll(resp.Body)
+			bodyBytes, truncated, done, err := readBody(tr, buf, resp.Body, start)
+			if !done {
+				h.readStreamingBody(tr, buf, resp, bodyBytes, truncated, start, pairID)
+				continue
+			}
 			if err != nil {
-				log.Println("Error reading response body", h.net, h.transport, ":", err)
+				h.bodyError(tr, buf, resync, err)
 				bodyBytes = []byte{}
 			}
 			resp.Body.Close()
 
-			h.logResponse(resp, bodyBytes)
+			// After an h2c upgrade the real response comes over HTTP/2 on stream 1
+			if resp.StatusCode == http.StatusSwitchingProtocols && strings.EqualFold(resp.Header.Get("Upgrade"), "h2c") {
+				h.logInterim(resp, tr.timeAt(start), 0)
+				h.readHTTP2(tr, buf, true)
+				return
+			}
+
+			end := tr.consumed(buf)
+			var pair PacketPair
+			if pairID != 0 {
+				pair = h.finishResponse(pairID, resp, bodyBytes, truncated, tr.timeAt(start), tr.timeAt(end-1), 0, tr.missing(start, end))
+			} else {
+				pair = h.logResponse(resp, bodyBytes, truncated, tr.timeAt(start), tr.timeAt(end-1), 0, tr.missing(start, end))
+			}
+
+			if resp.StatusCode == http.StatusSwitchingProtocols && isWebSocketUpgrade(resp.Header) {
+				h.readWebSocket(tr, buf, pair.ID, false)
+				return
+			}
+		}
+	}
+}
+
+// peekHead returns the header block of the message whose start line is at
+// the front of buf, without consuming it. A block that can't be complete is
+// recorded and skipped.
+func (h *httpStream) peekHead(tr *timedReader, buf *bufio.Reader, resync *streamResync, line []byte, start int64) ([]byte, bool) {
+	head, err := peekUntil(buf, headEnd)
+	if err != nil {
+		reason := "stream ended inside the headers"
+		if err == bufio.ErrBufferFull {
+			reason = fmt.Sprintf("headers larger than %d KB", maxHeaderSize>>10)
+		}
+		resync.fail(start, tr.timeAt(start), errors.New(reason), head)
+		n := len(head)
+		if next := nextStartLine(head[len(line):]); next >= 0 {
+			n = len(line) + next
+		}
+		buf.Discard(n)
+		resync.skip(n)
+		return nil, false
+	}
+
+	// A start line among the headers means this message was cut short
+	if next := headStartLine(head, len(line)); next >= 0 {
+		resync.fail(start, tr.timeAt(start), errors.New("headers interrupted by another message"), head[:next])
+		buf.Discard(next)
+		resync.skip(next)
+		resync.done()
+		return nil, false
+	}
+	return bytes.Clone(head), true
+}
+
+// skipHead records a header block that failed to parse and skips the rest of it
+func (h *httpStream) skipHead(tr *timedReader, buf *bufio.Reader, resync *streamResync, head []byte, start int64, err error) {
+	resync.fail(start, tr.timeAt(start), err, head)
+	read := int(tr.consumed(buf) - start)
+	if read < len(head) {
+		buf.Discard(len(head) - read)
+	}
+	resync.skip(max(read, len(head)))
+	resync.done()
+}
+
+// bodyError records a body that broke off in a way that loses the stream's
+// framing, so the bytes after it are skipped up to the next message
+func (h *httpStream) bodyError(tr *timedReader, buf *bufio.Reader, resync *streamResync, err error) {
+	if err == io.ErrUnexpectedEOF {
+		log.Println("Error reading body", h.net, h.transport, ":", err)
+		return
+	}
+	offset := tr.consumed(buf)
+	next, _ := buf.Peek(min(buf.Buffered(), maxSnippet))
+	resync.fail(offset, tr.timeAt(offset), fmt.Errorf("reading body: %w", err), next)
+}
+
+// readWebSocket decodes the frames that follow an upgrade until the stream
+// ends, adding each message to the pair that upgraded the connection
+func (h *httpStream) readWebSocket(tr *timedReader, buf *bufio.Reader, pairID int, fromClient bool) {
+	connection := fmt.Sprintf("%s ← %s", h.net.Dst(), h.net.Src())
+	if fromClient {
+		connection = fmt.Sprintf("%s → %s", h.net.Src(), h.net.Dst())
+	}
+
+	ws := &webSocketReader{buf: buf, fromClient: fromClient}
+	for {
+		tr.forget(tr.consumed(buf))
+		msg, err := ws.next()
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				// Framing is lost, so the rest of the stream can't be decoded
+				log.Println("Error reading WebSocket frame", h.net, h.transport, ":", err)
+				io.Copy(io.Discard, buf)
+			}
+			break
+		}
+		msg.Timestamp = tr.timeAt(tr.consumed(buf) - 1)
+		Store.AddWebSocketMessage(pairID, msg)
+		printWebSocketMessage(msg, connection)
+	}
+
+	// The server side saw the upgrade accepted, so it decides when the pair is done
+	if !fromClient {
+		Store.CloseWebSocket(pairID)
+	}
+}
+
+// peekLine returns the next line, including its newline, without consuming it.
+// It only waits for as much data as the line needs.
+func peekLine(buf *bufio.Reader) ([]byte, error) {
+	return peekUntil(buf, func(data []byte) int {
+		return bytes.IndexByte(data, '\n') + 1
+	})
+}
+
+// headEnd returns the length of the header block at the start of data,
+// including the blank line that ends it, or 0 if it isn't all there
+func headEnd(data []byte) int {
+	end := 0
+	if i := bytes.Index(data, []byte("\n\r\n")); i >= 0 {
+		end = i + 3
+	}
+	if i := bytes.Index(data, []byte("\n\n")); i >= 0 && (end == 0 || i+2 < end) {
+		end = i + 2
+	}
+	return end
+}
+
+// peekUntil peeks at buf until end finds where the data it wants ends,
+// returning it without consuming it. end returns 0 while it needs more.
+// It only waits for as much data as it needs.
+func peekUntil(buf *bufio.Reader, end func([]byte) int) ([]byte, error) {
+	n := 1
+	for {
+		data, err := buf.Peek(n)
+		if i := end(data); i > 0 {
+			return data[:i], nil
+		}
+		if err != nil {
+			return data, err
+		}
+		// Look through what's already buffered before waiting for more
+		if buffered := buf.Buffered(); buffered > n {
+			n = buffered
 		} else {
-			// Skip unknown data
-			continue
+			n = buffered + 1
 		}
 	}
 }
 
+// timedReader reads from the stream while remembering the capture time of
+// every byte range, so parsed messages can be stamped with packet times.
+type timedReader struct {
+	src    io.Reader
+	seen   func() time.Time           // capture time of the data just read
+	lost   func(from, to int64) int64 // bytes the capture missed in a range, if known
+	offset int64
+	marks  []timeMark
+}
+
+// timeMark records the capture time of the bytes starting at offset
+type timeMark struct {
+	offset int64
+	seen   time.Time
+}
+
+func (t *timedReader) Read(p []byte) (int, error) {
+	n, err := t.src.Read(p)
+	if n > 0 {
+		seen := t.seen()
+		if len(t.marks) == 0 || !t.marks[len(t.marks)-1].seen.Equal(seen) {
+			t.marks = append(t.marks, timeMark{offset: t.offset, seen: seen})
+		}
+		t.offset += int64(n)
+	}
+	return n, err
+}
+
+// consumed returns the stream offset the bufio reader has reached
+func (t *timedReader) consumed(buf *bufio.Reader) int64 {
+	return t.offset - int64(buf.Buffered())
+}
+
+// timeAt returns the capture time of the byte at offset
+func (t *timedReader) timeAt(offset int64) time.Time {
+	i := sort.Search(len(t.marks), func(i int) bool { return t.marks[i].offset > offset })
+	if i == 0 {
+		return time.Time{}
+	}
+	return t.marks[i-1].seen
+}
+
+// forget drops marks that only cover bytes before offset
+func (t *timedReader) forget(offset int64) {
+	i := sort.Search(len(t.marks), func(i int) bool { return t.marks[i].offset > offset })
+	if i > 1 {
+		t.marks = append(t.marks[:0], t.marks[i-1:]...)
+	}
+}
+
+// missing returns how many bytes the capture missed between two offsets
+func (t *timedReader) missing(from, to int64) int64 {
+	if t.lost == nil {
+		return 0
+	}
+	return t.lost(from, to)
+}
+
 func (h *httpStream) isHTTPRequest(line string) bool {
 	methods := []string{"GET", "POST", "PUT", "DELETE", "PATCH", "HEAD", "OPTIONS", "TRACE", "CONNECT"}
 	for _, method := range methods {
@@ -110,9 +585,169 @@ func (h *httpStream) isHTTPResponse(line string) bool {
 	return strings.HasPrefix(line, "HTTP/")
 }
 
-func (h *httpStream) logRequest(req *http.Request, bodyBytes []byte) {
-	now := time.Now()
-	timestamp := now.Format("2006-01-02 15:04:05")
+// logRequest stores and prints a request. truncated reports that bodyBytes
+// is only the start of its body. stream is the HTTP/2 stream it was sent on,
+// or 0 for HTTP/1.x.
+func (h *httpStream) logRequest(req *http.Request, bodyBytes []byte, truncated bool, start, end time.Time, stream uint32, missing int64) PacketPair {
+	packet := h.requestPacket(req, bodyBytes, start, end, stream, missing)
+	packet.Truncated = packet.Truncated || truncated
+	pair := Store.Add(packet)
+
+	printRequest(req, packet, fmt.Sprintf("%s → %s", h.net.Src(), h.net.Dst()))
+	return pair
+}
+
+// startRequest stores a request whose body is still to come, so it shows up
+// as in flight straight away. It returns the pair to complete with finishRequest.
+func (h *httpStream) startRequest(req *http.Request, start, end time.Time, stream uint32) int {
+	packet := h.requestPacket(req, nil, start, end, stream, 0)
+	packet.Streaming = true
+	return Store.Add(packet).ID
+}
+
+// finishRequest stores and prints a request started by startRequest, now
+// that its body has been read
+func (h *httpStream) finishRequest(pairID int, req *http.Request, bodyBytes []byte, truncated bool, start, end time.Time, stream uint32, missing int64) PacketPair {
+	packet := h.requestPacket(req, bodyBytes, start, end, stream, missing)
+	packet.Truncated = packet.Truncated || truncated
+	pair := Store.UpdatePacket(pairID, packet)
+
+	printRequest(req, packet, fmt.Sprintf("%s → %s", h.net.Src(), h.net.Dst()))
+	return pair
+}
+
+// requestPacket builds the stored form of a request read from this stream.
+// missing is how many of its bytes the capture missed.
+func (h *httpStream) requestPacket(req *http.Request, bodyBytes []byte, start, end time.Time, stream uint32, missing int64) CapturedPacket {
+	packet := newRequestPacket(req, bodyBytes, start, end)
+	packet.Incomplete, packet.Missing = missing > 0, missing
+	packet.Connection = fmt.Sprintf("%s:%s → %s:%s", h.net.Src(), h.transport.Src(), h.net.Dst(), h.transport.Dst())
+	// PairKey uses client:port-server:port to correlate request/response
+	packet.PairKey = streamPairKey(fmt.Sprintf("%s:%s-%s:%s", h.net.Src(), h.transport.Src(), h.net.Dst(), h.transport.Dst()), stream)
+	packet.ServicePort = h.servicePort
+	packet.Service = h.serviceLabel
+	return packet
+}
+
+// logResponse stores and prints a response, like logRequest
+func (h *httpStream) logResponse(resp *http.Response, bodyBytes []byte, truncated bool, start, end time.Time, stream uint32, missing int64) PacketPair {
+	packet := h.responsePacket(resp, bodyBytes, start, end, stream, missing)
+	packet.Truncated = packet.Truncated || truncated
+	pair := Store.Add(packet)
+
+	printResponse(resp, packet, pair.Timing, fmt.Sprintf("%s ← %s", h.net.Dst(), h.net.Src()))
+	return pair
+}
+
+// startResponse stores a response whose body is still to come, like
+// startRequest, and returns its pair's ID
+func (h *httpStream) startResponse(resp *http.Response, start, end time.Time, stream uint32) int {
+	packet := h.responsePacket(resp, nil, start, end, stream, 0)
+	packet.Streaming = true
+	return Store.Add(packet).ID
+}
+
+// finishResponse stores and prints a response started by startResponse, now
+// that its body has been read
+func (h *httpStream) finishResponse(pairID int, resp *http.Response, bodyBytes []byte, truncated bool, start, end time.Time, stream uint32, missing int64) PacketPair {
+	packet := h.responsePacket(resp, bodyBytes, start, end, stream, missing)
+	packet.Truncated = packet.Truncated || truncated
+	pair := Store.UpdatePacket(pairID, packet)
+
+	printResponse(resp, packet, pair.Timing, fmt.Sprintf("%s ← %s", h.net.Dst(), h.net.Src()))
+	return pair
+}
+
+// responsePacket builds the stored form of a response read from this stream
+func (h *httpStream) responsePacket(resp *http.Response, bodyBytes []byte, start, end time.Time, stream uint32, missing int64) CapturedPacket {
+	packet := newResponsePacket(resp, bodyBytes, start, end)
+	packet.Incomplete, packet.Missing = missing > 0, missing
+	packet.Connection = fmt.Sprintf("%s:%s ← %s:%s", h.net.Dst(), h.transport.Dst(), h.net.Src(), h.transport.Src())
+	// PairKey uses client:port-server:port to correlate request/response (same as request)
+	packet.PairKey = streamPairKey(fmt.Sprintf("%s:%s-%s:%s", h.net.Dst(), h.transport.Dst(), h.net.Src(), h.transport.Src()), stream)
+	packet.ServicePort = h.servicePort
+	packet.Service = h.serviceLabel
+	return packet
+}
+
+// streamPairKey gives each HTTP/2 stream of a connection its own pair key,
+// since their exchanges are interleaved rather than answered in order
+func streamPairKey(pairKey string, stream uint32) string {
+	if stream == 0 {
+		return pairKey
+	}
+	return fmt.Sprintf("%s#%d", pairKey, stream)
+}
+
+// newRequestPacket builds the stored form of a request. The caller fills in
+// where it was seen (Connection, PairKey and service).
+func newRequestPacket(req *http.Request, bodyBytes []byte, start, end time.Time) CapturedPacket {
+	headers := make(map[string]string)
+	for key, values := range req.Header {
+		headers[key] = strings.Join(values, ", ")
+	}
+
+	packet := CapturedPacket{
+		Type:        PacketRequest,
+		Timestamp:   start,
+		StartTime:   start,
+		EndTime:     end,
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		Host:        req.Host,
+		ContentType: req.Header.Get("Content-Type"),
+		Headers:     headers,
+		Protocol:    req.Proto,
+	}
+	packet.Trailers = joinHeader(req.Trailer)
+	packet.setBody(req.Header.Get("Content-Encoding"), bodyBytes)
+	packet.setGRPC(grpcMethod(packet.URL))
+	return packet
+}
+
+// newResponsePacket builds the stored form of a response, like newRequestPacket
+func newResponsePacket(resp *http.Response, bodyBytes []byte, start, end time.Time) CapturedPacket {
+	headers := make(map[string]string)
+	for key, values := range resp.Header {
+		headers[key] = strings.Join(values, ", ")
+	}
+
+	packet := CapturedPacket{
+		Type:        PacketResponse,
+		Timestamp:   start,
+		StartTime:   start,
+		EndTime:     end,
+		Status:      resp.Status,
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Headers:     headers,
+		Protocol:    resp.Proto,
+	}
+	packet.Trailers = joinHeader(resp.Trailer)
+	packet.setBody(resp.Header.Get("Content-Encoding"), bodyBytes)
+	packet.setGRPC("")
+	return packet
+}
+
+// joinHeader flattens header values for storage, or returns nil if there are none
+func joinHeader(header http.Header) map[string]string {
+	var joined map[string]string
+	for key, values := range header {
+		// Trailers declared up front but never sent have no values
+		if len(values) == 0 {
+			continue
+		}
+		if joined == nil {
+			joined = make(map[string]string)
+		}
+		joined[key] = strings.Join(values, ", ")
+	}
+	return joined
+}
+
+// printRequest logs a request to the console
+func printRequest(req *http.Request, packet CapturedPacket, connection string) {
+	timestamp := packet.StartTime.Format("2006-01-02 15:04:05")
 
 	fmt.Printf("┌─ HTTP REQUEST [%s]\n", timestamp)
 	fmt.Printf("├─ Method: %s\n", req.Method)
@@ -121,8 +756,15 @@ func (h *httpStream) logRequest(req *http.Request, bodyBytes []byte) {
 	fmt.Printf("├─ User-Agent: %s\n", req.Header.Get("User-Agent"))
 	fmt.Printf("├─ Content-Type: %s\n", req.Header.Get("Content-Type"))
 	fmt.Printf("├─ Content-Length: %s\n", req.Header.Get("Content-Length"))
-	fmt.Printf("├─ Body Size: %d bytes\n", len(bodyBytes))
-	fmt.Printf("├─ Connection: %s → %s\n", h.net.Src(), h.net.Dst())
+	fmt.Printf("├─ Body Size: %s\n", packet.bodySummary())
+	fmt.Printf("├─ Upload Time: %s\n", packet.EndTime.Sub(packet.StartTime))
+	if packet.Incomplete {
+		fmt.Printf("├─ Incomplete: %d bytes missing from the capture\n", packet.Missing)
+	}
+	if packet.Truncated {
+		fmt.Printf("├─ Truncated: only the first %d bytes of the body were kept\n", packet.BodySize)
+	}
+	fmt.Printf("├─ Connection: %s\n", connection)
 
 	alreadyLoggedHeader := []string{"User-Agent", "Content-Type", "Content-Length"}
 
@@ -136,49 +778,34 @@ func (h *httpStream) logRequest(req *http.Request, bodyBytes []byte) {
 	}
 
 	fmt.Printf("├─ Body Preview: \n")
-	if len(bodyBytes) > 0 {
-		preview := string(bodyBytes)
-		fmt.Printf("├  %s\n", strings.TrimSuffix(preview, "\n"))
+	if len(packet.Body) > 0 {
+		fmt.Printf("├  %s\n", strings.TrimSuffix(packet.BodyPreview(), "\n"))
 	}
 
 	fmt.Printf("└─ Protocol: %s\n", req.Proto)
 	fmt.Println()
-
-	// Store packet for web dashboard
-	headers := make(map[string]string)
-	for key, values := range req.Header {
-		headers[key] = strings.Join(values, ", ")
-	}
-
-	// PairKey uses client:port-server:port to correlate request/response
-	pairKey := fmt.Sprintf("%s:%s-%s:%s", h.net.Src(), h.transport.Src(), h.net.Dst(), h.transport.Dst())
-
-	Store.Add(CapturedPacket{
-		Type:        PacketRequest,
-		Timestamp:   now,
-		Method:      req.Method,
-		URL:         req.URL.String(),
-		Host:        req.Host,
-		ContentType: req.Header.Get("Content-Type"),
-		BodySize:    len(bodyBytes),
-		Body:        string(bodyBytes),
-		Headers:     headers,
-		Protocol:    req.Proto,
-		Connection:  fmt.Sprintf("%s:%s → %s:%s", h.net.Src(), h.transport.Src(), h.net.Dst(), h.transport.Dst()),
-		PairKey:     pairKey,
-	})
 }
 
-func (h *httpStream) logResponse(resp *http.Response, bodyBytes []byte) {
-	now := time.Now()
-	timestamp := now.Format("2006-01-02 15:04:05")
+// printResponse logs a response to the console
+func printResponse(resp *http.Response, packet CapturedPacket, timing PairTiming, connection string) {
+	timestamp := packet.StartTime.Format("2006-01-02 15:04:05")
 
 	fmt.Printf("┌─ HTTP RESPONSE [%s]\n", timestamp)
 	fmt.Printf("├─ Status: %s\n", resp.Status)
+	if packet.GRPC != nil && packet.GRPC.Status != "" {
+		fmt.Printf("├─ gRPC Status: %s %s\n", packet.GRPC.Status, packet.GRPC.StatusMessage)
+	}
 	fmt.Printf("├─ Content-Type: %s\n", resp.Header.Get("Content-Type"))
 	fmt.Printf("├─ Content-Length: %s\n", resp.Header.Get("Content-Length"))
-	fmt.Printf("├─ Body Size: %d bytes\n", len(bodyBytes))
-	fmt.Printf("├─ Connection: %s ← %s\n", h.net.Dst(), h.net.Src())
+	fmt.Printf("├─ Body Size: %s\n", packet.bodySummary())
+	fmt.Printf("├─ Timing: %s\n", timing)
+	if packet.Incomplete {
+		fmt.Printf("├─ Incomplete: %d bytes missing from the capture\n", packet.Missing)
+	}
+	if packet.Truncated {
+		fmt.Printf("├─ Truncated: only the first %d bytes of the body were kept\n", packet.BodySize)
+	}
+	fmt.Printf("├─ Connection: %s\n", connection)
 
 	alreadyLoggedHeader := []string{"Content-Type", "Content-Length"}
 
@@ -192,34 +819,10 @@ func (h *httpStream) logResponse(resp *http.Response, bodyBytes []byte) {
 	}
 
 	fmt.Printf("├─ Body Preview: \n")
-	if len(bodyBytes) > 0 {
-		preview := string(bodyBytes)
-		fmt.Printf("├  %s\n", strings.TrimSuffix(preview, "\n"))
+	if len(packet.Body) > 0 {
+		fmt.Printf("├  %s\n", strings.TrimSuffix(packet.BodyPreview(), "\n"))
 	}
 
 	fmt.Printf("└─ Protocol: %s\n", resp.Proto)
 	fmt.Println()
-
-	// Store packet for web dashboard
-	headers := make(map[string]string)
-	for key, values := range resp.Header {
-		headers[key] = strings.Join(values, ", ")
-	}
-
-	// PairKey uses client:port-server:port to correlate request/response (same as request)
-	pairKey := fmt.Sprintf("%s:%s-%s:%s", h.net.Dst(), h.transport.Dst(), h.net.Src(), h.transport.Src())
-
-	Store.Add(CapturedPacket{
-		Type:        PacketResponse,
-		Timestamp:   now,
-		Status:      resp.Status,
-		StatusCode:  resp.StatusCode,
-		ContentType: resp.Header.Get("Content-Type"),
-		BodySize:    len(bodyBytes),
-		Body:        string(bodyBytes),
-		Headers:     headers,
-		Protocol:    resp.Proto,
-		Connection:  fmt.Sprintf("%s:%s ← %s:%s", h.net.Dst(), h.transport.Dst(), h.net.Src(), h.transport.Src()),
-		PairKey:     pairKey,
-	})
 }
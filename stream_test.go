@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// testStream returns one direction of a connection between 127.0.0.1:50000
+// and a service on 127.0.0.2:8080, logging into a fresh Store
+func testStream(t *testing.T, fromServer bool) *httpStream {
+	t.Helper()
+	saved := Store
+	Store = NewPacketStore(100, 0)
+	t.Cleanup(func() { Store = saved })
+
+	client, server := net.IPv4(127, 0, 0, 1).To4(), net.IPv4(127, 0, 0, 2).To4()
+	clientPort, serverPort := layers.NewTCPPortEndpoint(50000), layers.NewTCPPortEndpoint(8080)
+	h := &httpStream{servicePort: 8080}
+	if fromServer {
+		h.net = gopacket.NewFlow(layers.EndpointIPv4, server, client)
+		h.transport, _ = gopacket.FlowFromEndpoints(serverPort, clientPort)
+	} else {
+		h.net = gopacket.NewFlow(layers.EndpointIPv4, client, server)
+		h.transport, _ = gopacket.FlowFromEndpoints(clientPort, serverPort)
+	}
+	return h
+}
+
+// testReader reads data as if it had all been captured at seen
+func testReader(data []byte, seen time.Time) (*timedReader, *bufio.Reader) {
+	tr := &timedReader{src: bytes.NewReader(data), seen: func() time.Time { return seen }}
+	return tr, bufio.NewReaderSize(tr, maxHeaderSize)
+}
+
+func TestReadHTTPCapsBodies(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), maxDecodedBodySize+100)
+	tests := []struct {
+		name       string
+		fromServer bool
+		head       string
+	}{
+		{"request", false, "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: %d\r\n\r\n"},
+		{"response", true, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := testStream(t, tt.fromServer)
+			h.requests = newRequestQueue()
+			tr, buf := testReader(append(fmt.Appendf(nil, tt.head, len(body)), body...), time.Now())
+			h.readHTTP(tr, buf)
+
+			pairs := Store.GetPairs()
+			if len(pairs) != 1 {
+				t.Fatalf("got %d pairs, want 1", len(pairs))
+			}
+			p := pairs[0].Request
+			if tt.fromServer {
+				p = pairs[0].Response
+			}
+			if p == nil {
+				t.Fatal("the message wasn't stored")
+			}
+			if !p.Truncated || len(p.Body) != maxDecodedBodySize || p.BodySize != maxDecodedBodySize {
+				t.Errorf("kept %d bytes, truncated %v; want the first %d, truncated", len(p.Body), p.Truncated, maxDecodedBodySize)
+			}
+			// Only what was kept counts toward the store's size
+			if stats := Store.Stats(); stats.MemoryBytes > maxDecodedBodySize+64<<10 {
+				t.Errorf("store holds %d bytes for a body capped at %d", stats.MemoryBytes, maxDecodedBodySize)
+			}
+		})
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// streamSyncInterval is how often a streaming response is republished
+	// while its body arrives
+	streamSyncInterval = 250 * time.Millisecond
+	// maxSSEEvents caps how many events a response keeps, dropping the oldest
+	maxSSEEvents = 1000
+	// maxSSEData caps how much of each event's data is kept
+	maxSSEData = 64 << 10
+	// streamingAfter is how long, in capture time, a response body can take
+	// before it's published as it arrives rather than once it ends
+	streamingAfter = 2 * time.Second
+	// maxStreamingUpdate caps how much of the body, counting back from the
+	// latest byte, each update of a streaming response carries, so a long
+	// stream costs no more to republish as it grows. The final update has it all.
+	maxStreamingUpdate = 64 << 10
+	// maxStreamingEvents likewise caps the events each update carries
+	maxStreamingEvents = 100
+)
+
+// SSEEvent is one event of a text/event-stream response
+type SSEEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	ID        string    `json:"id,omitempty"`
+	Event     string    `json:"event,omitempty"` // the event type, "message" when not given
+	Data      string    `json:"data"`
+	Retry     int       `json:"retry,omitempty"`
+	Truncated bool      `json:"truncated,omitempty"`
+}
+
+// EventLog holds the events of a text/event-stream response
+type EventLog struct {
+	Events  []SSEEvent `json:"events"`
+	Dropped int        `json:"dropped,omitempty"` // oldest events not kept
+}
+
+// isEventStream reports whether headers describe Server-Sent Events
+func isEventStream(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// isStreamingResponse reports whether a response's body is captured as it
+// arrives from the start, as event streams are. Other bodies only are if
+// they're still open after streamingAfter.
+func isStreamingResponse(resp *http.Response) bool {
+	if resp.Body == http.NoBody {
+		return false // a response to HEAD, or a status that has no body
+	}
+	return isEventStream(resp.Header)
+}
+
+// readBody reads a response body until it ends or has been open for
+// streamingAfter since the response started at start, reporting which with
+// done. Only the first maxDecodedBodySize bytes are kept; the rest is read
+// and dropped, reported with truncated.
+func readBody(tr *timedReader, buf *bufio.Reader, body io.Reader, start int64) (data []byte, truncated, done bool, err error) {
+	opened := tr.timeAt(start)
+	data = make([]byte, 0, 512)
+	chunk := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(chunk)
+		room := maxDecodedBodySize - len(data)
+		data = append(data, chunk[:min(n, max(room, 0))]...)
+		truncated = truncated || n > room
+		if err == io.EOF {
+			return data, truncated, true, nil
+		} else if err != nil {
+			return data, truncated, true, err
+		}
+		if n > 0 && tr.timeAt(tr.consumed(buf)-1).Sub(opened) > streamingAfter {
+			return data, truncated, false, nil
+		}
+	}
+}
+
+// sseParser splits a text/event-stream body into events as it arrives
+type sseParser struct {
+	line    []byte
+	skipLF  bool // the last chunk ended in \r, which may be half of \r\n
+	started bool // past the optional byte order mark
+
+	id, event string
+	data      []byte
+	retry     int
+	hasData   bool
+
+	events  []SSEEvent
+	dropped int
+}
+
+// feed parses a chunk of the stream, stamping events completed by it with seen
+func (p *sseParser) feed(chunk []byte, seen time.Time) {
+	if !p.started {
+		if len(p.line)+len(chunk) < 3 && bytes.HasPrefix([]byte("\xef\xbb\xbf"), append(p.line, chunk...)) {
+			p.line = append(p.line, chunk...)
+			return
+		}
+		chunk = bytes.TrimPrefix(append(p.line, chunk...), []byte("\xef\xbb\xbf"))
+		p.line, p.started = nil, true
+	}
+
+	for len(chunk) > 0 {
+		if p.skipLF {
+			p.skipLF = false
+			if chunk[0] == '\n' {
+				chunk = chunk[1:]
+				continue
+			}
+		}
+		i := bytes.IndexAny(chunk, "\r\n")
+		if i < 0 {
+			p.line = append(p.line, chunk...)
+			return
+		}
+		p.line = append(p.line, chunk[:i]...)
+		p.skipLF = chunk[i] == '\r'
+		chunk = chunk[i+1:]
+		p.processLine(seen)
+		p.line = p.line[:0]
+	}
+}
+
+// processLine handles one complete line of the stream
+func (p *sseParser) processLine(seen time.Time) {
+	if len(p.line) == 0 {
+		p.dispatch(seen)
+		return
+	}
+	if p.line[0] == ':' {
+		return // comment
+	}
+	field, value, _ := strings.Cut(string(p.line), ":")
+	value = strings.TrimPrefix(value, " ")
+	switch field {
+	case "event":
+		p.event = value
+	case "data":
+		if len(p.data) <= maxSSEData {
+			p.data = append(p.data, value...)
+			p.data = append(p.data, '\n')
+		}
+		p.hasData = true
+	case "id":
+		if !strings.ContainsRune(value, 0) {
+			p.id = value
+		}
+	case "retry":
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+			p.retry = n
+		}
+	}
+}
+
+// dispatch records the event built up by the lines since the last blank one
+func (p *sseParser) dispatch(seen time.Time) {
+	defer func() { p.event, p.data, p.hasData = "", nil, false }()
+	if !p.hasData {
+		return
+	}
+	event := SSEEvent{
+		Timestamp: seen,
+		ID:        p.id,
+		Event:     p.event,
+		Data:      strings.TrimSuffix(string(p.data), "\n"),
+		Retry:     p.retry,
+	}
+	if len(event.Data) > maxSSEData {
+		event.Data, event.Truncated = event.Data[:maxSSEData], true
+	}
+	p.events = append(p.events, event)
+	if len(p.events) > maxSSEEvents {
+		// Copied so the events already handed to the store stay as they were
+		p.events = append([]SSEEvent(nil), p.events[len(p.events)-maxSSEEvents:]...)
+		p.dropped++
+	}
+}
+
+// streamingResponse records a response as soon as its headers are read and
+// republishes it as its body arrives, marked as streaming until it ends
+type streamingResponse struct {
+	resp     *http.Response
+	describe responseDescriber
+	pairID   int
+	start    time.Time
+
+	mu        sync.Mutex
+	body      []byte
+	truncated bool  // more than maxDecodedBodySize arrived
+	missing   int64 // bytes the capture missed
+	end       time.Time
+	events    *sseParser // set for event streams sent without Content-Encoding
+	published time.Time  // wall clock time of the last update
+	timer     *time.Timer
+	done      bool
+}
+
+// responseDescriber builds the stored form of a response, without its body,
+// for where it was seen
+type responseDescriber func(resp *http.Response, start, end time.Time, missing int64) CapturedPacket
+
+// newStreamingResponse stores a response whose body is still to come, after
+// the part of it already read, which is truncated if some of what was read
+// wasn't kept. pairID is the response's pair if it's already
+// stored, otherwise 0.
+func newStreamingResponse(resp *http.Response, body []byte, truncated bool, start, end time.Time, pairID int, describe responseDescriber) (*streamingResponse, PacketPair) {
+	s := &streamingResponse{resp: resp, describe: describe, start: start, end: end}
+	s.body = body[:min(len(body), maxDecodedBodySize)]
+	s.truncated = truncated || len(body) > maxDecodedBodySize
+	if isEventStream(resp.Header) && resp.Header.Get("Content-Encoding") == "" {
+		s.events = &sseParser{}
+		s.events.feed(body, end)
+	}
+
+	packet := s.packet()
+	var pair PacketPair
+	if pairID != 0 {
+		pair = Store.UpdatePacket(pairID, packet)
+	} else {
+		pair = Store.Add(packet)
+	}
+	s.pairID, s.published = pair.ID, time.Now()
+	return s, pair
+}
+
+// startStreamingResponse stores and prints a response whose body is still
+// to come, like newStreamingResponse. pairID is the response's pair if
+// startResponse already stored it, otherwise 0.
+func (h *httpStream) startStreamingResponse(resp *http.Response, body []byte, truncated bool, start, end time.Time, stream uint32, pairID int) *streamingResponse {
+	s, pair := newStreamingResponse(resp, body, truncated, start, end, pairID, func(resp *http.Response, start, end time.Time, missing int64) CapturedPacket {
+		return h.responsePacket(resp, nil, start, end, stream, missing)
+	})
+	printResponse(resp, s.packet(), pair.Timing, fmt.Sprintf("%s ← %s", h.net.Dst(), h.net.Src()))
+	return s
+}
+
+// readStreamingBody reads the rest of the body of a streaming HTTP/1.x
+// response, publishing it as it arrives
+func (h *httpStream) readStreamingBody(tr *timedReader, buf *bufio.Reader, resp *http.Response, read []byte, truncated bool, start int64, pairID int) {
+	s := h.startStreamingResponse(resp, read, truncated, tr.timeAt(start), tr.timeAt(tr.consumed(buf)-1), 0, pairID)
+
+	chunk := make([]byte, 32<<10)
+	for {
+		n, err := resp.Body.Read(chunk)
+		if n > 0 {
+			last := tr.consumed(buf) - 1
+			s.setMissing(tr.missing(start, last+1))
+			s.add(chunk[:n], tr.timeAt(last))
+			tr.forget(last) // a long stream would otherwise keep a mark for every packet
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Error reading response body", h.net, h.transport, ":", err)
+			}
+			break
+		}
+	}
+	resp.Body.Close()
+	s.finish(tr.timeAt(tr.consumed(buf)-1), resp.Trailer)
+}
+
+// add appends a chunk of the body seen at the given capture time
+func (s *streamingResponse) add(data []byte, seen time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room := maxDecodedBodySize - len(s.body)
+	s.body = append(s.body, data[:min(len(data), max(room, 0))]...)
+	s.truncated = s.truncated || len(data) > room
+	if s.events != nil {
+		s.events.feed(data, seen)
+	}
+	s.end = seen
+
+	// Chunks often come in bursts, so publish at most every streamSyncInterval
+	// and catch up on the rest once the burst is over
+	if wait := streamSyncInterval - time.Since(s.published); wait > 0 {
+		if s.timer == nil {
+			s.timer = time.AfterFunc(wait, s.flush)
+		}
+		return
+	}
+	s.publish()
+}
+
+// setMissing records how many of the response's bytes the capture missed so far
+func (s *streamingResponse) setMissing(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.missing = n
+}
+
+// flush publishes the chunks held back by add
+func (s *streamingResponse) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timer = nil
+	if !s.done {
+		s.publish()
+	}
+}
+
+// finish records the complete response
+func (s *streamingResponse) finish(end time.Time, trailer http.Header) PacketPair {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.done = true
+	if !end.IsZero() {
+		s.end = end
+	}
+	s.resp.Trailer = trailer
+	return s.publish()
+}
+
+// publish stores the response as read so far. Must be called with s.mu held.
+func (s *streamingResponse) publish() PacketPair {
+	s.published = time.Now()
+	return Store.UpdatePacket(s.pairID, s.packet())
+}
+
+// packet builds the stored form of the response as read so far. Must be
+// called with s.mu held, or before the response is shared.
+func (s *streamingResponse) packet() CapturedPacket {
+	packet := s.describe(s.resp, s.start, s.end, s.missing)
+	packet.Streaming = !s.done
+	packet.Truncated = s.truncated
+	// Only a complete body is decoded, as a partial one would fail to
+	// decompress and redoing it on every update adds up
+	packet.setBody(s.resp.Header.Get("Content-Encoding"), s.body)
+	if s.done {
+		packet.setGRPC("")
+	} else if len(packet.Body) > maxStreamingUpdate {
+		packet.Body = packet.Body[len(packet.Body)-maxStreamingUpdate:]
+	}
+	switch {
+	case s.events != nil:
+		events, dropped := s.events.events, s.events.dropped
+		if !s.done && len(events) > maxStreamingEvents {
+			dropped += len(events) - maxStreamingEvents
+			events = events[len(events)-maxStreamingEvents:]
+		}
+		packet.Events = &EventLog{Events: events, Dropped: dropped}
+	case s.done && isEventStream(s.resp.Header):
+		// A compressed stream can only be split once it's complete
+		p := &sseParser{}
+		p.feed(packet.Body, s.end)
+		packet.Events = &EventLog{Events: p.events, Dropped: p.dropped}
+	}
+	return packet
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSEParserFeed(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []SSEEvent
+	}{
+		{
+			name:   "one event",
+			chunks: []string{"data: hello\n\n"},
+			want:   []SSEEvent{{Data: "hello"}},
+		},
+		{
+			name:   "fields and comments",
+			chunks: []string{": ping\nevent: update\nid: 7\nretry: 1500\ndata: a\ndata:b\n\n"},
+			want:   []SSEEvent{{Event: "update", ID: "7", Retry: 1500, Data: "a\nb"}},
+		},
+		{
+			name:   "id carries over",
+			chunks: []string{"id: 1\ndata: x\n\ndata: y\n\n"},
+			want:   []SSEEvent{{ID: "1", Data: "x"}, {ID: "1", Data: "y"}},
+		},
+		{
+			name:   "line split across chunks",
+			chunks: []string{"da", "ta: hel", "lo\n", "\n"},
+			want:   []SSEEvent{{Data: "hello"}},
+		},
+		{
+			name:   "CR line endings",
+			chunks: []string{"data: a\rdata: b\r\r"},
+			want:   []SSEEvent{{Data: "a\nb"}},
+		},
+		{
+			// The \n ends the same line as the \r before it, not a blank one
+			name:   "CRLF split across chunks",
+			chunks: []string{"data: a\r", "\ndata: b\r", "\n\r", "\n"},
+			want:   []SSEEvent{{Data: "a\nb"}},
+		},
+		{
+			name:   "byte order mark",
+			chunks: []string{"\xef\xbb\xbfdata: x\n\n"},
+			want:   []SSEEvent{{Data: "x"}},
+		},
+		{
+			name:   "byte order mark split across chunks",
+			chunks: []string{"\xef", "\xbb", "\xbfdata: x\n\n"},
+			want:   []SSEEvent{{Data: "x"}},
+		},
+		{
+			name:   "byte order mark split before the rest",
+			chunks: []string{"\xef\xbb", "\xbf", "data: x\n\n"},
+			want:   []SSEEvent{{Data: "x"}},
+		},
+		{
+			name:   "unfinished event",
+			chunks: []string{"data: done\n\ndata: pending\n"},
+			want:   []SSEEvent{{Data: "done"}},
+		},
+		{
+			name:   "no data",
+			chunks: []string{"event: empty\n\n"},
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &sseParser{}
+			for _, chunk := range tt.chunks {
+				p.feed([]byte(chunk), time.Time{})
+			}
+			if len(p.events) != len(tt.want) {
+				t.Fatalf("got %d events %+v, want %+v", len(p.events), p.events, tt.want)
+			}
+			for i, event := range p.events {
+				if event != tt.want[i] {
+					t.Errorf("event %d = %+v, want %+v", i, event, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSSEParserLimits(t *testing.T) {
+	p := &sseParser{}
+	for i := range maxSSEEvents + 5 {
+		p.feed(fmt.Appendf(nil, "data: %d\n\n", i), time.Time{})
+	}
+	if len(p.events) != maxSSEEvents || p.dropped != 5 || p.events[0].Data != "5" {
+		t.Errorf("kept %d events from %q, dropped %d", len(p.events), p.events[0].Data, p.dropped)
+	}
+
+	p = &sseParser{}
+	p.feed([]byte("data: "+string(bytes.Repeat([]byte("x"), maxSSEData+10))+"\n\n"), time.Time{})
+	if len(p.events) != 1 || len(p.events[0].Data) != maxSSEData || !p.events[0].Truncated {
+		t.Errorf("long event kept %d bytes, truncated %v", len(p.events[0].Data), p.events[0].Truncated)
+	}
+}
+
+// timedChunks hands out each chunk with its own capture time, calling
+// before ahead of the last one
+type timedChunks struct {
+	chunks [][]byte
+	times  []time.Time
+	seen   time.Time
+	before func()
+}
+
+func (c *timedChunks) Read(p []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	if len(c.chunks) == 1 && c.before != nil {
+		c.before()
+		c.before = nil
+	}
+	n := copy(p, c.chunks[0])
+	c.seen = c.times[0]
+	if c.chunks[0] = c.chunks[0][n:]; len(c.chunks[0]) == 0 {
+		c.chunks, c.times = c.chunks[1:], c.times[1:]
+	}
+	return n, nil
+}
+
+func TestResponseStreamedOnceOpenLong(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("hello, world"))
+	w.Close()
+	body := gz.Bytes()
+	third := len(body) / 3
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		gap      time.Duration // capture time between the first part of the body and the rest
+		streamed bool
+	}{
+		{"quick", streamingAfter / 2, false},
+		{"long", 2 * streamingAfter, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := testStream(t, true)
+			h.requests = newRequestQueue()
+
+			head := "HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n"
+			src := &timedChunks{
+				chunks: [][]byte{
+					[]byte(head),
+					fmt.Appendf(nil, "%x\r\n%s\r\n", third, body[:third]),
+					fmt.Appendf(nil, "%x\r\n%s\r\n", third, body[third:2*third]),
+					fmt.Appendf(nil, "%x\r\n%s\r\n0\r\n\r\n", len(body)-2*third, body[2*third:]),
+				},
+				times: []time.Time{start, start, start.Add(tt.gap), start.Add(tt.gap)},
+			}
+			// What's stored before the last part of the body arrives: the
+			// headers alone until the response has been open long enough
+			src.before = func() {
+				pairs := Store.GetPairs()
+				if len(pairs) != 1 || pairs[0].Response == nil {
+					t.Fatalf("got %d pairs before the body ended, want the streaming response", len(pairs))
+				}
+				want := body[:2*third]
+				if !tt.streamed {
+					want = nil
+				}
+				resp := pairs[0].Response
+				if !resp.Streaming || resp.DecodeError != "" || !bytes.Equal(resp.Body, want) {
+					t.Errorf("partial response: streaming %v, decode error %q, body % x", resp.Streaming, resp.DecodeError, resp.Body)
+				}
+			}
+			tr := &timedReader{src: src, seen: func() time.Time { return src.seen }}
+			h.readHTTP(tr, bufio.NewReaderSize(tr, maxHeaderSize))
+
+			pairs := Store.GetPairs()
+			if len(pairs) != 1 || pairs[0].Response == nil {
+				t.Fatalf("got %d pairs, want 1 response", len(pairs))
+			}
+			resp := pairs[0].Response
+			if resp.Streaming || string(resp.Body) != "hello, world" || resp.DecodeError != "" {
+				t.Errorf("response: streaming %v, body %q, decode error %q", resp.Streaming, resp.Body, resp.DecodeError)
+			}
+		})
+	}
+}
+
+func TestResponseRecordedAtHeaders(t *testing.T) {
+	h := testStream(t, true)
+	h.requests = newRequestQueue()
+
+	// A long poll: the headers, then nothing until there's news
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	src := &timedChunks{
+		chunks: [][]byte{[]byte("HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\n"), []byte("news")},
+		times:  []time.Time{start, start.Add(time.Minute)},
+	}
+	src.before = func() {
+		pairs := Store.GetPairs()
+		if len(pairs) != 1 || pairs[0].Response == nil || !pairs[0].Response.Streaming {
+			t.Errorf("got %d pairs while waiting for the body, want the response's headers", len(pairs))
+		}
+	}
+	tr := &timedReader{src: src, seen: func() time.Time { return src.seen }}
+	h.readHTTP(tr, bufio.NewReaderSize(tr, maxHeaderSize))
+
+	pairs := Store.GetPairs()
+	if len(pairs) != 1 || pairs[0].Response == nil || pairs[0].Response.Streaming || string(pairs[0].Response.Body) != "news" {
+		t.Fatalf("got %d pairs, want the finished response", len(pairs))
+	}
+}
+
+func TestStreamingUpdatesCapped(t *testing.T) {
+	h := testStream(t, true)
+	resp := &http.Response{
+		Status: "200 OK", StatusCode: 200, Proto: "HTTP/1.1",
+		Header: http.Header{"Content-Type": {"text/event-stream"}},
+		Body:   io.NopCloser(strings.NewReader("")),
+	}
+	now := time.Now()
+	s := h.startStreamingResponse(resp, nil, false, now, now, 0, 0)
+
+	const events = 2 * maxStreamingEvents
+	data := strings.Repeat("x", 2*maxStreamingUpdate/events)
+	var stream []byte
+	for i := range events {
+		stream = fmt.Appendf(stream, "id: %d\ndata: %s\n\n", i, data)
+	}
+	s.add(stream, now)
+
+	s.mu.Lock()
+	packet := s.packet()
+	s.mu.Unlock()
+	if packet.BodySize != len(stream) || !bytes.Equal(packet.Body, stream[len(stream)-maxStreamingUpdate:]) {
+		t.Errorf("update carries %d of %d bytes, want the last %d", len(packet.Body), packet.BodySize, maxStreamingUpdate)
+	}
+	if got := packet.Events; len(got.Events) != maxStreamingEvents || got.Dropped != events-maxStreamingEvents || got.Events[0].ID != fmt.Sprint(events-maxStreamingEvents) {
+		t.Errorf("update carries %d events, %d dropped", len(got.Events), got.Dropped)
+	}
+
+	s.finish(now, nil)
+	pair, _ := Store.GetPair(s.pairID)
+	if got := pair.Response; len(got.Body) != len(stream) || len(got.Events.Events) != events || got.Events.Dropped != 0 {
+		t.Errorf("finished response has %d bytes and %d events", len(got.Body), len(got.Events.Events))
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// TLS record content types
+const (
+	recordChangeCipherSpec = 20
+	recordAlert            = 21
+	recordHandshake        = 22
+	recordApplicationData  = 23
+)
+
+// TLS handshake message types
+const (
+	handshakeClientHello         = 1
+	handshakeServerHello         = 2
+	handshakeEncryptedExtensions = 8
+	handshakeFinished            = 20
+	handshakeKeyUpdate           = 24
+)
+
+// TLS versions and extensions we look at
+const (
+	versionTLS12 = 0x0303
+	versionTLS13 = 0x0304
+
+	extensionServerName          = 0
+	extensionSupportedGroups     = 10
+	extensionECPointFormats      = 11
+	extensionSignatureAlgorithms = 13
+	extensionALPN                = 16
+	extensionSupportedVersions   = 43
+)
+
+// maxTLSRecord is the largest record body allowed, with room for expansion
+const maxTLSRecord = 16384 + 2048
+
+// maxHandshakeMessage bounds a handshake message, so garbage that looks like
+// a huge one isn't buffered forever
+const maxHandshakeMessage = 1 << 18
+
+// alertCloseNotify is the alert sent when a connection ends normally
+const alertCloseNotify = 0
+
+// alertNames names the alert descriptions from RFC 8446 and RFC 5246
+var alertNames = map[byte]string{
+	10:  "unexpected_message",
+	20:  "bad_record_mac",
+	22:  "record_overflow",
+	40:  "handshake_failure",
+	42:  "bad_certificate",
+	43:  "unsupported_certificate",
+	44:  "certificate_revoked",
+	45:  "certificate_expired",
+	46:  "certificate_unknown",
+	47:  "illegal_parameter",
+	48:  "unknown_ca",
+	49:  "access_denied",
+	50:  "decode_error",
+	51:  "decrypt_error",
+	70:  "protocol_version",
+	71:  "insufficient_security",
+	80:  "internal_error",
+	86:  "inappropriate_fallback",
+	90:  "user_canceled",
+	100: "no_renegotiation",
+	109: "missing_extension",
+	110: "unsupported_extension",
+	112: "unrecognized_name",
+	113: "bad_certificate_status_response",
+	115: "unknown_psk_identity",
+	116: "certificate_required",
+	120: "no_application_protocol",
+}
+
+// alertName names an alert description
+func alertName(desc byte) string {
+	if name, ok := alertNames[desc]; ok {
+		return name
+	}
+	return fmt.Sprintf("alert %d", desc)
+}
+
+// helloRetryRandom is the ServerHello random that marks a HelloRetryRequest
+var helloRetryRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+var errShortHello = errors.New("truncated hello")
+
+// looksLikeTLS reports whether the stream starts with a TLS handshake record
+func looksLikeTLS(buf *bufio.Reader) bool {
+	header, err := buf.Peek(3)
+	return err == nil && header[0] == recordHandshake && header[1] == 3 && header[2] <= 4
+}
+
+// tlsRecord is one record read off the wire
+type tlsRecord struct {
+	typ     byte
+	version uint16
+	header  []byte
+	body    []byte
+	seen    time.Time // capture time of the record's first byte
+}
+
+// readTLSRecord reads the next record from buf
+func readTLSRecord(buf *bufio.Reader) (tlsRecord, error) {
+	header, err := buf.Peek(5)
+	if err != nil {
+		return tlsRecord{}, err
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if header[1] != 3 || length > maxTLSRecord {
+		return tlsRecord{}, errors.New("not a TLS record")
+	}
+	data := make([]byte, 5+length)
+	if _, err := io.ReadFull(buf, data); err != nil {
+		return tlsRecord{}, err
+	}
+	return tlsRecord{
+		typ:     data[0],
+		version: binary.BigEndian.Uint16(data[1:3]),
+		header:  data[:5],
+		body:    data[5:],
+	}, nil
+}
+
+// handshakeReader splits handshake messages out of records, which may carry
+// several messages or part of one
+type handshakeReader struct {
+	pending []byte
+}
+
+// add appends record data and returns every complete message (header included)
+func (h *handshakeReader) add(data []byte) [][]byte {
+	h.pending = append(h.pending, data...)
+	var msgs [][]byte
+	for len(h.pending) >= 4 {
+		length := int(h.pending[1])<<16 | int(h.pending[2])<<8 | int(h.pending[3])
+		if length > maxHandshakeMessage {
+			h.pending = nil
+			break
+		}
+		if len(h.pending) < 4+length {
+			break
+		}
+		msgs = append(msgs, h.pending[:4+length:4+length])
+		h.pending = h.pending[4+length:]
+	}
+	if len(h.pending) == 0 {
+		h.pending = nil
+	}
+	return msgs
+}
+
+// helloReader walks the fields of a hello message
+type helloReader struct {
+	data []byte
+	err  error
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.err = errShortHello
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *helloReader) uint8() int {
+	if b := r.bytes(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (r *helloReader) uint16() int {
+	if b := r.bytes(2); b != nil {
+		return int(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+// vector reads a length-prefixed field with a size prefix of n bytes
+func (r *helloReader) vector(n int) []byte {
+	var length int
+	switch n {
+	case 1:
+		length = r.uint8()
+	case 2:
+		length = r.uint16()
+	}
+	return r.bytes(length)
+}
+
+// tlsExtension is one extension from a hello
+type tlsExtension struct {
+	typ  uint16
+	data []byte
+}
+
+// extensions reads the extensions block that ends a hello, if present
+func (r *helloReader) extensions() []tlsExtension {
+	if r.err != nil || len(r.data) == 0 {
+		return nil
+	}
+	block := &helloReader{data: r.vector(2)}
+	var extensions []tlsExtension
+	for r.err == nil && block.err == nil && len(block.data) > 0 {
+		typ := uint16(block.uint16())
+		extensions = append(extensions, tlsExtension{typ: typ, data: block.vector(2)})
+	}
+	if r.err == nil {
+		r.err = block.err
+	}
+	return extensions
+}
+
+// uint16List splits data into 16-bit values
+func uint16List(data []byte) []uint16 {
+	values := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		values = append(values, binary.BigEndian.Uint16(data[i:]))
+	}
+	return values
+}
+
+// prefixed returns the contents of a vector with an n-byte length prefix
+func prefixed(data []byte, n int) []byte {
+	return (&helloReader{data: data}).vector(n)
+}
+
+// alpnList reads the protocol names from an ALPN extension
+func alpnList(data []byte) []string {
+	list := &helloReader{data: prefixed(data, 2)}
+	var protocols []string
+	for list.err == nil && len(list.data) > 0 {
+		if name := list.vector(1); list.err == nil {
+			protocols = append(protocols, string(name))
+		}
+	}
+	return protocols
+}
+
+// clientHello holds the ClientHello fields used for decryption and fingerprints
+type clientHello struct {
+	version             uint16
+	random              []byte
+	cipherSuites        []uint16
+	extensions          []uint16 // in the order sent
+	serverName          string
+	alpn                []string
+	supportedGroups     []uint16
+	pointFormats        []uint8
+	signatureAlgorithms []uint16
+	supportedVersions   []uint16
+}
+
+// parseClientHello parses a ClientHello message body
+func parseClientHello(body []byte) (*clientHello, error) {
+	r := &helloReader{data: body}
+	hello := &clientHello{version: uint16(r.uint16())}
+	hello.random = bytes.Clone(r.bytes(32))
+	r.vector(1) // legacy_session_id
+	hello.cipherSuites = uint16List(r.vector(2))
+	r.vector(1) // legacy_compression_methods
+	for _, ext := range r.extensions() {
+		hello.extensions = append(hello.extensions, ext.typ)
+		switch ext.typ {
+		case extensionServerName:
+			hello.serverName = parseServerName(ext.data)
+		case extensionSupportedGroups:
+			hello.supportedGroups = uint16List(prefixed(ext.data, 2))
+		case extensionECPointFormats:
+			hello.pointFormats = bytes.Clone(prefixed(ext.data, 1))
+		case extensionSignatureAlgorithms:
+			hello.signatureAlgorithms = uint16List(prefixed(ext.data, 2))
+		case extensionALPN:
+			hello.alpn = alpnList(ext.data)
+		case extensionSupportedVersions:
+			hello.supportedVersions = uint16List(prefixed(ext.data, 1))
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return hello, nil
+}
+
+// parseServerName returns the host name from a server_name extension
+func parseServerName(data []byte) string {
+	list := &helloReader{data: prefixed(data, 2)}
+	for list.err == nil && len(list.data) > 0 {
+		typ := list.uint8()
+		name := list.vector(2)
+		if typ == 0 && list.err == nil {
+			return string(name)
+		}
+	}
+	return ""
+}
+
+// serverHello holds the ServerHello fields we use
+type serverHello struct {
+	random      []byte
+	version     uint16
+	cipherSuite uint16
+	alpn        string
+}
+
+// parseServerHello parses a ServerHello message body
+func parseServerHello(body []byte) (*serverHello, error) {
+	r := &helloReader{data: body}
+	hello := &serverHello{version: uint16(r.uint16())}
+	hello.random = bytes.Clone(r.bytes(32))
+	r.vector(1) // legacy_session_id_echo
+	hello.cipherSuite = uint16(r.uint16())
+	r.uint8() // legacy_compression_method
+	for _, ext := range r.extensions() {
+		switch ext.typ {
+		case extensionSupportedVersions:
+			if len(ext.data) == 2 {
+				hello.version = binary.BigEndian.Uint16(ext.data)
+			}
+		case extensionALPN:
+			if protocols := alpnList(ext.data); len(protocols) > 0 {
+				hello.alpn = protocols[0]
+			}
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return hello, nil
+}
+
+// parseEncryptedExtensions returns the protocol a TLS 1.3 server picked
+func parseEncryptedExtensions(body []byte) string {
+	r := &helloReader{data: body}
+	for _, ext := range r.extensions() {
+		if ext.typ == extensionALPN {
+			if protocols := alpnList(ext.data); len(protocols) > 0 {
+				return protocols[0]
+			}
+		}
+	}
+	return ""
+}
+
+// isHelloRetry reports whether the ServerHello is really a HelloRetryRequest
+func (h *serverHello) isHelloRetry() bool {
+	return bytes.Equal(h.random, helloRetryRandom)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+// u16s encodes values as big-endian 16-bit integers
+func u16s(values ...uint16) []byte {
+	var b []byte
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	return b
+}
+
+// vec prefixes data with its length in n bytes
+func vec(n int, data []byte) []byte {
+	var b []byte
+	if n == 1 {
+		b = []byte{byte(len(data))}
+	} else {
+		b = binary.BigEndian.AppendUint16(nil, uint16(len(data)))
+	}
+	return append(b, data...)
+}
+
+func sniExtension(name string) tlsExtension {
+	return tlsExtension{extensionServerName, vec(2, append([]byte{0}, vec(2, []byte(name))...))}
+}
+
+func alpnExtension(protocols ...string) tlsExtension {
+	var list []byte
+	for _, p := range protocols {
+		list = append(list, vec(1, []byte(p))...)
+	}
+	return tlsExtension{extensionALPN, vec(2, list)}
+}
+
+// helloBody encodes a hello message body: a ClientHello when ciphers holds
+// the offered list, a ServerHello when it holds the one chosen suite
+func helloBody(client bool, version uint16, random []byte, ciphers []uint16, extensions ...tlsExtension) []byte {
+	b := binary.BigEndian.AppendUint16(nil, version)
+	b = append(b, random...)
+	b = append(b, vec(1, []byte("session"))...)
+	if client {
+		b = append(b, vec(2, u16s(ciphers...))...)
+		b = append(b, vec(1, []byte{0})...)
+	} else {
+		b = append(b, u16s(ciphers[0])...)
+		b = append(b, 0)
+	}
+	if extensions == nil {
+		return b
+	}
+	var block []byte
+	for _, ext := range extensions {
+		block = append(block, u16s(ext.typ)...)
+		block = append(block, vec(2, ext.data)...)
+	}
+	return append(b, vec(2, block)...)
+}
+
+func TestParseClientHello(t *testing.T) {
+	random := bytes.Repeat([]byte{7}, 32)
+	body := helloBody(true, 0x0303, random, []uint16{0x1301, 0xc02f},
+		sniExtension("example.com"),
+		tlsExtension{extensionSupportedGroups, vec(2, u16s(29, 23))},
+		tlsExtension{extensionECPointFormats, vec(1, []byte{0})},
+		tlsExtension{extensionSignatureAlgorithms, vec(2, u16s(0x0403, 0x0804))},
+		alpnExtension("h2", "http/1.1"),
+		tlsExtension{extensionSupportedVersions, vec(1, u16s(0x0304, 0x0303))},
+		tlsExtension{0xff01, []byte{0}},
+	)
+	hello, err := parseClientHello(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.version != 0x0303 || !bytes.Equal(hello.random, random) || hello.serverName != "example.com" ||
+		!slices.Equal(hello.cipherSuites, []uint16{0x1301, 0xc02f}) ||
+		!slices.Equal(hello.extensions, []uint16{0, 10, 11, 13, 16, 43, 0xff01}) ||
+		!slices.Equal(hello.supportedGroups, []uint16{29, 23}) || !slices.Equal(hello.pointFormats, []uint8{0}) ||
+		!slices.Equal(hello.signatureAlgorithms, []uint16{0x0403, 0x0804}) ||
+		!slices.Equal(hello.alpn, []string{"h2", "http/1.1"}) ||
+		!slices.Equal(hello.supportedVersions, []uint16{0x0304, 0x0303}) {
+		t.Errorf("parseClientHello = %+v", hello)
+	}
+
+	if _, err := parseClientHello(body[:len(body)-1]); err == nil {
+		t.Error("parseClientHello accepted a truncated hello")
+	}
+}
+
+func TestParseServerHello(t *testing.T) {
+	random := bytes.Repeat([]byte{9}, 32)
+	tests := []struct {
+		name    string
+		body    []byte
+		version uint16
+		cipher  uint16
+		alpn    string
+		retry   bool
+	}{
+		{
+			name:    "TLS 1.2",
+			body:    helloBody(false, 0x0303, random, []uint16{0xc02f}, alpnExtension("http/1.1")),
+			version: 0x0303, cipher: 0xc02f, alpn: "http/1.1",
+		},
+		{
+			name:    "TLS 1.2 without extensions",
+			body:    helloBody(false, 0x0303, random, []uint16{0x009c}),
+			version: 0x0303, cipher: 0x009c,
+		},
+		{
+			name:    "TLS 1.3 from supported_versions",
+			body:    helloBody(false, 0x0303, random, []uint16{0x1301}, tlsExtension{extensionSupportedVersions, u16s(0x0304)}),
+			version: 0x0304, cipher: 0x1301,
+		},
+		{
+			name:    "HelloRetryRequest",
+			body:    helloBody(false, 0x0303, helloRetryRandom, []uint16{0x1302}, tlsExtension{extensionSupportedVersions, u16s(0x0304)}),
+			version: 0x0304, cipher: 0x1302, retry: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello, err := parseServerHello(tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hello.version != tt.version || hello.cipherSuite != tt.cipher || hello.alpn != tt.alpn || hello.isHelloRetry() != tt.retry {
+				t.Errorf("parseServerHello = version %#04x, cipher %#04x, ALPN %q, retry %v", hello.version, hello.cipherSuite, hello.alpn, hello.isHelloRetry())
+			}
+		})
+	}
+
+	body := helloBody(false, 0x0303, random, []uint16{0x1301}, alpnExtension("h2"))
+	if _, err := parseServerHello(body[:len(body)-2]); err == nil {
+		t.Error("parseServerHello accepted a truncated hello")
+	}
+}
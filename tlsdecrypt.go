@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	_ "crypto/sha512" // SHA-384 for crypto.Hash
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"hash"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// cipherSuite describes how a suite protects records
+type cipherSuite struct {
+	hash          crypto.Hash // PRF or HKDF hash
+	keyLen        int
+	ivLen         int                                   // fixed part of the nonce, or the CBC IV
+	aead          func(key []byte) (cipher.AEAD, error) // nil for CBC suites
+	explicitNonce bool                                  // TLS 1.2 GCM sends 8 bytes of nonce per record
+	mac           func() hash.Hash                      // CBC suites only
+	macLen        int
+}
+
+var (
+	suiteAES128GCM  = &cipherSuite{hash: crypto.SHA256, keyLen: 16, ivLen: 12, aead: newAESGCM}
+	suiteAES256GCM  = &cipherSuite{hash: crypto.SHA384, keyLen: 32, ivLen: 12, aead: newAESGCM}
+	suiteChaCha20   = &cipherSuite{hash: crypto.SHA256, keyLen: 32, ivLen: 12, aead: chacha20poly1305.New}
+	suite12AES128   = &cipherSuite{hash: crypto.SHA256, keyLen: 16, ivLen: 4, aead: newAESGCM, explicitNonce: true}
+	suite12AES256   = &cipherSuite{hash: crypto.SHA384, keyLen: 32, ivLen: 4, aead: newAESGCM, explicitNonce: true}
+	suiteCBC128SHA  = &cipherSuite{hash: crypto.SHA256, keyLen: 16, ivLen: 16, mac: sha1.New, macLen: sha1.Size}
+	suiteCBC256SHA  = &cipherSuite{hash: crypto.SHA256, keyLen: 32, ivLen: 16, mac: sha1.New, macLen: sha1.Size}
+	suiteCBC128SHA2 = &cipherSuite{hash: crypto.SHA256, keyLen: 16, ivLen: 16, mac: sha256.New, macLen: sha256.Size}
+	suiteCBC256SHA2 = &cipherSuite{hash: crypto.SHA256, keyLen: 32, ivLen: 16, mac: sha256.New, macLen: sha256.Size}
+)
+
+// tls13Suites are the TLS 1.3 suites we can decrypt
+var tls13Suites = map[uint16]*cipherSuite{
+	tls.TLS_AES_128_GCM_SHA256:       suiteAES128GCM,
+	tls.TLS_AES_256_GCM_SHA384:       suiteAES256GCM,
+	tls.TLS_CHACHA20_POLY1305_SHA256: suiteChaCha20,
+}
+
+// tls12Suites are the TLS 1.2 suites we can decrypt
+var tls12Suites = map[uint16]*cipherSuite{
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         suite12AES128,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   suite12AES128,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: suite12AES128,
+	0x009e:                              suite12AES128, // TLS_DHE_RSA_WITH_AES_128_GCM_SHA256
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384: suite12AES256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   suite12AES256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: suite12AES256,
+	0x009f: suite12AES256, // TLS_DHE_RSA_WITH_AES_256_GCM_SHA384
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:   suiteChaCha20,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: suiteChaCha20,
+	0xccaa:                                      suiteChaCha20, // TLS_DHE_RSA_WITH_CHACHA20_POLY1305_SHA256
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:            suiteCBC128SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      suiteCBC128SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    suiteCBC128SHA,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:            suiteCBC256SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      suiteCBC256SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    suiteCBC256SHA,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256:         suiteCBC128SHA2,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:   suiteCBC128SHA2,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256: suiteCBC128SHA2,
+	0x003d: suiteCBC256SHA2, // TLS_RSA_WITH_AES_256_CBC_SHA256
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// recordDecrypter removes the protection from one direction's records
+type recordDecrypter struct {
+	suite   *cipherSuite
+	tls13   bool
+	secret  []byte // TLS 1.3 traffic secret, for key updates
+	aead    cipher.AEAD
+	block   cipher.Block
+	iv      []byte
+	macKey  []byte
+	seq     uint64
+	scratch [13]byte
+}
+
+// newTLS13Decrypter derives the record keys from a TLS 1.3 traffic secret
+func newTLS13Decrypter(suite *cipherSuite, secret []byte) (*recordDecrypter, error) {
+	key, err := hkdfExpandLabel(suite.hash, secret, "key", suite.keyLen)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := hkdfExpandLabel(suite.hash, secret, "iv", suite.ivLen)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := suite.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	return &recordDecrypter{suite: suite, tls13: true, secret: secret, aead: aead, iv: iv}, nil
+}
+
+// update moves to the next TLS 1.3 traffic secret after a KeyUpdate
+func (d *recordDecrypter) update() (*recordDecrypter, error) {
+	next, err := hkdfExpandLabel(d.suite.hash, d.secret, "traffic upd", d.suite.hash.Size())
+	if err != nil {
+		return nil, err
+	}
+	return newTLS13Decrypter(d.suite, next)
+}
+
+// newTLS12Decrypter derives the record keys for one side of a TLS 1.2
+// connection from the master secret
+func newTLS12Decrypter(suite *cipherSuite, masterSecret, clientRandom, serverRandom []byte, client bool) (*recordDecrypter, error) {
+	seed := append(bytes.Clone(serverRandom), clientRandom...)
+	n := 2*suite.macLen + 2*suite.keyLen + 2*suite.ivLen
+	block := prf12(suite.hash, masterSecret, "key expansion", seed, n)
+
+	// client MAC, server MAC, client key, server key, client IV, server IV
+	take := func(size int) (clientPart, serverPart []byte) {
+		clientPart, serverPart, block = block[:size], block[size:2*size], block[2*size:]
+		return
+	}
+	pick := func(clientPart, serverPart []byte) []byte {
+		if client {
+			return clientPart
+		}
+		return serverPart
+	}
+	macKey := pick(take(suite.macLen))
+	key := pick(take(suite.keyLen))
+	iv := pick(take(suite.ivLen))
+
+	d := &recordDecrypter{suite: suite, macKey: macKey, iv: iv}
+	var err error
+	if suite.aead != nil {
+		d.aead, err = suite.aead(key)
+	} else {
+		d.block, err = aes.NewCipher(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// decrypt opens a protected record, returning its real content type
+func (d *recordDecrypter) decrypt(rec tlsRecord) (byte, []byte, error) {
+	var typ byte
+	var plaintext []byte
+	var err error
+	switch {
+	case d.tls13:
+		typ, plaintext, err = d.open13(rec)
+	case d.aead != nil:
+		typ, plaintext, err = d.open12(rec)
+	default:
+		typ, plaintext, err = d.openCBC(rec)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	d.seq++
+	return typ, plaintext, nil
+}
+
+func (d *recordDecrypter) nonce() []byte {
+	nonce := bytes.Clone(d.iv)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], d.seq)
+	for i, b := range seq {
+		nonce[len(nonce)-8+i] ^= b
+	}
+	return nonce
+}
+
+func (d *recordDecrypter) open13(rec tlsRecord) (byte, []byte, error) {
+	plaintext, err := d.aead.Open(nil, d.nonce(), rec.body, rec.header)
+	if err != nil {
+		return 0, nil, err
+	}
+	// The real content type is the last non-zero byte
+	i := len(plaintext) - 1
+	for i >= 0 && plaintext[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		return 0, nil, errors.New("record has no content type")
+	}
+	return plaintext[i], plaintext[:i], nil
+}
+
+// additionalData builds the TLS 1.2 MAC and AEAD header for a record
+func (d *recordDecrypter) additionalData(rec tlsRecord, length int) []byte {
+	ad := d.scratch[:]
+	binary.BigEndian.PutUint64(ad, d.seq)
+	ad[8] = rec.typ
+	binary.BigEndian.PutUint16(ad[9:], rec.version)
+	binary.BigEndian.PutUint16(ad[11:], uint16(length))
+	return ad
+}
+
+func (d *recordDecrypter) open12(rec tlsRecord) (byte, []byte, error) {
+	body := rec.body
+	var nonce []byte
+	if d.suite.explicitNonce {
+		if len(body) < 8 {
+			return 0, nil, errors.New("record too short")
+		}
+		nonce = append(bytes.Clone(d.iv), body[:8]...)
+		body = body[8:]
+	} else {
+		nonce = d.nonce()
+	}
+	if len(body) < d.aead.Overhead() {
+		return 0, nil, errors.New("record too short")
+	}
+	ad := d.additionalData(rec, len(body)-d.aead.Overhead())
+	plaintext, err := d.aead.Open(nil, nonce, body, ad)
+	return rec.typ, plaintext, err
+}
+
+func (d *recordDecrypter) openCBC(rec tlsRecord) (byte, []byte, error) {
+	size := d.block.BlockSize()
+	body := rec.body
+	if len(body) < 2*size || len(body)%size != 0 {
+		return 0, nil, errors.New("bad CBC record length")
+	}
+	plaintext := make([]byte, len(body)-size)
+	cipher.NewCBCDecrypter(d.block, body[:size]).CryptBlocks(plaintext, body[size:])
+
+	// Every padding byte, including the last, holds the padding length
+	padding := int(plaintext[len(plaintext)-1]) + 1
+	if padding+d.suite.macLen > len(plaintext) {
+		return 0, nil, errors.New("bad CBC padding")
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding-1 {
+			return 0, nil, errors.New("bad CBC padding")
+		}
+	}
+	plaintext = plaintext[:len(plaintext)-padding]
+	content, sum := plaintext[:len(plaintext)-d.suite.macLen], plaintext[len(plaintext)-d.suite.macLen:]
+
+	mac := hmac.New(d.suite.mac, d.macKey)
+	mac.Write(d.additionalData(rec, len(content)))
+	mac.Write(content)
+	if !hmac.Equal(mac.Sum(nil), sum) {
+		return 0, nil, errors.New("bad record MAC")
+	}
+	return rec.typ, content, nil
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label from RFC 8446 with an empty context
+func hkdfExpandLabel(h crypto.Hash, secret []byte, label string, length int) ([]byte, error) {
+	label = "tls13 " + label
+	info := binary.BigEndian.AppendUint16(nil, uint16(length))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	return hkdf.Expand(h.New, secret, string(info), length)
+}
+
+// prf12 is the TLS 1.2 pseudorandom function from RFC 5246
+func prf12(h crypto.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	labelSeed := append([]byte(label), seed...)
+	out := make([]byte, 0, length+h.Size())
+	a := labelSeed
+	for len(out) < length {
+		mac := hmac.New(h.New, secret)
+		mac.Write(a)
+		a = mac.Sum(nil)
+
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelSeed)
+		out = mac.Sum(out)
+	}
+	return out[:length]
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The traffic key derivations from RFC 8448, section 3 (Simple 1-RTT Handshake)
+func TestHKDFExpandLabelRFC8448(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		key, iv string
+	}{
+		{
+			name:   "server handshake",
+			secret: "b6 7b 7d 69 0c c1 6c 4e 75 e5 42 13 cb 2d 37 b4 e9 c9 12 bc de d9 10 5d 42 be fd 59 d3 91 ad 38",
+			key:    "3f ce 51 60 09 c2 17 27 d0 f2 e4 e8 6e e4 03 bc",
+			iv:     "5d 31 3e b2 67 12 76 ee 13 00 0b 30",
+		},
+		{
+			name:   "client handshake",
+			secret: "b3 ed db 12 6e 06 7f 35 a7 80 b3 ab f4 5e 2d 8f 3b 1a 95 07 38 f5 2e 96 00 74 6a 0e 27 a5 5a 21",
+			key:    "db fa a6 93 d1 76 2c 5b 66 6a f5 d9 50 25 8d 01",
+			iv:     "5b d3 c7 1b 83 6e 0b 76 bb 73 26 5f",
+		},
+		{
+			name:   "server application",
+			secret: "a1 1a f9 f0 55 31 f8 56 ad 47 11 6b 45 a9 50 32 82 04 b4 f4 4b fb 6b 3a 4b 4f 1f 3f cb 63 16 43",
+			key:    "9f 02 28 3b 6c 9c 07 ef c2 6b b9 f2 ac 92 e3 56",
+			iv:     "cf 78 2b 88 dd 83 54 9a ad f1 e9 84",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := unhex(t, tt.secret)
+			key, err := hkdfExpandLabel(crypto.SHA256, secret, "key", 16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			iv, err := hkdfExpandLabel(crypto.SHA256, secret, "iv", 12)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(key, unhex(t, tt.key)) {
+				t.Errorf("key = % x, want %s", key, tt.key)
+			}
+			if !bytes.Equal(iv, unhex(t, tt.iv)) {
+				t.Errorf("iv = % x, want %s", iv, tt.iv)
+			}
+		})
+	}
+}
+
+// The TLS 1.2 PRF test vector for SHA-256 published alongside RFC 5246
+func TestPRF12(t *testing.T) {
+	secret := unhex(t, "9b be 43 6b a9 40 f0 17 b1 76 52 84 9a 71 db 35")
+	seed := unhex(t, "a0 ba 9f 93 6c da 31 18 27 a6 f7 96 ff d5 19 8c")
+	want := unhex(t, "e3 f2 29 ba 72 7b e1 7b 8d 12 26 20 55 7c d4 53 c2 aa b2 1d 07 c3 d4 95 32 9b 52 d4 e6 1e db 5a"+
+		"6b 30 17 91 e9 0d 35 c9 c9 a4 6b 4e 14 ba f9 af 0f a0 22 f7 07 7d ef 17 ab fd 37 97 c0 56 4b ab"+
+		"4f bc 91 66 6e 9d ef 9b 97 fc e3 4f 79 67 89 ba a4 80 82 d1 22 ee 42 c5 a7 2e 5a 51 10 ff f7 01"+
+		"87 34 7b 66")
+
+	got := prf12(crypto.SHA256, secret, "test label", seed, len(want))
+	if !bytes.Equal(got, want) {
+		t.Errorf("prf12 = % x\nwant   % x", got, want)
+	}
+	// Shorter outputs are a prefix of longer ones
+	if short := prf12(crypto.SHA256, secret, "test label", seed, 20); !bytes.Equal(short, want[:20]) {
+		t.Errorf("prf12 (20 bytes) = % x, want % x", short, want[:20])
+	}
+}
+
+// recordingConn keeps a copy of everything written to the connection
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(p)
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *recordingConn) bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Clone(c.written.Bytes())
+}
+
+// handshakeOver runs a TLS exchange over a pipe and returns what each side
+// sent on the wire, along with the key log it wrote. A suite of 0 leaves the
+// choice of TLS 1.2 cipher suite to crypto/tls.
+func handshakeOver(t *testing.T, version, suite uint16, request, response string) (fromClient, fromServer, keyLog []byte) {
+	t.Helper()
+	ca, _, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.leafFor("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys bytes.Buffer
+	var suites []uint16
+	if suite != 0 {
+		suites = []uint16{suite}
+	}
+	clientRaw, serverRaw := net.Pipe()
+	client := &recordingConn{Conn: clientRaw}
+	server := &recordingConn{Conn: serverRaw}
+
+	done := make(chan error, 1)
+	go func() {
+		conn := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{*cert}, MaxVersion: version, CipherSuites: suites})
+		buf := make([]byte, len(request))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			done <- err
+			return
+		}
+		_, err := conn.Write([]byte(response))
+		conn.Close()
+		done <- err
+	}()
+
+	conn := tls.Client(client, &tls.Config{InsecureSkipVerify: true, KeyLogWriter: &keys, MinVersion: version, MaxVersion: version, CipherSuites: suites})
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != response {
+		t.Fatalf("client read %q", got)
+	}
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return client.bytes(), server.bytes(), keys.Bytes()
+}
+
+// atEOF calls fn when the reader it wraps runs out, before returning EOF
+type atEOF struct {
+	r    io.Reader
+	once sync.Once
+	fn   func()
+}
+
+func (a *atEOF) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if err == io.EOF {
+		a.once.Do(a.fn)
+	}
+	return n, err
+}
+
+func TestTLSDecryptWithLateKeyLog(t *testing.T) {
+	saved := Store
+	Store = NewPacketStore(10, 0)
+	t.Cleanup(func() { Store = saved })
+
+	tests := []struct {
+		name    string
+		version uint16
+		suite   uint16
+	}{
+		{"TLS 1.2 AES-GCM", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		{"TLS 1.2 ChaCha20-Poly1305", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256},
+		{"TLS 1.2 AES-CBC SHA-1", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA},
+		{"TLS 1.2 AES-CBC SHA-256", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256},
+		{"TLS 1.3", tls.VersionTLS13, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+			response := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+			fromClient, fromServer, secrets := handshakeOver(t, tt.version, tt.suite, request, response)
+
+			// The secrets only reach the key log once every record has been
+			// read, so the records have to be held until then
+			path := filepath.Join(t.TempDir(), "keys.log")
+			if err := os.WriteFile(path, nil, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			keyLog, err := OpenKeyLog(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var logged sync.WaitGroup
+			logged.Add(2)
+			var writeOnce sync.Once
+			writeKeys := func() {
+				logged.Done()
+				logged.Wait()
+				writeOnce.Do(func() { os.WriteFile(path, secrets, 0o600) })
+			}
+
+			session := newTLSSession()
+			read := func(data []byte, ep tlsEndpoints, out *[]byte, wg *sync.WaitGroup) {
+				defer wg.Done()
+				seen := time.Now()
+				tr := &timedReader{src: &atEOF{r: bytes.NewReader(data), fn: writeKeys}, seen: func() time.Time { return seen }}
+				plain := newTLSReader(tr, bufio.NewReader(tr), session, keyLog, ep)
+				*out, _ = io.ReadAll(plain)
+			}
+			var wg sync.WaitGroup
+			var gotRequest, gotResponse []byte
+			wg.Add(2)
+			go read(fromClient, tlsEndpoints{src: "127.0.0.1:50000", dst: "127.0.0.1:443", servicePort: 443}, &gotRequest, &wg)
+			go read(fromServer, tlsEndpoints{src: "127.0.0.1:443", dst: "127.0.0.1:50000", servicePort: 443}, &gotResponse, &wg)
+			wg.Wait()
+
+			if string(gotRequest) != request {
+				t.Errorf("decrypted request = %q, want %q", gotRequest, request)
+			}
+			if string(gotResponse) != response {
+				t.Errorf("decrypted response = %q, want %q", gotResponse, response)
+			}
+		})
+	}
+}
+
+func TestOpenCBCPadding(t *testing.T) {
+	block, err := aes.NewCipher(bytes.Repeat([]byte{1}, suiteCBC128SHA.keyLen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	macKey := bytes.Repeat([]byte{2}, suiteCBC128SHA.macLen)
+	content := []byte("hello world") // with its MAC, one byte short of two blocks
+
+	// seal builds a record the way a TLS 1.2 CBC sender does, with the given
+	// padding after the content and its MAC
+	seal := func(d *recordDecrypter, padding []byte) tlsRecord {
+		rec := tlsRecord{typ: 23, version: tls.VersionTLS12}
+		mac := hmac.New(suiteCBC128SHA.mac, macKey)
+		mac.Write(d.additionalData(rec, len(content)))
+		mac.Write(content)
+		plaintext := append(mac.Sum(bytes.Clone(content)), padding...)
+		iv := bytes.Repeat([]byte{3}, block.BlockSize())
+		rec.body = append(iv, make([]byte, len(plaintext))...)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(rec.body[len(iv):], plaintext)
+		return rec
+	}
+
+	tests := []struct {
+		name    string
+		padding []byte
+		err     string
+	}{
+		{"one byte", []byte{0}, ""},
+		{"an extra block", bytes.Repeat([]byte{16}, 17), ""},
+		{"bytes that don't match the length", append(bytes.Repeat([]byte{0}, 16), 16), "bad CBC padding"},
+		{"longer than the record", []byte{255}, "bad CBC padding"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &recordDecrypter{suite: suiteCBC128SHA, block: block, macKey: macKey}
+			_, got, err := d.openCBC(seal(d, tt.padding))
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("openCBC error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(got, content) {
+				t.Errorf("openCBC = %q, %v; want %q", got, err, content)
+			}
+		})
+	}
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsHelloWait is how long one direction of a connection waits for the other
+// to show its hello before giving up on decrypting
+const tlsHelloWait = 2 * time.Second
+
+// keyLogHoldLimit is how many bytes of encrypted records a direction holds
+// on to while its secrets haven't been logged yet, before giving up on them
+const keyLogHoldLimit = 1 << 20
+
+// tlsSyncInterval is how often a live connection's entry is updated as bytes flow
+const tlsSyncInterval = time.Second
+
+// TLSConnection describes an encrypted connection seen on a monitored port.
+// It is filled in from the handshake, so it's available without keys.
+type TLSConnection struct {
+	ServerName     string    `json:"serverName,omitempty"`
+	ALPN           []string  `json:"alpn,omitempty"`           // offered by the client
+	NegotiatedALPN string    `json:"negotiatedAlpn,omitempty"` // picked by the server, when visible
+	Version        string    `json:"version,omitempty"`
+	CipherSuite    string    `json:"cipherSuite,omitempty"`
+	JA3            string    `json:"ja3,omitempty"`
+	JA3String      string    `json:"ja3String,omitempty"`
+	JA4            string    `json:"ja4,omitempty"`
+	Alert          string    `json:"alert,omitempty"`
+	Decrypted      bool      `json:"decrypted"`
+	Closed         bool      `json:"closed"`
+	ClientBytes    int64     `json:"clientBytes"`
+	ServerBytes    int64     `json:"serverBytes"`
+	StartTime      time.Time `json:"startTime"`
+	EndTime        time.Time `json:"endTime"`
+	DurationMs     float64   `json:"durationMs"`
+	Connection     string    `json:"connection"`
+	PairKey        string    `json:"pairKey"`
+	ServicePort    int       `json:"servicePort"`
+	Service        string    `json:"service,omitempty"`
+}
+
+// tlsEndpoints says where one direction of a stream was seen
+type tlsEndpoints struct {
+	src, dst    string
+	servicePort int
+	service     string
+}
+
+// tlsSession is the state shared by both directions of a TLS connection.
+// Each direction needs both hellos to find its keys, and together they fill
+// in the connection's entry in the store.
+type tlsSession struct {
+	refs int // streams using the session, guarded by the factory
+
+	mu           sync.Mutex
+	clientRandom []byte
+	server       *serverHello
+	clientSeen   chan struct{}
+	serverSeen   chan struct{}
+	clientOnce   sync.Once
+	serverOnce   sync.Once
+
+	info    TLSConnection
+	entryID int       // the connection's pair in the store, once recorded
+	synced  time.Time // when the entry was last updated
+}
+
+func newTLSSession() *tlsSession {
+	return &tlsSession{
+		clientSeen: make(chan struct{}),
+		serverSeen: make(chan struct{}),
+	}
+}
+
+// setClientHello records the ClientHello, sent from ep.src to ep.dst
+func (s *tlsSession) setClientHello(hello *clientHello, ep tlsEndpoints, seen time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientRandom = hello.random
+	s.clientOnce.Do(func() { close(s.clientSeen) })
+
+	s.info.ServerName = hello.serverName
+	s.info.ALPN = hello.alpn
+	s.info.JA3String, s.info.JA3 = hello.JA3()
+	s.info.JA4 = hello.JA4()
+	s.setEndpoints(ep.src, ep.dst, ep)
+	s.seen(seen)
+	s.sync(false)
+}
+
+// setServerHello records the ServerHello, sent from ep.src to ep.dst
+func (s *tlsSession) setServerHello(hello *serverHello, ep tlsEndpoints, seen time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.server = hello
+	s.serverOnce.Do(func() { close(s.serverSeen) })
+
+	s.info.Version = tls.VersionName(hello.version)
+	s.info.CipherSuite = tls.CipherSuiteName(hello.cipherSuite)
+	if hello.alpn != "" {
+		s.info.NegotiatedALPN = hello.alpn
+	}
+	if s.info.Connection == "" {
+		// The ClientHello was missed, e.g. the capture started mid-handshake
+		s.setEndpoints(ep.dst, ep.src, ep)
+	}
+	s.seen(seen)
+	s.sync(false)
+}
+
+func (s *tlsSession) setEndpoints(client, server string, ep tlsEndpoints) {
+	s.info.Connection = client + " → " + server
+	s.info.PairKey = client + "-" + server
+	s.info.ServicePort = ep.servicePort
+	s.info.Service = ep.service
+}
+
+// setALPN records the protocol a TLS 1.3 server picked, once decrypted
+func (s *tlsSession) setALPN(protocol string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if protocol != "" && s.info.NegotiatedALPN != protocol {
+		s.info.NegotiatedALPN = protocol
+		s.sync(false)
+	}
+}
+
+// setDecrypted notes that records of the connection could be decrypted
+func (s *tlsSession) setDecrypted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.info.Decrypted {
+		s.info.Decrypted = true
+		s.sync(false)
+	}
+}
+
+// setAlert records an alert that ended or broke the connection
+func (s *tlsSession) setAlert(alert string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.info.Alert = alert
+	s.sync(false)
+}
+
+// addBytes counts a record, updating the entry now and then
+func (s *tlsSession) addBytes(client bool, n int, seen time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if client {
+		s.info.ClientBytes += int64(n)
+	} else {
+		s.info.ServerBytes += int64(n)
+	}
+	s.seen(seen)
+	if s.entryID != 0 && time.Since(s.synced) >= tlsSyncInterval {
+		s.sync(false)
+	}
+}
+
+// seen extends the connection's time span. Must be called with s.mu held.
+func (s *tlsSession) seen(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	if s.info.StartTime.IsZero() || t.Before(s.info.StartTime) {
+		s.info.StartTime = t
+	}
+	if t.After(s.info.EndTime) {
+		s.info.EndTime = t
+	}
+}
+
+// sync writes the connection to the store. Must be called with s.mu held.
+func (s *tlsSession) sync(done bool) {
+	s.info.DurationMs = durationMs(s.info.StartTime, s.info.EndTime)
+	s.entryID = Store.RecordTLS(s.entryID, s.info, done)
+	s.synced = time.Now()
+}
+
+// finish records the final state once both directions have ended
+func (s *tlsSession) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entryID == 0 && s.server == nil && s.clientRandom == nil {
+		return // never got as far as a hello
+	}
+	s.info.Closed = true
+	s.sync(true)
+	printTLS(s.info)
+}
+
+// wait returns the client random and ServerHello once both have been seen
+func (s *tlsSession) wait(timeout time.Duration) ([]byte, *serverHello, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for _, ch := range []chan struct{}{s.clientSeen, s.serverSeen} {
+		select {
+		case <-ch:
+		case <-timer.C:
+			return nil, nil, false
+		}
+	}
+	clientRandom, hello := s.hellos()
+	return clientRandom, hello, true
+}
+
+// hellos returns what has been seen of the handshake so far
+func (s *tlsSession) hellos() ([]byte, *serverHello) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clientRandom, s.server
+}
+
+// tlsReader reads one direction of a TLS connection record by record. It
+// reports the handshake to the session and, given a key log, returns the
+// decrypted application data; otherwise it returns nothing but EOF.
+type tlsReader struct {
+	buf     *bufio.Reader
+	raw     *timedReader
+	session *tlsSession
+	keyLog  *KeyLog
+	ep      tlsEndpoints
+
+	client    bool // this direction sent the ClientHello
+	encrypted bool // this direction's handshake messages are now encrypted
+	handshake handshakeReader
+	version   uint16
+	suite     *cipherSuite
+	decrypter *recordDecrypter
+	next      []byte // TLS 1.3 application traffic secret, used after Finished
+	decrypt   bool
+	warned    bool
+
+	// Set while the key log doesn't have this connection's secrets yet.
+	// Records are held and the lookup retried with each new one.
+	setup     func() string // sets up the decrypter, or names the secret still missing
+	held      []tlsRecord
+	heldBytes int
+
+	plain []byte
+	seen  time.Time
+}
+
+func newTLSReader(raw *timedReader, buf *bufio.Reader, session *tlsSession, keyLog *KeyLog, ep tlsEndpoints) *tlsReader {
+	return &tlsReader{buf: buf, raw: raw, session: session, keyLog: keyLog, ep: ep, decrypt: keyLog != nil}
+}
+
+// lastSeen returns the capture time of the record the plaintext came from
+func (t *tlsReader) lastSeen() time.Time {
+	return t.seen
+}
+
+func (t *tlsReader) Read(p []byte) (int, error) {
+	for len(t.plain) == 0 {
+		start := t.raw.consumed(t.buf)
+		rec, err := readTLSRecord(t.buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// The secrets may have been logged since the last record
+			if t.setup != nil {
+				if missing := t.retryKeys(); missing != "" {
+					t.stopDecrypting("no " + missing + " in the key log for this connection")
+				}
+			}
+			if len(t.plain) > 0 {
+				break
+			}
+			return 0, io.EOF
+		} else if err != nil {
+			// Without record framing nothing more can be read; drain the stream
+			t.stopDecrypting(err.Error())
+			io.Copy(io.Discard, t.buf)
+			return 0, io.EOF
+		}
+		rec.seen = t.raw.timeAt(start)
+		t.raw.forget(start)
+		t.handle(rec)
+		t.session.addBytes(t.client, len(rec.header)+len(rec.body), rec.seen)
+	}
+	n := copy(p, t.plain)
+	t.plain = t.plain[n:]
+	return n, nil
+}
+
+// stopDecrypting gives up on decrypting the stream, which is still read for
+// its handshake and byte counts
+func (t *tlsReader) stopDecrypting(reason string) {
+	if t.decrypt {
+		log.Printf("Not decrypting TLS %s → %s: %s\n", t.ep.src, t.ep.dst, reason)
+	}
+	t.decrypt = false
+	t.decrypter = nil
+	t.setup, t.held, t.heldBytes = nil, nil, 0
+}
+
+func (t *tlsReader) handle(rec tlsRecord) {
+	switch rec.typ {
+	case recordChangeCipherSpec:
+		// TLS 1.2 encrypts everything after this; TLS 1.3 only sends it for middleboxes
+		if _, hello := t.session.hellos(); hello != nil && hello.version == versionTLS12 {
+			t.encrypted = true
+		}
+		if t.decrypt && t.keys() && t.version == versionTLS12 {
+			t.encrypted = true
+			t.setup = t.start12
+		}
+		return
+	case recordHandshake:
+		if !t.encrypted {
+			for _, msg := range t.handshake.add(rec.body) {
+				t.plainHandshake(msg, rec.seen)
+			}
+			return
+		}
+	case recordAlert:
+		if !t.encrypted {
+			t.alert(rec.body)
+			return
+		}
+	case recordApplicationData:
+		// TLS 1.3 encrypts everything after the ServerHello
+		if !t.encrypted {
+			t.encrypted = true
+			if t.decrypt && t.keys() {
+				if t.version != versionTLS13 {
+					t.stopDecrypting("application data before the handshake finished")
+				} else {
+					t.setup = t.start13
+				}
+			}
+		}
+	default:
+		return
+	}
+	if t.setup != nil && !t.awaitKeys(rec) {
+		return
+	}
+	if t.decrypter == nil {
+		return
+	}
+	t.decryptRecord(rec)
+}
+
+// awaitKeys holds rec until this connection's secrets are logged. It
+// returns true once they are, with the records held before rec decrypted.
+func (t *tlsReader) awaitKeys(rec tlsRecord) bool {
+	missing := t.retryKeys()
+	if missing == "" {
+		return t.decrypter != nil
+	}
+	if t.heldBytes+len(rec.body) > keyLogHoldLimit {
+		t.stopDecrypting("no " + missing + " in the key log for this connection")
+		return false
+	}
+	t.held = append(t.held, rec)
+	t.heldBytes += len(rec.body)
+	return false
+}
+
+// retryKeys looks for this connection's secrets again and decrypts the held
+// records once they're logged. It returns the label of a secret still missing.
+func (t *tlsReader) retryKeys() string {
+	if missing := t.setup(); missing != "" {
+		return missing
+	}
+	held := t.held
+	t.setup, t.held, t.heldBytes = nil, nil, 0
+	for _, rec := range held {
+		if t.decrypter == nil {
+			break
+		}
+		t.decryptRecord(rec)
+	}
+	return ""
+}
+
+// decryptRecord decrypts a record and handles what it carried
+func (t *tlsReader) decryptRecord(rec tlsRecord) {
+	typ, plaintext, err := t.decrypter.decrypt(rec)
+	if err != nil {
+		// Most likely 0-RTT data, which is protected with keys we don't track
+		if !t.warned {
+			log.Printf("Skipping undecryptable TLS record on %s → %s: %v\n", t.ep.src, t.ep.dst, err)
+			t.warned = true
+		}
+		return
+	}
+	t.session.setDecrypted()
+	switch typ {
+	case recordApplicationData:
+		// Held records are decrypted together, so add to what's unread
+		if len(t.plain) == 0 {
+			t.seen = rec.seen
+		}
+		t.plain = append(t.plain, plaintext...)
+	case recordHandshake:
+		if t.decrypter.tls13 {
+			for _, msg := range t.handshake.add(plaintext) {
+				t.encryptedHandshake(msg)
+			}
+		}
+	case recordAlert:
+		t.alert(plaintext)
+	}
+}
+
+// plainHandshake handles a handshake message sent before encryption started
+func (t *tlsReader) plainHandshake(msg []byte, seen time.Time) {
+	switch msg[0] {
+	case handshakeClientHello:
+		hello, err := parseClientHello(msg[4:])
+		if err != nil {
+			log.Printf("Bad ClientHello on %s → %s: %v\n", t.ep.src, t.ep.dst, err)
+			return
+		}
+		t.client = true
+		t.session.setClientHello(hello, t.ep, seen)
+	case handshakeServerHello:
+		hello, err := parseServerHello(msg[4:])
+		if err != nil {
+			log.Printf("Bad ServerHello on %s → %s: %v\n", t.ep.src, t.ep.dst, err)
+			return
+		}
+		if !hello.isHelloRetry() {
+			t.session.setServerHello(hello, t.ep, seen)
+		}
+	}
+}
+
+// encryptedHandshake handles a TLS 1.3 handshake message, which decides when
+// the traffic keys change
+func (t *tlsReader) encryptedHandshake(msg []byte) {
+	var err error
+	switch msg[0] {
+	case handshakeEncryptedExtensions:
+		t.session.setALPN(parseEncryptedExtensions(msg[4:]))
+	case handshakeFinished:
+		t.decrypter, err = newTLS13Decrypter(t.suite, t.next)
+	case handshakeKeyUpdate:
+		t.decrypter, err = t.decrypter.update()
+	}
+	if err != nil {
+		t.stopDecrypting(err.Error())
+	}
+}
+
+// alert records a fatal alert, or a warning other than a normal close
+func (t *tlsReader) alert(body []byte) {
+	if len(body) < 2 || body[1] == alertCloseNotify {
+		return
+	}
+	side := "server"
+	if t.client {
+		side = "client"
+	}
+	t.session.setAlert(fmt.Sprintf("%s from %s", alertName(body[1]), side))
+}
+
+// keys waits for both hellos and checks the connection can be decrypted
+func (t *tlsReader) keys() bool {
+	if t.suite != nil {
+		return true
+	}
+	_, hello, ok := t.session.wait(tlsHelloWait)
+	if !ok {
+		t.stopDecrypting("didn't see both the ClientHello and ServerHello")
+		return false
+	}
+
+	suites := tls12Suites
+	if hello.version == versionTLS13 {
+		suites = tls13Suites
+	} else if hello.version != versionTLS12 {
+		t.stopDecrypting(fmt.Sprintf("%s isn't supported", tls.VersionName(hello.version)))
+		return false
+	}
+	suite, ok := suites[hello.cipherSuite]
+	if !ok {
+		t.stopDecrypting(fmt.Sprintf("cipher suite %s isn't supported", tls.CipherSuiteName(hello.cipherSuite)))
+		return false
+	}
+	t.version = hello.version
+	t.suite = suite
+	return true
+}
+
+// start12 sets up the TLS 1.2 keys for this direction. It returns the label
+// of the secret if the key log doesn't have it yet.
+func (t *tlsReader) start12() string {
+	clientRandom, hello := t.session.hellos()
+	secret, ok := t.keyLog.Secret(keyLogMasterSecret, clientRandom)
+	if !ok {
+		return keyLogMasterSecret
+	}
+	d, err := newTLS12Decrypter(t.suite, secret, clientRandom, hello.random, t.client)
+	if err != nil {
+		t.stopDecrypting(err.Error())
+		return ""
+	}
+	t.decrypter = d
+	return ""
+}
+
+// start13 sets up the TLS 1.3 handshake keys for this direction, like start12
+func (t *tlsReader) start13() string {
+	handshakeLabel, trafficLabel := keyLogServerHandshakeSecret, keyLogServerTrafficSecret
+	if t.client {
+		handshakeLabel, trafficLabel = keyLogClientHandshakeSecret, keyLogClientTrafficSecret
+	}
+	clientRandom, _ := t.session.hellos()
+	handshakeSecret, ok := t.keyLog.Secret(handshakeLabel, clientRandom)
+	if !ok {
+		return handshakeLabel
+	}
+	next, ok := t.keyLog.Secret(trafficLabel, clientRandom)
+	if !ok {
+		return trafficLabel
+	}
+	d, err := newTLS13Decrypter(t.suite, handshakeSecret)
+	if err != nil {
+		t.stopDecrypting(err.Error())
+		return ""
+	}
+	t.decrypter, t.next = d, next
+	return ""
+}
+
+// printTLS logs a finished TLS connection to the console
+func printTLS(info TLSConnection) {
+	timestamp := info.StartTime.Format("2006-01-02 15:04:05")
+
+	fmt.Printf("┌─ TLS CONNECTION [%s]\n", timestamp)
+	fmt.Printf("├─ Server Name: %s\n", info.ServerName)
+	fmt.Printf("├─ Version: %s\n", info.Version)
+	fmt.Printf("├─ Cipher Suite: %s\n", info.CipherSuite)
+	fmt.Printf("├─ ALPN: %s", strings.Join(info.ALPN, ", "))
+	if info.NegotiatedALPN != "" {
+		fmt.Printf(" (negotiated %s)", info.NegotiatedALPN)
+	}
+	fmt.Println()
+	fmt.Printf("├─ JA3: %s\n", info.JA3)
+	fmt.Printf("├─ JA4: %s\n", info.JA4)
+	if info.Alert != "" {
+		fmt.Printf("├─ Alert: %s\n", info.Alert)
+	}
+	fmt.Printf("├─ Bytes: %d sent, %d received\n", info.ClientBytes, info.ServerBytes)
+	fmt.Printf("├─ Duration: %s\n", formatMs(info.DurationMs))
+	fmt.Printf("├─ Decrypted: %t\n", info.Decrypted)
+	fmt.Printf("└─ Connection: %s\n", info.Connection)
+	fmt.Println()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+var wsOpcodeNames = map[byte]string{
+	wsContinuation: "continuation",
+	wsText:         "text",
+	wsBinary:       "binary",
+	wsClose:        "close",
+	wsPing:         "ping",
+	wsPong:         "pong",
+}
+
+const (
+	// maxWebSocketMessage caps how much of one message is buffered for
+	// reassembly and decompression; the rest is counted but skipped
+	maxWebSocketMessage = 16 << 20
+	// maxWebSocketData caps how much of each message is kept in the store
+	maxWebSocketData = 64 << 10
+	// maxWebSocketMessages caps how many messages a pair keeps, dropping the oldest
+	maxWebSocketMessages = 1000
+	// deflateWindow is the most a permessage-deflate message can refer back
+	deflateWindow = 32 << 10
+)
+
+// deflateTail ends a permessage-deflate message: the sync flush marker the
+// sender strips, then an empty final block so the reader stops cleanly
+const deflateTail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+
+// WebSocketMessage is one message sent over a connection upgraded to WebSocket
+type WebSocketMessage struct {
+	Timestamp  time.Time `json:"timestamp"`
+	FromClient bool      `json:"fromClient"`
+	Type       string    `json:"type"` // text, binary, close, ping or pong
+	Size       int       `json:"size"` // payload size, after decompression
+	Compressed bool      `json:"compressed,omitempty"`
+	Truncated  bool      `json:"truncated,omitempty"` // Data holds only the start of the payload
+	CloseCode  int       `json:"closeCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Data       []byte    `json:"-"`
+}
+
+// WebSocketLog holds the messages of a pair whose exchange upgraded the
+// connection to WebSocket
+type WebSocketLog struct {
+	Messages []WebSocketMessage `json:"messages"`
+	Dropped  int                `json:"dropped,omitempty"` // oldest messages not kept
+	Closed   bool               `json:"closed"`
+}
+
+// MarshalJSON sends text data as a string and binary data as base64, like
+// CapturedPacket bodies
+func (m WebSocketMessage) MarshalJSON() ([]byte, error) {
+	type messageJSON WebSocketMessage
+	out := struct {
+		messageJSON
+		Data         string `json:"data"`
+		DataEncoding string `json:"dataEncoding,omitempty"`
+	}{messageJSON: messageJSON(m)}
+
+	if len(m.Data) > 0 {
+		out.Data, out.DataEncoding = encodeBody(m.Data)
+		if m.Type == "text" && out.DataEncoding == "base64" && utf8.Valid(m.Data) {
+			out.Data, out.DataEncoding = string(m.Data), "text"
+		}
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON reverses MarshalJSON
+func (m *WebSocketMessage) UnmarshalJSON(data []byte) error {
+	type messageJSON WebSocketMessage
+	var in struct {
+		messageJSON
+		Data         string `json:"data"`
+		DataEncoding string `json:"dataEncoding"`
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	*m = WebSocketMessage(in.messageJSON)
+
+	var err error
+	if m.Data, err = decodeJSONBody(in.Data, in.DataEncoding); err != nil {
+		return fmt.Errorf("data: %w", err)
+	}
+	return nil
+}
+
+// isWebSocketUpgrade reports whether headers ask for or accept a WebSocket upgrade
+func isWebSocketUpgrade(header http.Header) bool {
+	return strings.EqualFold(header.Get("Upgrade"), "websocket")
+}
+
+// webSocketReader decodes the frames sent in one direction of a WebSocket
+type webSocketReader struct {
+	buf        *bufio.Reader
+	fromClient bool
+
+	// The data message being reassembled from fragments
+	opcode     byte
+	compressed bool
+	payload    []byte
+	size       int
+	truncated  bool
+
+	// Recent decompressed output, which permessage-deflate may refer back to.
+	// It's kept even when no_context_takeover was negotiated, as a sender
+	// that resets its context never refers back to it.
+	window []byte
+}
+
+// next returns the next complete message. Control frames come back as soon
+// as they are read, even in the middle of a fragmented message.
+func (r *webSocketReader) next() (WebSocketMessage, error) {
+	for {
+		header, err := r.buf.Peek(2)
+		if err != nil {
+			return WebSocketMessage{}, err
+		}
+		fin := header[0]&0x80 != 0
+		rsv1 := header[0]&0x40 != 0
+		opcode := header[0] & 0x0f
+		if _, ok := wsOpcodeNames[opcode]; !ok {
+			return WebSocketMessage{}, fmt.Errorf("unknown opcode %#x", opcode)
+		}
+
+		if opcode >= wsClose {
+			payload, _, err := r.readFrame(maxWebSocketData)
+			if err != nil {
+				return WebSocketMessage{}, err
+			}
+			return r.controlMessage(opcode, payload), nil
+		}
+
+		if opcode != wsContinuation {
+			r.opcode, r.compressed = opcode, rsv1
+			r.payload, r.size, r.truncated = nil, 0, false
+		}
+		payload, n, err := r.readFrame(maxWebSocketMessage - len(r.payload))
+		if err != nil {
+			return WebSocketMessage{}, err
+		}
+		r.payload = append(r.payload, payload...)
+		r.size += n
+		r.truncated = r.truncated || len(payload) < n
+		if fin {
+			return r.dataMessage(), nil
+		}
+	}
+}
+
+// readFrame reads one frame and returns up to limit bytes of its unmasked
+// payload along with the full payload length
+func (r *webSocketReader) readFrame(limit int) ([]byte, int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r.buf, header[:]); err != nil {
+		return nil, 0, err
+	}
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r.buf, ext[:]); err != nil {
+			return nil, 0, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r.buf, ext[:]); err != nil {
+			return nil, 0, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > 1<<40 {
+		return nil, 0, errors.New("frame length out of range")
+	}
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r.buf, key[:]); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	keep := int(min(length, uint64(max(limit, 0))))
+	payload := make([]byte, keep)
+	if _, err := io.ReadFull(r.buf, payload); err != nil {
+		return nil, 0, err
+	}
+	if skip := int64(length) - int64(keep); skip > 0 {
+		if _, err := io.CopyN(io.Discard, r.buf, skip); err != nil {
+			return nil, 0, err
+		}
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return payload, int(length), nil
+}
+
+// controlMessage builds a close, ping or pong message
+func (r *webSocketReader) controlMessage(opcode byte, payload []byte) WebSocketMessage {
+	msg := WebSocketMessage{
+		FromClient: r.fromClient,
+		Type:       wsOpcodeNames[opcode],
+		Size:       len(payload),
+		Data:       payload,
+	}
+	if opcode == wsClose && len(payload) >= 2 {
+		msg.CloseCode = int(binary.BigEndian.Uint16(payload))
+		msg.Data = payload[2:]
+	}
+	return msg
+}
+
+// dataMessage builds the message reassembled from fragments, decompressing it
+// if needed
+func (r *webSocketReader) dataMessage() WebSocketMessage {
+	msg := WebSocketMessage{
+		FromClient: r.fromClient,
+		Type:       wsOpcodeNames[r.opcode],
+		Size:       r.size,
+		Compressed: r.compressed,
+		Truncated:  r.truncated,
+		Data:       r.payload,
+	}
+	if r.compressed {
+		if r.truncated {
+			// Later messages may refer back to what was skipped, so they can't be trusted either
+			msg.Error = "too large to decompress"
+			r.window = nil
+		} else if data, err := r.inflate(r.payload); err != nil {
+			msg.Error = "decompressing: " + err.Error()
+		} else {
+			msg.Data, msg.Size = data, len(data)
+		}
+	}
+	if len(msg.Data) > maxWebSocketData {
+		msg.Data, msg.Truncated = msg.Data[:maxWebSocketData], true
+	}
+	r.opcode, r.payload = wsContinuation, nil
+	return msg
+}
+
+// inflate decompresses a permessage-deflate message (RFC 7692)
+func (r *webSocketReader) inflate(data []byte) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(data), strings.NewReader(deflateTail))
+	fr := flate.NewReaderDict(src, r.window)
+	defer fr.Close()
+	out, err := io.ReadAll(io.LimitReader(fr, maxDecodedBodySize))
+	if err != nil {
+		r.window = nil
+		return nil, err
+	}
+	r.window = append(r.window, out...)
+	if len(r.window) > deflateWindow {
+		r.window = append([]byte(nil), r.window[len(r.window)-deflateWindow:]...)
+	}
+	return out, nil
+}
+
+// printWebSocketMessage logs a message to the console
+func printWebSocketMessage(msg WebSocketMessage, connection string) {
+	timestamp := msg.Timestamp.Format("2006-01-02 15:04:05")
+
+	fmt.Printf("┌─ WEBSOCKET %s [%s]\n", strings.ToUpper(msg.Type), timestamp)
+	fmt.Printf("├─ Size: %d bytes\n", msg.Size)
+	if msg.CloseCode != 0 {
+		fmt.Printf("├─ Close Code: %d\n", msg.CloseCode)
+	}
+	if msg.Error != "" {
+		fmt.Printf("├─ Error: %s\n", msg.Error)
+	}
+	if len(msg.Data) > 0 {
+		fmt.Printf("├─ Data Preview: \n")
+		if utf8.Valid(msg.Data) {
+			fmt.Printf("├  %s\n", strings.TrimSuffix(string(msg.Data), "\n"))
+		} else {
+			fmt.Printf("├  (binary data, %d bytes)\n", len(msg.Data))
+		}
+	}
+	fmt.Printf("└─ Connection: %s\n", connection)
+	fmt.Println()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// wsFrame encodes one frame, masking the payload when key is set
+func wsFrame(fin, rsv1 bool, opcode byte, key []byte, payload []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	if rsv1 {
+		first |= 0x40
+	}
+	var mask byte
+	if key != nil {
+		mask = 0x80
+	}
+	b := []byte{first}
+	switch {
+	case len(payload) < 126:
+		b = append(b, mask|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		b = binary.BigEndian.AppendUint16(append(b, mask|126), uint16(len(payload)))
+	default:
+		b = binary.BigEndian.AppendUint64(append(b, mask|127), uint64(len(payload)))
+	}
+	b = append(b, key...)
+	for i, c := range payload {
+		if key != nil {
+			c ^= key[i%4]
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// readMessages decodes every message in data
+func readMessages(t *testing.T, data []byte) []WebSocketMessage {
+	t.Helper()
+	r := &webSocketReader{buf: bufio.NewReader(bytes.NewReader(data)), fromClient: true}
+	var msgs []WebSocketMessage
+	for {
+		msg, err := r.next()
+		if err == io.EOF {
+			return msgs
+		}
+		if err != nil {
+			t.Fatalf("after %d messages: %v", len(msgs), err)
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+func TestWebSocketMasking(t *testing.T) {
+	key := []byte{0x37, 0xfa, 0x21, 0x3d}
+	long := bytes.Repeat([]byte("0123456789"), 7000) // needs the 64-bit length
+	data := bytes.Join([][]byte{
+		// The example from RFC 6455 §5.7
+		{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58},
+		wsFrame(true, false, wsBinary, key, bytes.Repeat([]byte{0xab}, 300)),
+		wsFrame(true, false, wsText, nil, []byte("unmasked")),
+		wsFrame(true, false, wsBinary, key, long),
+	}, nil)
+
+	msgs := readMessages(t, data)
+	if len(msgs) != 4 {
+		t.Fatalf("got %d messages, want 4", len(msgs))
+	}
+	if msgs[0].Type != "text" || string(msgs[0].Data) != "Hello" {
+		t.Errorf("first message = %s %q, want text Hello", msgs[0].Type, msgs[0].Data)
+	}
+	if msgs[1].Size != 300 || !bytes.Equal(msgs[1].Data, bytes.Repeat([]byte{0xab}, 300)) {
+		t.Errorf("second message unmasked wrongly: size %d", msgs[1].Size)
+	}
+	if string(msgs[2].Data) != "unmasked" {
+		t.Errorf("third message = %q", msgs[2].Data)
+	}
+	if msgs[3].Size != len(long) || !msgs[3].Truncated || !bytes.Equal(msgs[3].Data, long[:maxWebSocketData]) {
+		t.Errorf("long message: size %d, kept %d, truncated %v", msgs[3].Size, len(msgs[3].Data), msgs[3].Truncated)
+	}
+}
+
+func TestWebSocketFragmentation(t *testing.T) {
+	key := []byte{1, 2, 3, 4}
+	data := bytes.Join([][]byte{
+		wsFrame(false, false, wsText, key, []byte("Hel")),
+		// Control frames may come between the fragments of a message
+		wsFrame(true, false, wsPing, key, []byte("are you there")),
+		wsFrame(false, false, wsContinuation, key, []byte("lo, ")),
+		wsFrame(true, false, wsContinuation, key, []byte("world")),
+		wsFrame(true, false, wsClose, key, append(binary.BigEndian.AppendUint16(nil, 1001), "going away"...)),
+	}, nil)
+
+	msgs := readMessages(t, data)
+	if len(msgs) != 3 {
+		t.Fatalf("got %d messages, want 3", len(msgs))
+	}
+	if msgs[0].Type != "ping" || string(msgs[0].Data) != "are you there" {
+		t.Errorf("first message = %s %q, want the ping", msgs[0].Type, msgs[0].Data)
+	}
+	if msgs[1].Type != "text" || msgs[1].Size != 12 || string(msgs[1].Data) != "Hello, world" {
+		t.Errorf("reassembled message = %s %d %q", msgs[1].Type, msgs[1].Size, msgs[1].Data)
+	}
+	if msgs[2].Type != "close" || msgs[2].CloseCode != 1001 || string(msgs[2].Data) != "going away" {
+		t.Errorf("close message = %s %d %q", msgs[2].Type, msgs[2].CloseCode, msgs[2].Data)
+	}
+
+	if _, err := (&webSocketReader{buf: bufio.NewReader(bytes.NewReader([]byte{0x83, 0x00}))}).next(); err == nil {
+		t.Error("next accepted a reserved opcode")
+	}
+}
+
+// deflateMessages compresses each message with one shared window, as a
+// permessage-deflate sender with context takeover does
+func deflateMessages(t *testing.T, messages ...string) [][]byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out [][]byte
+	for _, msg := range messages {
+		buf.Reset()
+		w.Write([]byte(msg))
+		w.Flush()
+		out = append(out, bytes.Clone(bytes.TrimSuffix(buf.Bytes(), []byte("\x00\x00\xff\xff"))))
+	}
+	return out
+}
+
+func TestWebSocketDeflate(t *testing.T) {
+	first := `{"type":"subscribe","channel":"prices","symbols":["AAA","BBB"]}`
+	second := `{"type":"subscribe","channel":"prices","symbols":["AAA","CCC"]}`
+	compressed := deflateMessages(t, first, second)
+	if _, err := (&webSocketReader{}).inflate(compressed[1]); err == nil {
+		t.Fatal("the second message doesn't refer back to the first")
+	}
+	half := len(compressed[1]) / 2
+
+	data := bytes.Join([][]byte{
+		wsFrame(true, true, wsText, nil, compressed[0]),
+		// Only the first frame of a fragmented message has RSV1 set
+		wsFrame(false, true, wsText, nil, compressed[1][:half]),
+		wsFrame(true, false, wsContinuation, nil, compressed[1][half:]),
+		wsFrame(true, true, wsBinary, nil, []byte("not deflate")),
+	}, nil)
+
+	msgs := readMessages(t, data)
+	if len(msgs) != 3 {
+		t.Fatalf("got %d messages, want 3", len(msgs))
+	}
+	for i, want := range []string{first, second} {
+		msg := msgs[i]
+		if !msg.Compressed || msg.Error != "" || string(msg.Data) != want || msg.Size != len(want) {
+			t.Errorf("message %d: compressed %v, error %q, size %d, data %q", i, msg.Compressed, msg.Error, msg.Size, msg.Data)
+		}
+	}
+	if msgs[2].Error == "" {
+		t.Error("a message that isn't deflate data decompressed without an error")
+	}
+}